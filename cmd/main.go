@@ -4,22 +4,42 @@ import (
 	"context"
 	"errors"
 	"flag"
+	"fmt"
+	"os"
 	"os/signal"
 	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/puzhihao/kubelet-cadvisor-addlabel/config"
 	"github.com/puzhihao/kubelet-cadvisor-addlabel/internal/app"
 	"github.com/puzhihao/kubelet-cadvisor-addlabel/internal/kube"
+	"github.com/puzhihao/kubelet-cadvisor-addlabel/internal/version"
 
 	"k8s.io/klog/v2"
 )
 
 func main() {
 	klog.InitFlags(nil)
+	showVersion := flag.Bool("version", false, "print the version, git commit and build date, and exit")
+	preview := flag.Bool("preview", false, "read metric lines from stdin, print them enriched with the configured labels, and exit")
+	previewPodLabels := flag.String("preview-pod-labels", "", "comma-separated key=value pod labels returned by the preview resolver")
+	previewPodAnnotations := flag.String("preview-pod-annotations", "", "comma-separated key=value pod annotations returned by the preview resolver")
+	previewNamespaceLabels := flag.String("preview-namespace-labels", "", "comma-separated key=value namespace labels returned by the preview resolver")
+	previewCRLabels := flag.String("preview-cr-labels", "", "comma-separated key=value custom resource labels returned by the preview resolver")
+	previewContainerFields := flag.String("preview-container-fields", "", "comma-separated key=value container fields (e.g. image=nginx:1.27) returned by the preview resolver")
+	flag.Parse()
 	defer klog.Flush()
 
-	cfg := config.NewConfig()
+	if *showVersion {
+		fmt.Println(version.Get())
+		return
+	}
+
+	cfg, err := config.NewConfig()
+	if err != nil {
+		klog.Fatalf("load configuration: %v", err)
+	}
 	if err := cfg.Validate(); err != nil {
 		klog.Fatalf("invalid configuration: %v", err)
 	}
@@ -28,21 +48,64 @@ func main() {
 		klog.Warningf("unable to apply log verbosity: %v", err)
 	}
 
+	if *preview {
+		if err := runPreview(cfg, previewMetadata{
+			podLabels:       *previewPodLabels,
+			podAnnotations:  *previewPodAnnotations,
+			namespaceLabels: *previewNamespaceLabels,
+			crLabels:        *previewCRLabels,
+			containerFields: *previewContainerFields,
+		}, os.Stdin, os.Stdout); err != nil {
+			klog.Fatalf("preview: %v", err)
+		}
+		return
+	}
+
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
-	factory, err := kube.NewInformerFactory()
+	restConfig, err := kube.NewRESTConfig()
+	if err != nil {
+		klog.Fatalf("load Kubernetes config: %v", err)
+	}
+	restConfig.UserAgent = cfg.UserAgent
+
+	factory, err := kube.NewInformerFactory(restConfig, time.Duration(cfg.ResyncPeriod)*time.Second)
 	if err != nil {
 		klog.Fatalf("create informer factory: %v", err)
 	}
 
-	application := app.New(cfg, factory)
+	application, err := app.New(cfg, factory, restConfig)
+	if err != nil {
+		klog.Fatalf("create application: %v", err)
+	}
 	klog.InfoS("application starting")
 
+	go reloadOnHangup(ctx, application)
+
 	if err := application.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
 		klog.ErrorS(err, "application terminated")
-		return
+		klog.Flush()
+		os.Exit(1)
 	}
 
 	klog.InfoS("application stopped")
 }
+
+// reloadOnHangup reloads the label configuration every time SIGHUP is received.
+func reloadOnHangup(ctx context.Context, application *app.Application) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := application.Reload(); err != nil {
+				klog.ErrorS(err, "reload configuration")
+			}
+		}
+	}
+}
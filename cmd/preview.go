@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/puzhihao/kubelet-cadvisor-addlabel/config"
+	"github.com/puzhihao/kubelet-cadvisor-addlabel/internal/app"
+	"github.com/puzhihao/kubelet-cadvisor-addlabel/internal/metrics"
+)
+
+// runPreview enriches the metric lines read from in with the configured
+// ADD_LABELS and LABEL_DEFAULTS and writes the result to out. Metadata is
+// provided by a stub resolver that returns the given pod labels, pod
+// annotations, namespace labels, custom resource labels and container fields
+// (each a comma-separated list of key=value pairs) for whichever pod,
+// namespace or container the line references; empty lists
+// report nothing so only defaults apply.
+func runPreview(cfg *config.Config, metadata previewMetadata, in io.Reader, out io.Writer) error {
+	input, err := io.ReadAll(in)
+	if err != nil {
+		return fmt.Errorf("read metric lines: %w", err)
+	}
+
+	resolver := previewResolver{
+		pod:         parsePreviewLabels(metadata.podLabels),
+		annotations: parsePreviewLabels(metadata.podAnnotations),
+		namespace:   parsePreviewLabels(metadata.namespaceLabels),
+		cr:          parsePreviewLabels(metadata.crLabels),
+		container:   parsePreviewLabels(metadata.containerFields),
+	}
+
+	enriched, _, err := metrics.NewLabelProcessor(app.ProcessorOptions(cfg)).AddLabelsToMetrics(
+		context.Background(),
+		strings.TrimRight(string(input), "\n"),
+		cfg.AddLabels,
+		cfg.LabelDefaults,
+		resolver,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(out, enriched)
+	return err
+}
+
+// previewMetadata holds the raw -preview-* flag values.
+type previewMetadata struct {
+	podLabels       string
+	podAnnotations  string
+	namespaceLabels string
+	crLabels        string
+	containerFields string
+}
+
+// previewResolver answers every lookup with the same fixed metadata.
+type previewResolver struct {
+	pod         map[string]string
+	annotations map[string]string
+	namespace   map[string]string
+	cr          map[string]string
+	container   map[string]string
+}
+
+func (r previewResolver) PodLabels(_, _ string) map[string]string { return r.pod }
+
+func (r previewResolver) PodAnnotations(_, _ string) map[string]string { return r.annotations }
+
+func (r previewResolver) NamespaceLabels(_ string) map[string]string { return r.namespace }
+
+func (r previewResolver) CustomResourceLabels(_, _ string) map[string]string { return r.cr }
+
+func (r previewResolver) ContainerMetadata(_, _, _ string) map[string]string { return r.container }
+
+func parsePreviewLabels(raw string) map[string]string {
+	if strings.TrimSpace(raw) == "" {
+		return nil
+	}
+
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(raw, ",") {
+		key, value, _ := strings.Cut(pair, "=")
+		if key = strings.TrimSpace(key); key != "" {
+			labels[key] = strings.TrimSpace(value)
+		}
+	}
+	return labels
+}
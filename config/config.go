@@ -1,48 +1,597 @@
 package config
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"maps"
+	"net"
 	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+
+	"github.com/puzhihao/kubelet-cadvisor-addlabel/internal/metrics"
+	"github.com/puzhihao/kubelet-cadvisor-addlabel/internal/version"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	metricNamePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNamePattern  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
 )
 
 // Config captures the runtime parameters for the collector.
 type Config struct {
-	Port               int    `json:"port" env:"PORT"`
-	LogLevel           string `json:"log_level" env:"LOG_LEVEL"`
-	AddLabels          string `json:"add_labels" env:"ADD_LABELS"`
-	LabelDefaults      string `json:"label_defaults" env:"LABEL_DEFAULTS"`
-	TokenFile          string `json:"token_file" env:"TOKEN_FILE"`
-	CACertFile         string `json:"ca_cert_file" env:"CA_CERT_FILE"`
-	InsecureSkipVerify bool   `json:"insecure_skip_verify" env:"INSECURE_SKIP_VERIFY"`
-	FetchInterval      int    `json:"fetch_interval" env:"FETCH_INTERVAL"`
-}
-
-// NewConfig loads configuration from environment variables, falling back to sensible defaults.
-func NewConfig() *Config {
+	ConfigFile           string  `json:"-" env:"CONFIG_FILE"`
+	Port                 int     `json:"port" env:"PORT"`
+	ListenAddress        string  `json:"listen_address" env:"LISTEN_ADDRESS"`
+	KubeletScheme        string  `json:"kubelet_scheme" env:"KUBELET_SCHEME"`
+	KubeletPort          int     `json:"kubelet_port" env:"KUBELET_PORT"`
+	StaticNodes          string  `json:"static_nodes" env:"STATIC_NODES"`
+	FallbackNodes        string  `json:"fallback_nodes" env:"FALLBACK_NODES"`
+	NodeLabelSelector    string  `json:"node_label_selector" env:"NODE_LABEL_SELECTOR"`
+	ScrapePaths          string  `json:"scrape_paths" env:"SCRAPE_PATHS"`
+	ScrapeHeaders        string  `json:"scrape_headers" env:"SCRAPE_HEADERS"`
+	UserAgent            string  `json:"user_agent" env:"USER_AGENT"`
+	DisablePodInformer   bool    `json:"disable_pod_informer" env:"DISABLE_POD_INFORMER"`
+	CustomResource       string  `json:"custom_resource" env:"CUSTOM_RESOURCE"`
+	CustomResourceJoin   string  `json:"custom_resource_join_label" env:"CUSTOM_RESOURCE_JOIN_LABEL"`
+	ScrapeViaAPIServer   bool    `json:"scrape_via_apiserver" env:"SCRAPE_VIA_APISERVER"`
+	LogLevel             string  `json:"log_level" env:"LOG_LEVEL"`
+	AddLabels            string  `json:"add_labels" env:"ADD_LABELS"`
+	LabelDefaults        string  `json:"label_defaults" env:"LABEL_DEFAULTS"`
+	ConstantLabels       string  `json:"constant_labels" env:"CONSTANT_LABELS"`
+	CollisionStrategy    string  `json:"label_collision_strategy" env:"LABEL_COLLISION_STRATEGY"`
+	AnnotateLabelSource  bool    `json:"annotate_label_source" env:"ANNOTATE_LABEL_SOURCE"`
+	MaxLabelValueLen     int     `json:"max_label_value_len" env:"MAX_LABEL_VALUE_LEN"`
+	EmitEmpty            string  `json:"emit_empty" env:"EMIT_EMPTY"`
+	EmitEmptyAs          string  `json:"emit_empty_as" env:"EMIT_EMPTY_AS"`
+	EnrichMetricPrefixes string  `json:"enrich_metric_prefixes" env:"ENRICH_METRIC_PREFIXES"`
+	DropMetricPrefixes   string  `json:"drop_metric_prefixes" env:"DROP_METRIC_PREFIXES"`
+	SumMetrics           string  `json:"sum_metrics" env:"SUM_METRICS"`
+	DropLabels           string  `json:"drop_labels" env:"DROP_LABELS"`
+	SortLabels           bool    `json:"sort_labels" env:"SORT_LABELS"`
+	Token                string  `json:"token" env:"TOKEN"`
+	TokenFile            string  `json:"token_file" env:"TOKEN_FILE"`
+	CACertFile           string  `json:"ca_cert_file" env:"CA_CERT_FILE"`
+	CAReloadInterval     int     `json:"ca_reload_interval" env:"CA_RELOAD_INTERVAL"`
+	InsecureSkipVerify   bool    `json:"insecure_skip_verify" env:"INSECURE_SKIP_VERIFY"`
+	TLSServerName        string  `json:"tls_server_name" env:"TLS_SERVER_NAME"`
+	NoKubeletProxy       bool    `json:"no_kubelet_proxy" env:"NO_KUBELET_PROXY"`
+	KubeletHTTP2         bool    `json:"kubelet_http2" env:"KUBELET_HTTP2"`
+	MaxIdleConnsPerHost  int     `json:"max_idle_conns_per_host" env:"MAX_IDLE_CONNS_PER_HOST"`
+	IdleConnTimeout      int     `json:"idle_conn_timeout" env:"IDLE_CONN_TIMEOUT"`
+	MaxNodePayloadBytes  int64   `json:"max_node_payload_bytes" env:"MAX_NODE_PAYLOAD_BYTES"`
+	FetchInterval        int     `json:"fetch_interval" env:"FETCH_INTERVAL"`
+	FetchJitter          float64 `json:"fetch_jitter" env:"FETCH_JITTER"`
+	CollectOnScrape      bool    `json:"collect_on_scrape" env:"COLLECT_ON_SCRAPE"`
+	PodCacheTTL          int     `json:"pod_cache_ttl" env:"POD_CACHE_TTL"`
+	SyncTimeout          int     `json:"sync_timeout" env:"SYNC_TIMEOUT"`
+	ResyncPeriod         int     `json:"resync_period" env:"RESYNC_PERIOD"`
+	NodeAddressGrace     int     `json:"node_address_grace" env:"NODE_ADDRESS_GRACE"`
+	RelationHashAlgo     string  `json:"relation_hash_algo" env:"RELATION_HASH_ALGO"`
+	RelationHashMod      uint64  `json:"relation_hash_mod" env:"RELATION_HASH_MOD"`
+	RelationMetricName   string  `json:"relation_metric_name" env:"RELATION_METRIC_NAME"`
+	EmitRelationMetrics  bool    `json:"emit_relation_metrics" env:"EMIT_RELATION_METRICS"`
+	EmitPodInfo          bool    `json:"emit_pod_info" env:"EMIT_POD_INFO"`
+	RelationNodeLabels   string  `json:"relation_node_labels" env:"RELATION_NODE_LABELS"`
+	ServerTLSCertFile    string  `json:"server_tls_cert_file" env:"SERVER_TLS_CERT_FILE"`
+	ServerTLSKeyFile     string  `json:"server_tls_key_file" env:"SERVER_TLS_KEY_FILE"`
+	ServerAuthToken      string  `json:"server_auth_token" env:"SERVER_AUTH_TOKEN"`
+	OutputFormat         string  `json:"output_format" env:"OUTPUT_FORMAT"`
+	PrecompressGzip      bool    `json:"precompress_gzip" env:"PRECOMPRESS_GZIP"`
+	EmitTimestamps       bool    `json:"emit_timestamps" env:"EMIT_TIMESTAMPS"`
+	EnablePprof          bool    `json:"enable_pprof" env:"ENABLE_PPROF"`
+	EnableDebugCache     bool    `json:"enable_debug_cache" env:"ENABLE_DEBUG_CACHE"`
+	SelfTestOnStart      bool    `json:"self_test_on_start" env:"SELF_TEST_ON_START"`
+	SelfTestRequired     bool    `json:"self_test_required" env:"SELF_TEST_REQUIRED"`
+	NodeIPLabel          string  `json:"node_ip_label" env:"NODE_IP_LABEL"`
+	NodeLabelSource      string  `json:"node_label_source" env:"NODE_LABEL_SOURCE"`
+	NodeBanner           string  `json:"node_banner" env:"NODE_BANNER"`
+	EmitFailureComment   bool    `json:"emit_failure_comment" env:"EMIT_FAILURE_COMMENT"`
+	ScrapeTimeout        int     `json:"scrape_timeout" env:"SCRAPE_TIMEOUT"`
+	MaxConcurrentScrapes int     `json:"max_concurrent_scrapes" env:"MAX_CONCURRENT_SCRAPES"`
+	PrefetchConcurrency  int     `json:"prefetch_concurrency" env:"PREFETCH_CONCURRENCY"`
+	MinSuccessRatio      float64 `json:"min_success_ratio" env:"MIN_SUCCESS_RATIO"`
+	BreakerFailures      int     `json:"breaker_failures" env:"BREAKER_FAILURES"`
+	BreakerCooldown      int     `json:"breaker_cooldown" env:"BREAKER_COOLDOWN"`
+	DeepHealthFailures   int     `json:"deep_health_failures" env:"DEEP_HEALTH_FAILURES"`
+	WarmupDuration       int     `json:"warmup_duration" env:"WARMUP_DURATION"`
+
+	// LabelRules and PathAddLabels can only be set from CONFIG_FILE.
+	LabelRules    []LabelRule       `json:"label_rules"`
+	PathAddLabels map[string]string `json:"path_add_labels"`
+}
+
+// LabelRule replaces ADD_LABELS for metrics from namespaces matching one of
+// Namespaces, a comma-separated list of glob patterns such as "team-a-*".
+type LabelRule struct {
+	Namespaces string `json:"namespaces"`
+	AddLabels  string `json:"add_labels"`
+}
+
+// NewConfig loads configuration from an optional CONFIG_FILE and environment
+// variables, falling back to sensible defaults. Environment variables take
+// precedence over values read from the file.
+func NewConfig() (*Config, error) {
+	cfg := defaultConfig()
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+		cfg.ConfigFile = path
+	}
+
+	cfg.applyEnv()
+	return cfg, nil
+}
+
+// ReloadFile re-reads ConfigFile on top of a copy of c, for SIGHUP reloads.
+// The environment of a running process cannot change, so it is not applied
+// again: keys present in the file replace the running values, even ones that
+// were set from the environment, and keys absent from it keep them.
+func (c *Config) ReloadFile() (*Config, error) {
+	if c.ConfigFile == "" {
+		return nil, fmt.Errorf("reload requires CONFIG_FILE; environment variables cannot change while running")
+	}
+
+	cfg := *c
+	cfg.LabelRules = slices.Clone(c.LabelRules)
+	cfg.PathAddLabels = maps.Clone(c.PathAddLabels)
+	if err := cfg.loadFile(c.ConfigFile); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// reloadableKeys are the CONFIG_FILE keys a SIGHUP reload applies to the
+// running exporter; every other key only takes effect on restart.
+var reloadableKeys = map[string]bool{
+	"add_labels":     true,
+	"label_defaults": true,
+	"fetch_interval": true,
+	"fetch_jitter":   true,
+}
+
+// RestartRequiredChanges returns the CONFIG_FILE keys whose value differs
+// between c and next but which a reload does not apply.
+func (c *Config) RestartRequiredChanges(next *Config) []string {
+	var keys []string
+	cur, nv := reflect.ValueOf(c).Elem(), reflect.ValueOf(next).Elem()
+	for i := 0; i < cur.NumField(); i++ {
+		key, _, _ := strings.Cut(cur.Type().Field(i).Tag.Get("json"), ",")
+		if key == "" || key == "-" || reloadableKeys[key] {
+			continue
+		}
+		if !reflect.DeepEqual(cur.Field(i).Interface(), nv.Field(i).Interface()) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func defaultConfig() *Config {
 	return &Config{
-		Port:               getEnvInt("PORT", 9090),
-		LogLevel:           getEnvString("LOG_LEVEL", "info"),
-		AddLabels:          getEnvString("ADD_LABELS", ""),
-		LabelDefaults:      getEnvString("LABEL_DEFAULTS", "unknown"),
-		TokenFile:          getEnvString("TOKEN_FILE", "/var/run/secrets/kubernetes.io/serviceaccount/token"),
-		CACertFile:         getEnvString("CA_CERT_FILE", "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"),
-		InsecureSkipVerify: getEnvBool("INSECURE_SKIP_VERIFY", false),
-		FetchInterval:      getEnvInt("FETCH_INTERVAL", 30),
+		Port:                 9090,
+		KubeletScheme:        "https",
+		ScrapePaths:          metrics.DefaultScrapePath,
+		UserAgent:            version.UserAgent(),
+		LogLevel:             "info",
+		LabelDefaults:        "unknown",
+		CollisionStrategy:    "skip",
+		EmitEmpty:            metrics.EmptyPlaceholder,
+		EmitEmptyAs:          "unknown",
+		TokenFile:            "/var/run/secrets/kubernetes.io/serviceaccount/token",
+		CACertFile:           "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt",
+		CAReloadInterval:     300,
+		FetchInterval:        30,
+		NodeAddressGrace:     60,
+		SyncTimeout:          120,
+		RelationHashAlgo:     "md5",
+		RelationHashMod:      4294967295,
+		RelationMetricName:   "kubelet_cadvisor_label_relation",
+		EmitRelationMetrics:  true,
+		OutputFormat:         "prometheus",
+		NodeIPLabel:          "node_ip",
+		NodeLabelSource:      metrics.NodeLabelSourceIP,
+		NodeBanner:           metrics.NodeBannerComment,
+		KubeletHTTP2:         true,
+		EmitFailureComment:   true,
+		ScrapeTimeout:        8,
+		MaxConcurrentScrapes: 10,
+		DeepHealthFailures:   3,
+		BreakerCooldown:      300,
+		MaxIdleConnsPerHost:  1,
+		IdleConnTimeout:      90,
+		MaxNodePayloadBytes:  metrics.DefaultMaxNodePayloadBytes,
+	}
+}
+
+// loadFile decodes a JSON or YAML configuration file, selected by extension,
+// on top of the current values. Unknown keys are rejected.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
 	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(c); err != nil {
+			return fmt.Errorf("parse config file %s: %w", path, err)
+		}
+	case ".yaml", ".yml":
+		if err := yaml.UnmarshalStrict(data, c); err != nil {
+			return fmt.Errorf("parse config file %s: %w", path, err)
+		}
+	default:
+		return fmt.Errorf("unsupported config file extension %q (expected .json, .yaml or .yml)", ext)
+	}
+	return nil
+}
+
+// applyEnv overrides individual fields with any environment variables that are set.
+func (c *Config) applyEnv() {
+	c.Port = getEnvInt("PORT", c.Port)
+	c.ListenAddress = getEnvString("LISTEN_ADDRESS", c.ListenAddress)
+	c.KubeletScheme = getEnvString("KUBELET_SCHEME", c.KubeletScheme)
+	c.KubeletPort = getEnvInt("KUBELET_PORT", c.KubeletPort)
+	c.StaticNodes = getEnvString("STATIC_NODES", c.StaticNodes)
+	c.FallbackNodes = getEnvString("FALLBACK_NODES", c.FallbackNodes)
+	c.NodeLabelSelector = getEnvString("NODE_LABEL_SELECTOR", c.NodeLabelSelector)
+	c.ScrapePaths = getEnvString("SCRAPE_PATHS", c.ScrapePaths)
+	c.ScrapeHeaders = getEnvString("SCRAPE_HEADERS", c.ScrapeHeaders)
+	c.UserAgent = getEnvString("USER_AGENT", c.UserAgent)
+	c.ScrapeViaAPIServer = getEnvBool("SCRAPE_VIA_APISERVER", c.ScrapeViaAPIServer)
+	c.DisablePodInformer = getEnvBool("DISABLE_POD_INFORMER", c.DisablePodInformer)
+	c.CustomResource = getEnvString("CUSTOM_RESOURCE", c.CustomResource)
+	c.CustomResourceJoin = getEnvString("CUSTOM_RESOURCE_JOIN_LABEL", c.CustomResourceJoin)
+	c.LogLevel = getEnvString("LOG_LEVEL", c.LogLevel)
+	c.AddLabels = getEnvString("ADD_LABELS", c.AddLabels)
+	c.LabelDefaults = getEnvString("LABEL_DEFAULTS", c.LabelDefaults)
+	c.ConstantLabels = getEnvString("CONSTANT_LABELS", c.ConstantLabels)
+	c.CollisionStrategy = getEnvString("LABEL_COLLISION_STRATEGY", c.CollisionStrategy)
+	c.AnnotateLabelSource = getEnvBool("ANNOTATE_LABEL_SOURCE", c.AnnotateLabelSource)
+	c.MaxLabelValueLen = getEnvInt("MAX_LABEL_VALUE_LEN", c.MaxLabelValueLen)
+	c.EmitEmpty = getEnvString("EMIT_EMPTY", c.EmitEmpty)
+	c.EmitEmptyAs = getEnvString("EMIT_EMPTY_AS", c.EmitEmptyAs)
+	c.EnrichMetricPrefixes = getEnvString("ENRICH_METRIC_PREFIXES", c.EnrichMetricPrefixes)
+	c.DropMetricPrefixes = getEnvString("DROP_METRIC_PREFIXES", c.DropMetricPrefixes)
+	c.SumMetrics = getEnvString("SUM_METRICS", c.SumMetrics)
+	c.DropLabels = getEnvString("DROP_LABELS", c.DropLabels)
+	c.SortLabels = getEnvBool("SORT_LABELS", c.SortLabels)
+	c.Token = getEnvString("TOKEN", c.Token)
+	c.TokenFile = getEnvString("TOKEN_FILE", c.TokenFile)
+	c.CACertFile = getEnvString("CA_CERT_FILE", c.CACertFile)
+	c.CAReloadInterval = getEnvInt("CA_RELOAD_INTERVAL", c.CAReloadInterval)
+	c.InsecureSkipVerify = getEnvBool("INSECURE_SKIP_VERIFY", c.InsecureSkipVerify)
+	c.TLSServerName = getEnvString("TLS_SERVER_NAME", c.TLSServerName)
+	c.NoKubeletProxy = getEnvBool("NO_KUBELET_PROXY", c.NoKubeletProxy)
+	c.KubeletHTTP2 = getEnvBool("KUBELET_HTTP2", c.KubeletHTTP2)
+	c.MaxIdleConnsPerHost = getEnvInt("MAX_IDLE_CONNS_PER_HOST", c.MaxIdleConnsPerHost)
+	c.IdleConnTimeout = getEnvInt("IDLE_CONN_TIMEOUT", c.IdleConnTimeout)
+	c.MaxNodePayloadBytes = int64(getEnvUint64("MAX_NODE_PAYLOAD_BYTES", uint64(c.MaxNodePayloadBytes)))
+	c.FetchInterval = getEnvInt("FETCH_INTERVAL", c.FetchInterval)
+	c.FetchJitter = getEnvFloat("FETCH_JITTER", c.FetchJitter)
+	c.CollectOnScrape = getEnvBool("COLLECT_ON_SCRAPE", c.CollectOnScrape)
+	c.PodCacheTTL = getEnvInt("POD_CACHE_TTL", c.PodCacheTTL)
+	c.SyncTimeout = getEnvInt("SYNC_TIMEOUT", c.SyncTimeout)
+	c.ResyncPeriod = getEnvInt("RESYNC_PERIOD", c.ResyncPeriod)
+	c.NodeAddressGrace = getEnvInt("NODE_ADDRESS_GRACE", c.NodeAddressGrace)
+	c.RelationHashAlgo = getEnvString("RELATION_HASH_ALGO", c.RelationHashAlgo)
+	c.RelationHashMod = getEnvUint64("RELATION_HASH_MOD", c.RelationHashMod)
+	c.RelationMetricName = lookupEnvString("RELATION_METRIC_NAME", c.RelationMetricName)
+	c.EmitRelationMetrics = getEnvBool("EMIT_RELATION_METRICS", c.EmitRelationMetrics)
+	c.EmitPodInfo = getEnvBool("EMIT_POD_INFO", c.EmitPodInfo)
+	c.RelationNodeLabels = getEnvString("RELATION_NODE_LABELS", c.RelationNodeLabels)
+	c.ServerTLSCertFile = getEnvString("SERVER_TLS_CERT_FILE", c.ServerTLSCertFile)
+	c.ServerTLSKeyFile = getEnvString("SERVER_TLS_KEY_FILE", c.ServerTLSKeyFile)
+	c.ServerAuthToken = getEnvString("SERVER_AUTH_TOKEN", c.ServerAuthToken)
+	c.OutputFormat = getEnvString("OUTPUT_FORMAT", c.OutputFormat)
+	c.PrecompressGzip = getEnvBool("PRECOMPRESS_GZIP", c.PrecompressGzip)
+	c.EmitTimestamps = getEnvBool("EMIT_TIMESTAMPS", c.EmitTimestamps)
+	c.EnablePprof = getEnvBool("ENABLE_PPROF", c.EnablePprof)
+	c.EnableDebugCache = getEnvBool("ENABLE_DEBUG_CACHE", c.EnableDebugCache)
+	c.SelfTestOnStart = getEnvBool("SELF_TEST_ON_START", c.SelfTestOnStart)
+	c.SelfTestRequired = getEnvBool("SELF_TEST_REQUIRED", c.SelfTestRequired)
+	c.NodeIPLabel = lookupEnvString("NODE_IP_LABEL", c.NodeIPLabel)
+	c.NodeLabelSource = getEnvString("NODE_LABEL_SOURCE", c.NodeLabelSource)
+	c.NodeBanner = getEnvString("NODE_BANNER", c.NodeBanner)
+	c.EmitFailureComment = getEnvBool("EMIT_FAILURE_COMMENT", c.EmitFailureComment)
+	c.ScrapeTimeout = getEnvInt("SCRAPE_TIMEOUT", c.ScrapeTimeout)
+	c.MaxConcurrentScrapes = getEnvInt("MAX_CONCURRENT_SCRAPES", c.MaxConcurrentScrapes)
+	c.PrefetchConcurrency = getEnvInt("PREFETCH_CONCURRENCY", c.PrefetchConcurrency)
+	c.MinSuccessRatio = getEnvFloat("MIN_SUCCESS_RATIO", c.MinSuccessRatio)
+	c.BreakerFailures = getEnvInt("BREAKER_FAILURES", c.BreakerFailures)
+	c.BreakerCooldown = getEnvInt("BREAKER_COOLDOWN", c.BreakerCooldown)
+	c.DeepHealthFailures = getEnvInt("DEEP_HEALTH_FAILURES", c.DeepHealthFailures)
+	c.WarmupDuration = getEnvInt("WARMUP_DURATION", c.WarmupDuration)
 }
 
 // Validate ensures the configuration values fall within acceptable ranges.
 func (c *Config) Validate() error {
+	if c.ListenAddress != "" && net.ParseIP(c.ListenAddress) == nil {
+		return fmt.Errorf("listen address %q is not a valid IP address", c.ListenAddress)
+	}
+
 	if c.Port <= 0 || c.Port > 65535 {
 		return fmt.Errorf("port must be within range 1-65535")
 	}
 
+	switch c.KubeletScheme {
+	case "https", "http":
+	default:
+		return fmt.Errorf("kubelet scheme must be one of https, http")
+	}
+
+	if c.KubeletScheme == "https" && !c.ScrapeViaAPIServer &&
+		strings.TrimSpace(c.Token) == "" && strings.TrimSpace(c.TokenFile) == "" {
+		return fmt.Errorf("https kubelet scheme requires TOKEN or TOKEN_FILE")
+	}
+
+	if strings.TrimSpace(c.CustomResource) != "" {
+		if _, err := metrics.ParseGroupVersionResource(c.CustomResource); err != nil {
+			return fmt.Errorf("custom resource: %w", err)
+		}
+		if strings.TrimSpace(c.CustomResourceJoin) == "" {
+			return fmt.Errorf("custom resource requires CUSTOM_RESOURCE_JOIN_LABEL")
+		}
+	}
+
+	if strings.TrimSpace(c.NodeLabelSelector) != "" {
+		if strings.TrimSpace(c.StaticNodes) != "" {
+			return fmt.Errorf("node label selector cannot be combined with static nodes")
+		}
+		if _, err := labels.Parse(c.NodeLabelSelector); err != nil {
+			return fmt.Errorf("node label selector: %w", err)
+		}
+	}
+
+	if c.ScrapeViaAPIServer && strings.TrimSpace(c.StaticNodes) != "" {
+		return fmt.Errorf("static nodes cannot be scraped via the API server node proxy")
+	}
+
+	if strings.TrimSpace(c.FallbackNodes) != "" {
+		if strings.TrimSpace(c.StaticNodes) != "" {
+			return fmt.Errorf("fallback nodes cannot be combined with static nodes")
+		}
+		if c.ScrapeViaAPIServer {
+			return fmt.Errorf("fallback nodes cannot be scraped via the API server node proxy")
+		}
+	}
+
+	if err := validateNodeTargets("static node", c.StaticNodes); err != nil {
+		return err
+	}
+	if err := validateNodeTargets("fallback node", c.FallbackNodes); err != nil {
+		return err
+	}
+
+	if c.KubeletPort < 0 || c.KubeletPort > 65535 {
+		return fmt.Errorf("kubelet port must be within range 1-65535")
+	}
+
+	if err := metrics.ValidateLabelConfig(c.AddLabels, c.LabelDefaults); err != nil {
+		return err
+	}
+
+	for i, rule := range c.LabelRules {
+		if strings.TrimSpace(rule.Namespaces) == "" {
+			return fmt.Errorf("label rule %d has no namespaces", i)
+		}
+		for _, pattern := range strings.Split(rule.Namespaces, ",") {
+			if _, err := path.Match(strings.TrimSpace(pattern), ""); err != nil {
+				return fmt.Errorf("label rule %d: invalid namespace pattern %q: %w", i, pattern, err)
+			}
+		}
+		if strings.TrimSpace(rule.AddLabels) == "" {
+			return fmt.Errorf("label rule %d has no add_labels", i)
+		}
+		if err := metrics.ValidateLabelConfig(rule.AddLabels, ""); err != nil {
+			return fmt.Errorf("label rule %d: %w", i, err)
+		}
+	}
+
+	paths := make(map[string]struct{})
+	for _, p := range strings.Split(c.ScrapePaths, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("scrape path %q must start with /", p)
+		}
+		paths[p] = struct{}{}
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("at least one scrape path is required")
+	}
+	for p, labels := range c.PathAddLabels {
+		if _, ok := paths[p]; !ok {
+			return fmt.Errorf("path_add_labels: %q is not listed in SCRAPE_PATHS", p)
+		}
+		if err := metrics.ValidateLabelConfig(labels, ""); err != nil {
+			return fmt.Errorf("path_add_labels %q: %w", p, err)
+		}
+	}
+
+	for _, name := range strings.Split(c.DropLabels, ",") {
+		if name = strings.TrimSpace(name); name != "" && !labelNamePattern.MatchString(name) {
+			return fmt.Errorf("DROP_LABELS: %q is not a valid Prometheus label name", name)
+		}
+	}
+
+	if _, err := metrics.ParseConstantLabels(c.ConstantLabels); err != nil {
+		return err
+	}
+
+	for _, name := range strings.Split(c.SumMetrics, ",") {
+		if name = strings.TrimSpace(name); name != "" && !metricNamePattern.MatchString(name) {
+			return fmt.Errorf("SUM_METRICS: %q is not a valid Prometheus metric name", name)
+		}
+	}
+
+	if _, err := metrics.ParseScrapeHeaders(c.ScrapeHeaders); err != nil {
+		return err
+	}
+
+	if err := metrics.ValidateMetricMatchers(strings.Split(c.EnrichMetricPrefixes, ",")); err != nil {
+		return fmt.Errorf("ENRICH_METRIC_PREFIXES: %w", err)
+	}
+
+	if c.CAReloadInterval < 0 {
+		return fmt.Errorf("CA reload interval must not be negative")
+	}
+
 	if c.FetchInterval <= 0 {
 		return fmt.Errorf("fetch interval must be greater than zero seconds")
 	}
 
+	if c.FetchJitter < 0 || c.FetchJitter > 1 {
+		return fmt.Errorf("fetch jitter must be within range 0-1")
+	}
+
+	if c.ResyncPeriod < 0 {
+		return fmt.Errorf("resync period must not be negative")
+	}
+
+	if c.SyncTimeout < 0 {
+		return fmt.Errorf("sync timeout must not be negative")
+	}
+
+	if c.PodCacheTTL < 0 {
+		return fmt.Errorf("pod cache TTL must not be negative")
+	}
+
+	if c.NodeAddressGrace < 0 {
+		return fmt.Errorf("node address grace period must not be negative")
+	}
+
+	if c.WarmupDuration < 0 {
+		return fmt.Errorf("warmup duration must not be negative")
+	}
+
+	if c.ScrapeTimeout <= 0 || c.ScrapeTimeout > 120 {
+		return fmt.Errorf("scrape timeout must be within range 1-120 seconds")
+	}
+
+	if c.MaxConcurrentScrapes <= 0 {
+		return fmt.Errorf("max concurrent scrapes must be greater than zero")
+	}
+
+	if c.PrefetchConcurrency < 0 {
+		return fmt.Errorf("prefetch concurrency must not be negative")
+	}
+
+	if c.MaxIdleConnsPerHost <= 0 {
+		return fmt.Errorf("max idle connections per host must be greater than zero")
+	}
+
+	if c.IdleConnTimeout <= 0 {
+		return fmt.Errorf("idle connection timeout must be greater than zero seconds")
+	}
+
+	if c.MaxNodePayloadBytes <= 0 {
+		return fmt.Errorf("max node payload bytes must be greater than zero")
+	}
+
+	if c.BreakerFailures < 0 {
+		return fmt.Errorf("breaker failures must not be negative")
+	}
+
+	if c.BreakerFailures > 0 && c.BreakerCooldown <= 0 {
+		return fmt.Errorf("breaker cooldown must be greater than zero seconds")
+	}
+
+	if c.DeepHealthFailures <= 0 {
+		return fmt.Errorf("deep health failures must be greater than zero")
+	}
+
+	if c.MinSuccessRatio < 0 || c.MinSuccessRatio > 1 {
+		return fmt.Errorf("min success ratio must be within range 0-1")
+	}
+
+	switch strings.ToLower(strings.TrimSpace(c.RelationHashAlgo)) {
+	case "md5", "sha256", "fnv":
+	default:
+		return fmt.Errorf("relation hash algorithm must be one of md5, sha256, fnv")
+	}
+
+	if c.RelationHashMod == 0 {
+		return fmt.Errorf("relation hash modulo must be greater than zero")
+	}
+
+	if c.RelationMetricName != "" && !metricNamePattern.MatchString(c.RelationMetricName) {
+		return fmt.Errorf("relation metric name %q is not a valid Prometheus metric name", c.RelationMetricName)
+	}
+
+	if (c.ServerTLSCertFile == "") != (c.ServerTLSKeyFile == "") {
+		return fmt.Errorf("server TLS certificate and key files must be provided together")
+	}
+
+	if c.MaxLabelValueLen < 0 {
+		return fmt.Errorf("max label value length must not be negative")
+	}
+
+	switch c.CollisionStrategy {
+	case metrics.CollisionSkip, metrics.CollisionPrefix, metrics.CollisionOverwrite:
+	default:
+		return fmt.Errorf("label collision strategy must be one of skip, prefix, overwrite")
+	}
+
+	switch c.EmitEmpty {
+	case metrics.EmptySkip, metrics.EmptyBlank:
+	case metrics.EmptyPlaceholder:
+		if c.EmitEmptyAs == "" {
+			return fmt.Errorf("EMIT_EMPTY=placeholder requires a non-empty EMIT_EMPTY_AS")
+		}
+	default:
+		return fmt.Errorf("EMIT_EMPTY must be one of skip, empty, placeholder")
+	}
+
+	switch c.OutputFormat {
+	case "prometheus", "openmetrics":
+	default:
+		return fmt.Errorf("output format must be one of prometheus, openmetrics")
+	}
+
+	switch c.NodeLabelSource {
+	case metrics.NodeLabelSourceIP, metrics.NodeLabelSourceName:
+	default:
+		return fmt.Errorf("node label source must be one of ip, name")
+	}
+
+	if err := metrics.ValidateNodeBanner(c.NodeBanner); err != nil {
+		return err
+	}
+
+	if c.NodeIPLabel != "" && !labelNamePattern.MatchString(c.NodeIPLabel) {
+		return fmt.Errorf("node IP label %q is not a valid Prometheus label name", c.NodeIPLabel)
+	}
+
+	return nil
+}
+
+// CheckTokenFile reports an error when kubelet scrapes need TokenFile and it
+// cannot be read. It is part of the startup pre-flight rather than Validate,
+// so modes that never contact a kubelet, such as -preview, work without a
+// service account token; without it an unreadable file would only surface on
+// the first collection, a full fetch interval after startup.
+func (c *Config) CheckTokenFile() error {
+	if c.KubeletScheme != "https" || c.ScrapeViaAPIServer || strings.TrimSpace(c.Token) != "" {
+		return nil
+	}
+	if _, err := os.ReadFile(c.TokenFile); err != nil {
+		return fmt.Errorf("token file is not readable: %w", err)
+	}
 	return nil
 }
 
@@ -62,6 +611,23 @@ func (c *Config) Verbosity() int {
 	}
 }
 
+// validateNodeTargets checks a comma-separated list of "host" or "host:port"
+// scrape targets; kind names the list in errors.
+func validateNodeTargets(kind, targets string) error {
+	for _, target := range strings.Split(targets, ",") {
+		target = strings.TrimSpace(target)
+		if target == "" {
+			continue
+		}
+		if host, port, err := net.SplitHostPort(target); err == nil {
+			if n, err := strconv.Atoi(port); host == "" || err != nil || n < 1 || n > 65535 {
+				return fmt.Errorf("%s %q is not a valid host:port target", kind, target)
+			}
+		}
+	}
+	return nil
+}
+
 func getEnvString(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -69,6 +635,15 @@ func getEnvString(key, defaultValue string) string {
 	return defaultValue
 }
 
+// lookupEnvString behaves like getEnvString but honours variables that are
+// explicitly set to an empty value.
+func lookupEnvString(key, defaultValue string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return strings.TrimSpace(value)
+	}
+	return defaultValue
+}
+
 func getEnvInt(key string, defaultValue int) int {
 	if value := os.Getenv(key); value != "" {
 		if parsed, err := strconv.Atoi(value); err == nil {
@@ -78,6 +653,24 @@ func getEnvInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+func getEnvUint64(key string, defaultValue uint64) uint64 {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.ParseUint(value, 10, 64); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
 func getEnvBool(key string, defaultValue bool) bool {
 	if value := os.Getenv(key); value != "" {
 		if parsed, err := strconv.ParseBool(value); err == nil {
@@ -0,0 +1,406 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReloadFileIgnoresEnvironment(t *testing.T) {
+	path := writeConfigFile(t, "add_labels: app\nfetch_interval: 60\n")
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("ADD_LABELS", "team")
+	t.Setenv("LABEL_DEFAULTS", "none")
+
+	cfg, err := NewConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.AddLabels != "team" {
+		t.Fatalf("startup ADD_LABELS = %q, want the environment value", cfg.AddLabels)
+	}
+
+	if err := os.WriteFile(path, []byte("add_labels: app,version\nfetch_interval: 15\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := cfg.ReloadFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.AddLabels != "app,version" {
+		t.Errorf("reloaded ADD_LABELS = %q, want the file value", reloaded.AddLabels)
+	}
+	if reloaded.FetchInterval != 15 {
+		t.Errorf("reloaded FETCH_INTERVAL = %d, want 15", reloaded.FetchInterval)
+	}
+	if reloaded.LabelDefaults != "none" {
+		t.Errorf("LABEL_DEFAULTS absent from the file = %q, want the running value", reloaded.LabelDefaults)
+	}
+	if cfg.AddLabels != "team" {
+		t.Errorf("ReloadFile modified the running config")
+	}
+}
+
+func TestReloadFileRequiresConfigFile(t *testing.T) {
+	if _, err := defaultConfig().ReloadFile(); err == nil {
+		t.Error("ReloadFile without CONFIG_FILE succeeded")
+	}
+}
+
+func TestRestartRequiredChanges(t *testing.T) {
+	path := writeConfigFile(t, "add_labels: app\nport: 9090\n")
+	t.Setenv("CONFIG_FILE", path)
+	cfg, err := NewConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := "add_labels: app,version\nfetch_interval: 15\nport: 9191\n" +
+		"label_rules:\n- namespaces: kube-system\n  add_labels: k8s-app\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := cfg.ReloadFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(cfg.RestartRequiredChanges(reloaded), ",")
+	if want := "port,label_rules"; got != want {
+		t.Errorf("RestartRequiredChanges = %q, want %q", got, want)
+	}
+	if keys := cfg.RestartRequiredChanges(cfg); len(keys) != 0 {
+		t.Errorf("unchanged config reported %v", keys)
+	}
+}
+
+func TestCheckTokenFile(t *testing.T) {
+	dir := t.TempDir()
+	readable := filepath.Join(dir, "token")
+	if err := os.WriteFile(readable, []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		mutate  func(*Config)
+		wantErr bool
+	}{
+		{"readable file", func(c *Config) { c.TokenFile = readable }, false},
+		{"missing file", func(c *Config) { c.TokenFile = filepath.Join(dir, "missing") }, true},
+		{"directory", func(c *Config) { c.TokenFile = dir }, true},
+		{"static token", func(c *Config) { c.TokenFile, c.Token = filepath.Join(dir, "missing"), "secret" }, false},
+		{"http scheme", func(c *Config) { c.TokenFile, c.KubeletScheme = filepath.Join(dir, "missing"), "http" }, false},
+		{"api server proxy", func(c *Config) { c.TokenFile, c.ScrapeViaAPIServer = filepath.Join(dir, "missing"), true }, false},
+	}
+	for _, tt := range tests {
+		cfg := defaultConfig()
+		tt.mutate(cfg)
+		if err := cfg.CheckTokenFile(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: CheckTokenFile() = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckTokenFileUnreadable(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("file permissions do not apply to root")
+	}
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("secret"), 0o000); err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultConfig()
+	cfg.TokenFile = path
+	if err := cfg.CheckTokenFile(); err == nil {
+		t.Error("CheckTokenFile accepted an unreadable file")
+	}
+}
+
+func TestValidateDoesNotReadTokenFile(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.TokenFile = filepath.Join(t.TempDir(), "missing")
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate without a token file on disk: %v", err)
+	}
+}
+
+func TestDefaultConfigIsValid(t *testing.T) {
+	if err := defaultConfig().Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+}
+
+func TestValidateRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(*Config)
+	}{
+		{"server TLS pair", func(c *Config) { c.ServerTLSCertFile = "tls.crt" }},
+		{"node IP label", func(c *Config) { c.NodeIPLabel = "node-ip" }},
+		{"scrape timeout", func(c *Config) { c.ScrapeTimeout = 0 }},
+		{"scrape timeout ceiling", func(c *Config) { c.ScrapeTimeout = 121 }},
+		{"max concurrent scrapes zero", func(c *Config) { c.MaxConcurrentScrapes = 0 }},
+		{"max concurrent scrapes negative", func(c *Config) { c.MaxConcurrentScrapes = -1 }},
+		{"min success ratio", func(c *Config) { c.MinSuccessRatio = 1.5 }},
+		{"kubelet scheme", func(c *Config) { c.KubeletScheme = "ftp" }},
+		{"add labels", func(c *Config) { c.AddLabels = "app,,team" }},
+		{"label defaults", func(c *Config) { c.LabelDefaults = "app=x,app=y" }},
+		{"pod cache TTL", func(c *Config) { c.PodCacheTTL = -1 }},
+		{"node address grace", func(c *Config) { c.NodeAddressGrace = -1 }},
+		{"fetch interval", func(c *Config) { c.FetchInterval = 0 }},
+		{"fetch jitter", func(c *Config) { c.FetchJitter = 1.5 }},
+		{"negative fetch jitter", func(c *Config) { c.FetchJitter = -0.1 }},
+		{"constant labels", func(c *Config) { c.ConstantLabels = "cluster" }},
+		{"static node port", func(c *Config) { c.StaticNodes = "10.0.0.1:99999" }},
+		{"static node empty host", func(c *Config) { c.StaticNodes = ":10255" }},
+		{"static nodes via api server", func(c *Config) { c.StaticNodes, c.ScrapeViaAPIServer = "10.0.0.1", true }},
+		{"enrich metric pattern", func(c *Config) { c.EnrichMetricPrefixes = "container_,~container_(cpu" }},
+		{"max idle conns per host", func(c *Config) { c.MaxIdleConnsPerHost = 0 }},
+		{"idle conn timeout", func(c *Config) { c.IdleConnTimeout = 0 }},
+		{"max node payload bytes", func(c *Config) { c.MaxNodePayloadBytes = 0 }},
+		{"collision strategy", func(c *Config) { c.CollisionStrategy = "merge" }},
+		{"sync timeout", func(c *Config) { c.SyncTimeout = -1 }},
+		{"label rule without namespaces", func(c *Config) { c.LabelRules = []LabelRule{{AddLabels: "app"}} }},
+		{"label rule pattern", func(c *Config) { c.LabelRules = []LabelRule{{Namespaces: "team-[", AddLabels: "app"}} }},
+		{"label rule without labels", func(c *Config) { c.LabelRules = []LabelRule{{Namespaces: "team-a"}} }},
+		{"deep health failures", func(c *Config) { c.DeepHealthFailures = 0 }},
+		{"listen address", func(c *Config) { c.ListenAddress = "not-an-ip" }},
+		{"scrape path", func(c *Config) { c.ScrapePaths = "metrics/cadvisor" }},
+		{"no scrape path", func(c *Config) { c.ScrapePaths = " , " }},
+		{"path add labels path", func(c *Config) { c.PathAddLabels = map[string]string{"/metrics/resource": "app"} }},
+		{"drop labels", func(c *Config) { c.DropLabels = "id,container-image" }},
+		{"https without token", func(c *Config) { c.Token, c.TokenFile = "", "" }},
+		{"node label source", func(c *Config) { c.NodeLabelSource = "hostname" }},
+		{"max label value len", func(c *Config) { c.MaxLabelValueLen = -1 }},
+		{"sanitized label collision", func(c *Config) { c.AddLabels = "app.name,app/name" }},
+		{"label rule sanitized collision", func(c *Config) {
+			c.LabelRules = []LabelRule{{Namespaces: "team-a", AddLabels: "app.name,app/name"}}
+		}},
+		{"scrape header name", func(c *Config) { c.ScrapeHeaders = "Bad Name:1" }},
+		{"node label selector", func(c *Config) { c.NodeLabelSelector = "pool in (gpu" }},
+		{"node label selector with static nodes", func(c *Config) {
+			c.NodeLabelSelector = "pool=gpu"
+			c.StaticNodes = "10.0.0.1"
+		}},
+		{"sum metrics", func(c *Config) { c.SumMetrics = "cluster-jobs" }},
+		{"warmup duration", func(c *Config) { c.WarmupDuration = -1 }},
+		{"fallback nodes with static nodes", func(c *Config) {
+			c.FallbackNodes = "10.0.0.1"
+			c.StaticNodes = "10.0.0.2"
+		}},
+		{"fallback nodes via api server", func(c *Config) {
+			c.FallbackNodes = "10.0.0.1"
+			c.ScrapeViaAPIServer = true
+		}},
+		{"fallback node port", func(c *Config) { c.FallbackNodes = "10.0.0.1:0" }},
+		{"emit empty mode", func(c *Config) { c.EmitEmpty = "drop" }},
+		{"emit empty placeholder", func(c *Config) { c.EmitEmptyAs = "" }},
+		{"resync period", func(c *Config) { c.ResyncPeriod = -1 }},
+		{"output format", func(c *Config) { c.OutputFormat = "json" }},
+		{"relation hash algo", func(c *Config) { c.RelationHashAlgo = "crc32" }},
+		{"relation hash mod", func(c *Config) { c.RelationHashMod = 0 }},
+		{"relation metric name", func(c *Config) { c.RelationMetricName = "bad-name" }},
+	}
+	for _, tt := range tests {
+		cfg := defaultConfig()
+		tt.mutate(cfg)
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%s: Validate accepted an invalid config", tt.name)
+		}
+	}
+}
+
+func TestRelationHashFromEnvironment(t *testing.T) {
+	t.Setenv("RELATION_HASH_ALGO", "fnv")
+	t.Setenv("RELATION_HASH_MOD", "1000")
+
+	cfg, err := NewConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RelationHashAlgo != "fnv" || cfg.RelationHashMod != 1000 {
+		t.Errorf("relation hash = %s mod %d, want fnv mod 1000", cfg.RelationHashAlgo, cfg.RelationHashMod)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+}
+
+func TestNewConfigFromFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{"yaml", "config.yaml", "port: 9191\nadd_labels: app,team\nfetch_interval: 15\n"},
+		{"yml", "config.yml", "port: 9191\nadd_labels: app,team\nfetch_interval: 15\n"},
+		{"json", "config.json", `{"port": 9191, "add_labels": "app,team", "fetch_interval": 15}`},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), tt.file)
+		if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("CONFIG_FILE", path)
+
+		cfg, err := NewConfig()
+		if err != nil {
+			t.Fatalf("%s: NewConfig: %v", tt.name, err)
+		}
+		if cfg.Port != 9191 || cfg.AddLabels != "app,team" || cfg.FetchInterval != 15 {
+			t.Errorf("%s: port=%d labels=%q interval=%d, want the file values", tt.name, cfg.Port, cfg.AddLabels, cfg.FetchInterval)
+		}
+		if cfg.KubeletScheme != "https" {
+			t.Errorf("%s: keys absent from the file lost their defaults: scheme %q", tt.name, cfg.KubeletScheme)
+		}
+		if cfg.ConfigFile != path {
+			t.Errorf("%s: ConfigFile = %q, want %q", tt.name, cfg.ConfigFile, path)
+		}
+	}
+}
+
+func TestNewConfigEnvironmentOverridesFile(t *testing.T) {
+	t.Setenv("CONFIG_FILE", writeConfigFile(t, "port: 70000\nadd_labels: app\n"))
+
+	cfg, err := NewConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Validate accepted the invalid port from the file")
+	}
+
+	t.Setenv("PORT", "9191")
+	cfg, err = NewConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != 9191 || cfg.AddLabels != "app" {
+		t.Errorf("port=%d labels=%q, want the environment port and the file labels", cfg.Port, cfg.AddLabels)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate of the merged config: %v", err)
+	}
+}
+
+func TestNewConfigRejectsBadFile(t *testing.T) {
+	tests := []struct {
+		name, file, content string
+	}{
+		{"malformed yaml", "config.yaml", "port: [9090\n"},
+		{"malformed json", "config.json", `{"port": `},
+		{"wrong type", "config.yaml", "port: ninety\n"},
+		{"unknown yaml key", "config.yaml", "prot: 9090\n"},
+		{"unknown json key", "config.json", `{"prot": 9090}`},
+		{"unsupported extension", "config.toml", "port = 9090\n"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), tt.file)
+		if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("CONFIG_FILE", path)
+		if _, err := NewConfig(); err == nil {
+			t.Errorf("%s: NewConfig accepted the file", tt.name)
+		}
+	}
+
+	t.Setenv("CONFIG_FILE", filepath.Join(t.TempDir(), "missing.yaml"))
+	if _, err := NewConfig(); err == nil {
+		t.Error("missing config file: NewConfig succeeded")
+	}
+}
+
+func TestNoKubeletProxyFromEnvironment(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"", false},
+		{"true", true},
+		{"1", true},
+		{"not-a-bool", false},
+	}
+	for _, tt := range tests {
+		t.Setenv("NO_KUBELET_PROXY", tt.value)
+		cfg, err := NewConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.NoKubeletProxy != tt.want {
+			t.Errorf("NO_KUBELET_PROXY=%q: got %v, want %v", tt.value, cfg.NoKubeletProxy, tt.want)
+		}
+	}
+}
+
+func TestEmitRelationMetricsFromEnvironment(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"", true},
+		{"false", false},
+		{"0", false},
+		{"true", true},
+	}
+	for _, tt := range tests {
+		t.Setenv("EMIT_RELATION_METRICS", tt.value)
+		cfg, err := NewConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.EmitRelationMetrics != tt.want {
+			t.Errorf("EMIT_RELATION_METRICS=%q: got %v, want %v", tt.value, cfg.EmitRelationMetrics, tt.want)
+		}
+	}
+}
+
+func TestUserAgentFromEnvironment(t *testing.T) {
+	t.Setenv("USER_AGENT", "")
+	cfg, err := NewConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(cfg.UserAgent, "kubelet-cadvisor-addlabel/") {
+		t.Errorf("default UserAgent = %q, want the exporter name and version", cfg.UserAgent)
+	}
+
+	t.Setenv("USER_AGENT", "platform-exporter/2.0")
+	if cfg, err = NewConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.UserAgent != "platform-exporter/2.0" {
+		t.Errorf("USER_AGENT override: got %q", cfg.UserAgent)
+	}
+}
+
+func TestEmitFailureCommentFromEnvironment(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"", true},
+		{"false", false},
+		{"true", true},
+	}
+	for _, tt := range tests {
+		t.Setenv("EMIT_FAILURE_COMMENT", tt.value)
+		cfg, err := NewConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.EmitFailureComment != tt.want {
+			t.Errorf("EMIT_FAILURE_COMMENT=%q: got %v, want %v", tt.value, cfg.EmitFailureComment, tt.want)
+		}
+	}
+}
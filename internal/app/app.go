@@ -1,39 +1,458 @@
 package app
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/puzhihao/kubelet-cadvisor-addlabel/config"
+	"github.com/puzhihao/kubelet-cadvisor-addlabel/internal/kube"
 	"github.com/puzhihao/kubelet-cadvisor-addlabel/internal/metrics"
+	"github.com/puzhihao/kubelet-cadvisor-addlabel/internal/selfmetrics"
 	"github.com/puzhihao/kubelet-cadvisor-addlabel/internal/server"
+	"github.com/puzhihao/kubelet-cadvisor-addlabel/internal/version"
 
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/informers"
+	"k8s.io/client-go/rest"
 	"k8s.io/klog/v2"
 )
 
+var (
+	payloadRetained = selfmetrics.NewCounter(
+		"addlabel_payload_retained_total",
+		"Collection cycles whose result was rejected so the previously published payload kept being served.",
+	)
+	scrapeSkipped = selfmetrics.NewCounter(
+		"addlabel_scrape_skipped_total",
+		"Collection cycles skipped because the previous cycle was still running.",
+	)
+	scrapeCoalesced = selfmetrics.NewCounter(
+		"addlabel_scrape_coalesced_total",
+		"COLLECT_ON_SCRAPE requests served from a collection another request had already started.",
+	)
+	lastGoodPayload = selfmetrics.NewGauge(
+		"addlabel_last_good_payload_timestamp_seconds",
+		"Unix time at which the currently served payload was published.",
+	)
+	lastScrapeSuccess = selfmetrics.NewGauge(
+		"addlabel_last_scrape_success",
+		"Whether the most recent collection cycle succeeded (1) or failed (0).",
+	)
+	lastScrapeTimestamp = selfmetrics.NewGauge(
+		"addlabel_last_scrape_timestamp_seconds",
+		"Unix time at which the most recent collection cycle finished.",
+	)
+	payloadBytes = selfmetrics.NewGauge(
+		"addlabel_payload_bytes",
+		"Size in bytes of the most recently published metrics payload.",
+	)
+	payloadLines = selfmetrics.NewGauge(
+		"addlabel_payload_lines",
+		"Number of lines, including comments, of the most recently published metrics payload.",
+	)
+	buildInfo = selfmetrics.NewGaugeVec(
+		"addlabel_build_info",
+		"Always 1; labelled with the exporter version, git commit and build date, and the Go version it was built with.",
+		"version", "git_commit", "build_date", "go_version",
+	)
+)
+
+func init() {
+	info := version.Get()
+	buildInfo.Set(1, info.Version, info.GitCommit, info.BuildDate, info.GoVersion)
+}
+
+// lineCountingWriter counts the bytes and lines of a payload streamed
+// through it.
+type lineCountingWriter struct {
+	w     io.Writer
+	bytes int
+	lines int
+}
+
+func (lw *lineCountingWriter) Write(p []byte) (int, error) {
+	n, err := lw.w.Write(p)
+	lw.bytes += n
+	lw.lines += bytes.Count(p[:n], []byte{'\n'})
+	return n, err
+}
+
+// errCycleInFlight is returned by collectAndPublish when another cycle is
+// still running.
+var errCycleInFlight = errors.New("previous collection cycle is still running")
+
 // Application wires together the informer service, metrics collector, and HTTP exporter.
 type Application struct {
-	cfg           *config.Config
-	service       *metrics.Service
-	collector     *metrics.Collector
-	httpServer    *server.MetricsServer
+	cfg        *config.Config
+	service    *metrics.Service
+	collector  *metrics.Collector
+	httpServer *server.MetricsServer
+	lastGoodAt time.Time
+	// collecting guards against overlapping collection cycles.
+	collecting atomic.Bool
+	// failures counts consecutive failed cycles; it is only touched while
+	// collecting is held.
+	failures int
+	// flightMu guards flight, the COLLECT_ON_SCRAPE collection concurrent
+	// scrapes join instead of being turned away.
+	flightMu sync.Mutex
+	flight   *generateFlight
+	// payloadHash is the SHA-256 of the last published payload, so an
+	// identical one does not replace it; also only touched while collecting.
+	payloadHash [sha256.Size]byte
+
+	labelsMu      sync.RWMutex
+	addLabels     string
+	labelDefaults string
+
+	scheduleMu    sync.Mutex
 	fetchInterval time.Duration
+	fetchJitter   float64
 }
 
-// New creates a new Application instance.
-func New(cfg *config.Config, factory informers.SharedInformerFactory) *Application {
-	service := metrics.NewService(factory)
-	return &Application{
+// New creates a new Application instance. restConfig supplies the API server
+// address and credentials used when SCRAPE_VIA_APISERVER is enabled.
+func New(cfg *config.Config, factory informers.SharedInformerFactory, restConfig *rest.Config) (*Application, error) {
+	if err := cfg.CheckTokenFile(); err != nil {
+		return nil, err
+	}
+
+	hasher, err := metrics.NewRelationHasher(cfg.RelationHashAlgo, cfg.RelationHashMod)
+	if err != nil {
+		return nil, fmt.Errorf("build relation hasher: %w", err)
+	}
+
+	crSource, err := customResourceSource(cfg, restConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	var nodeSelector labels.Selector
+	if strings.TrimSpace(cfg.NodeLabelSelector) != "" {
+		if nodeSelector, err = labels.Parse(cfg.NodeLabelSelector); err != nil {
+			return nil, fmt.Errorf("node label selector: %w", err)
+		}
+	}
+
+	service := metrics.NewService(factory, metrics.ServiceOptions{
+		PodCacheTTL:         time.Duration(cfg.PodCacheTTL) * time.Second,
+		NodeAddressGrace:    time.Duration(cfg.NodeAddressGrace) * time.Second,
+		WatchNamespaces:     metrics.UsesNamespaceLabels(allAddLabels(cfg)),
+		CachePodAnnotations: metrics.UsesPodAnnotations(allAddLabels(cfg)),
+		StaticNodes:         splitList(cfg.StaticNodes),
+		FallbackNodes:       splitList(cfg.FallbackNodes),
+		NodeSelector:        nodeSelector,
+		DisablePodInformer:  cfg.DisablePodInformer,
+		CustomResources:     crSource,
+	})
+	var apiServerClient *http.Client
+	if cfg.ScrapeViaAPIServer {
+		apiServerClient, err = rest.HTTPClientFor(restConfig)
+		if err != nil {
+			return nil, fmt.Errorf("build API server client: %w", err)
+		}
+	}
+
+	// An empty relation metric name is how the collector skips the relation
+	// block, so EMIT_RELATION_METRICS=false maps onto it.
+	relationMetricName := cfg.RelationMetricName
+	if !cfg.EmitRelationMetrics {
+		relationMetricName = ""
+	}
+
+	// SCRAPE_HEADERS is checked by Validate, so a parse error cannot occur here.
+	scrapeHeaders, _ := metrics.ParseScrapeHeaders(cfg.ScrapeHeaders)
+
+	collector := metrics.NewCollector(service, metrics.CollectorOptions{
+		Scheme:               cfg.KubeletScheme,
+		Port:                 cfg.KubeletPort,
+		Token:                cfg.Token,
+		TokenFile:            cfg.TokenFile,
+		CACertFile:           cfg.CACertFile,
+		CAReloadInterval:     time.Duration(cfg.CAReloadInterval) * time.Second,
+		InsecureSkipVerify:   cfg.InsecureSkipVerify,
+		TLSServerName:        strings.TrimSpace(cfg.TLSServerName),
+		NoProxy:              cfg.NoKubeletProxy,
+		DisableHTTP2:         !cfg.KubeletHTTP2,
+		Headers:              scrapeHeaders,
+		UserAgent:            cfg.UserAgent,
+		APIServerClient:      apiServerClient,
+		APIServerHost:        restConfig.Host,
+		MaxIdleConnsPerHost:  cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:      time.Duration(cfg.IdleConnTimeout) * time.Second,
+		MaxNodePayloadBytes:  cfg.MaxNodePayloadBytes,
+		RelationHasher:       hasher,
+		RelationMetricName:   relationMetricName,
+		RelationNodeLabels:   splitList(cfg.RelationNodeLabels),
+		EmitPodInfo:          cfg.EmitPodInfo,
+		OutputFormat:         cfg.OutputFormat,
+		NodeIPLabel:          cfg.NodeIPLabel,
+		NodeLabelSource:      cfg.NodeLabelSource,
+		NodeBanner:           cfg.NodeBanner,
+		OmitFailureComment:   !cfg.EmitFailureComment,
+		ScrapeTimeout:        time.Duration(cfg.ScrapeTimeout) * time.Second,
+		MaxConcurrentScrapes: cfg.MaxConcurrentScrapes,
+		PrefetchConcurrency:  cfg.PrefetchConcurrency,
+		MinSuccessRatio:      cfg.MinSuccessRatio,
+		DropMetricPrefixes:   splitList(cfg.DropMetricPrefixes),
+		SumMetrics:           splitList(cfg.SumMetrics),
+		Paths:                splitList(cfg.ScrapePaths),
+		BreakerFailures:      cfg.BreakerFailures,
+		BreakerCooldown:      time.Duration(cfg.BreakerCooldown) * time.Second,
+		PathAddLabels:        cfg.PathAddLabels,
+		EmitTimestamps:       cfg.EmitTimestamps,
+		Processor:            ProcessorOptions(cfg),
+	})
+
+	a := &Application{
 		cfg:           cfg,
 		service:       service,
-		collector:     metrics.NewCollector(service, cfg.TokenFile, cfg.CACertFile, cfg.InsecureSkipVerify),
-		httpServer:    server.NewMetricsServer(cfg.Port),
+		collector:     collector,
 		fetchInterval: time.Duration(cfg.FetchInterval) * time.Second,
+		fetchJitter:   cfg.FetchJitter,
+		addLabels:     cfg.AddLabels,
+		labelDefaults: cfg.LabelDefaults,
+	}
+	a.httpServer = server.NewMetricsServer(a.serveOptions(server.Options{
+		Port:            cfg.Port,
+		ListenAddress:   cfg.ListenAddress,
+		TLSCertFile:     cfg.ServerTLSCertFile,
+		TLSKeyFile:      cfg.ServerTLSKeyFile,
+		AuthToken:       cfg.ServerAuthToken,
+		OpenMetrics:     cfg.OutputFormat == metrics.FormatOpenMetrics,
+		PrecompressGzip: cfg.PrecompressGzip,
+		EnablePprof:     cfg.EnablePprof,
+		CacheDump:       cacheDump(cfg, service),
+
+		WarmupDuration:     time.Duration(cfg.WarmupDuration) * time.Second,
+		DeepHealthFailures: cfg.DeepHealthFailures,
+	}))
+	return a, nil
+}
+
+// customResourceSource builds the dynamic informer source for "cr:" entries,
+// or returns nil when CUSTOM_RESOURCE is not set.
+func customResourceSource(cfg *config.Config, restConfig *rest.Config) (*metrics.CustomResourceSource, error) {
+	if strings.TrimSpace(cfg.CustomResource) == "" {
+		if metrics.UsesCustomResourceLabels(allAddLabels(cfg)) {
+			return nil, fmt.Errorf("ADD_LABELS uses %q entries but CUSTOM_RESOURCE is not set", "cr:")
+		}
+		return nil, nil
+	}
+
+	resource, err := metrics.ParseGroupVersionResource(cfg.CustomResource)
+	if err != nil {
+		return nil, fmt.Errorf("custom resource: %w", err)
+	}
+	factory, err := kube.NewDynamicInformerFactory(restConfig, time.Duration(cfg.ResyncPeriod)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &metrics.CustomResourceSource{
+		Factory:   factory,
+		Resource:  resource,
+		JoinLabel: strings.TrimSpace(cfg.CustomResourceJoin),
+	}, nil
+}
+
+// serveOptions selects how /metrics is produced: from the payload published
+// by periodic cycles, refreshable via POST /refresh, or by collecting on
+// every request.
+func (a *Application) serveOptions(opts server.Options) server.Options {
+	if a.cfg.CollectOnScrape {
+		opts.Generate = a.generate
+	} else {
+		opts.Refresh = a.refresh
+	}
+	return opts
+}
+
+// refresh runs an out-of-band collection cycle for POST /refresh, sharing the
+// in-flight guard with scheduled cycles. The HTTP server starts before the
+// informers sync, and a cycle run against the empty cache would publish
+// unenriched metrics and mark the exporter ready, so it is refused until then.
+func (a *Application) refresh(ctx context.Context) error {
+	if !a.service.HasSynced() {
+		return server.ErrNotSynced
+	}
+	err := a.collectAndPublish(ctx, false)
+	if errors.Is(err, errCycleInFlight) {
+		return server.ErrRefreshInFlight
+	}
+	return err
+}
+
+// cacheDump returns the /debug/cache source, or nil when the endpoint is disabled.
+func cacheDump(cfg *config.Config, service *metrics.Service) func(int) any {
+	if !cfg.EnableDebugCache {
+		return nil
+	}
+	return func(maxPods int) any { return service.CacheSnapshot(maxPods) }
+}
+
+// ProcessorOptions derives the label processor settings from the configuration.
+func ProcessorOptions(cfg *config.Config) metrics.ProcessorOptions {
+	// CONSTANT_LABELS is checked by Validate, so a parse error cannot occur here.
+	constantLabels, _ := metrics.ParseConstantLabels(cfg.ConstantLabels)
+	rules := make([]metrics.NamespaceRule, 0, len(cfg.LabelRules))
+	for _, rule := range cfg.LabelRules {
+		rules = append(rules, metrics.NamespaceRule{
+			Namespaces: splitList(rule.Namespaces),
+			AddLabels:  rule.AddLabels,
+		})
+	}
+	return metrics.ProcessorOptions{
+		EnrichPrefixes:    splitList(cfg.EnrichMetricPrefixes),
+		ConstantLabels:    constantLabels,
+		DropLabels:        splitList(cfg.DropLabels),
+		NamespaceRules:    rules,
+		CollisionStrategy: cfg.CollisionStrategy,
+		AnnotateSource:    cfg.AnnotateLabelSource,
+		MaxLabelValueLen:  cfg.MaxLabelValueLen,
+		SortLabels:        cfg.SortLabels,
+		EmptyMode:         cfg.EmitEmpty,
+		EmptyValue:        cfg.EmitEmptyAs,
+	}
+}
+
+// allAddLabels joins ADD_LABELS with the label lists of every label rule and
+// scrape path, so
+// informers and caches are set up for any source a rule reads from.
+func allAddLabels(cfg *config.Config) string {
+	lists := []string{cfg.AddLabels}
+	for _, rule := range cfg.LabelRules {
+		lists = append(lists, rule.AddLabels)
+	}
+	for _, labels := range cfg.PathAddLabels {
+		lists = append(lists, labels)
+	}
+	return strings.Join(lists, ",")
+}
+
+// Reload re-reads the configuration and swaps in the label settings and fetch
+// schedule used by the next collection cycle. Other settings require a restart.
+func (a *Application) Reload() error {
+	cfg, err := a.cfg.ReloadFile()
+	if err != nil {
+		return fmt.Errorf("load configuration: %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	if err := a.checkReloadSources(cfg.AddLabels); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	if keys := a.cfg.RestartRequiredChanges(cfg); len(keys) > 0 {
+		klog.Warningf("configuration keys %s changed but are not reloaded; restart to apply them", strings.Join(keys, ", "))
+	}
+
+	a.labelsMu.Lock()
+	a.addLabels = cfg.AddLabels
+	a.labelDefaults = cfg.LabelDefaults
+	a.labelsMu.Unlock()
+	klog.InfoS("label configuration reloaded", "labels", cfg.AddLabels, "defaults", cfg.LabelDefaults)
+
+	a.scheduleMu.Lock()
+	a.fetchInterval = time.Duration(cfg.FetchInterval) * time.Second
+	a.fetchJitter = cfg.FetchJitter
+	a.scheduleMu.Unlock()
+	klog.InfoS("fetch schedule reloaded", "interval", time.Duration(cfg.FetchInterval)*time.Second, "jitter", cfg.FetchJitter)
+	return nil
+}
+
+// checkReloadSources rejects reloaded ADD_LABELS entries reading metadata
+// whose informer or cache was not set up at startup; they would silently
+// never resolve.
+func (a *Application) checkReloadSources(addLabels string) error {
+	running := allAddLabels(a.cfg)
+	if metrics.UsesNamespaceLabels(addLabels) && !metrics.UsesNamespaceLabels(running) {
+		return fmt.Errorf("ADD_LABELS: %q entries need the Namespace informer, which was not started; restart to use them", "ns:")
+	}
+	if metrics.UsesPodAnnotations(addLabels) && !metrics.UsesPodAnnotations(running) {
+		return fmt.Errorf("ADD_LABELS: %q entries need pod annotations, which are not cached; restart to use them", "anno:")
+	}
+	if metrics.UsesCustomResourceLabels(addLabels) && strings.TrimSpace(a.cfg.CustomResource) == "" {
+		return fmt.Errorf("ADD_LABELS: %q entries need CUSTOM_RESOURCE, which was not set at startup", "cr:")
+	}
+	return nil
+}
+
+// waitForSync waits for the informer caches, bounded by SYNC_TIMEOUT so an
+// exporter that cannot list its objects fails instead of hanging.
+func (a *Application) waitForSync(ctx context.Context) error {
+	syncCtx := ctx
+	if a.cfg.SyncTimeout > 0 {
+		var cancel context.CancelFunc
+		syncCtx, cancel = context.WithTimeout(ctx, time.Duration(a.cfg.SyncTimeout)*time.Second)
+		defer cancel()
+	}
+
+	err := a.service.WaitForSync(syncCtx)
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		return fmt.Errorf(
+			"informer caches did not sync within %ds; check that the service account "+
+				"is allowed (RBAC) to list and watch nodes, pods and namespaces: %w",
+			a.cfg.SyncTimeout, err,
+		)
+	}
+	return fmt.Errorf("wait for informer sync: %w", err)
+}
+
+// selfTest scrapes a single node and logs whether the token, TLS settings and
+// kubelet connectivity work.
+func (a *Application) selfTest(ctx context.Context) error {
+	result := a.collector.SelfCheck(ctx)
+	if result.Err != nil {
+		klog.ErrorS(result.Err, "startup self-test failed",
+			"node", result.Node,
+			"statusCode", result.StatusCode,
+			"tls", result.TLS,
+			"duration", result.Duration,
+		)
+		return fmt.Errorf("startup self-test: %w", result.Err)
+	}
+
+	klog.InfoS("startup self-test succeeded",
+		"node", result.Node,
+		"statusCode", result.StatusCode,
+		"bytes", result.Bytes,
+		"tls", result.TLS,
+		"duration", result.Duration,
+	)
+	return nil
+}
+
+// nextFetchDelay returns the wait before the next collection: the fetch
+// interval extended by a random share of up to fetchJitter of the interval,
+// so replicas started together drift apart instead of scraping in lockstep.
+func (a *Application) nextFetchDelay() time.Duration {
+	a.scheduleMu.Lock()
+	interval, jitter := a.fetchInterval, a.fetchJitter
+	a.scheduleMu.Unlock()
+
+	if jitter <= 0 {
+		return interval
 	}
+	return interval + time.Duration(rand.Float64()*jitter*float64(interval))
+}
+
+func (a *Application) labelConfig() (addLabels, labelDefaults string) {
+	a.labelsMu.RLock()
+	defer a.labelsMu.RUnlock()
+	return a.addLabels, a.labelDefaults
 }
 
 // Run starts all components and blocks until the context is cancelled or one component fails.
@@ -60,18 +479,38 @@ func (a *Application) Run(ctx context.Context) error {
 		}
 	}()
 
-	if err := a.service.WaitForSync(ctx); err != nil {
+	if err := a.waitForSync(ctx); err != nil {
 		cancel()
 		wg.Wait()
-		return fmt.Errorf("wait for informer sync: %w", err)
+		return err
+	}
+
+	if a.cfg.SelfTestOnStart {
+		if err := a.selfTest(ctx); err != nil && a.cfg.SelfTestRequired {
+			cancel()
+			wg.Wait()
+			return err
+		}
 	}
 
-	if err := a.collectAndPublish(ctx, true); err != nil {
+	if a.cfg.CollectOnScrape {
+		a.httpServer.SetReady(true)
+		klog.InfoS("collecting on every /metrics request; periodic collection disabled")
+	} else if err := a.collectAndPublish(ctx, true); err != nil {
 		klog.ErrorS(err, "initial metrics collection failed")
 	}
 
-	ticker := time.NewTicker(a.fetchInterval)
-	defer ticker.Stop()
+	// The timer is re-armed on every tick, picking up interval changes made by
+	// Reload and fresh jitter. Cycles run in the background so the schedule
+	// does not drift with slow scrapes; a cycle that overlaps a still-running
+	// one is skipped by collectAndPublish. With COLLECT_ON_SCRAPE the tick
+	// channel stays nil and never fires.
+	timer := time.NewTimer(a.nextFetchDelay())
+	defer timer.Stop()
+	var tick <-chan time.Time
+	if !a.cfg.CollectOnScrape {
+		tick = timer.C
+	}
 
 	for {
 		select {
@@ -83,25 +522,186 @@ func (a *Application) Run(ctx context.Context) error {
 			cancel()
 			wg.Wait()
 			return err
-		case <-ticker.C:
-			if err := a.collectAndPublish(ctx, false); err != nil {
-				klog.ErrorS(err, "metrics collection failed")
-			}
+		case <-tick:
+			timer.Reset(a.nextFetchDelay())
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := a.collectAndPublish(ctx, false); err != nil && !errors.Is(err, errCycleInFlight) {
+					klog.ErrorS(err, "metrics collection failed")
+				}
+			}()
 		}
 	}
 }
 
-func (a *Application) collectAndPublish(ctx context.Context, initial bool) error {
-	payload, err := a.collector.Collect(ctx, a.cfg.AddLabels, a.cfg.LabelDefaults)
+// generateFlight is one COLLECT_ON_SCRAPE collection. Scrapes arriving while
+// it is still fetching from kubelets join it as waiters and are served its
+// result; once it starts producing output it no longer accepts waiters.
+// Fields other than done are guarded by Application.flightMu until done is
+// closed.
+type generateFlight struct {
+	done    chan struct{}
+	waiters int
+	started bool
+	payload []byte
+	err     error
+}
+
+// flightWriter is the leading scrape's view of a flight. On the first write
+// it streams straight to w when nobody joined the flight, so the payload is
+// never held in memory; otherwise it buffers the payload for the waiters and
+// the leader alike, so a slow leading client does not hold them up.
+type flightWriter struct {
+	a        *Application
+	f        *generateFlight
+	w        io.Writer
+	started  bool
+	buffered bool
+	buf      bytes.Buffer
+}
+
+func (fw *flightWriter) Write(p []byte) (int, error) {
+	if !fw.started {
+		fw.started = true
+		fw.a.flightMu.Lock()
+		fw.f.started = true
+		fw.buffered = fw.f.waiters > 0
+		fw.a.flightMu.Unlock()
+	}
+	if fw.buffered {
+		return fw.buf.Write(p)
+	}
+	return fw.w.Write(p)
+}
+
+// generate streams a fresh collection into w for COLLECT_ON_SCRAPE.
+// Concurrent scrapes share the collection already in flight instead of
+// multiplying the load on kubelets; a scrape arriving after that collection
+// started writing waits for it to finish and then runs its own.
+func (a *Application) generate(ctx context.Context, w io.Writer) error {
+	for {
+		a.flightMu.Lock()
+		f := a.flight
+		if f == nil {
+			break
+		}
+		joined := !f.started
+		if joined {
+			f.waiters++
+		}
+		a.flightMu.Unlock()
+
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if !joined {
+			continue
+		}
+		scrapeCoalesced.Inc()
+		if f.err != nil {
+			return f.err
+		}
+		_, err := w.Write(f.payload)
+		return err
+	}
+	f := &generateFlight{done: make(chan struct{})}
+	a.flight = f
+	a.flightMu.Unlock()
+
+	// Waiters may join until the first byte is written, so the leading
+	// client going away must not cancel the collection.
+	fw := &flightWriter{a: a, f: f, w: w}
+	err := a.generateTo(context.WithoutCancel(ctx), fw)
+
+	a.flightMu.Lock()
+	f.err = err
+	if fw.buffered {
+		f.payload = fw.buf.Bytes()
+	}
+	a.flight = nil
+	a.flightMu.Unlock()
+	close(f.done)
+
+	if err != nil || !fw.buffered {
+		return err
+	}
+	_, err = w.Write(f.payload)
+	return err
+}
+
+// generateTo runs one collection into w and records its outcome.
+func (a *Application) generateTo(ctx context.Context, w io.Writer) error {
+	if !a.collecting.CompareAndSwap(false, true) {
+		scrapeSkipped.Inc()
+		return server.ErrRefreshInFlight
+	}
+	defer a.collecting.Store(false)
+
+	addLabels, labelDefaults := a.labelConfig()
+	lw := &lineCountingWriter{w: w}
+	result, err := a.collector.CollectTo(ctx, lw, addLabels, labelDefaults)
+	if result != nil {
+		a.httpServer.SetNodeStatus(nodeStatuses(result))
+	}
+	a.recordOutcome(err)
 	if err != nil {
 		return err
 	}
 
-	if payload == "" {
-		return fmt.Errorf("collector returned an empty payload")
+	payloadBytes.Set(float64(lw.bytes))
+	payloadLines.Set(float64(lw.lines))
+
+	a.lastGoodAt = time.Now()
+	lastGoodPayload.Set(float64(a.lastGoodAt.Unix()))
+	return nil
+}
+
+// recordOutcome updates the failure streak and last-scrape self-metrics with
+// the result of a collection cycle. Callers hold the collecting guard.
+func (a *Application) recordOutcome(err error) {
+	lastScrapeTimestamp.Set(float64(time.Now().Unix()))
+	if err != nil {
+		a.failures++
+		lastScrapeSuccess.Set(0)
+	} else {
+		a.failures = 0
+		lastScrapeSuccess.Set(1)
 	}
+	a.httpServer.SetConsecutiveFailures(a.failures)
+}
 
-	a.httpServer.Update(payload)
+func (a *Application) collectAndPublish(ctx context.Context, initial bool) error {
+	if !a.collecting.CompareAndSwap(false, true) {
+		scrapeSkipped.Inc()
+		klog.Warning("skipping collection cycle: previous cycle is still running")
+		return errCycleInFlight
+	}
+	defer a.collecting.Store(false)
+
+	addLabels, labelDefaults := a.labelConfig()
+	result, err := a.collector.Collect(ctx, addLabels, labelDefaults)
+	if result != nil {
+		a.httpServer.SetNodeStatus(nodeStatuses(result))
+	}
+	if err == nil {
+		err = acceptResult(result)
+	}
+	a.recordOutcome(err)
+	if err != nil {
+		a.retainPayload()
+		return err
+	}
+
+	payload := result.Payload
+	publishIfChanged(a.httpServer, &a.payloadHash, payload, a.lastGoodAt.IsZero())
+	payloadBytes.Set(float64(len(payload)))
+	payloadLines.Set(float64(strings.Count(payload, "\n")))
+	a.httpServer.SetReady(true)
+	a.lastGoodAt = time.Now()
+	lastGoodPayload.Set(float64(a.lastGoodAt.Unix()))
 	if initial {
 		klog.InfoS("published initial metrics snapshot", "bytes", len(payload))
 	} else {
@@ -109,3 +709,74 @@ func (a *Application) collectAndPublish(ctx context.Context, initial bool) error
 	}
 	return nil
 }
+
+// payloadPublisher is the part of the metrics server publishIfChanged uses.
+type payloadPublisher interface {
+	Update(data string)
+	Touch(at time.Time)
+}
+
+// publishIfChanged hands payload to p unless its SHA-256 equals *last, in
+// which case only the refresh time is recorded, sparing the copy and
+// compression of an identical payload. force publishes regardless. It
+// reports whether the payload was replaced.
+func publishIfChanged(p payloadPublisher, last *[sha256.Size]byte, payload string, force bool) bool {
+	hash := sha256.Sum256([]byte(payload))
+	if hash == *last && !force {
+		p.Touch(time.Now())
+		return false
+	}
+	p.Update(payload)
+	*last = hash
+	return true
+}
+
+// acceptResult is the sanity check a collection result must pass before it
+// replaces the served payload. Collect itself already rejects cycles that fall
+// below the configured minimum success ratio.
+func acceptResult(result *metrics.CollectResult) error {
+	if result == nil || result.Payload == "" {
+		return fmt.Errorf("collector returned an empty payload")
+	}
+	return nil
+}
+
+// retainPayload records that the previously published payload keeps being served.
+func (a *Application) retainPayload() {
+	payloadRetained.Inc()
+	if a.lastGoodAt.IsZero() {
+		klog.InfoS("no metrics payload published yet; nothing to retain")
+		return
+	}
+	klog.InfoS("retaining last good metrics payload", "lastGoodAt", a.lastGoodAt, "age", time.Since(a.lastGoodAt))
+}
+
+// nodeStatuses converts the collector's per-node outcomes into the form served under /status.
+func nodeStatuses(result *metrics.CollectResult) map[string]server.NodeStatus {
+	scrapedAt := result.StartedAt.Add(result.Duration)
+	statuses := make(map[string]server.NodeStatus, len(result.Nodes))
+	for ip, node := range result.Nodes {
+		status := server.NodeStatus{
+			OK:              node.Err == nil,
+			Bytes:           node.Bytes,
+			LastScrape:      scrapedAt,
+			DurationSeconds: node.Duration.Seconds(),
+		}
+		if node.Err != nil {
+			status.Error = node.Err.Error()
+		}
+		statuses[ip] = status
+	}
+	return statuses
+}
+
+// splitList parses a comma-separated configuration value, dropping empty entries.
+func splitList(value string) []string {
+	var out []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -0,0 +1,120 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/puzhihao/kubelet-cadvisor-addlabel/internal/server"
+)
+
+func TestGenerateJoinsInFlightCollection(t *testing.T) {
+	a := &Application{}
+	f := &generateFlight{done: make(chan struct{})}
+	a.flight = f
+
+	var buf bytes.Buffer
+	errCh := make(chan error, 1)
+	go func() { errCh <- a.generate(context.Background(), &buf) }()
+
+	f.payload = []byte("up 1\n")
+	close(f.done)
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("generate: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("generate did not return after the flight finished")
+	}
+	if buf.String() != "up 1\n" {
+		t.Errorf("payload = %q, want the in-flight result", buf.String())
+	}
+}
+
+func TestGenerateSharesInFlightError(t *testing.T) {
+	a := &Application{}
+	want := errors.New("kubelets unreachable")
+	f := &generateFlight{done: make(chan struct{}), err: want}
+	close(f.done)
+	a.flight = f
+
+	if err := a.generate(context.Background(), &bytes.Buffer{}); !errors.Is(err, want) {
+		t.Errorf("generate error = %v, want %v", err, want)
+	}
+}
+
+func TestGenerateWaiterHonoursContext(t *testing.T) {
+	a := &Application{flight: &generateFlight{done: make(chan struct{})}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := a.generate(ctx, &bytes.Buffer{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("generate error = %v, want context.Canceled", err)
+	}
+}
+
+func TestGenerateRunsOwnCollectionAfterStartedFlight(t *testing.T) {
+	a := &Application{}
+	f := &generateFlight{done: make(chan struct{}), started: true, payload: []byte("stale 1\n")}
+	a.flight = f
+	// With the collecting guard held, a scrape that becomes the leader fails
+	// fast instead of reaching the collector.
+	a.collecting.Store(true)
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- a.generate(context.Background(), &bytes.Buffer{}) }()
+	a.flightMu.Lock()
+	a.flight = nil
+	a.flightMu.Unlock()
+	close(f.done)
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, server.ErrRefreshInFlight) {
+			t.Errorf("generate error = %v, want its own collection's %v", err, server.ErrRefreshInFlight)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("generate did not return")
+	}
+	if f.waiters != 0 {
+		t.Errorf("a started flight accepted %d waiters", f.waiters)
+	}
+}
+
+func TestFlightWriterStreamsWithoutWaiters(t *testing.T) {
+	a := &Application{}
+	f := &generateFlight{done: make(chan struct{})}
+	var out bytes.Buffer
+	fw := &flightWriter{a: a, f: f, w: &out}
+
+	for _, s := range []string{"a 1\n", "b 2\n"} {
+		if _, err := fw.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if out.String() != "a 1\nb 2\n" || fw.buf.Len() != 0 {
+		t.Errorf("streamed %q, buffered %d bytes", out.String(), fw.buf.Len())
+	}
+	if !f.started {
+		t.Error("flight not marked started after the first write")
+	}
+}
+
+func TestFlightWriterBuffersForWaiters(t *testing.T) {
+	a := &Application{}
+	f := &generateFlight{done: make(chan struct{}), waiters: 1}
+	fw := &flightWriter{a: a, f: f, w: failingWriter{}}
+
+	if _, err := fw.Write([]byte("a 1\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if !fw.buffered || fw.buf.String() != "a 1\n" {
+		t.Errorf("buffered=%v %q, want the payload held for the waiter", fw.buffered, fw.buf.String())
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("client went away") }
@@ -0,0 +1,277 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/puzhihao/kubelet-cadvisor-addlabel/internal/metrics"
+	"github.com/puzhihao/kubelet-cadvisor-addlabel/internal/selfmetrics"
+	"github.com/puzhihao/kubelet-cadvisor-addlabel/internal/server"
+
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type recordingPublisher struct {
+	updates int
+	touches int
+}
+
+func (p *recordingPublisher) Update(string)   { p.updates++ }
+func (p *recordingPublisher) Touch(time.Time) { p.touches++ }
+
+func TestPublishIfChangedSkipsIdenticalPayload(t *testing.T) {
+	var p recordingPublisher
+	var last [sha256.Size]byte
+
+	if !publishIfChanged(&p, &last, "up 1\n", true) {
+		t.Fatal("first payload was not published")
+	}
+	if publishIfChanged(&p, &last, "up 1\n", false) {
+		t.Error("identical payload was published again")
+	}
+	if !publishIfChanged(&p, &last, "up 0\n", false) {
+		t.Error("changed payload was not published")
+	}
+	if p.updates != 2 || p.touches != 1 {
+		t.Errorf("updates=%d touches=%d, want 2 and 1", p.updates, p.touches)
+	}
+}
+
+func TestPublishIfChangedForce(t *testing.T) {
+	var p recordingPublisher
+	var last [sha256.Size]byte
+	publishIfChanged(&p, &last, "up 1\n", true)
+
+	if !publishIfChanged(&p, &last, "up 1\n", true) {
+		t.Error("forced publish of an identical payload was skipped")
+	}
+}
+
+// newTestKubelet serves up 1 until fail is set, then answers every scrape
+// with a server error, and returns the host:port to scrape it at.
+func newTestKubelet(t *testing.T, fail *atomic.Bool) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if fail != nil && fail.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte("up 1\n"))
+	}))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+// newTestApplication wires a collector scraping the given static kubelets over
+// plain HTTP to a metrics server, without starting either.
+func newTestApplication(t *testing.T, opts metrics.CollectorOptions, kubelets ...string) *Application {
+	t.Helper()
+	factory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	svc := metrics.NewService(factory, metrics.ServiceOptions{StaticNodes: kubelets, DisablePodInformer: true})
+	opts.Scheme = metrics.SchemeHTTP
+	return &Application{
+		collector:  metrics.NewCollector(svc, opts),
+		httpServer: server.NewMetricsServer(server.Options{}),
+	}
+}
+
+func TestCollectAndPublishRetainsPayloadBelowMinSuccessRatio(t *testing.T) {
+	var fail atomic.Bool
+	a := newTestApplication(t, metrics.CollectorOptions{MinSuccessRatio: 0.5},
+		newTestKubelet(t, nil), newTestKubelet(t, &fail), newTestKubelet(t, &fail))
+
+	if err := a.collectAndPublish(context.Background(), true); err != nil {
+		t.Fatalf("healthy cycle: %v", err)
+	}
+	published, lastGood := a.payloadHash, a.lastGoodAt
+
+	fail.Store(true)
+	if err := a.collectAndPublish(context.Background(), false); err == nil {
+		t.Fatal("cycle with 1 of 3 nodes up was accepted at MIN_SUCCESS_RATIO 0.5")
+	}
+	if a.payloadHash != published || !a.lastGoodAt.Equal(lastGood) {
+		t.Error("a rejected cycle replaced the published payload")
+	}
+	if a.failures != 1 {
+		t.Errorf("failures = %d, want 1", a.failures)
+	}
+}
+
+func TestCollectAndPublishRetainOrReplace(t *testing.T) {
+	var fail atomic.Bool
+	a := newTestApplication(t, metrics.CollectorOptions{}, newTestKubelet(t, &fail))
+
+	if err := a.collectAndPublish(context.Background(), true); err != nil {
+		t.Fatalf("healthy cycle: %v", err)
+	}
+	published, lastGood := a.payloadHash, a.lastGoodAt
+	if published == ([sha256.Size]byte{}) || lastGood.IsZero() {
+		t.Fatal("healthy cycle did not publish")
+	}
+
+	retained := payloadRetained.Value()
+	fail.Store(true)
+	if err := a.collectAndPublish(context.Background(), false); err == nil {
+		t.Fatal("cycle with every node failing succeeded")
+	}
+	if a.payloadHash != published || !a.lastGoodAt.Equal(lastGood) {
+		t.Error("a failed cycle replaced the published payload")
+	}
+	if got := payloadRetained.Value() - retained; got != 1 {
+		t.Errorf("payload retained counter advanced by %v, want 1", got)
+	}
+
+	fail.Store(false)
+	if err := a.collectAndPublish(context.Background(), false); err != nil {
+		t.Fatalf("recovered cycle: %v", err)
+	}
+	if !a.lastGoodAt.After(lastGood) {
+		t.Error("a recovered cycle did not replace the retained payload")
+	}
+}
+
+func TestAcceptResult(t *testing.T) {
+	if err := acceptResult(nil); err == nil {
+		t.Error("nil result accepted")
+	}
+	if err := acceptResult(&metrics.CollectResult{}); err == nil {
+		t.Error("empty payload accepted")
+	}
+	if err := acceptResult(&metrics.CollectResult{Payload: "up 1\n"}); err != nil {
+		t.Errorf("non-empty payload rejected: %v", err)
+	}
+}
+
+func TestCollectAndPublishSkipsOverlappingCycle(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		<-release
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte("up 1\n"))
+	}))
+	defer srv.Close()
+	a := newTestApplication(t, metrics.CollectorOptions{}, strings.TrimPrefix(srv.URL, "http://"))
+
+	slow := make(chan error, 1)
+	go func() { slow <- a.collectAndPublish(context.Background(), true) }()
+	for deadline := time.Now().Add(5 * time.Second); !a.collecting.Load(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("first cycle never started")
+		}
+	}
+
+	skipped := scrapeSkipped.Value()
+	if err := a.collectAndPublish(context.Background(), false); !errors.Is(err, errCycleInFlight) {
+		t.Errorf("overlapping cycle: err = %v, want errCycleInFlight", err)
+	}
+	if got := scrapeSkipped.Value() - skipped; got != 1 {
+		t.Errorf("skipped counter advanced by %v, want 1", got)
+	}
+
+	close(release)
+	if err := <-slow; err != nil {
+		t.Errorf("slow cycle: %v", err)
+	}
+	if a.collecting.Load() {
+		t.Error("in-flight guard still set after the cycle finished")
+	}
+}
+
+func TestCollectAndPublishCountsConsecutiveFailures(t *testing.T) {
+	var fail atomic.Bool
+	a := newTestApplication(t, metrics.CollectorOptions{}, newTestKubelet(t, &fail))
+
+	fail.Store(true)
+	for cycle := 1; cycle <= 3; cycle++ {
+		if err := a.collectAndPublish(context.Background(), cycle == 1); err == nil {
+			t.Fatalf("cycle %d against a failing kubelet succeeded", cycle)
+		}
+		if a.failures != cycle {
+			t.Errorf("after %d failed cycles: failures = %d", cycle, a.failures)
+		}
+	}
+
+	fail.Store(false)
+	if err := a.collectAndPublish(context.Background(), false); err != nil {
+		t.Fatalf("recovered cycle: %v", err)
+	}
+	if a.failures != 0 {
+		t.Errorf("after recovery: failures = %d, want 0", a.failures)
+	}
+}
+
+func TestCollectAndPublishRecordsExporterHealth(t *testing.T) {
+	var fail atomic.Bool
+	a := newTestApplication(t, metrics.CollectorOptions{}, newTestKubelet(t, &fail))
+
+	before := time.Now().Unix()
+	if err := a.collectAndPublish(context.Background(), true); err != nil {
+		t.Fatalf("healthy cycle: %v", err)
+	}
+	if got := lastScrapeSuccess.Value(); got != 1 {
+		t.Errorf("addlabel_last_scrape_success = %v after a healthy cycle, want 1", got)
+	}
+	if got := lastScrapeTimestamp.Value(); got < float64(before) {
+		t.Errorf("addlabel_last_scrape_timestamp_seconds = %v, want at least %d", got, before)
+	}
+
+	fail.Store(true)
+	_ = a.collectAndPublish(context.Background(), false)
+	if got := lastScrapeSuccess.Value(); got != 0 {
+		t.Errorf("addlabel_last_scrape_success = %v after a failed cycle, want 0", got)
+	}
+
+	rendered := selfmetrics.Render()
+	for _, want := range []string{
+		"addlabel_last_scrape_success 0",
+		"addlabel_last_scrape_timestamp_seconds ",
+		`addlabel_build_info{version="`,
+		`go_version="` + runtime.Version() + `"`,
+	} {
+		if !strings.Contains(rendered, want) {
+			t.Errorf("self-metrics lack %q:\n%s", want, rendered)
+		}
+	}
+}
+
+func TestPayloadSizeGauges(t *testing.T) {
+	a := newTestApplication(t, metrics.CollectorOptions{}, newTestKubelet(t, nil))
+
+	if err := a.collectAndPublish(context.Background(), true); err != nil {
+		t.Fatalf("collectAndPublish: %v", err)
+	}
+	result, err := a.collector.Collect(context.Background(), "", "")
+	if err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	if sha256.Sum256([]byte(result.Payload)) != a.payloadHash {
+		t.Fatal("a second collection produced a different payload")
+	}
+	if got, want := payloadBytes.Value(), float64(len(result.Payload)); got != want {
+		t.Errorf("addlabel_payload_bytes = %v after publish, want %v", got, want)
+	}
+	if got, want := payloadLines.Value(), float64(strings.Count(result.Payload, "\n")); got != want {
+		t.Errorf("addlabel_payload_lines = %v after publish, want %v", got, want)
+	}
+
+	var streamed strings.Builder
+	if err := a.generateTo(context.Background(), &streamed); err != nil {
+		t.Fatalf("generateTo: %v", err)
+	}
+	if got, want := payloadBytes.Value(), float64(streamed.Len()); got != want {
+		t.Errorf("addlabel_payload_bytes = %v after streaming, want %v", got, want)
+	}
+	if got, want := payloadLines.Value(), float64(strings.Count(streamed.String(), "\n")); got != want {
+		t.Errorf("addlabel_payload_lines = %v after streaming, want %v", got, want)
+	}
+}
@@ -0,0 +1,136 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/puzhihao/kubelet-cadvisor-addlabel/config"
+)
+
+func TestCheckReloadSources(t *testing.T) {
+	tests := []struct {
+		name           string
+		startup        string
+		customResource string
+		reloaded       string
+		wantErr        bool
+	}{
+		{"pod labels only", "app", "", "app,version", false},
+		{"namespace informer running", "ns:team", "", "app,ns:owner", false},
+		{"namespace informer missing", "app", "", "app,ns:team", true},
+		{"annotations cached", "anno:owner", "", "anno:team", false},
+		{"annotations not cached", "app", "", "anno:owner", true},
+		{"custom resource configured", "app", "apps.example.com/v1/apps", "cr:owner", false},
+		{"custom resource missing", "app", "", "cr:owner", true},
+	}
+	for _, tt := range tests {
+		a := &Application{cfg: &config.Config{AddLabels: tt.startup, CustomResource: tt.customResource}}
+		err := a.checkReloadSources(tt.reloaded)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestReloadAppliesLabelsAndSchedule(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("add_labels: app\nport: 9090\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("KUBELET_SCHEME", "http")
+	cfg, err := config.NewConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Application{cfg: cfg, addLabels: cfg.AddLabels}
+
+	content := "add_labels: app,version\nfetch_interval: 15\nfetch_jitter: 0.2\nport: 9191\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if a.addLabels != "app,version" {
+		t.Errorf("addLabels = %q, want the reloaded value", a.addLabels)
+	}
+	if a.fetchInterval != 15*time.Second || a.fetchJitter != 0.2 {
+		t.Errorf("schedule = %s/%v, want 15s/0.2", a.fetchInterval, a.fetchJitter)
+	}
+	if a.cfg.Port != 9090 {
+		t.Errorf("running port changed to %d on reload", a.cfg.Port)
+	}
+}
+
+func TestReloadRejectsInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("add_labels: app\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("KUBELET_SCHEME", "http")
+	cfg, err := config.NewConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Application{cfg: cfg, addLabels: cfg.AddLabels}
+
+	if err := os.WriteFile(path, []byte("add_labels: app\nfetch_jitter: 2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Reload(); err == nil {
+		t.Error("Reload accepted an out-of-range FETCH_JITTER")
+	}
+	if a.addLabels != "app" {
+		t.Errorf("addLabels = %q after a rejected reload", a.addLabels)
+	}
+}
+
+func TestNextFetchDelayJitterBounds(t *testing.T) {
+	a := &Application{fetchInterval: 10 * time.Second, fetchJitter: 0.3}
+	lo, hi := 10*time.Second, 13*time.Second
+	varied := false
+	first := a.nextFetchDelay()
+	for range 1000 {
+		d := a.nextFetchDelay()
+		if d < lo || d > hi {
+			t.Fatalf("delay %s outside [%s, %s]", d, lo, hi)
+		}
+		varied = varied || d != first
+	}
+	if !varied {
+		t.Error("jittered delays never varied")
+	}
+
+	a.fetchJitter = 0
+	if d := a.nextFetchDelay(); d != 10*time.Second {
+		t.Errorf("without jitter: delay %s, want the interval", d)
+	}
+}
+
+func TestNextFetchDelayFollowsReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("fetch_interval: 30\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("KUBELET_SCHEME", "http")
+	cfg, err := config.NewConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Application{cfg: cfg, fetchInterval: 30 * time.Second}
+
+	if err := os.WriteFile(path, []byte("fetch_interval: 5\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if d := a.nextFetchDelay(); d != 5*time.Second {
+		t.Errorf("delay after reload = %s, want 5s", d)
+	}
+}
@@ -0,0 +1,22 @@
+package app
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/puzhihao/kubelet-cadvisor-addlabel/internal/metrics"
+)
+
+func TestSelfTest(t *testing.T) {
+	var fail atomic.Bool
+	a := newTestApplication(t, metrics.CollectorOptions{}, newTestKubelet(t, &fail))
+
+	if err := a.selfTest(context.Background()); err != nil {
+		t.Errorf("healthy kubelet: %v", err)
+	}
+	fail.Store(true)
+	if err := a.selfTest(context.Background()); err == nil {
+		t.Error("failing kubelet passed the self-test")
+	}
+}
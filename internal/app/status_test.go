@@ -0,0 +1,37 @@
+package app
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/puzhihao/kubelet-cadvisor-addlabel/internal/metrics"
+)
+
+func TestNodeStatuses(t *testing.T) {
+	started := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	result := &metrics.CollectResult{
+		StartedAt: started,
+		Duration:  2 * time.Second,
+		Nodes: map[string]metrics.NodeResult{
+			"10.0.0.1": {Bytes: 42, Duration: time.Second},
+			"10.0.0.2": {Duration: 500 * time.Millisecond, Err: errors.New("connection refused")},
+		},
+	}
+
+	statuses := nodeStatuses(result)
+	if len(statuses) != 2 {
+		t.Fatalf("got %d statuses, want 2", len(statuses))
+	}
+	ok := statuses["10.0.0.1"]
+	if !ok.OK || ok.Bytes != 42 || ok.Error != "" || ok.DurationSeconds != 1 {
+		t.Errorf("successful node = %+v", ok)
+	}
+	if want := started.Add(2 * time.Second); !ok.LastScrape.Equal(want) {
+		t.Errorf("LastScrape = %s, want the end of the cycle %s", ok.LastScrape, want)
+	}
+	failed := statuses["10.0.0.2"]
+	if failed.OK || failed.Error != "connection refused" || failed.DurationSeconds != 0.5 {
+		t.Errorf("failed node = %+v", failed)
+	}
+}
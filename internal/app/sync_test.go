@@ -0,0 +1,46 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/puzhihao/kubelet-cadvisor-addlabel/config"
+	"github.com/puzhihao/kubelet-cadvisor-addlabel/internal/metrics"
+
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// unsyncedApplication returns an Application whose informers are never
+// started, so WaitForSync only returns when its context ends.
+func unsyncedApplication(syncTimeout int) *Application {
+	factory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	return &Application{
+		cfg:     &config.Config{SyncTimeout: syncTimeout},
+		service: metrics.NewService(factory, metrics.ServiceOptions{}),
+	}
+}
+
+func TestWaitForSyncTimeout(t *testing.T) {
+	err := unsyncedApplication(1).waitForSync(context.Background())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if !strings.Contains(err.Error(), "within 1s") || !strings.Contains(err.Error(), "RBAC") {
+		t.Errorf("timeout error does not point at RBAC: %v", err)
+	}
+}
+
+func TestWaitForSyncCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := unsyncedApplication(0).waitForSync(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if strings.Contains(err.Error(), "RBAC") {
+		t.Errorf("cancellation reported as a sync timeout: %v", err)
+	}
+}
@@ -2,16 +2,19 @@ package kube
 
 import (
 	"fmt"
+	"time"
 
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
-// NewInformerFactory creates a shared informer factory that works both
-// in-cluster and out of cluster.
-func NewInformerFactory() (informers.SharedInformerFactory, error) {
+// NewRESTConfig builds a client configuration that works both in-cluster and
+// out of cluster, preferring a kubeconfig when one is available.
+func NewRESTConfig() (*rest.Config, error) {
 	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
 	overrides := &clientcmd.ConfigOverrides{}
 	cfg, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides).ClientConfig()
@@ -21,11 +24,29 @@ func NewInformerFactory() (informers.SharedInformerFactory, error) {
 			return nil, fmt.Errorf("build Kubernetes config: %w", err)
 		}
 	}
+	return cfg, nil
+}
 
+// NewInformerFactory creates a shared informer factory for the cluster
+// described by cfg. A non-zero resync periodically re-delivers every cached
+// object to the event handlers; zero disables it.
+func NewInformerFactory(cfg *rest.Config, resync time.Duration) (informers.SharedInformerFactory, error) {
 	clientSet, err := kubernetes.NewForConfig(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("construct Kubernetes client: %w", err)
 	}
 
-	return informers.NewSharedInformerFactory(clientSet, 0), nil
+	return informers.NewSharedInformerFactory(clientSet, resync), nil
+}
+
+// NewDynamicInformerFactory creates a dynamic shared informer factory for
+// watching custom resources in the cluster described by cfg, with the same
+// resync semantics as NewInformerFactory.
+func NewDynamicInformerFactory(cfg *rest.Config, resync time.Duration) (dynamicinformer.DynamicSharedInformerFactory, error) {
+	client, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("construct dynamic Kubernetes client: %w", err)
+	}
+
+	return dynamicinformer.NewDynamicSharedInformerFactory(client, resync), nil
 }
@@ -0,0 +1,96 @@
+package kube
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+// newTestAPIServer serves a single-node list and holds watches open until the
+// client goes away, so only resyncs can re-deliver the node.
+func newTestAPIServer(t *testing.T) *rest.Config {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/nodes" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("watch") == "true" {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		_, _ = w.Write([]byte(`{"kind":"NodeList","apiVersion":"v1","metadata":{"resourceVersion":"1"},` +
+			`"items":[{"metadata":{"name":"worker-1","resourceVersion":"1"}}]}`))
+	}))
+	t.Cleanup(srv.Close)
+	return &rest.Config{Host: srv.URL}
+}
+
+func TestNewInformerFactoryResync(t *testing.T) {
+	factory, err := NewInformerFactory(newTestAPIServer(t), time.Second)
+	if err != nil {
+		t.Fatalf("NewInformerFactory: %v", err)
+	}
+
+	var updates atomic.Int32
+	informer := factory.Core().V1().Nodes().Informer()
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(_, _ any) { updates.Add(1) },
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	t.Cleanup(func() {
+		close(stop)
+		factory.Shutdown()
+	})
+	factory.Start(stop)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for updates.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no resync delivered within 5s of a 1s resync period")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestNewInformerFactoryNoResync(t *testing.T) {
+	factory, err := NewInformerFactory(newTestAPIServer(t), 0)
+	if err != nil {
+		t.Fatalf("NewInformerFactory: %v", err)
+	}
+
+	var adds, updates atomic.Int32
+	informer := factory.Core().V1().Nodes().Informer()
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(_ any) { adds.Add(1) },
+		UpdateFunc: func(_, _ any) { updates.Add(1) },
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	t.Cleanup(func() {
+		close(stop)
+		factory.Shutdown()
+	})
+	factory.Start(stop)
+	if !cache.WaitForCacheSync(stop, informer.HasSynced) {
+		t.Fatal("node informer did not sync")
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+	if adds.Load() != 1 || updates.Load() != 0 {
+		t.Errorf("adds = %d, updates = %d; want the node delivered once and never resynced", adds.Load(), updates.Load())
+	}
+}
@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/puzhihao/kubelet-cadvisor-addlabel/internal/selfmetrics"
+)
+
+const (
+	// maxBreakerBackoff caps how far the cooldown grows, as a multiple of the
+	// configured cooldown, after repeated failed probes.
+	maxBreakerBackoff = 16
+	// breakerJitter spreads the cooldown of nodes that tripped together by up
+	// to this fraction so their probes do not land in the same cycle.
+	breakerJitter = 0.1
+)
+
+var nodeCircuitOpen = selfmetrics.NewGaugeVec(
+	"addlabel_node_circuit_open",
+	"Whether scrapes of a node are suspended by its circuit breaker (1) or not (0).",
+	"node",
+)
+
+// errCircuitOpen marks a node skipped because its circuit breaker is open.
+var errCircuitOpen = errors.New("circuit breaker open; scrape skipped")
+
+// nodeBreaker suspends scrapes of nodes that failed threshold cycles in a
+// row. After a cooldown one probe scrape is let through (half-open); success
+// closes the breaker, failure re-opens it with a doubled cooldown.
+type nodeBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	nodes     map[string]*breakerState
+	now       func() time.Time
+}
+
+type breakerState struct {
+	failures int
+	// trips counts consecutive openings and scales the cooldown.
+	trips   int
+	retryAt time.Time
+}
+
+// newNodeBreaker returns nil, which allows every scrape, when threshold is
+// not positive.
+func newNodeBreaker(threshold int, cooldown time.Duration) *nodeBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &nodeBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		nodes:     make(map[string]*breakerState),
+		now:       time.Now,
+	}
+}
+
+// allow reports whether ip may be scraped this cycle. Once the cooldown of an
+// open breaker has elapsed, a single probe is allowed.
+func (b *nodeBreaker) allow(ip string) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state, ok := b.nodes[ip]
+	if !ok || state.failures < b.threshold {
+		return true
+	}
+	now := b.now()
+	if now.Before(state.retryAt) {
+		return false
+	}
+	// Hold further probes back for one cooldown in case this one never
+	// reports, e.g. because the cycle was cancelled.
+	state.retryAt = now.Add(b.cooldown)
+	return true
+}
+
+// record updates the breaker of ip with the outcome of a scrape.
+func (b *nodeBreaker) record(ip string, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		if _, ok := b.nodes[ip]; ok {
+			delete(b.nodes, ip)
+			nodeCircuitOpen.Set(0, ip)
+		}
+		return
+	}
+
+	state, ok := b.nodes[ip]
+	if !ok {
+		state = &breakerState{}
+		b.nodes[ip] = state
+	}
+	state.failures++
+	if state.failures < b.threshold {
+		return
+	}
+
+	state.trips++
+	backoff := b.cooldown * time.Duration(min(1<<(state.trips-1), maxBreakerBackoff))
+	backoff += time.Duration(rand.Float64() * breakerJitter * float64(backoff))
+	state.retryAt = b.now().Add(backoff)
+	nodeCircuitOpen.Set(1, ip)
+}
@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNodeBreakerLifecycle(t *testing.T) {
+	const ip = "10.0.0.1"
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newNodeBreaker(2, time.Minute)
+	b.now = func() time.Time { return now }
+	errScrape := errors.New("connection refused")
+
+	// Closed: failures below the threshold keep the node scraped.
+	if !b.allow(ip) {
+		t.Fatal("closed breaker rejected a scrape")
+	}
+	b.record(ip, errScrape)
+	if !b.allow(ip) {
+		t.Fatal("breaker opened before the threshold")
+	}
+	b.record(ip, errScrape)
+
+	// Open: scrapes are skipped for the cooldown.
+	if b.allow(ip) {
+		t.Fatal("open breaker allowed a scrape")
+	}
+	if got := nodeCircuitOpen.Value(ip); got != 1 {
+		t.Errorf("addlabel_node_circuit_open = %v while open, want 1", got)
+	}
+	now = now.Add(30 * time.Second)
+	if b.allow(ip) {
+		t.Fatal("breaker allowed a scrape during the cooldown")
+	}
+
+	// Half-open: one probe after the cooldown; a failed probe re-opens it
+	// with a doubled cooldown.
+	now = now.Add(2 * time.Minute)
+	if !b.allow(ip) {
+		t.Fatal("breaker did not allow a probe after the cooldown")
+	}
+	if b.allow(ip) {
+		t.Fatal("breaker allowed a second concurrent probe")
+	}
+	b.record(ip, errScrape)
+	now = now.Add(90 * time.Second)
+	if b.allow(ip) {
+		t.Fatal("cooldown did not grow after a failed probe")
+	}
+
+	// Closed again after a successful probe.
+	now = now.Add(time.Minute)
+	if !b.allow(ip) {
+		t.Fatal("breaker did not allow a probe after the doubled cooldown")
+	}
+	b.record(ip, nil)
+	if got := nodeCircuitOpen.Value(ip); got != 0 {
+		t.Errorf("addlabel_node_circuit_open = %v after recovery, want 0", got)
+	}
+	b.record(ip, errScrape)
+	if !b.allow(ip) {
+		t.Error("recovered node's failure count was not reset")
+	}
+}
+
+func TestNodeBreakerDisabled(t *testing.T) {
+	b := newNodeBreaker(0, time.Minute)
+	if b != nil {
+		t.Fatalf("newNodeBreaker(0) = %v, want nil", b)
+	}
+	for range 5 {
+		b.record("10.0.0.1", errors.New("down"))
+	}
+	if !b.allow("10.0.0.1") {
+		t.Error("disabled breaker rejected a scrape")
+	}
+}
@@ -5,65 +5,230 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/puzhihao/kubelet-cadvisor-addlabel/internal/selfmetrics"
 
 	"k8s.io/klog/v2"
 )
 
+var (
+	podLabelCacheHits = selfmetrics.NewCounter(
+		"addlabel_podlabel_cache_hits_total",
+		"Pod label lookups served from the cache.",
+	)
+	podLabelCacheMisses = selfmetrics.NewCounter(
+		"addlabel_podlabel_cache_misses_total",
+		"Pod label lookups that were not found in the cache.",
+	)
+	podLabelCacheEntries = selfmetrics.NewGauge(
+		"addlabel_podlabel_cache_entries",
+		"Number of pods whose labels are cached.",
+	)
+	nodeCacheEntries = selfmetrics.NewGauge(
+		"addlabel_node_cache_entries",
+		"Number of nodes with a cached IP address.",
+	)
+	nodesWithoutAddress = selfmetrics.NewGauge(
+		"addlabel_nodes_without_address",
+		"Number of known nodes currently reporting no InternalIP.",
+	)
+)
+
 // Cache keeps a lightweight in-memory view of node IPs and pod labels.
 // It is populated by informer event handlers and queried by the collector.
 type Cache struct {
-	nodeIPs   sync.Map
-	podLabels sync.Map
+	nodeIPs         sync.Map
+	nodeLabels      sync.Map
+	podLabels       sync.Map
+	namespaceLabels sync.Map
+	// crLabels holds custom resource labels keyed by "namespace/name".
+	crLabels sync.Map
+
+	// podTTL, when positive, is how long a pod entry survives without being
+	// refreshed by StorePodMetadata before EvictExpired removes it.
+	podTTL time.Duration
+	// nodeGrace is how long a node that stops reporting an InternalIP keeps
+	// being scraped at its last known address.
+	nodeGrace time.Duration
+	now       func() time.Time
+}
+
+// NodeTarget is a node to scrape, by name via the API server proxy or by IP.
+type NodeTarget struct {
+	Name string
+	IP   string
+}
+
+// nodeEntry is the last known address of a node. missingSince is set while the
+// node reports no InternalIP.
+type nodeEntry struct {
+	ip           string
+	missingSince time.Time
+}
+
+// podEntry is a cached set of pod labels and annotations and the time it was
+// last stored.
+type podEntry struct {
+	labels      map[string]string
+	annotations map[string]string
+	storedAt    time.Time
 }
 
-// NewCache returns an initialized Cache instance.
-func NewCache() *Cache {
-	return &Cache{}
+// NewCache returns an initialized Cache instance. A positive podTTL enables
+// time-based eviction of pod entries via EvictExpired; a positive nodeGrace
+// keeps the last known IP of a node whose address disappears for that long.
+func NewCache(podTTL, nodeGrace time.Duration) *Cache {
+	return &Cache{podTTL: podTTL, nodeGrace: nodeGrace, now: time.Now}
 }
 
 // PodLabels returns a defensive copy of the cached pod labels.
 // The second return value reports whether the labels were present.
 func (c *Cache) PodLabels(namespace, podName string) (map[string]string, bool) {
 	key := cacheKey(namespace, podName)
-	if labels, ok := c.podLabels.Load(key); ok {
+	if entry, ok := c.podLabels.Load(key); ok {
+		podLabelCacheHits.Inc()
 		klog.V(5).InfoS("pod labels cache hit", "pod", key)
-		return cloneStringMap(labels.(map[string]string)), true
+		return cloneStringMap(entry.(*podEntry).labels), true
 	}
 
+	podLabelCacheMisses.Inc()
 	klog.V(6).InfoS("pod labels cache miss", "pod", key)
 	return nil, false
 }
 
-// NodeIPs returns the known node IP addresses.
+// PodAnnotations returns a defensive copy of the cached pod annotations.
+// The second return value reports whether the pod was present.
+func (c *Cache) PodAnnotations(namespace, podName string) (map[string]string, bool) {
+	key := cacheKey(namespace, podName)
+	if entry, ok := c.podLabels.Load(key); ok {
+		klog.V(5).InfoS("pod annotations cache hit", "pod", key)
+		return cloneStringMap(entry.(*podEntry).annotations), true
+	}
+	klog.V(6).InfoS("pod annotations cache miss", "pod", key)
+	return nil, false
+}
+
+// NodeIPs returns the known node IP addresses. Nodes without an address are
+// included at their last known IP until the grace period elapses.
 func (c *Cache) NodeIPs() []string {
-	var ips []string
-	c.nodeIPs.Range(func(_, value interface{}) bool {
-		ip := value.(string)
-		if ip != "" {
-			ips = append(ips, ip)
+	targets := c.NodeTargets()
+	ips := make([]string, 0, len(targets))
+	for _, target := range targets {
+		ips = append(ips, target.IP)
+	}
+	return ips
+}
+
+// NodeTargets returns every scrapeable node with its name, applying the same
+// address grace period as NodeIPs.
+func (c *Cache) NodeTargets() []NodeTarget {
+	var targets []NodeTarget
+	missing := 0
+	now := c.now()
+	c.nodeIPs.Range(func(key, value interface{}) bool {
+		entry := value.(*nodeEntry)
+		if !entry.missingSince.IsZero() {
+			missing++
+			if now.Sub(entry.missingSince) >= c.nodeGrace {
+				return true
+			}
+		}
+		if entry.ip != "" {
+			targets = append(targets, NodeTarget{Name: key.(string), IP: entry.ip})
 		}
 		return true
 	})
 
-	return ips
+	nodeCacheEntries.Set(float64(len(targets)))
+	nodesWithoutAddress.Set(float64(missing))
+	return targets
+}
+
+// NamespaceLabels returns a defensive copy of the cached namespace labels.
+// The second return value reports whether the namespace was present.
+func (c *Cache) NamespaceLabels(namespace string) (map[string]string, bool) {
+	if labels, ok := c.namespaceLabels.Load(namespace); ok {
+		return cloneStringMap(labels.(map[string]string)), true
+	}
+	klog.V(6).InfoS("namespace labels cache miss", "namespace", namespace)
+	return nil, false
 }
 
 // UniqueLabelValues returns all unique, non-empty values observed for a specific label key.
 func (c *Cache) UniqueLabelValues(label string) []string {
+	return c.uniquePodValues(label, func(entry *podEntry) map[string]string { return entry.labels })
+}
+
+// UniqueAnnotationValues returns all unique, non-empty values observed for a
+// specific pod annotation key.
+func (c *Cache) UniqueAnnotationValues(annotation string) []string {
+	return c.uniquePodValues(annotation, func(entry *podEntry) map[string]string { return entry.annotations })
+}
+
+func (c *Cache) uniquePodValues(key string, field func(*podEntry) map[string]string) []string {
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return nil
+	}
+
+	values := make(map[string]struct{})
+	c.podLabels.Range(func(_, value interface{}) bool {
+		if v := strings.TrimSpace(field(value.(*podEntry))[key]); v != "" {
+			values[v] = struct{}{}
+		}
+		return true
+	})
+	return sortedValues(values)
+}
+
+// RangePods calls fn for every cached pod, in no particular order, until it
+// returns false. The maps are the cached ones and must not be modified.
+func (c *Cache) RangePods(fn func(namespace, podName string, labels, annotations map[string]string) bool) {
+	c.podLabels.Range(func(key, value interface{}) bool {
+		namespace, podName, _ := strings.Cut(key.(string), "/")
+		entry := value.(*podEntry)
+		return fn(namespace, podName, entry.labels, entry.annotations)
+	})
+}
+
+// UniqueNamespaceLabelValues returns all unique, non-empty values observed for
+// a namespace label key.
+func (c *Cache) UniqueNamespaceLabelValues(label string) []string {
 	label = strings.TrimSpace(label)
 	if label == "" {
 		return nil
 	}
 
 	values := make(map[string]struct{})
-	c.podLabels.Range(func(_, value interface{}) bool {
-		labels := value.(map[string]string)
-		if v := strings.TrimSpace(labels[label]); v != "" {
+	c.namespaceLabels.Range(func(_, value interface{}) bool {
+		if v := strings.TrimSpace(value.(map[string]string)[label]); v != "" {
 			values[v] = struct{}{}
 		}
 		return true
 	})
+	return sortedValues(values)
+}
 
+// UniqueNodeLabelValues returns all unique, non-empty values observed for a
+// node label key.
+func (c *Cache) UniqueNodeLabelValues(label string) []string {
+	label = strings.TrimSpace(label)
+	if label == "" {
+		return nil
+	}
+
+	values := make(map[string]struct{})
+	c.nodeLabels.Range(func(_, value interface{}) bool {
+		if v := strings.TrimSpace(value.(map[string]string)[label]); v != "" {
+			values[v] = struct{}{}
+		}
+		return true
+	})
+	return sortedValues(values)
+}
+
+func sortedValues(values map[string]struct{}) []string {
 	if len(values) == 0 {
 		return nil
 	}
@@ -78,39 +243,166 @@ func (c *Cache) UniqueLabelValues(label string) []string {
 
 // StorePodLabels stores a defensive copy of the provided labels.
 func (c *Cache) StorePodLabels(namespace, podName string, labels map[string]string) {
+	c.StorePodMetadata(namespace, podName, labels, nil)
+}
+
+// StorePodMetadata stores defensive copies of the provided labels and
+// annotations; a pod with neither is removed from the cache.
+func (c *Cache) StorePodMetadata(namespace, podName string, labels, annotations map[string]string) {
 	key := cacheKey(namespace, podName)
-	if len(labels) == 0 {
-		c.podLabels.Delete(key)
+	if len(labels) == 0 && len(annotations) == 0 {
+		if _, loaded := c.podLabels.LoadAndDelete(key); loaded {
+			podLabelCacheEntries.Add(-1)
+		}
 		klog.V(5).InfoS("removed pod labels from cache", "pod", key)
 		return
 	}
 
-	c.podLabels.Store(key, cloneStringMap(labels))
-	klog.V(6).InfoS("cached pod labels", "pod", key, "count", len(labels))
+	entry := &podEntry{
+		labels:      cloneStringMap(labels),
+		annotations: cloneStringMap(annotations),
+		storedAt:    c.now(),
+	}
+	if _, loaded := c.podLabels.Swap(key, entry); !loaded {
+		podLabelCacheEntries.Add(1)
+	}
+	klog.V(6).InfoS("cached pod labels", "pod", key, "count", len(labels), "annotations", len(annotations))
 }
 
 // DeletePodLabels removes cached pod labels.
 func (c *Cache) DeletePodLabels(namespace, podName string) {
 	key := cacheKey(namespace, podName)
-	c.podLabels.Delete(key)
+	if _, loaded := c.podLabels.LoadAndDelete(key); loaded {
+		podLabelCacheEntries.Add(-1)
+	}
 	klog.V(6).InfoS("deleted pod labels cache entry", "pod", key)
 }
 
-// StoreNodeIP registers a node IP; empty IPs are ignored and remove the entry.
+// EvictExpired removes pod entries that have not been refreshed within the
+// configured TTL and returns how many were evicted. It is a no-op when no TTL
+// is configured.
+func (c *Cache) EvictExpired() int {
+	if c.podTTL <= 0 {
+		return 0
+	}
+
+	cutoff := c.now().Add(-c.podTTL)
+	evicted := 0
+	c.podLabels.Range(func(key, value interface{}) bool {
+		entry := value.(*podEntry)
+		if entry.storedAt.Before(cutoff) && c.podLabels.CompareAndDelete(key, entry) {
+			podLabelCacheEntries.Add(-1)
+			evicted++
+		}
+		return true
+	})
+
+	if evicted > 0 {
+		klog.V(4).InfoS("evicted expired pod label cache entries", "count", evicted, "ttl", c.podTTL)
+	}
+	return evicted
+}
+
+// StoreNamespaceLabels stores a defensive copy of the namespace labels.
+func (c *Cache) StoreNamespaceLabels(namespace string, labels map[string]string) {
+	c.namespaceLabels.Store(namespace, cloneStringMap(labels))
+	klog.V(6).InfoS("cached namespace labels", "namespace", namespace, "count", len(labels))
+}
+
+// DeleteNamespaceLabels removes cached namespace labels.
+func (c *Cache) DeleteNamespaceLabels(namespace string) {
+	c.namespaceLabels.Delete(namespace)
+	klog.V(6).InfoS("deleted namespace labels cache entry", "namespace", namespace)
+}
+
+// CustomResourceLabels returns a defensive copy of the cached labels of a
+// custom resource object. The second return value reports whether the
+// object was present.
+func (c *Cache) CustomResourceLabels(namespace, name string) (map[string]string, bool) {
+	if labels, ok := c.crLabels.Load(cacheKey(namespace, name)); ok {
+		return cloneStringMap(labels.(map[string]string)), true
+	}
+	klog.V(6).InfoS("custom resource labels cache miss", "object", cacheKey(namespace, name))
+	return nil, false
+}
+
+// StoreCustomResourceLabels stores a defensive copy of a custom resource
+// object's labels.
+func (c *Cache) StoreCustomResourceLabels(namespace, name string, labels map[string]string) {
+	c.crLabels.Store(cacheKey(namespace, name), cloneStringMap(labels))
+	klog.V(6).InfoS("cached custom resource labels", "object", cacheKey(namespace, name), "count", len(labels))
+}
+
+// DeleteCustomResourceLabels removes cached custom resource labels.
+func (c *Cache) DeleteCustomResourceLabels(namespace, name string) {
+	c.crLabels.Delete(cacheKey(namespace, name))
+	klog.V(6).InfoS("deleted custom resource labels cache entry", "object", cacheKey(namespace, name))
+}
+
+// UniqueCustomResourceLabelValues returns all unique, non-empty values
+// observed for a custom resource label key.
+func (c *Cache) UniqueCustomResourceLabelValues(label string) []string {
+	label = strings.TrimSpace(label)
+	if label == "" {
+		return nil
+	}
+
+	values := make(map[string]struct{})
+	c.crLabels.Range(func(_, value interface{}) bool {
+		if v := strings.TrimSpace(value.(map[string]string)[label]); v != "" {
+			values[v] = struct{}{}
+		}
+		return true
+	})
+	return sortedValues(values)
+}
+
+// NodeLabels returns a defensive copy of the cached node labels. The second
+// return value reports whether the node was present.
+func (c *Cache) NodeLabels(nodeName string) (map[string]string, bool) {
+	if labels, ok := c.nodeLabels.Load(nodeName); ok {
+		return cloneStringMap(labels.(map[string]string)), true
+	}
+	return nil, false
+}
+
+// StoreNodeLabels stores a defensive copy of the node labels.
+func (c *Cache) StoreNodeLabels(nodeName string, labels map[string]string) {
+	c.nodeLabels.Store(nodeName, cloneStringMap(labels))
+	klog.V(6).InfoS("cached node labels", "node", nodeName, "count", len(labels))
+}
+
+// DeleteNodeLabels removes cached node labels.
+func (c *Cache) DeleteNodeLabels(nodeName string) {
+	c.nodeLabels.Delete(nodeName)
+	klog.V(6).InfoS("deleted node labels cache entry", "node", nodeName)
+}
+
+// StoreNodeIP registers a node IP. An empty IP marks the node as address-less
+// while retaining its previous IP for the grace period.
 func (c *Cache) StoreNodeIP(nodeName, ip string) {
 	if ip == "" {
-		c.nodeIPs.Delete(nodeName)
-		klog.V(5).InfoS("removed node IP due to empty address", "node", nodeName)
+		entry := &nodeEntry{missingSince: c.now()}
+		if value, ok := c.nodeIPs.Load(nodeName); ok {
+			prev := value.(*nodeEntry)
+			entry.ip = prev.ip
+			if !prev.missingSince.IsZero() {
+				entry.missingSince = prev.missingSince
+			}
+		}
+		c.nodeIPs.Store(nodeName, entry)
+		klog.V(4).InfoS("node reports no InternalIP", "node", nodeName, "lastIP", entry.ip, "since", entry.missingSince, "grace", c.nodeGrace)
 		return
 	}
 
-	c.nodeIPs.Store(nodeName, ip)
+	c.nodeIPs.Store(nodeName, &nodeEntry{ip: ip})
 	klog.V(6).InfoS("cached node IP", "node", nodeName, "ip", ip)
 }
 
 // DeleteNode removes a node entry from the cache.
 func (c *Cache) DeleteNode(nodeName string) {
 	c.nodeIPs.Delete(nodeName)
+	c.DeleteNodeLabels(nodeName)
 	klog.V(6).InfoS("deleted node IP cache entry", "node", nodeName)
 }
 
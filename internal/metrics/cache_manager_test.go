@@ -0,0 +1,217 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/puzhihao/kubelet-cadvisor-addlabel/internal/selfmetrics"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPodLabelCacheMetrics(t *testing.T) {
+	c := NewCache(0, 0)
+	hits, misses, entries := podLabelCacheHits.Value(), podLabelCacheMisses.Value(), podLabelCacheEntries.Value()
+
+	c.StorePodLabels("default", "web-0", map[string]string{"app": "web"})
+	c.StorePodLabels("default", "web-0", map[string]string{"app": "web", "version": "v2"})
+	if _, ok := c.PodLabels("default", "web-0"); !ok {
+		t.Fatal("cached pod not found")
+	}
+	if _, ok := c.PodLabels("default", "missing"); ok {
+		t.Fatal("uncached pod found")
+	}
+
+	if got := podLabelCacheHits.Value() - hits; got != 1 {
+		t.Errorf("hits advanced by %v, want 1", got)
+	}
+	if got := podLabelCacheMisses.Value() - misses; got != 1 {
+		t.Errorf("misses advanced by %v, want 1", got)
+	}
+	if got := podLabelCacheEntries.Value() - entries; got != 1 {
+		t.Errorf("entries grew by %v after storing one pod twice, want 1", got)
+	}
+
+	c.DeletePodLabels("default", "web-0")
+	c.DeletePodLabels("default", "web-0")
+	if got := podLabelCacheEntries.Value() - entries; got != 0 {
+		t.Errorf("entries = %+v after deleting the pod, want the starting value", got)
+	}
+}
+
+func TestPodLabelsReturnsCopy(t *testing.T) {
+	c := NewCache(0, 0)
+	c.StorePodLabels("default", "web-0", map[string]string{"app": "web"})
+
+	labels, _ := c.PodLabels("default", "web-0")
+	labels["app"] = "changed"
+	if again, _ := c.PodLabels("default", "web-0"); again["app"] != "web" {
+		t.Errorf("mutating a lookup result changed the cache: %v", again)
+	}
+}
+
+func TestNodeCacheEntriesMetric(t *testing.T) {
+	c := NewCache(0, 0)
+	c.StoreNodeIP("worker-1", "10.0.0.1")
+	c.StoreNodeIP("worker-2", "10.0.0.2")
+
+	if ips := c.NodeIPs(); len(ips) != 2 {
+		t.Fatalf("NodeIPs = %v, want 2 nodes", ips)
+	}
+	if got := nodeCacheEntries.Value(); got != 2 {
+		t.Errorf("node cache entries = %v, want 2", got)
+	}
+
+	rendered := selfmetrics.Render()
+	for _, name := range []string{"addlabel_podlabel_cache_hits_total", "addlabel_podlabel_cache_misses_total", "addlabel_podlabel_cache_entries", "addlabel_node_cache_entries 2"} {
+		if !strings.Contains(rendered, name) {
+			t.Errorf("self-metrics lack %s", name)
+		}
+	}
+}
+
+func TestEvictExpired(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewCache(time.Minute, 0)
+	c.now = func() time.Time { return now }
+
+	c.StorePodLabels("default", "stale", map[string]string{"app": "stale"})
+	c.StorePodLabels("default", "fresh", map[string]string{"app": "fresh"})
+	now = now.Add(45 * time.Second)
+	c.StorePodLabels("default", "fresh", map[string]string{"app": "fresh"})
+	now = now.Add(30 * time.Second)
+
+	if n := c.EvictExpired(); n != 1 {
+		t.Errorf("EvictExpired = %d, want 1", n)
+	}
+	if _, ok := c.PodLabels("default", "stale"); ok {
+		t.Error("entry older than the TTL survived")
+	}
+	if _, ok := c.PodLabels("default", "fresh"); !ok {
+		t.Error("entry refreshed within the TTL was evicted")
+	}
+}
+
+func TestEvictExpiredWithoutTTL(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewCache(0, 0)
+	c.now = func() time.Time { return now }
+	c.StorePodLabels("default", "web-0", map[string]string{"app": "web"})
+	now = now.Add(24 * time.Hour)
+
+	if n := c.EvictExpired(); n != 0 {
+		t.Errorf("EvictExpired without a TTL evicted %d entries", n)
+	}
+}
+
+func TestServiceRunEvictsExpiredPods(t *testing.T) {
+	factory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	svc := NewService(factory, ServiceOptions{StaticNodes: []string{"10.0.0.1"}, DisablePodInformer: true, PodCacheTTL: 20 * time.Millisecond})
+	svc.cache.StorePodLabels("default", "web-0", map[string]string{"app": "web"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- svc.Run(ctx) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := svc.cache.PodLabels("default", "web-0"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("janitor did not evict the expired pod")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Run = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after cancellation")
+	}
+}
+
+func TestServiceSyncsWithoutPodInformer(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-0", Labels: map[string]string{"app": "web"}}}
+	for _, disabled := range []bool{true, false} {
+		client := fake.NewSimpleClientset(testNode("worker-1", "10.0.0.1", nil), pod)
+		factory := informers.NewSharedInformerFactory(client, 0)
+		svc := NewService(factory, ServiceOptions{DisablePodInformer: disabled})
+		if (svc.podInformer == nil) != disabled {
+			t.Fatalf("disabled=%v: pod informer = %v", disabled, svc.podInformer)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- svc.Run(ctx) }()
+		syncCtx, syncCancel := context.WithTimeout(ctx, 5*time.Second)
+		if err := svc.WaitForSync(syncCtx); err != nil {
+			t.Fatalf("disabled=%v: WaitForSync: %v", disabled, err)
+		}
+		syncCancel()
+
+		// Handlers may still be delivering the initial list after sync.
+		deadline := time.Now().Add(5 * time.Second)
+		for len(svc.NodeIPs()) == 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if ips := svc.NodeIPs(); len(ips) != 1 || ips[0] != "10.0.0.1" {
+			t.Errorf("disabled=%v: NodeIPs = %v, want [10.0.0.1]", disabled, ips)
+		}
+		labels := svc.PodLabels("default", "web-0")
+		if disabled && labels != nil {
+			t.Errorf("PodLabels with the pod informer disabled = %v, want nil", labels)
+		}
+		if !disabled && labels["app"] != "web" {
+			t.Errorf("PodLabels with the pod informer enabled = %v", labels)
+		}
+
+		cancel()
+		<-done
+	}
+}
+
+func TestNodeLabelCache(t *testing.T) {
+	store := NewCache(0, 0)
+	store.StorePodLabels("default", "web-0", map[string]string{"zone": "pod-zone"})
+	labels := map[string]string{"zone": "a", "pool": "gpu"}
+	store.StoreNodeLabels("worker-1", labels)
+	store.StoreNodeLabels("worker-2", map[string]string{"zone": "b", "pool": " "})
+	store.StoreNodeLabels("worker-3", map[string]string{"zone": "a"})
+
+	labels["zone"] = "mutated"
+	if got, ok := store.NodeLabels("worker-1"); !ok || got["zone"] != "a" {
+		t.Errorf("NodeLabels(worker-1) = %v, %v; want a stored copy", got, ok)
+	}
+	if got := store.UniqueNodeLabelValues("zone"); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("UniqueNodeLabelValues(zone) = %v, want [a b]", got)
+	}
+	if got := store.UniqueNodeLabelValues("pool"); !reflect.DeepEqual(got, []string{"gpu"}) {
+		t.Errorf("UniqueNodeLabelValues(pool) = %v, want [gpu]", got)
+	}
+	if got := store.UniqueNodeLabelValues(" "); got != nil {
+		t.Errorf("UniqueNodeLabelValues(blank) = %v, want nil", got)
+	}
+	if got := store.UniqueLabelValues("zone"); !reflect.DeepEqual(got, []string{"pod-zone"}) {
+		t.Errorf("UniqueLabelValues(zone) = %v; node labels leaked into pod values", got)
+	}
+
+	store.DeleteNodeLabels("worker-2")
+	if _, ok := store.NodeLabels("worker-2"); ok {
+		t.Error("worker-2 labels still cached after delete")
+	}
+	if got := store.UniqueNodeLabelValues("zone"); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("UniqueNodeLabelValues(zone) after delete = %v, want [a]", got)
+	}
+}
@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"sort"
+	"time"
+)
+
+// CacheSnapshot is a point-in-time view of the metadata cache used to debug
+// enrichment gaps.
+type CacheSnapshot struct {
+	Nodes      map[string]NodeSnapshot `json:"nodes"`
+	PodCount   int                     `json:"podCount"`
+	Pods       []PodSnapshot           `json:"pods"`
+	Truncated  bool                    `json:"truncated"`
+	Namespaces int                     `json:"namespaceCount"`
+}
+
+// NodeSnapshot is the cached scrape address of a node.
+type NodeSnapshot struct {
+	IP           string     `json:"ip"`
+	MissingSince *time.Time `json:"missingSince,omitempty"`
+}
+
+// PodSnapshot is a cached pod entry.
+type PodSnapshot struct {
+	Pod         string            `json:"pod"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	StoredAt    time.Time         `json:"storedAt"`
+}
+
+// Snapshot returns every cached node and up to maxPods pods, ordered by
+// namespace/name so repeated dumps are comparable.
+func (c *Cache) Snapshot(maxPods int) CacheSnapshot {
+	snapshot := CacheSnapshot{Nodes: make(map[string]NodeSnapshot)}
+
+	c.nodeIPs.Range(func(key, value interface{}) bool {
+		entry := value.(*nodeEntry)
+		node := NodeSnapshot{IP: entry.ip}
+		if !entry.missingSince.IsZero() {
+			since := entry.missingSince
+			node.MissingSince = &since
+		}
+		snapshot.Nodes[key.(string)] = node
+		return true
+	})
+
+	entries := make(map[string]*podEntry)
+	var keys []string
+	c.podLabels.Range(func(key, value interface{}) bool {
+		keys = append(keys, key.(string))
+		entries[key.(string)] = value.(*podEntry)
+		return true
+	})
+	sort.Strings(keys)
+
+	snapshot.PodCount = len(keys)
+	if maxPods >= 0 && len(keys) > maxPods {
+		keys = keys[:maxPods]
+		snapshot.Truncated = true
+	}
+	snapshot.Pods = make([]PodSnapshot, 0, len(keys))
+	for _, key := range keys {
+		entry := entries[key]
+		snapshot.Pods = append(snapshot.Pods, PodSnapshot{
+			Pod:         key,
+			Labels:      cloneStringMap(entry.labels),
+			Annotations: cloneStringMap(entry.annotations),
+			StoredAt:    entry.storedAt,
+		})
+	}
+
+	c.namespaceLabels.Range(func(_, _ interface{}) bool {
+		snapshot.Namespaces++
+		return true
+	})
+	return snapshot
+}
@@ -0,0 +1,38 @@
+package metrics
+
+import "testing"
+
+func TestCacheSnapshot(t *testing.T) {
+	store := NewCache(0, 0)
+	store.StoreNodeIP("worker-1", "10.0.0.1")
+	store.StoreNodeIP("worker-2", "10.0.0.2")
+	store.StorePodMetadata("default", "web-1", map[string]string{"app": "web"}, nil)
+	store.StorePodMetadata("default", "web-0", map[string]string{"app": "web"}, map[string]string{"owner": "alice"})
+	store.StorePodLabels("kube-system", "dns-0", map[string]string{"k8s-app": "dns"})
+	store.StoreNamespaceLabels("default", map[string]string{"team": "web"})
+
+	snapshot := store.Snapshot(2)
+	if len(snapshot.Nodes) != 2 || snapshot.Nodes["worker-1"].IP != "10.0.0.1" {
+		t.Errorf("nodes = %v", snapshot.Nodes)
+	}
+	if snapshot.PodCount != 3 || !snapshot.Truncated || len(snapshot.Pods) != 2 {
+		t.Fatalf("pods: count %d, truncated %v, listed %d; want 3, true, 2", snapshot.PodCount, snapshot.Truncated, len(snapshot.Pods))
+	}
+	if snapshot.Pods[0].Pod != "default/web-0" || snapshot.Pods[1].Pod != "default/web-1" {
+		t.Errorf("pods not ordered by key: %s, %s", snapshot.Pods[0].Pod, snapshot.Pods[1].Pod)
+	}
+	if snapshot.Pods[0].Annotations["owner"] != "alice" || snapshot.Pods[0].Labels["app"] != "web" {
+		t.Errorf("pod metadata = %+v", snapshot.Pods[0])
+	}
+	if snapshot.Namespaces != 1 {
+		t.Errorf("namespace count = %d, want 1", snapshot.Namespaces)
+	}
+
+	snapshot.Pods[0].Labels["app"] = "changed"
+	if labels, _ := store.PodLabels("default", "web-0"); labels["app"] != "web" {
+		t.Error("snapshot shares label maps with the cache")
+	}
+	if all := store.Snapshot(10); all.Truncated || len(all.Pods) != 3 {
+		t.Errorf("untruncated snapshot: truncated %v, listed %d", all.Truncated, len(all.Pods))
+	}
+}
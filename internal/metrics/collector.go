@@ -1,78 +1,511 @@
 package metrics
 
 import (
+	"compress/gzip"
 	"context"
 	"crypto/tls"
-	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/puzhihao/kubelet-cadvisor-addlabel/internal/selfmetrics"
+
 	"k8s.io/klog/v2"
 )
 
 const (
-	defaultRequestTimeout       = 8 * time.Second
-	defaultMaxConcurrentScrapes = 10
-	cadvisorEndpoint            = "https://%s:10250/metrics/cadvisor"
+	// DefaultScrapeTimeout bounds a single node scrape when none is configured.
+	DefaultScrapeTimeout = 8 * time.Second
+	// maxRequestTimeout is the client-level ceiling applied on top of the
+	// per-node scrape timeout.
+	maxRequestTimeout = 2 * time.Minute
+	// DefaultMaxConcurrentScrapes caps parallel node scrapes when none is configured.
+	DefaultMaxConcurrentScrapes = 10
+	// DefaultMaxIdleConnsPerHost keeps one warm connection per kubelet, which
+	// is all a single scrape per cycle can reuse.
+	DefaultMaxIdleConnsPerHost = 1
+	// DefaultIdleConnTimeout outlives the default fetch interval so idle
+	// connections survive until the next cycle instead of being re-handshaked.
+	DefaultIdleConnTimeout = 90 * time.Second
+	// DefaultMaxNodePayloadBytes bounds a single decompressed kubelet body;
+	// large nodes produce tens of megabytes, far below this ceiling.
+	DefaultMaxNodePayloadBytes = 256 << 20
+	// DefaultScrapePath is the kubelet path scraped when none is configured.
+	DefaultScrapePath = "/metrics/cadvisor"
+	// apiServerProxyEndpoint is completed with the API server host, a node
+	// name and a scrape path; the API server forwards the request to that
+	// node's kubelet.
+	apiServerProxyEndpoint = "%s/api/v1/nodes/%s/proxy%s"
+	// kubeletEndpoint is completed with the scheme, a host:port pair built by
+	// kubeletHost, which brackets IPv6 addresses, and a scrape path.
+	kubeletEndpoint = "%s://%s%s"
+	// SchemeHTTPS scrapes the authenticated kubelet port with a bearer token.
+	SchemeHTTPS = "https"
+	// SchemeHTTP scrapes the read-only kubelet port without authentication.
+	SchemeHTTP       = "http"
+	defaultHTTPSPort = 10250
+	defaultHTTPPort  = 10255
+	// DefaultNodeIPLabel is the label injected with each sample's source node IP.
+	DefaultNodeIPLabel = "node_ip"
+	nodeUpMetricName   = "addlabel_node_up"
+	// maxLoggedNodeFailures caps the per-node scrape errors logged at error
+	// level in one cycle; the rest are summarized.
+	maxLoggedNodeFailures = 5
+	failureCircuitOpen    = "circuit_open"
+	// NodeLabelSourceIP tags samples with the IP of the node they came from.
+	NodeLabelSourceIP = "ip"
+	// NodeLabelSourceName tags samples with the Kubernetes node name.
+	NodeLabelSourceName = "name"
+	// NodeBannerComment precedes the combined payload with one
+	// "# -------- Node: <ip> --------" comment per scraped node.
+	NodeBannerComment = "comment"
+	// NodeBannerNone omits the node banner entirely.
+	NodeBannerNone = "none"
+	// nodeBannerPlaceholder is replaced with the node identifier in a custom
+	// banner: the node name under NodeLabelSourceName, otherwise the IP.
+	nodeBannerPlaceholder = "{node}"
 )
 
 // Collector fetches metrics from kubelet cadvisor endpoints and decorates the
 // payload with configured labels.
 type Collector struct {
 	service              *Service
+	scheme               string
+	port                 int
+	staticToken          string
 	tokenFile            string
+	tokenReloader        *tokenReloader
 	caFile               string
+	caBundle             *caBundle
 	insecureSkipVerify   bool
+	tlsServerName        string
 	client               *http.Client
 	processor            *LabelProcessor
+	relationHasher       RelationHasher
+	relationMetricName   string
+	outputFormat         string
+	nodeIPLabel          string
+	nodeBanner           string
+	omitFailureComment   bool
+	nodeLabelSource      string
+	scrapeTimeout        time.Duration
 	maxConcurrentScrapes int
+	prefetchConcurrency  int
+	minSuccessRatio      float64
+	dropMetricPrefixes   []string
+	sumMetrics           []string
+	relationNodeLabels   []string
+	emitPodInfo          bool
+	emitTimestamps       bool
+	maxNodePayloadBytes  int64
+	collision            string
+	apiServerHost        string
+	paths                []string
+	pathAddLabels        map[string]string
+	pathProcessor        *LabelProcessor
+	breaker              *nodeBreaker
+	headers              http.Header
+	userAgent            string
+}
+
+// CollectorOptions configures how a Collector authenticates against kubelets
+// and renders the combined payload.
+type CollectorOptions struct {
+	// Scheme is SchemeHTTPS (the default) or SchemeHTTP. Bearer tokens and TLS
+	// settings are only used for HTTPS.
+	Scheme string
+	// Port is the kubelet port; the scheme's well-known port is used when zero.
+	Port int
+	// Token is the bearer token sent to kubelets; when set, TokenFile is not read.
+	Token     string
+	TokenFile string
+	// CACertFile lists the PEM files or directories of the CAs trusted for
+	// kubelet certificates. They replace the system roots, so the bundle must
+	// hold every CA a kubelet chain can end at.
+	CACertFile string
+	// CAReloadInterval controls how often CACertFile is re-read so CA rotation
+	// does not require a restart; zero disables reloading.
+	CAReloadInterval   time.Duration
+	InsecureSkipVerify bool
+	// TLSServerName, when set, is the name kubelet certificates are verified
+	// against instead of the node IP; "{node}" is replaced with the node name.
+	TLSServerName string
+	// RelationHasher computes relation metric values; MD5 is used when nil.
+	RelationHasher RelationHasher
+	// RelationMetricName names the relation series; relation metrics are
+	// skipped entirely when it is empty.
+	RelationMetricName string
+	// OutputFormat is FormatPrometheus (the default) or FormatOpenMetrics.
+	OutputFormat string
+	// NodeIPLabel is the label injected with the source node IP of every
+	// sample; injection is disabled when it is empty.
+	NodeIPLabel string
+	// NodeLabelSource selects the value of NodeIPLabel and of addlabel_node_up:
+	// NodeLabelSourceIP (the default) or NodeLabelSourceName.
+	NodeLabelSource string
+	// NodeBanner is NodeBannerComment (the default), NodeBannerNone, or a
+	// comment template written once per node with "{node}" replaced by its IP.
+	NodeBanner string
+	// OmitFailureComment drops the "# scrape failures:" comment that otherwise
+	// precedes the payload when some nodes could not be scraped.
+	OmitFailureComment bool
+	// ScrapeTimeout bounds each node scrape; DefaultScrapeTimeout is used when zero.
+	ScrapeTimeout time.Duration
+	// MaxConcurrentScrapes caps parallel node scrapes; DefaultMaxConcurrentScrapes
+	// is used when zero.
+	MaxConcurrentScrapes int
+	// PrefetchConcurrency, when positive, resolves the metadata of every pod
+	// in the combined payload with that many workers before enrichment, so
+	// the enrichment pass only hits the memo and a cold cache does not
+	// serialize it on lister lookups.
+	PrefetchConcurrency int
+	// MinSuccessRatio is the minimum fraction of nodes that must scrape
+	// successfully for a cycle to produce a payload; zero accepts any success.
+	MinSuccessRatio float64
+	// EmitPodInfo appends an addlabel_pod_info series per cached pod carrying
+	// its ADD_LABELS values.
+	EmitPodInfo bool
+	// RelationNodeLabels lists node label keys whose unique values are emitted
+	// as relation series with source="node".
+	RelationNodeLabels []string
+	// MaxIdleConnsPerHost and IdleConnTimeout tune kubelet connection reuse.
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	// MaxNodePayloadBytes fails a node whose decompressed body exceeds it;
+	// DefaultMaxNodePayloadBytes is used when zero.
+	MaxNodePayloadBytes int64
+	// APIServerClient, when set, scrapes every node through the API server's
+	// node proxy at APIServerHost. The client carries the API server
+	// credentials, so TokenFile and the kubelet TLS settings are unused.
+	APIServerClient *http.Client
+	APIServerHost   string
+	// NoProxy dials kubelets directly, ignoring the proxy environment.
+	NoProxy bool
+	// DisableHTTP2 restricts kubelet connections to HTTP/1.1. HTTP/2 is
+	// otherwise negotiated over TLS, multiplexing each node's scrape paths on
+	// a single connection.
+	DisableHTTP2 bool
+	// Headers are added to every scrape request, e.g. for an auth proxy in
+	// front of the kubelet. A bearer token still sets Authorization.
+	Headers http.Header
+	// UserAgent identifies the exporter on every scrape request; Go's
+	// default is sent when it is empty.
+	UserAgent string
+	// EmitTimestamps stamps every sample without a timestamp with the time
+	// the collection cycle started.
+	EmitTimestamps bool
+	// BreakerFailures is how many consecutive failed scrapes suspend a node
+	// for BreakerCooldown before it is probed again; zero disables it.
+	BreakerFailures int
+	BreakerCooldown time.Duration
+	// Paths lists the kubelet paths scraped on every node; their payloads are
+	// merged family by family. DefaultScrapePath is used when empty.
+	Paths []string
+	// PathAddLabels maps a path to ADD_LABELS entries added only to metrics
+	// scraped from that path, on top of the labels passed to Collect.
+	PathAddLabels map[string]string
+	// SumMetrics lists metric families whose series are summed across nodes
+	// into one series each, instead of being tagged with the node label.
+	SumMetrics []string
+	// DropMetricPrefixes discards every metric family whose name starts with
+	// one of the prefixes before enrichment.
+	DropMetricPrefixes []string
+	// Processor configures label enrichment.
+	Processor ProcessorOptions
 }
 
 // NewCollector returns a Collector backed by the provided service cache.
-func NewCollector(service *Service, tokenFile, caFile string, insecureSkipVerify bool) *Collector {
-	tlsConfig := buildTLSConfig(caFile, insecureSkipVerify)
-	tr := &http.Transport{TLSClientConfig: tlsConfig}
+func NewCollector(service *Service, opts CollectorOptions) *Collector {
+	scheme := opts.Scheme
+	if scheme == "" {
+		scheme = SchemeHTTPS
+	}
+
+	port := opts.Port
+	if port <= 0 {
+		port = defaultHTTPSPort
+		if scheme == SchemeHTTP {
+			port = defaultHTTPPort
+		}
+	}
+
+	maxIdlePerHost := opts.MaxIdleConnsPerHost
+	if maxIdlePerHost <= 0 {
+		maxIdlePerHost = DefaultMaxIdleConnsPerHost
+	}
+	idleTimeout := opts.IdleConnTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultIdleConnTimeout
+	}
+
+	// MaxIdleConns is left unlimited so the per-host limit alone decides how
+	// many kubelet connections stay open, however many nodes there are.
+	tr := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost: maxIdlePerHost,
+		IdleConnTimeout:     idleTimeout,
+	}
+	// Kubelet scrapes honour HTTP(S)_PROXY and NO_PROXY unless the proxy is
+	// explicitly bypassed for in-cluster traffic.
+	if opts.NoProxy {
+		tr.Proxy = nil
+	}
+	// A custom TLSClientConfig turns off the transport's implicit HTTP/2
+	// support, so it is requested explicitly; a non-nil empty TLSNextProto
+	// keeps it off.
+	if opts.DisableHTTP2 {
+		tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	} else {
+		tr.ForceAttemptHTTP2 = true
+	}
+	var bundle *caBundle
+	if scheme == SchemeHTTPS && opts.APIServerClient == nil {
+		if opts.CACertFile != "" && !opts.InsecureSkipVerify {
+			bundle = newCABundle(opts.CACertFile, opts.CAReloadInterval)
+		}
+		tr.TLSClientConfig = buildTLSConfig(opts.InsecureSkipVerify)
+		if !opts.InsecureSkipVerify {
+			tr.DialTLSContext = newKubeletDialer(tr.TLSClientConfig, bundle)
+		}
+	}
+
+	hasher := opts.RelationHasher
+	if hasher == nil {
+		hasher = defaultRelationHasher()
+	}
+
+	scrapeTimeout := opts.ScrapeTimeout
+	if scrapeTimeout <= 0 {
+		scrapeTimeout = DefaultScrapeTimeout
+	}
+
+	maxConcurrentScrapes := opts.MaxConcurrentScrapes
+	if maxConcurrentScrapes <= 0 {
+		maxConcurrentScrapes = DefaultMaxConcurrentScrapes
+	}
+
+	maxPayload := opts.MaxNodePayloadBytes
+	if maxPayload <= 0 {
+		maxPayload = DefaultMaxNodePayloadBytes
+	}
+
+	paths := opts.Paths
+	if len(paths) == 0 {
+		paths = []string{DefaultScrapePath}
+	}
+
+	client := &http.Client{Timeout: maxRequestTimeout, Transport: tr}
+	if opts.APIServerClient != nil {
+		client = opts.APIServerClient
+	}
 
-	return &Collector{
+	c := &Collector{
 		service:              service,
-		tokenFile:            tokenFile,
-		caFile:               caFile,
-		insecureSkipVerify:   insecureSkipVerify,
-		client:               &http.Client{Timeout: defaultRequestTimeout, Transport: tr},
-		processor:            NewLabelProcessor(),
-		maxConcurrentScrapes: defaultMaxConcurrentScrapes,
+		scheme:               scheme,
+		port:                 port,
+		staticToken:          strings.TrimSpace(opts.Token),
+		tokenFile:            opts.TokenFile,
+		caFile:               opts.CACertFile,
+		caBundle:             bundle,
+		insecureSkipVerify:   opts.InsecureSkipVerify,
+		tlsServerName:        opts.TLSServerName,
+		client:               client,
+		processor:            NewLabelProcessor(opts.Processor),
+		relationHasher:       hasher,
+		relationMetricName:   opts.RelationMetricName,
+		outputFormat:         opts.OutputFormat,
+		nodeIPLabel:          opts.NodeIPLabel,
+		nodeBanner:           opts.NodeBanner,
+		omitFailureComment:   opts.OmitFailureComment,
+		nodeLabelSource:      opts.NodeLabelSource,
+		scrapeTimeout:        scrapeTimeout,
+		maxConcurrentScrapes: maxConcurrentScrapes,
+		prefetchConcurrency:  opts.PrefetchConcurrency,
+		minSuccessRatio:      opts.MinSuccessRatio,
+		dropMetricPrefixes:   opts.DropMetricPrefixes,
+		sumMetrics:           opts.SumMetrics,
+		relationNodeLabels:   opts.RelationNodeLabels,
+		emitPodInfo:          opts.EmitPodInfo,
+		emitTimestamps:       opts.EmitTimestamps,
+		maxNodePayloadBytes:  maxPayload,
+		collision:            opts.Processor.CollisionStrategy,
+		apiServerHost:        strings.TrimSuffix(opts.APIServerHost, "/"),
+		paths:                paths,
+		pathAddLabels:        opts.PathAddLabels,
+		breaker:              newNodeBreaker(opts.BreakerFailures, opts.BreakerCooldown),
+		headers:              opts.Headers,
+		userAgent:            opts.UserAgent,
+		// Per-path labels are applied before the payloads are merged, so
+		// constant labels and namespace rules are left to the main pass.
+		pathProcessor: NewLabelProcessor(ProcessorOptions{
+			EnrichPrefixes:    opts.Processor.EnrichPrefixes,
+			CollisionStrategy: opts.Processor.CollisionStrategy,
+			AnnotateSource:    opts.Processor.AnnotateSource,
+			MaxLabelValueLen:  opts.Processor.MaxLabelValueLen,
+		}),
+	}
+	c.tokenReloader = &tokenReloader{read: c.readTokenFile}
+	return c
+}
+
+// acceptHeader asks for the Prometheus text format, the only one the merge
+// and enrichment pipeline parses; OPENMETRICS output is converted from it on
+// the way out.
+const acceptHeader = "text/plain;version=0.0.4"
+
+// checkContentType rejects bodies that are not Prometheus text, such as the
+// protobuf format some endpoints can negotiate, or OpenMetrics, whose "# EOF"
+// and "_created" lines would corrupt the merged payload. A missing
+// Content-Type is accepted.
+func checkContentType(contentType string) error {
+	if contentType == "" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("unparseable content type %q: %w", contentType, err)
+	}
+	if mediaType != "text/plain" {
+		return fmt.Errorf("unsupported content type %q: only the Prometheus text format can be processed", contentType)
+	}
+	return nil
+}
+
+// ParseScrapeHeaders parses SCRAPE_HEADERS, a comma-separated list of
+// Name:Value pairs, rejecting names that are not valid HTTP header tokens and
+// values containing control characters. Repeated names add further values.
+func ParseScrapeHeaders(raw string) (http.Header, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+
+	headers := make(http.Header)
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			return nil, fmt.Errorf("SCRAPE_HEADERS contains an empty entry")
+		}
+		name, value, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("SCRAPE_HEADERS: entry %q is not a Name:Value pair", entry)
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("SCRAPE_HEADERS: %q is not a valid header name", name)
+		}
+		if strings.ContainsFunc(value, func(r rune) bool { return r < ' ' && r != '\t' || r == 0x7f }) {
+			return nil, fmt.Errorf("SCRAPE_HEADERS: value of %q contains control characters", name)
+		}
+		headers.Add(name, value)
+	}
+	return headers, nil
+}
+
+// validHeaderName reports whether name is an RFC 9110 token.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", r):
+		default:
+			return false
+		}
 	}
+	return true
+}
+
+// CollectResult summarises a single collection cycle.
+type CollectResult struct {
+	// Payload is the combined and enriched metrics text; CollectTo leaves it
+	// empty.
+	Payload   string
+	StartedAt time.Time
+	Duration  time.Duration
+	// Nodes maps every scraped node IP to the outcome of its scrape.
+	Nodes map[string]NodeResult
+	// Enrich counts the lines handled by label enrichment.
+	Enrich EnrichStats
 }
 
+// NodeResult is the outcome of scraping a single node.
+type NodeResult struct {
+	Bytes    int
+	Duration time.Duration
+	Err      error
+}
+
+var kubeletRequests = selfmetrics.NewCounterVec(
+	"addlabel_kubelet_requests_total",
+	"Kubelet requests that received a response, by protocol and whether the connection was new or reused.",
+	"protocol", "connection",
+)
+
 // Collect retrieves the metrics payload from every known node and applies the
-// configured label enrichment rules.
-func (c *Collector) Collect(ctx context.Context, addLabels, labelDefaults string) (string, error) {
-	nodeIPs := c.service.NodeIPs()
-	if len(nodeIPs) == 0 {
-		return "", fmt.Errorf("no node IPs available for scraping")
+// configured label enrichment rules. The returned result is non-nil whenever
+// nodes were scraped, even if the cycle as a whole failed, so callers can
+// still report per-node outcomes.
+func (c *Collector) Collect(ctx context.Context, addLabels, labelDefaults string) (*CollectResult, error) {
+	var b strings.Builder
+	result, err := c.CollectTo(ctx, &b, addLabels, labelDefaults)
+	if err == nil {
+		result.Payload = b.String()
 	}
+	return result, err
+}
 
-	token, err := os.ReadFile(c.tokenFile)
+// CollectTo is Collect writing the payload to w instead of returning it. In
+// the Prometheus format without timestamps the enriched output is streamed to
+// w, so no full copy of the final payload is held in memory; otherwise it is
+// rendered first. If an error is returned, w may have received only part of
+// the payload. result.Payload is left empty.
+func (c *Collector) CollectTo(ctx context.Context, w io.Writer, addLabels, labelDefaults string) (*CollectResult, error) {
+	nodes := c.service.NodeTargets()
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no node IPs available for scraping")
+	}
+
+	tokenString, err := c.token()
 	if err != nil {
-		return "", fmt.Errorf("read service account token: %w", err)
+		return nil, err
 	}
 
-	tokenString := strings.TrimSpace(string(token))
-	if tokenString == "" {
-		return "", fmt.Errorf("service account token is empty")
+	if c.caBundle != nil {
+		c.caBundle.maybeReload()
 	}
 
 	startTime := time.Now()
-	klog.InfoS("starting cadvisor scrape", "nodes", len(nodeIPs))
+	klog.InfoS("starting cadvisor scrape", "nodes", len(nodes))
 
-	results := make(map[string]string, len(nodeIPs))
+	results := make(map[string]string, len(nodes))
 	failures := make(map[string]error)
+	durations := make(map[string]time.Duration, len(nodes))
+
+	resolver := memoizeResolver(c.service)
+	var enrichPath func(path, payload string) (string, error)
+	if len(c.pathAddLabels) > 0 {
+		enrichPath = func(path, payload string) (string, error) {
+			labels := c.pathAddLabels[path]
+			if labels == "" {
+				return payload, nil
+			}
+			enriched, _, err := c.pathProcessor.AddLabelsToMetrics(ctx, payload, labels, labelDefaults, resolver)
+			return enriched, err
+		}
+	}
 
 	var wg sync.WaitGroup
 	var mu sync.Mutex
@@ -82,19 +515,36 @@ func (c *Collector) Collect(ctx context.Context, addLabels, labelDefaults string
 	}
 	sem := make(chan struct{}, maxWorkers)
 
-	for _, ip := range nodeIPs {
-		ip := ip
+	for _, node := range nodes {
+		ip := node.IP
+		if !c.breaker.allow(ip) {
+			mu.Lock()
+			failures[ip] = errCircuitOpen
+			mu.Unlock()
+			continue
+		}
 		wg.Add(1)
 
 		go func() {
 			defer wg.Done()
-			sem <- struct{}{}
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
 			defer func() { <-sem }()
 
-			data, err := c.fetchNode(ctx, ip, tokenString)
+			nodeStart := time.Now()
+			data, err := c.fetchNode(ctx, node, tokenString, enrichPath)
+			elapsed := time.Since(nodeStart)
+			if ctx.Err() == nil {
+				c.breaker.record(ip, err)
+			}
 			mu.Lock()
 			defer mu.Unlock()
 
+			durations[ip] = elapsed
+
 			if err != nil {
 				failures[ip] = err
 				return
@@ -104,22 +554,60 @@ func (c *Collector) Collect(ctx context.Context, addLabels, labelDefaults string
 		}()
 	}
 
-	wg.Wait()
+	// Requests carry ctx and abort on cancellation, but a worker may still be
+	// unwinding; return immediately instead of waiting for it. The workers
+	// only touch the maps under mu, which are abandoned in that case.
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("cadvisor scrape cancelled: %w", ctx.Err())
+	}
 
+	result := &CollectResult{
+		StartedAt: startTime,
+		Nodes:     make(map[string]NodeResult, len(nodes)),
+	}
+	for ip, data := range results {
+		result.Nodes[ip] = NodeResult{Bytes: len(data), Duration: durations[ip]}
+	}
 	for ip, err := range failures {
-		klog.ErrorS(err, "cadvisor scrape failed", "node", ip)
+		result.Nodes[ip] = NodeResult{Err: err, Duration: durations[ip]}
 	}
+	logFailures(failures, durations)
 
 	if len(results) == 0 {
-		return "", fmt.Errorf("cadvisor scrape failed for all %d nodes", len(nodeIPs))
+		result.Duration = time.Since(startTime)
+		return result, fmt.Errorf("cadvisor scrape failed for all %d nodes", len(nodes))
+	}
+
+	if ratio := float64(len(results)) / float64(len(nodes)); ratio < c.minSuccessRatio {
+		result.Duration = time.Since(startTime)
+		return result, fmt.Errorf(
+			"cadvisor scrape succeeded for %d of %d nodes, below minimum success ratio %.2f",
+			len(results), len(nodes), c.minSuccessRatio,
+		)
 	}
 
-	payload := combineMetrics(results)
-	if len(failures) > 0 {
+	nodeValues := c.nodeLabelValues(nodes)
+	payload := combineMetrics(results, c.nodeIPLabel, nodeValues, c.nodeBanner, c.dropMetricPrefixes, c.sumMetrics, c.collision)
+	if len(failures) > 0 && c.outputFormat != FormatOpenMetrics && !c.omitFailureComment {
 		payload = annotateFailures(payload, failures)
 	}
+	payload += buildNodeUpMetrics(results, failures, c.nodeIPLabel, nodeValues)
 
-	relationMetrics := buildRelationMetrics(c.service, splitLabels(addLabels), parseLabelDefaults(labelDefaults))
+	relationMetrics := buildRelationMetrics(
+		c.service,
+		c.relationMetricName,
+		c.relationHasher,
+		parseLabelTargets(addLabels),
+		parseLabelDefaults(labelDefaults),
+		c.relationNodeLabels,
+	)
 	if relationMetrics != "" {
 		if !strings.HasSuffix(payload, "\n") {
 			payload += "\n"
@@ -127,6 +615,16 @@ func (c *Collector) Collect(ctx context.Context, addLabels, labelDefaults string
 		payload += relationMetrics
 	}
 
+	if c.emitPodInfo {
+		if podInfo := buildPodInfoMetrics(c.service, parseLabelTargets(addLabels), parseLabelDefaults(labelDefaults)); podInfo != "" {
+			if !strings.HasSuffix(payload, "\n") {
+				payload += "\n"
+			}
+			payload += podInfo
+		}
+	}
+
+	minDuration, maxDuration, avgDuration := durationStats(durations)
 	klog.InfoS(
 		"cadvisor scrape completed",
 		"successes", len(results),
@@ -135,78 +633,397 @@ func (c *Collector) Collect(ctx context.Context, addLabels, labelDefaults string
 		len(payload),
 		"duration",
 		time.Since(startTime),
+		"minNodeDuration", minDuration,
+		"maxNodeDuration", maxDuration,
+		"avgNodeDuration", avgDuration,
 	)
 
-	if addLabels == "" {
-		return payload, nil
+	// Enrichment is the last stage unless the payload is rewritten for
+	// OpenMetrics or timestamps, in which case it is buffered first.
+	out := w
+	var rendered strings.Builder
+	rewrite := c.outputFormat == FormatOpenMetrics || c.emitTimestamps
+	if rewrite {
+		out = &rendered
+	}
+
+	if c.prefetchConcurrency > 0 && c.processor.Enabled(addLabels) {
+		resolver.prefetch(ctx, payload, c.prefetchConcurrency, c.processor.sources(addLabels))
+	}
+
+	stats, err := c.enrich(ctx, out, payload, addLabels, labelDefaults, resolver)
+	result.Enrich = stats
+	if err != nil {
+		result.Duration = time.Since(startTime)
+		return result, err
+	}
+
+	if rewrite {
+		payload = rendered.String()
+		if c.outputFormat == FormatOpenMetrics {
+			payload = toOpenMetrics(payload)
+		}
+		if c.emitTimestamps {
+			payload = appendTimestamps(payload, startTime, c.outputFormat == FormatOpenMetrics)
+		}
+		if _, err := io.WriteString(w, payload); err != nil {
+			result.Duration = time.Since(startTime)
+			return result, fmt.Errorf("write payload: %w", err)
+		}
+	}
+
+	result.Duration = time.Since(startTime)
+	return result, nil
+}
+
+// logFailures logs the failed nodes of a cycle. The first
+// maxLoggedNodeFailures are logged at error level and the rest at V(3); when
+// any were demoted, a summary with counts per error category follows, so a
+// cluster-wide outage does not flood the log. /status keeps every error.
+func logFailures(failures map[string]error, durations map[string]time.Duration) {
+	ips := make([]string, 0, len(failures))
+	for ip := range failures {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+
+	logged := 0
+	categories := make(map[string]int)
+	for _, ip := range ips {
+		err := failures[ip]
+		categories[failureCategory(err)]++
+		switch {
+		case errors.Is(err, errCircuitOpen):
+			klog.V(2).InfoS("node skipped by circuit breaker", "node", ip)
+		case logged < maxLoggedNodeFailures:
+			klog.ErrorS(err, "cadvisor scrape failed", "node", ip, "duration", durations[ip])
+			logged++
+		default:
+			klog.V(3).InfoS("cadvisor scrape failed", "node", ip, "duration", durations[ip], "err", err)
+		}
+	}
+
+	if suppressed := len(ips) - categories[failureCircuitOpen] - logged; suppressed > 0 {
+		klog.ErrorS(nil, "cadvisor scrape failures summarized",
+			"failures", len(ips),
+			"logged", logged,
+			"suppressed", suppressed,
+			"byCategory", categories,
+		)
+	}
+}
+
+// failureCategory groups a node scrape error for the failure summary.
+func failureCategory(err error) string {
+	var se *statusError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errCircuitOpen):
+		return failureCircuitOpen
+	case errors.As(err, &se):
+		return "http_" + strconv.Itoa(se.code)
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &netErr):
+		return "connection"
+	default:
+		return "other"
+	}
+}
+
+// enrich writes payload to w with the requested labels added, or unchanged
+// when enrichment is disabled.
+func (c *Collector) enrich(
+	ctx context.Context,
+	w io.Writer,
+	payload,
+	addLabels,
+	labelDefaults string,
+	resolver LabelResolver,
+) (EnrichStats, error) {
+	if !c.processor.Enabled(addLabels) {
+		if _, err := io.WriteString(w, payload); err != nil {
+			return EnrichStats{}, fmt.Errorf("write payload: %w", err)
+		}
+		return EnrichStats{}, nil
 	}
 
 	klog.InfoS("enriching metrics with labels", "labels", addLabels, "defaults", labelDefaults)
-	enriched := c.processor.AddLabelsToMetrics(payload, addLabels, labelDefaults, c.service.PodLabels)
-	klog.InfoS("metrics enrichment completed", "originalBytes", len(payload), "enrichedBytes", len(enriched))
+	cw := &countingWriter{w: w}
+	stats, err := c.processor.EnrichTo(ctx, cw, payload, addLabels, labelDefaults, resolver)
+	if err != nil {
+		return stats, err
+	}
+	stats.publish()
+	klog.InfoS("metrics enrichment completed",
+		"originalBytes", len(payload),
+		"enrichedBytes", cw.n,
+		"linesProcessed", stats.Processed,
+		"linesEnriched", stats.Enriched,
+		"linesSkipped", stats.Skipped,
+	)
+	return stats, nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// token returns the bearer token used to authenticate kubelet scrapes. It is
+// empty when scraping over plain HTTP.
+func (c *Collector) token() (string, error) {
+	if c.scheme != SchemeHTTPS || c.apiServerHost != "" {
+		return "", nil
+	}
+	if c.staticToken != "" {
+		return c.staticToken, nil
+	}
+	return c.readTokenFile()
+}
+
+func (c *Collector) readTokenFile() (string, error) {
+	token, err := os.ReadFile(c.tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("read service account token: %w", err)
+	}
+
+	tokenString := strings.TrimSpace(string(token))
+	if tokenString == "" {
+		return "", fmt.Errorf("service account token is empty")
+	}
+	return tokenString, nil
+}
+
+// durationStats returns the minimum, maximum and mean of the per-node scrape durations.
+func durationStats(durations map[string]time.Duration) (minimum, maximum, mean time.Duration) {
+	if len(durations) == 0 {
+		return 0, 0, 0
+	}
+
+	var total time.Duration
+	first := true
+	for _, d := range durations {
+		if first || d < minimum {
+			minimum = d
+		}
+		if first || d > maximum {
+			maximum = d
+		}
+		first = false
+		total += d
+	}
+	return minimum, maximum, total / time.Duration(len(durations))
+}
+
+// kubeletHost returns the host:port to scrape for a target. Targets that
+// already carry a port, such as static "ip:port" entries, are used as-is.
+func kubeletHost(target string, port int) string {
+	if _, _, err := net.SplitHostPort(target); err == nil {
+		return target
+	}
+	return net.JoinHostPort(target, strconv.Itoa(port))
+}
+
+// nodeURL returns the URL of a scrape path on a node, either on its kubelet
+// or through the API server node proxy.
+func (c *Collector) nodeURL(node NodeTarget, path string) string {
+	if c.apiServerHost != "" {
+		return fmt.Sprintf(apiServerProxyEndpoint, c.apiServerHost, url.PathEscape(node.Name), path)
+	}
+	return fmt.Sprintf(kubeletEndpoint, c.scheme, kubeletHost(node.IP, c.port), path)
+}
+
+// fetchNode scrapes every configured path of a node and concatenates the
+// payloads; a failing path fails the whole node. SCRAPE_TIMEOUT bounds the
+// node as a whole, token retries included. enrich, when non-nil, is applied
+// to each path's payload first.
+func (c *Collector) fetchNode(
+	ctx context.Context,
+	node NodeTarget,
+	token string,
+	enrich func(path, payload string) (string, error),
+) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.scrapeTimeout)
+	defer cancel()
+
+	if len(c.paths) == 1 && enrich == nil {
+		return c.fetchPathAuthorized(ctx, node, c.paths[0], &token)
+	}
+
+	var b strings.Builder
+	for _, path := range c.paths {
+		data, err := c.fetchPathAuthorized(ctx, node, path, &token)
+		if err == nil && enrich != nil {
+			data, err = enrich(path, data)
+		}
+		if err != nil {
+			if len(c.paths) > 1 {
+				err = fmt.Errorf("%s: %w", path, err)
+			}
+			return "", err
+		}
+		b.WriteString(data)
+		if data != "" && !strings.HasSuffix(data, "\n") {
+			b.WriteByte('\n')
+		}
+	}
+	return b.String(), nil
+}
 
-	return enriched, nil
+// fetchPathAuthorized is fetchPath retrying once with a reloaded token when
+// the kubelet rejects *token, which is then updated for the node's remaining
+// paths. A static TOKEN is never reloaded.
+func (c *Collector) fetchPathAuthorized(ctx context.Context, node NodeTarget, path string, token *string) (string, error) {
+	data, err := c.fetchPath(ctx, node, path, *token)
+	if err == nil || *token == "" || c.staticToken != "" || !isAuthError(err) {
+		return data, err
+	}
+
+	fresh, ok := c.tokenReloader.refresh(*token)
+	if !ok {
+		return data, err
+	}
+	*token = fresh
+	return c.fetchPath(ctx, node, path, fresh)
 }
 
-func (c *Collector) fetchNode(ctx context.Context, ip, token string) (string, error) {
-	url := fmt.Sprintf(cadvisorEndpoint, ip)
+func (c *Collector) fetchPath(ctx context.Context, node NodeTarget, path, token string) (string, error) {
+	start := time.Now()
+	ip := node.IP
+	endpoint := c.nodeURL(node, path)
+
+	if c.tlsServerName != "" {
+		ctx = context.WithValue(ctx, serverNameKey{}, tlsServerName(c.tlsServerName, node))
+	}
+
+	connState := "new"
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				connState = "reused"
+			}
+		},
+	})
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
 	if err != nil {
 		return "", fmt.Errorf("create request: %w", err)
 	}
-	req.Header.Set("Authorization", "Bearer "+token)
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+	for name, values := range c.headers {
+		req.Header[name] = values
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	// Requesting gzip explicitly disables the transport's transparent
+	// decompression, so compressed bodies are unpacked below.
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Accept", acceptHeader)
 
 	resp, err := c.client.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("execute request: %w", err)
 	}
 	defer resp.Body.Close()
+	kubeletRequests.Inc(resp.Proto, connState)
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
-		return "", fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+		return "", &statusError{code: resp.StatusCode, body: strings.TrimSpace(string(body))}
+	}
+
+	if err := checkContentType(resp.Header.Get("Content-Type")); err != nil {
+		klog.V(2).InfoS("rejecting kubelet response", "node", ip, "path", path, "err", err)
+		return "", err
+	}
+
+	reader := io.Reader(resp.Body)
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return "", fmt.Errorf("open gzip response: %w", err)
+		}
+		defer gz.Close()
+		reader = gz
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	// Reading one byte past the limit distinguishes an oversized body from
+	// one that is exactly at the limit, without buffering the rest.
+	body, err := io.ReadAll(io.LimitReader(reader, c.maxNodePayloadBytes+1))
 	if err != nil {
 		return "", fmt.Errorf("read response: %w", err)
 	}
+	if int64(len(body)) > c.maxNodePayloadBytes {
+		return "", fmt.Errorf("response exceeds %d bytes", c.maxNodePayloadBytes)
+	}
 
-	klog.V(4).InfoS("fetched cadvisor metrics", "node", ip, "bytes", len(body))
+	klog.V(4).InfoS("fetched cadvisor metrics",
+		"node", ip,
+		"path", path,
+		"status", resp.StatusCode,
+		"proto", resp.Proto,
+		"bytes", len(body),
+		"duration", time.Since(start),
+	)
 	return string(body), nil
 }
 
-func buildTLSConfig(caFile string, insecureSkipVerify bool) *tls.Config {
-	cfg := &tls.Config{
-		InsecureSkipVerify: insecureSkipVerify,
-	}
-
-	if caFile == "" || insecureSkipVerify {
-		return cfg
-	}
-
-	pool, err := x509.SystemCertPool()
-	if err != nil {
-		pool = x509.NewCertPool()
+// nodeLabelValues maps node IPs to the value written to the node label, or
+// returns nil when the IP itself is used. Nodes without a name keep their IP.
+func (c *Collector) nodeLabelValues(nodes []NodeTarget) map[string]string {
+	if c.nodeLabelSource != NodeLabelSourceName {
+		return nil
 	}
-
-	caData, err := os.ReadFile(caFile)
-	if err != nil {
-		klog.Warningf("unable to read CA certificate from %s: %v", caFile, err)
-		return cfg
+	values := make(map[string]string, len(nodes))
+	for _, node := range nodes {
+		if node.Name != "" {
+			values[node.IP] = node.Name
+		}
 	}
+	return values
+}
 
-	if ok := pool.AppendCertsFromPEM(caData); !ok {
-		klog.Warningf("failed to append CA certificate from %s", caFile)
-		return cfg
+// nodeLabelValue returns the node label value of ip from values, falling back
+// to the IP.
+func nodeLabelValue(values map[string]string, ip string) string {
+	if value, ok := values[ip]; ok {
+		return value
 	}
-
-	cfg.RootCAs = pool
-	return cfg
+	return ip
 }
 
-func combineMetrics(data map[string]string) string {
+// combineMetrics merges the payloads of every node into a single exposition.
+// Each metric family's HELP and TYPE lines are emitted once, followed by the
+// samples of all nodes. When nodeLabel is set, samples are tagged with it,
+// valued from nodeValues or the node IP, so series from different nodes stay
+// distinct; lines that already carry a label
+// of that name are resolved with the collision strategy. Families matching
+// dropPrefixes are omitted, and families listed in sumMetrics are not tagged
+// but summed into one series per distinct label set.
+// A comment banner listing the scraped nodes precedes the families unless
+// banner is NodeBannerNone; any value other than NodeBannerComment is used as
+// a per-node template. Nodes are identified in the banner by the same value
+// their samples carry.
+func combineMetrics(
+	data map[string]string,
+	nodeLabel string,
+	nodeValues map[string]string,
+	banner string,
+	dropPrefixes []string,
+	sumMetrics []string,
+	collision string,
+) string {
 	if len(data) == 0 {
 		return ""
 	}
@@ -217,20 +1034,56 @@ func combineMetrics(data map[string]string) string {
 	}
 	sort.Strings(ips)
 
-	var b strings.Builder
+	families := newFamilySet()
+	families.dropPrefixes = dropPrefixes
+	if len(sumMetrics) > 0 {
+		families.summed = make(map[string]struct{}, len(sumMetrics))
+		for _, name := range sumMetrics {
+			families.summed[name] = struct{}{}
+		}
+	}
 	for _, ip := range ips {
-		b.WriteString("# -------- Node: ")
-		b.WriteString(ip)
-		b.WriteString(" --------\n")
-		b.WriteString(data[ip])
-		if !strings.HasSuffix(data[ip], "\n") {
+		var tag func(string) string
+		if nodeLabel != "" {
+			tag = func(line string) string {
+				return setLabel(line, nodeLabel, nodeLabelValue(nodeValues, ip), collision)
+			}
+		}
+		families.add(data[ip], tag)
+	}
+	families.aggregate()
+
+	var b strings.Builder
+	if banner != NodeBannerNone {
+		for _, ip := range ips {
+			b.WriteString(nodeBannerLine(banner, nodeLabelValue(nodeValues, ip)))
 			b.WriteByte('\n')
 		}
 	}
+	families.write(&b)
 
 	return b.String()
 }
 
+func nodeBannerLine(banner, node string) string {
+	if banner == "" || banner == NodeBannerComment {
+		return "# -------- Node: " + node + " --------"
+	}
+	return strings.ReplaceAll(banner, nodeBannerPlaceholder, node)
+}
+
+// ValidateNodeBanner reports NODE_BANNER templates that would not render as
+// a single comment line.
+func ValidateNodeBanner(banner string) error {
+	if banner == "" || banner == NodeBannerComment || banner == NodeBannerNone {
+		return nil
+	}
+	if !strings.HasPrefix(banner, "#") || strings.ContainsAny(banner, "\r\n") {
+		return fmt.Errorf("node banner template %q must be a single line starting with '#'", banner)
+	}
+	return nil
+}
+
 func annotateFailures(payload string, failures map[string]error) string {
 	if len(failures) == 0 {
 		return payload
@@ -254,3 +1107,46 @@ func annotateFailures(payload string, failures map[string]error) string {
 	b.WriteString(payload)
 	return b.String()
 }
+
+// buildNodeUpMetrics renders a gauge per scraped node that is 1 when the node
+// was scraped successfully and 0 otherwise, so dropped nodes can be alerted on.
+func buildNodeUpMetrics(results map[string]string, failures map[string]error, nodeLabel string, nodeValues map[string]string) string {
+	if len(results)+len(failures) == 0 {
+		return ""
+	}
+	if nodeLabel == "" {
+		nodeLabel = DefaultNodeIPLabel
+	}
+
+	ips := make([]string, 0, len(results)+len(failures))
+	for ip := range results {
+		ips = append(ips, ip)
+	}
+	for ip := range failures {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+
+	var b strings.Builder
+	b.WriteString("# HELP ")
+	b.WriteString(nodeUpMetricName)
+	b.WriteString(" Whether the last cadvisor scrape of the node succeeded.\n")
+	b.WriteString("# TYPE ")
+	b.WriteString(nodeUpMetricName)
+	b.WriteString(" gauge\n")
+	for _, ip := range ips {
+		up := "1"
+		if _, failed := failures[ip]; failed {
+			up = "0"
+		}
+		b.WriteString(nodeUpMetricName)
+		b.WriteString("{")
+		b.WriteString(nodeLabel)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(nodeLabelValue(nodeValues, ip)))
+		b.WriteString(`"} `)
+		b.WriteString(up)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
@@ -0,0 +1,1177 @@
+package metrics
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/klog/v2"
+)
+
+func TestCheckContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		wantErr     bool
+	}{
+		{"", false},
+		{"text/plain", false},
+		{"text/plain; version=0.0.4; charset=utf-8", false},
+		{"application/openmetrics-text; version=1.0.0; charset=utf-8", true},
+		{"application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited", true},
+		{"text/html", true},
+		{";;", true},
+	}
+	for _, tt := range tests {
+		if err := checkContentType(tt.contentType); (err != nil) != tt.wantErr {
+			t.Errorf("checkContentType(%q) = %v, wantErr %v", tt.contentType, err, tt.wantErr)
+		}
+	}
+}
+
+func TestFetchNodeTimeoutCoversAllPaths(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(150 * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte("up 1\n"))
+	}))
+	defer srv.Close()
+
+	c := &Collector{
+		client:              srv.Client(),
+		scheme:              SchemeHTTP,
+		paths:               []string{"/a", "/b", "/c"},
+		scrapeTimeout:       250 * time.Millisecond,
+		maxNodePayloadBytes: 1 << 20,
+	}
+	node := NodeTarget{IP: strings.TrimPrefix(srv.URL, "http://")}
+
+	// Each path alone fits in the timeout; the three together do not.
+	_, err := c.fetchNode(context.Background(), node, "", nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("fetchNode error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	c.paths = c.paths[:1]
+	if _, err := c.fetchNode(context.Background(), node, "", nil); err != nil {
+		t.Errorf("single path: %v", err)
+	}
+}
+
+// newTestKubelet serves body as the cAdvisor payload on every path and returns
+// the host:port to scrape it at.
+func newTestKubelet(t *testing.T, body string) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+// newTestCollector returns a Collector scraping the given static kubelets over
+// plain HTTP, with the pod cache available for seeding through the service.
+func newTestCollector(t *testing.T, opts CollectorOptions, kubelets ...string) (*Collector, *Service) {
+	t.Helper()
+	factory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	svc := NewService(factory, ServiceOptions{StaticNodes: kubelets, DisablePodInformer: true})
+	opts.Scheme = SchemeHTTP
+	return NewCollector(svc, opts), svc
+}
+
+func TestCollectToMatchesCollect(t *testing.T) {
+	const body = "# HELP container_cpu_usage_seconds_total CPU.\n# TYPE container_cpu_usage_seconds_total counter\n" +
+		"container_cpu_usage_seconds_total{namespace=\"default\",pod=\"web-0\",container=\"app\"} 3\n"
+	nodes := []string{newTestKubelet(t, body), newTestKubelet(t, body)}
+
+	for _, format := range []string{FormatPrometheus, FormatOpenMetrics} {
+		c, svc := newTestCollector(t, CollectorOptions{OutputFormat: format, NodeIPLabel: "node_ip"}, nodes...)
+		svc.cache.StorePodLabels("default", "web-0", map[string]string{"app": "web"})
+
+		result, err := c.Collect(context.Background(), "app", "")
+		if err != nil {
+			t.Fatalf("%s: Collect: %v", format, err)
+		}
+		var streamed strings.Builder
+		if _, err := c.CollectTo(context.Background(), &streamed, "app", ""); err != nil {
+			t.Fatalf("%s: CollectTo: %v", format, err)
+		}
+		if streamed.String() != result.Payload {
+			t.Errorf("%s: CollectTo output differs from Collect:\n got %q\nwant %q", format, streamed.String(), result.Payload)
+		}
+		if !strings.Contains(result.Payload, `app="web"`) {
+			t.Errorf("%s: payload was not enriched:\n%s", format, result.Payload)
+		}
+	}
+}
+
+func TestCombineMetricsBannerUsesNodeLabelValue(t *testing.T) {
+	data := map[string]string{
+		"10.0.0.1": "# TYPE up gauge\nup 1\n",
+		"10.0.0.2": "# TYPE up gauge\nup 1\n",
+	}
+	names := map[string]string{"10.0.0.1": "worker-1"}
+	tests := []struct {
+		name   string
+		banner string
+		values map[string]string
+		want   []string
+	}{
+		{"comment by ip", NodeBannerComment, nil, []string{"# -------- Node: 10.0.0.1 --------", "# -------- Node: 10.0.0.2 --------"}},
+		{"comment by name", NodeBannerComment, names, []string{"# -------- Node: worker-1 --------", "# -------- Node: 10.0.0.2 --------"}},
+		{"template by name", "# node {node}", names, []string{"# node worker-1", "# node 10.0.0.2"}},
+	}
+	for _, tt := range tests {
+		got := combineMetrics(data, "node", tt.values, tt.banner, nil, nil, "skip")
+		for _, line := range tt.want {
+			if !strings.Contains(got, line+"\n") {
+				t.Errorf("%s: banner %q missing from:\n%s", tt.name, line, got)
+			}
+		}
+		if tt.values != nil && !strings.Contains(got, `up{node="worker-1"} 1`) {
+			t.Errorf("%s: samples not labelled with the node name:\n%s", tt.name, got)
+		}
+	}
+}
+
+func TestCombineMetricsDeclaresFamiliesOnce(t *testing.T) {
+	const payload = "# HELP container_cpu_usage_seconds_total CPU.\n# TYPE container_cpu_usage_seconds_total counter\n" +
+		"container_cpu_usage_seconds_total{pod=\"web-0\"} 3\n"
+	data := map[string]string{"10.0.0.1": payload, "10.0.0.2": payload}
+
+	got := combineMetrics(data, "node_ip", nil, NodeBannerNone, nil, nil, CollisionSkip)
+	want := "# HELP container_cpu_usage_seconds_total CPU.\n# TYPE container_cpu_usage_seconds_total counter\n" +
+		"container_cpu_usage_seconds_total{pod=\"web-0\",node_ip=\"10.0.0.1\"} 3\n" +
+		"container_cpu_usage_seconds_total{pod=\"web-0\",node_ip=\"10.0.0.2\"} 3\n"
+	if got != want {
+		t.Errorf("combineMetrics:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestCombineMetricsNodeIPLabel(t *testing.T) {
+	data := map[string]string{"10.0.0.1": "machine_cpu_cores 4\nup{node_ip=\"1.2.3.4\"} 1\nup{job=\"a\"} 1\n"}
+	tests := []struct {
+		name  string
+		label string
+		want  string
+	}{
+		{"injected", "node_ip", "machine_cpu_cores{node_ip=\"10.0.0.1\"} 4\nup{node_ip=\"1.2.3.4\"} 1\nup{job=\"a\",node_ip=\"10.0.0.1\"} 1\n"},
+		{"custom name", "instance_ip", "machine_cpu_cores{instance_ip=\"10.0.0.1\"} 4\nup{node_ip=\"1.2.3.4\",instance_ip=\"10.0.0.1\"} 1\nup{job=\"a\",instance_ip=\"10.0.0.1\"} 1\n"},
+		{"disabled", "", "machine_cpu_cores 4\nup{node_ip=\"1.2.3.4\"} 1\nup{job=\"a\"} 1\n"},
+	}
+	for _, tt := range tests {
+		if got := combineMetrics(data, tt.label, nil, NodeBannerNone, nil, nil, CollisionSkip); got != tt.want {
+			t.Errorf("%s:\n got %q\nwant %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCombineMetricsSumsAcrossNodes(t *testing.T) {
+	data := map[string]string{
+		"10.0.0.1": "# TYPE cluster_jobs gauge\ncluster_jobs{queue=\"a\"} 2\nup 1\n",
+		"10.0.0.2": "# TYPE cluster_jobs gauge\ncluster_jobs{queue=\"a\"} 3\ncluster_jobs{queue=\"b\"} 1\nup 1\n",
+	}
+	got := combineMetrics(data, "node_ip", nil, NodeBannerNone, nil, []string{"cluster_jobs"}, CollisionSkip)
+	want := "# TYPE cluster_jobs gauge\ncluster_jobs{queue=\"a\"} 5\ncluster_jobs{queue=\"b\"} 1\n" +
+		"up{node_ip=\"10.0.0.1\"} 1\nup{node_ip=\"10.0.0.2\"} 1\n"
+	if got != want {
+		t.Errorf("combineMetrics:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestFetchNodeHonoursParentContext(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	c := &Collector{
+		client:              srv.Client(),
+		scheme:              SchemeHTTP,
+		paths:               []string{DefaultScrapePath},
+		scrapeTimeout:       time.Minute,
+		maxNodePayloadBytes: 1 << 20,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := c.fetchNode(ctx, NodeTarget{IP: strings.TrimPrefix(srv.URL, "http://")}, "", nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("fetchNode error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("fetchNode waited %s for the scrape timeout instead of the parent deadline", elapsed)
+	}
+}
+
+func TestCollectLimitsConcurrentScrapes(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, peak := 0, 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		mu.Lock()
+		inFlight++
+		peak = max(peak, inFlight)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte("up 1\n"))
+	})
+	var nodes []string
+	for range 4 {
+		srv := httptest.NewServer(handler)
+		t.Cleanup(srv.Close)
+		nodes = append(nodes, strings.TrimPrefix(srv.URL, "http://"))
+	}
+
+	for _, limit := range []int{1, 2} {
+		peak = 0
+		c, _ := newTestCollector(t, CollectorOptions{MaxConcurrentScrapes: limit}, nodes...)
+		if _, err := c.Collect(context.Background(), "", ""); err != nil {
+			t.Fatalf("limit %d: Collect: %v", limit, err)
+		}
+		if peak > limit {
+			t.Errorf("limit %d: %d scrapes ran at once", limit, peak)
+		}
+	}
+}
+
+// newDeadKubelet returns the address of a kubelet that refuses connections.
+func newDeadKubelet(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+func TestCollectMinSuccessRatio(t *testing.T) {
+	nodes := []string{newTestKubelet(t, "up 1\n"), newDeadKubelet(t)}
+	tests := []struct {
+		ratio   float64
+		wantErr bool
+	}{
+		{0, false},
+		{0.5, false},
+		{0.51, true},
+		{1, true},
+	}
+	for _, tt := range tests {
+		c, _ := newTestCollector(t, CollectorOptions{MinSuccessRatio: tt.ratio}, nodes...)
+		result, err := c.Collect(context.Background(), "", "")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ratio %.2f with 1 of 2 nodes up: err = %v, wantErr %v", tt.ratio, err, tt.wantErr)
+		}
+		if result == nil || len(result.Nodes) != 2 {
+			t.Errorf("ratio %.2f: per-node results missing: %+v", tt.ratio, result)
+		}
+	}
+}
+
+func TestCollectHTTPSchemeSendsNoToken(t *testing.T) {
+	var mu sync.Mutex
+	var authorization []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		authorization = append(authorization, r.Header.Get("Authorization"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte("up 1\n"))
+	}))
+	defer srv.Close()
+
+	c, _ := newTestCollector(t, CollectorOptions{Token: "secret"}, strings.TrimPrefix(srv.URL, "http://"))
+	if _, err := c.Collect(context.Background(), "", ""); err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	if len(authorization) != 1 || authorization[0] != "" {
+		t.Errorf("Authorization headers sent over http: %q", authorization)
+	}
+	if c.caBundle != nil {
+		t.Error("a CA bundle was set up for the http scheme")
+	}
+}
+
+func TestNodeURLScheme(t *testing.T) {
+	tests := []struct {
+		scheme string
+		port   int
+		want   string
+	}{
+		{SchemeHTTPS, 0, "https://10.0.0.1:10250/metrics/cadvisor"},
+		{SchemeHTTP, 0, "http://10.0.0.1:10255/metrics/cadvisor"},
+		{SchemeHTTP, 8080, "http://10.0.0.1:8080/metrics/cadvisor"},
+	}
+	for _, tt := range tests {
+		c := NewCollector(nil, CollectorOptions{Scheme: tt.scheme, Port: tt.port, Token: "t"})
+		if got := c.nodeURL(NodeTarget{IP: "10.0.0.1"}, DefaultScrapePath); got != tt.want {
+			t.Errorf("%s port %d: nodeURL = %s, want %s", tt.scheme, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestBuildNodeUpMetrics(t *testing.T) {
+	results := map[string]string{"10.0.0.1": "up 1\n"}
+	failures := map[string]error{"10.0.0.2": errors.New("connection refused")}
+
+	got := buildNodeUpMetrics(results, failures, "", nil)
+	want := "# HELP addlabel_node_up Whether the last cadvisor scrape of the node succeeded.\n" +
+		"# TYPE addlabel_node_up gauge\n" +
+		"addlabel_node_up{node_ip=\"10.0.0.1\"} 1\n" +
+		"addlabel_node_up{node_ip=\"10.0.0.2\"} 0\n"
+	if got != want {
+		t.Errorf("buildNodeUpMetrics:\n got %q\nwant %q", got, want)
+	}
+	if got := buildNodeUpMetrics(nil, nil, "", nil); got != "" {
+		t.Errorf("no nodes: got %q, want no series", got)
+	}
+}
+
+func TestCollectReportsNodeUp(t *testing.T) {
+	up, down := newTestKubelet(t, "up 1\n"), newDeadKubelet(t)
+	c, _ := newTestCollector(t, CollectorOptions{}, up, down)
+
+	result, err := c.Collect(context.Background(), "", "")
+	if err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	for _, series := range []string{
+		`addlabel_node_up{node_ip="` + up + `"} 1`,
+		`addlabel_node_up{node_ip="` + down + `"} 0`,
+	} {
+		if !strings.Contains(result.Payload, series+"\n") {
+			t.Errorf("payload lacks %s:\n%s", series, result.Payload)
+		}
+	}
+	if !strings.HasPrefix(result.Payload, "# scrape failures: "+down+"=") {
+		t.Errorf("payload does not start with the failure comment:\n%s", result.Payload)
+	}
+}
+
+func TestCollectDropsMetricPrefixes(t *testing.T) {
+	const body = "# TYPE container_network_receive_bytes_total counter\n" +
+		"container_network_receive_bytes_total{namespace=\"default\",pod=\"web-0\",interface=\"eth0\"} 7\n" +
+		"container_network_transmit_bytes_total{namespace=\"default\",pod=\"web-0\",interface=\"eth0\"} 9\n" +
+		"# TYPE container_cpu_usage_seconds_total counter\n" +
+		"container_cpu_usage_seconds_total{namespace=\"default\",pod=\"web-0\"} 3\n"
+	c, _ := newTestCollector(t, CollectorOptions{DropMetricPrefixes: []string{"container_network_"}}, newTestKubelet(t, body))
+
+	result, err := c.Collect(context.Background(), "", "")
+	if err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	if strings.Contains(result.Payload, "container_network_") {
+		t.Errorf("dropped families still present:\n%s", result.Payload)
+	}
+	if !strings.Contains(result.Payload, "# TYPE container_cpu_usage_seconds_total counter\ncontainer_cpu_usage_seconds_total{") {
+		t.Errorf("kept family lost its samples or TYPE line:\n%s", result.Payload)
+	}
+}
+
+func TestKubeletHost(t *testing.T) {
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"10.0.0.1", "10.0.0.1:10250"},
+		{"fd00::1", "[fd00::1]:10250"},
+		{"[fd00::1]:8080", "[fd00::1]:8080"},
+		{"10.0.0.1:8080", "10.0.0.1:8080"},
+		{"worker-1", "worker-1:10250"},
+	}
+	for _, tt := range tests {
+		if got := kubeletHost(tt.target, 10250); got != tt.want {
+			t.Errorf("kubeletHost(%q) = %q, want %q", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestCollectIPv6Node(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte("up 1\n"))
+	}))
+	srv.Listener = l
+	srv.Start()
+	defer srv.Close()
+
+	c, _ := newTestCollector(t, CollectorOptions{Port: l.Addr().(*net.TCPAddr).Port}, "::1")
+	result, err := c.Collect(context.Background(), "", "")
+	if err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	if !strings.Contains(result.Payload, `up{node_ip="::1"} 1`) {
+		t.Errorf("IPv6 node payload:\n%s", result.Payload)
+	}
+}
+
+func TestNewCollectorProxy(t *testing.T) {
+	fromEnvironment := reflect.ValueOf(http.ProxyFromEnvironment).Pointer()
+	for _, noProxy := range []bool{false, true} {
+		c := NewCollector(nil, CollectorOptions{Scheme: SchemeHTTP, NoProxy: noProxy})
+		tr, ok := c.client.Transport.(*http.Transport)
+		if !ok {
+			t.Fatalf("transport is %T, want *http.Transport", c.client.Transport)
+		}
+		switch {
+		case noProxy && tr.Proxy != nil:
+			t.Error("NoProxy left a proxy function on the transport")
+		case !noProxy && (tr.Proxy == nil || reflect.ValueOf(tr.Proxy).Pointer() != fromEnvironment):
+			t.Error("transport does not use http.ProxyFromEnvironment")
+		}
+	}
+}
+
+func TestStaticNodesDriveScrapeList(t *testing.T) {
+	nodes := []string{newTestKubelet(t, "up 1\n"), newTestKubelet(t, "up 1\n")}
+	c, svc := newTestCollector(t, CollectorOptions{}, nodes...)
+	if svc.nodeInformer != nil {
+		t.Error("node informer created despite static nodes")
+	}
+	if got := svc.NodeTargets(); len(got) != len(nodes) {
+		t.Errorf("NodeTargets = %v, want %v", got, nodes)
+	}
+
+	result, err := c.Collect(context.Background(), "", "")
+	if err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	for _, node := range nodes {
+		if _, ok := result.Nodes[node]; !ok {
+			t.Errorf("static node %s was not scraped: %v", node, result.Nodes)
+		}
+	}
+}
+
+func TestFallbackNodesUsedWhileCacheEmpty(t *testing.T) {
+	fallback := newTestKubelet(t, "fallback_up 1\n")
+	factory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	svc := NewService(factory, ServiceOptions{FallbackNodes: []string{fallback}, DisablePodInformer: true})
+	c := NewCollector(svc, CollectorOptions{Scheme: SchemeHTTP})
+
+	result, err := c.Collect(context.Background(), "", "")
+	if err != nil {
+		t.Fatalf("Collect with an empty node cache: %v", err)
+	}
+	if _, ok := result.Nodes[fallback]; !ok || !strings.Contains(result.Payload, "fallback_up") {
+		t.Errorf("fallback target not scraped: nodes %v\n%s", result.Nodes, result.Payload)
+	}
+
+	cached := newTestKubelet(t, "cached_up 1\n")
+	svc.cache.StoreNodeIP("worker-1", cached)
+	if got := svc.NodeTargets(); len(got) != 1 || got[0].IP != cached {
+		t.Errorf("NodeTargets with a cached node = %v, want only %s", got, cached)
+	}
+}
+
+func TestDurationStats(t *testing.T) {
+	if minimum, maximum, mean := durationStats(nil); minimum != 0 || maximum != 0 || mean != 0 {
+		t.Errorf("durationStats(nil) = %v, %v, %v; want zeros", minimum, maximum, mean)
+	}
+	minimum, maximum, mean := durationStats(map[string]time.Duration{
+		"a": 10 * time.Millisecond,
+		"b": 30 * time.Millisecond,
+		"c": 20 * time.Millisecond,
+	})
+	if minimum != 10*time.Millisecond || maximum != 30*time.Millisecond || mean != 20*time.Millisecond {
+		t.Errorf("durationStats = %v, %v, %v; want 10ms, 30ms, 20ms", minimum, maximum, mean)
+	}
+}
+
+func TestCollectLogsNodeDurations(t *testing.T) {
+	var buf bytes.Buffer
+	klog.LogToStderr(false)
+	klog.SetOutput(&buf)
+	t.Cleanup(func() {
+		klog.SetOutput(io.Discard)
+		klog.LogToStderr(true)
+	})
+
+	good, dead := newTestKubelet(t, "up 1\n"), newDeadKubelet(t)
+	c, _ := newTestCollector(t, CollectorOptions{}, good, dead)
+	result, err := c.Collect(context.Background(), "", "")
+	if err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	klog.Flush()
+
+	for _, node := range []string{good, dead} {
+		if d := result.Nodes[node].Duration; d < 0 {
+			t.Errorf("node %s duration = %v, want non-negative", node, d)
+		}
+	}
+	if result.Nodes[dead].Err == nil {
+		t.Errorf("dead node %s reported no error", dead)
+	}
+
+	logs := buf.String()
+	for _, field := range []string{"minNodeDuration=", "maxNodeDuration=", "avgNodeDuration="} {
+		if !strings.Contains(logs, field) {
+			t.Errorf("completion log lacks %s:\n%s", field, logs)
+		}
+	}
+	if !strings.Contains(logs, `"cadvisor scrape failed"`) || !strings.Contains(logs, "duration=") {
+		t.Errorf("failure log lacks the node duration:\n%s", logs)
+	}
+}
+
+func TestCollectDecompressesGzip(t *testing.T) {
+	var acceptEncoding string
+	gzipped := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding = r.Header.Get("Accept-Encoding")
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		_, _ = gz.Write([]byte("up 1\n"))
+		_ = gz.Close()
+	}))
+	t.Cleanup(gzipped.Close)
+	corrupt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		_, _ = w.Write([]byte("up 1\n"))
+	}))
+	t.Cleanup(corrupt.Close)
+
+	good := strings.TrimPrefix(gzipped.URL, "http://")
+	bad := strings.TrimPrefix(corrupt.URL, "http://")
+	c, _ := newTestCollector(t, CollectorOptions{}, good, bad)
+	var out strings.Builder
+	result, err := c.CollectTo(context.Background(), &out, "", "")
+	if err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	if acceptEncoding != "gzip" {
+		t.Errorf("Accept-Encoding = %q, want gzip", acceptEncoding)
+	}
+	if !strings.Contains(out.String(), "up 1") {
+		t.Errorf("decompressed payload missing:\n%s", out.String())
+	}
+	if err := result.Nodes[bad].Err; err == nil || !strings.Contains(err.Error(), "gzip") {
+		t.Errorf("corrupt gzip node err = %v, want a gzip error", err)
+	}
+}
+
+func TestNewCollectorIdleConnections(t *testing.T) {
+	tests := []struct {
+		name        string
+		opts        CollectorOptions
+		wantIdle    int
+		wantTimeout time.Duration
+	}{
+		{"defaults", CollectorOptions{}, DefaultMaxIdleConnsPerHost, DefaultIdleConnTimeout},
+		{"configured", CollectorOptions{MaxIdleConnsPerHost: 4, IdleConnTimeout: 5 * time.Minute}, 4, 5 * time.Minute},
+		{"invalid falls back", CollectorOptions{MaxIdleConnsPerHost: -1, IdleConnTimeout: -time.Second}, DefaultMaxIdleConnsPerHost, DefaultIdleConnTimeout},
+	}
+	for _, tt := range tests {
+		tt.opts.Scheme = SchemeHTTP
+		tr := NewCollector(nil, tt.opts).client.Transport.(*http.Transport)
+		if tr.MaxIdleConnsPerHost != tt.wantIdle || tr.IdleConnTimeout != tt.wantTimeout {
+			t.Errorf("%s: transport idle %d/%v, want %d/%v", tt.name, tr.MaxIdleConnsPerHost, tr.IdleConnTimeout, tt.wantIdle, tt.wantTimeout)
+		}
+	}
+}
+
+func TestCollectEmitTimestamps(t *testing.T) {
+	node := newTestKubelet(t, "# TYPE up gauge\nup 1\nup_with_time 1 1600000000000\n")
+	for _, emit := range []bool{false, true} {
+		c, _ := newTestCollector(t, CollectorOptions{EmitTimestamps: emit}, node)
+		result, err := c.Collect(context.Background(), "", "")
+		if err != nil {
+			t.Fatalf("Collect: %v", err)
+		}
+		stamp := " " + strconv.FormatInt(result.StartedAt.UnixMilli(), 10)
+		for _, line := range strings.Split(strings.TrimSpace(result.Payload), "\n") {
+			if strings.HasPrefix(line, "#") {
+				continue
+			}
+			if strings.HasPrefix(line, "up_with_time") {
+				if !strings.HasSuffix(line, " 1600000000000") {
+					t.Errorf("emit=%v: existing timestamp replaced: %s", emit, line)
+				}
+				continue
+			}
+			if strings.HasSuffix(line, stamp) != emit {
+				t.Errorf("emit=%v: line %q, collection timestamp %s", emit, line, stamp)
+			}
+		}
+	}
+}
+
+func TestCollectRejectsOversizedPayload(t *testing.T) {
+	const limit = 32
+	atLimit := newTestKubelet(t, strings.Repeat("#", limit-1)+"\n")
+	oversized := newTestKubelet(t, strings.Repeat("#", limit)+"\n")
+	c, _ := newTestCollector(t, CollectorOptions{MaxNodePayloadBytes: limit}, atLimit, oversized)
+
+	result, err := c.Collect(context.Background(), "", "")
+	if err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	if err := result.Nodes[atLimit].Err; err != nil {
+		t.Errorf("body at the limit failed: %v", err)
+	}
+	if err := result.Nodes[oversized].Err; err == nil || !strings.Contains(err.Error(), "exceeds 32 bytes") {
+		t.Errorf("oversized body err = %v, want a size error", err)
+	}
+}
+
+func TestCombineMetricsNodeIPCollision(t *testing.T) {
+	data := map[string]string{"10.0.0.1": "up{node_ip=\"1.2.3.4\"} 1\n"}
+	tests := []struct {
+		strategy string
+		want     string
+	}{
+		{CollisionSkip, "up{node_ip=\"1.2.3.4\"} 1\n"},
+		{CollisionOverwrite, "up{node_ip=\"10.0.0.1\"} 1\n"},
+		{CollisionPrefix, "up{exported_node_ip=\"1.2.3.4\",node_ip=\"10.0.0.1\"} 1\n"},
+	}
+	for _, tt := range tests {
+		if got := combineMetrics(data, "node_ip", nil, NodeBannerNone, nil, nil, tt.strategy); got != tt.want {
+			t.Errorf("strategy %q:\n got %q\nwant %q", tt.strategy, got, tt.want)
+		}
+	}
+}
+
+func TestCollectViaAPIServerProxy(t *testing.T) {
+	var paths sync.Map
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths.Store(r.URL.Path, true)
+		if r.URL.Path != "/api/v1/nodes/worker-1/proxy/metrics/cadvisor" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte("up 1\n"))
+	}))
+	t.Cleanup(apiServer.Close)
+
+	c, svc := newTestCollector(t, CollectorOptions{APIServerClient: apiServer.Client(), APIServerHost: apiServer.URL + "/"})
+	svc.cache.StoreNodeIP("worker-1", "10.0.0.1")
+	svc.cache.StoreNodeIP("worker-2", "10.0.0.2")
+
+	result, err := c.Collect(context.Background(), "", "")
+	if err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	if err := result.Nodes["10.0.0.1"].Err; err != nil {
+		t.Errorf("proxied node failed: %v", err)
+	}
+	if !strings.Contains(result.Payload, "up 1") {
+		t.Errorf("payload lacks the proxied metrics:\n%s", result.Payload)
+	}
+	if err := result.Nodes["10.0.0.2"].Err; err == nil {
+		t.Error("node unknown to the API server proxy succeeded")
+	}
+	if _, ok := paths.Load("/api/v1/nodes/worker-2/proxy/metrics/cadvisor"); !ok {
+		t.Error("worker-2 was not scraped through the API server proxy")
+	}
+}
+
+func TestCollectPublishesEnrichStats(t *testing.T) {
+	node := newTestKubelet(t, "machine_cpu_cores 4\nup{namespace=\"default\",pod=\"web-0\"} 1\n")
+	c, svc := newTestCollector(t, CollectorOptions{}, node)
+	svc.cache.StorePodLabels("default", "web-0", map[string]string{"app": "web"})
+
+	result, err := c.Collect(context.Background(), "app", "")
+	if err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	if result.Enrich.Enriched != 1 || result.Enrich.Skipped < 1 {
+		t.Errorf("Enrich = %+v, want 1 enriched and the node-level line skipped", result.Enrich)
+	}
+	for kind, want := range map[string]int{"processed": result.Enrich.Processed, "enriched": 1, "skipped": result.Enrich.Skipped} {
+		if got := enrichLines.Value(kind); got != float64(want) {
+			t.Errorf("addlabel_enrich_lines{kind=%q} = %v, want %d", kind, got, want)
+		}
+	}
+}
+
+func TestCollectReturnsPromptlyOnCancel(t *testing.T) {
+	aborted := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(aborted)
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	t.Cleanup(slow.Close)
+
+	c, _ := newTestCollector(t, CollectorOptions{ScrapeTimeout: 30 * time.Second}, strings.TrimPrefix(slow.URL, "http://"))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := c.Collect(ctx, "", "")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want the context error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Collect took %v after cancellation", elapsed)
+	}
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Error("in-flight kubelet request was not aborted")
+	}
+}
+
+func TestCollectMergesScrapePaths(t *testing.T) {
+	kubelet := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		switch r.URL.Path {
+		case "/metrics/cadvisor":
+			_, _ = io.WriteString(w, "# HELP up Scrape health.\n# TYPE up gauge\nup{path=\"cadvisor\"} 1\n"+
+				"container_cpu_usage_seconds_total{namespace=\"default\",pod=\"web-0\"} 2\n")
+		case "/metrics/resource":
+			_, _ = io.WriteString(w, "# HELP up Scrape health.\n# TYPE up gauge\nup{path=\"resource\"} 1\n"+
+				"pod_memory_working_set_bytes{namespace=\"default\",pod=\"web-0\"} 3\n")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(kubelet.Close)
+
+	c, svc := newTestCollector(t, CollectorOptions{
+		Paths:         []string{"/metrics/cadvisor", "/metrics/resource"},
+		PathAddLabels: map[string]string{"/metrics/resource": "app"},
+	}, strings.TrimPrefix(kubelet.URL, "http://"))
+	svc.cache.StorePodLabels("default", "web-0", map[string]string{"app": "web"})
+
+	result, err := c.Collect(context.Background(), "", "")
+	if err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	payload := result.Payload
+	if n := strings.Count(payload, "# TYPE up gauge"); n != 1 {
+		t.Errorf("TYPE up declared %d times:\n%s", n, payload)
+	}
+	for _, want := range []string{`path="cadvisor"`, `path="resource"`, `pod_memory_working_set_bytes{namespace="default",pod="web-0",app="web"`} {
+		if !strings.Contains(payload, want) {
+			t.Errorf("payload lacks %s:\n%s", want, payload)
+		}
+	}
+	if strings.Contains(payload, `container_cpu_usage_seconds_total{namespace="default",pod="web-0",app=`) {
+		t.Errorf("path labels applied to the other path:\n%s", payload)
+	}
+}
+
+func TestCollectorTokenSources(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(t.TempDir(), "missing")
+	tests := []struct {
+		name    string
+		opts    CollectorOptions
+		want    string
+		wantErr bool
+	}{
+		{"token wins over file", CollectorOptions{Token: " from-env ", TokenFile: missing}, "from-env", false},
+		{"token file", CollectorOptions{TokenFile: tokenFile}, "from-file", false},
+		{"missing token file", CollectorOptions{TokenFile: missing}, "", true},
+	}
+	for _, tt := range tests {
+		tt.opts.Scheme = SchemeHTTPS
+		got, err := NewCollector(nil, tt.opts).token()
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%s: token() = %q, %v; want %q, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestCollectHTTPSSendsStaticToken(t *testing.T) {
+	var authorization atomic.Value
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization.Store(r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte("up 1\n"))
+	}))
+	t.Cleanup(srv.Close)
+
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(srv.URL, "https://"))
+	portNumber, _ := strconv.Atoi(port)
+	factory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	svc := NewService(factory, ServiceOptions{StaticNodes: []string{host}, DisablePodInformer: true})
+	c := NewCollector(svc, CollectorOptions{
+		Scheme:             SchemeHTTPS,
+		Port:               portNumber,
+		Token:              "secret",
+		TokenFile:          filepath.Join(t.TempDir(), "missing"),
+		InsecureSkipVerify: true,
+	})
+
+	if _, err := c.Collect(context.Background(), "", ""); err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	if got := authorization.Load(); got != "Bearer secret" {
+		t.Errorf("Authorization = %v, want the TOKEN value", got)
+	}
+}
+
+func TestCollectReloadsRejectedToken(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("old"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var seen []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		mu.Lock()
+		seen = append(seen, auth)
+		mu.Unlock()
+		if auth != "Bearer new" {
+			// The token is rotated on disk while the cycle holds the old one.
+			_ = os.WriteFile(tokenFile, []byte("new"), 0o600)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte("up 1\n"))
+	}))
+	t.Cleanup(srv.Close)
+
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(srv.URL, "https://"))
+	portNumber, _ := strconv.Atoi(port)
+	factory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	svc := NewService(factory, ServiceOptions{StaticNodes: []string{host}, DisablePodInformer: true})
+	c := NewCollector(svc, CollectorOptions{Scheme: SchemeHTTPS, Port: portNumber, TokenFile: tokenFile, InsecureSkipVerify: true})
+
+	result, err := c.Collect(context.Background(), "", "")
+	if err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	if !strings.Contains(result.Payload, "up 1") {
+		t.Errorf("payload after token reload:\n%s", result.Payload)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(seen, []string{"Bearer old", "Bearer new"}) {
+		t.Errorf("Authorization headers = %q, want the old token then the reloaded one", seen)
+	}
+}
+
+func TestCollectNodeNameLabel(t *testing.T) {
+	node := newTestKubelet(t, "machine_cpu_cores 4\n")
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{NodeLabelSourceName, `machine_cpu_cores{node="worker-1"} 4`},
+		{NodeLabelSourceIP, `machine_cpu_cores{node="` + node + `"} 4`},
+	}
+	for _, tt := range tests {
+		c, svc := newTestCollector(t, CollectorOptions{NodeIPLabel: "node", NodeLabelSource: tt.source})
+		svc.cache.StoreNodeIP("worker-1", node)
+		result, err := c.Collect(context.Background(), "", "")
+		if err != nil {
+			t.Fatalf("source %q: Collect: %v", tt.source, err)
+		}
+		if !strings.Contains(result.Payload, tt.want) {
+			t.Errorf("source %q: payload lacks %s:\n%s", tt.source, tt.want, result.Payload)
+		}
+	}
+}
+
+func TestCollectRelationMetricsToggle(t *testing.T) {
+	node := newTestKubelet(t, "up{namespace=\"default\",pod=\"web-0\"} 1\n")
+	for _, name := range []string{DefaultRelationMetricName, ""} {
+		c, svc := newTestCollector(t, CollectorOptions{RelationMetricName: name}, node)
+		svc.cache.StorePodLabels("default", "web-0", map[string]string{"app": "web"})
+
+		result, err := c.Collect(context.Background(), "app", "")
+		if err != nil {
+			t.Fatalf("Collect: %v", err)
+		}
+		emitted := strings.Contains(result.Payload, DefaultRelationMetricName)
+		if emitted != (name != "") {
+			t.Errorf("relation metric name %q: relation series emitted = %v:\n%s", name, emitted, result.Payload)
+		}
+		if !strings.Contains(result.Payload, `app="web"`) {
+			t.Errorf("relation metric name %q: enrichment missing:\n%s", name, result.Payload)
+		}
+	}
+}
+
+func TestParseScrapeHeaders(t *testing.T) {
+	headers, err := ParseScrapeHeaders(" X-Scope-OrgID: tenant-a , X-Trace:on,X-Trace:verbose")
+	if err != nil {
+		t.Fatalf("ParseScrapeHeaders: %v", err)
+	}
+	if got := headers.Get("X-Scope-OrgID"); got != "tenant-a" {
+		t.Errorf("X-Scope-OrgID = %q, want tenant-a", got)
+	}
+	if got := headers.Values("X-Trace"); !reflect.DeepEqual(got, []string{"on", "verbose"}) {
+		t.Errorf("X-Trace = %v, want both values", got)
+	}
+
+	if headers, err := ParseScrapeHeaders("  "); err != nil || headers != nil {
+		t.Errorf("blank SCRAPE_HEADERS = %v, %v; want nil, nil", headers, err)
+	}
+	for _, raw := range []string{"X-A:1,", "X-A", "Bad Name:1", ":1", "X-(A):1", "X-A:a\x01b"} {
+		if _, err := ParseScrapeHeaders(raw); err == nil {
+			t.Errorf("ParseScrapeHeaders(%q) accepted an invalid entry", raw)
+		}
+	}
+}
+
+func TestCollectSendsScrapeHeaders(t *testing.T) {
+	var received atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Store(r.Header.Clone())
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte("up 1\n"))
+	}))
+	t.Cleanup(srv.Close)
+
+	headers, err := ParseScrapeHeaders("X-Scope-OrgID:tenant-a")
+	if err != nil {
+		t.Fatalf("ParseScrapeHeaders: %v", err)
+	}
+	c, _ := newTestCollector(t, CollectorOptions{Headers: headers}, strings.TrimPrefix(srv.URL, "http://"))
+	if _, err := c.Collect(context.Background(), "", ""); err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	got, _ := received.Load().(http.Header)
+	if got.Get("X-Scope-OrgID") != "tenant-a" {
+		t.Errorf("scrape request headers = %v, want X-Scope-OrgID: tenant-a", got)
+	}
+}
+
+func TestLogFailuresSummarized(t *testing.T) {
+	var buf bytes.Buffer
+	klog.LogToStderr(false)
+	klog.SetOutput(&buf)
+	t.Cleanup(func() {
+		klog.SetOutput(io.Discard)
+		klog.LogToStderr(true)
+	})
+
+	failures := make(map[string]error)
+	for i := 0; i < maxLoggedNodeFailures; i++ {
+		failures["10.0.0."+strconv.Itoa(i)] = &statusError{code: http.StatusForbidden}
+	}
+	logFailures(failures, nil)
+	klog.Flush()
+	if logs := buf.String(); strings.Contains(logs, "summarized") {
+		t.Errorf("failures at the threshold were summarized:\n%s", logs)
+	}
+
+	buf.Reset()
+	for i := maxLoggedNodeFailures; i < maxLoggedNodeFailures+3; i++ {
+		failures["10.0.1."+strconv.Itoa(i)] = context.DeadlineExceeded
+	}
+	failures["10.0.2.1"] = errCircuitOpen
+	logFailures(failures, nil)
+	klog.Flush()
+
+	// klog writes an error line once per severity at or below it, so count
+	// distinct lines.
+	logs := buf.String()
+	logged := make(map[string]bool)
+	for _, line := range strings.Split(logs, "\n") {
+		if strings.Contains(line, `"cadvisor scrape failed"`) {
+			logged[line] = true
+		}
+	}
+	if got := len(logged); got != maxLoggedNodeFailures {
+		t.Errorf("logged %d node errors at error level, want %d:\n%s", got, maxLoggedNodeFailures, logs)
+	}
+	for _, field := range []string{"failures=" + strconv.Itoa(len(failures)), "suppressed=3", "http_403", "timeout", failureCircuitOpen} {
+		if !strings.Contains(logs, field) {
+			t.Errorf("failure summary lacks %s:\n%s", field, logs)
+		}
+	}
+}
+
+func TestFailureCategory(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&statusError{code: http.StatusUnauthorized}, "http_401"},
+		{fmt.Errorf("fetch: %w", context.DeadlineExceeded), "timeout"},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, "connection"},
+		{errCircuitOpen, failureCircuitOpen},
+		{errors.New("boom"), "other"},
+	}
+	for _, tt := range tests {
+		if got := failureCategory(tt.err); got != tt.want {
+			t.Errorf("failureCategory(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestCollectEmitPodInfo(t *testing.T) {
+	node := newTestKubelet(t, "up 1\n")
+	for _, emit := range []bool{true, false} {
+		c, svc := newTestCollector(t, CollectorOptions{EmitPodInfo: emit}, node)
+		svc.cache.StorePodLabels("default", "web-0", map[string]string{"app": "web"})
+		svc.cache.StorePodLabels("default", "web-1", map[string]string{"app": "web"})
+
+		result, err := c.Collect(context.Background(), "app", "")
+		if err != nil {
+			t.Fatalf("Collect: %v", err)
+		}
+		want := 0
+		if emit {
+			want = 2
+		}
+		if got := strings.Count(result.Payload, podInfoMetricName+"{"); got != want {
+			t.Errorf("EmitPodInfo=%v: %d pod info series, want %d:\n%s", emit, got, want, result.Payload)
+		}
+	}
+}
+
+func TestCollectSendsUserAgent(t *testing.T) {
+	var received atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Store(r.UserAgent())
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte("up 1\n"))
+	}))
+	t.Cleanup(srv.Close)
+	node := strings.TrimPrefix(srv.URL, "http://")
+
+	c, _ := newTestCollector(t, CollectorOptions{UserAgent: "kubelet-cadvisor-addlabel/v1.2.0"}, node)
+	if _, err := c.Collect(context.Background(), "", ""); err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	if got := received.Load(); got != "kubelet-cadvisor-addlabel/v1.2.0" {
+		t.Errorf("User-Agent = %v, want the configured value", got)
+	}
+
+	c, _ = newTestCollector(t, CollectorOptions{}, node)
+	if _, err := c.Collect(context.Background(), "", ""); err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	if got, _ := received.Load().(string); !strings.HasPrefix(got, "Go-http-client/") {
+		t.Errorf("User-Agent without configuration = %q, want Go's default", got)
+	}
+}
+
+func TestCollectRejectsNonTextPayload(t *testing.T) {
+	var accept atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept.Store(r.Header.Get("Accept"))
+		w.Header().Set("Content-Type", "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited")
+		_, _ = w.Write([]byte{0x0a, 0x02, 0x75, 0x70})
+	}))
+	t.Cleanup(srv.Close)
+	proto := strings.TrimPrefix(srv.URL, "http://")
+	good := newTestKubelet(t, "up 1\n")
+
+	c, _ := newTestCollector(t, CollectorOptions{}, good, proto)
+	result, err := c.Collect(context.Background(), "", "")
+	if err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	if got := accept.Load(); got != acceptHeader {
+		t.Errorf("Accept = %v, want %q", got, acceptHeader)
+	}
+	if err := result.Nodes[proto].Err; err == nil || !strings.Contains(err.Error(), "unsupported content type") {
+		t.Errorf("protobuf node error = %v, want an unsupported content type error", err)
+	}
+	if strings.Contains(result.Payload, "\x0a\x02") {
+		t.Errorf("protobuf body leaked into the payload:\n%q", result.Payload)
+	}
+	if !strings.Contains(result.Payload, "up 1") {
+		t.Errorf("text node missing from the payload:\n%s", result.Payload)
+	}
+}
+
+func TestCollectFailureComment(t *testing.T) {
+	good, dead := newTestKubelet(t, "up 1\n"), newDeadKubelet(t)
+	for _, omit := range []bool{false, true} {
+		c, _ := newTestCollector(t, CollectorOptions{OmitFailureComment: omit}, good, dead)
+		result, err := c.Collect(context.Background(), "", "")
+		if err != nil {
+			t.Fatalf("Collect: %v", err)
+		}
+		hasComment := strings.Contains(result.Payload, "# scrape failures: "+dead+"=")
+		if hasComment == omit {
+			t.Errorf("OmitFailureComment=%v: failure comment present = %v:\n%s", omit, hasComment, result.Payload)
+		}
+		if !strings.Contains(result.Payload, `addlabel_node_up{node_ip="`+dead+`"} 0`) {
+			t.Errorf("OmitFailureComment=%v: node up series missing for the dead node:\n%s", omit, result.Payload)
+		}
+		if result.Nodes[dead].Err == nil {
+			t.Errorf("OmitFailureComment=%v: dead node reported no error", omit)
+		}
+	}
+}
+
+func TestCollectNegotiatesHTTP2(t *testing.T) {
+	var proto atomic.Value
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto.Store(r.Proto)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte("up 1\n"))
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(srv.URL, "https://"))
+	portNumber, _ := strconv.Atoi(port)
+	for _, tt := range []struct {
+		disable bool
+		want    string
+	}{
+		{false, "HTTP/2.0"},
+		{true, "HTTP/1.1"},
+	} {
+		factory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+		svc := NewService(factory, ServiceOptions{StaticNodes: []string{host}, DisablePodInformer: true})
+		c := NewCollector(svc, CollectorOptions{
+			Scheme:             SchemeHTTPS,
+			Port:               portNumber,
+			Token:              "secret",
+			InsecureSkipVerify: true,
+			DisableHTTP2:       tt.disable,
+		})
+
+		reused := kubeletRequests.Value(tt.want, "reused")
+		for i := 0; i < 2; i++ {
+			if _, err := c.Collect(context.Background(), "", ""); err != nil {
+				t.Fatalf("Collect: %v", err)
+			}
+		}
+		if got := proto.Load(); got != tt.want {
+			t.Errorf("DisableHTTP2=%v: negotiated %v, want %s", tt.disable, got, tt.want)
+		}
+		if got := kubeletRequests.Value(tt.want, "reused") - reused; got < 1 {
+			t.Errorf("DisableHTTP2=%v: %v reused connections over two cycles, want at least 1", tt.disable, got)
+		}
+		c.client.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	containerRequestsPrefix = "requests."
+	containerLimitsPrefix   = "limits."
+)
+
+// validContainerField reports whether field is a key containerFields fills.
+func validContainerField(field string) bool {
+	switch field {
+	case "image", "imagePullPolicy":
+		return true
+	}
+	for _, prefix := range []string{containerRequestsPrefix, containerLimitsPrefix} {
+		if rest, ok := strings.CutPrefix(field, prefix); ok {
+			return rest != ""
+		}
+	}
+	return false
+}
+
+// containerFields flattens the parts of a container spec that "container:"
+// entries can read: its image and pull policy, and every resource request
+// and limit as "requests.<resource>" and "limits.<resource>".
+func containerFields(c *corev1.Container) map[string]string {
+	fields := map[string]string{
+		"image":           c.Image,
+		"imagePullPolicy": string(c.ImagePullPolicy),
+	}
+	for name, quantity := range c.Resources.Requests {
+		fields[containerRequestsPrefix+string(name)] = quantity.String()
+	}
+	for name, quantity := range c.Resources.Limits {
+		fields[containerLimitsPrefix+string(name)] = quantity.String()
+	}
+	return fields
+}
@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// CustomResourceSource configures the namespaced custom resource whose
+// labels "cr:" entries in ADD_LABELS read. A pod is joined to the object of
+// that resource named by its JoinLabel, in the pod's namespace.
+type CustomResourceSource struct {
+	Factory   dynamicinformer.DynamicSharedInformerFactory
+	Resource  schema.GroupVersionResource
+	JoinLabel string
+}
+
+// ParseGroupVersionResource parses a "<group>/<version>/<resource>" string
+// such as "apps.example.com/v1alpha1/applications".
+func ParseGroupVersionResource(raw string) (schema.GroupVersionResource, error) {
+	parts := strings.Split(strings.TrimSpace(raw), "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return schema.GroupVersionResource{}, fmt.Errorf("resource %q is not of the form <group>/<version>/<resource>", raw)
+	}
+	return schema.GroupVersionResource{Group: parts[0], Version: parts[1], Resource: parts[2]}, nil
+}
+
+// newCustomResourceEventHandler caches the labels of custom resource objects
+// keyed by namespace and name.
+func newCustomResourceEventHandler(store *Cache) cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj any) {
+			cr := toUnstructured(obj)
+			if cr == nil {
+				return
+			}
+			klog.V(6).InfoS("custom resource added", "object", cacheKey(cr.GetNamespace(), cr.GetName()))
+			store.StoreCustomResourceLabels(cr.GetNamespace(), cr.GetName(), cr.GetLabels())
+		},
+		UpdateFunc: func(_, newObj any) {
+			cr := toUnstructured(newObj)
+			if cr == nil {
+				return
+			}
+			klog.V(6).InfoS("custom resource updated", "object", cacheKey(cr.GetNamespace(), cr.GetName()))
+			store.StoreCustomResourceLabels(cr.GetNamespace(), cr.GetName(), cr.GetLabels())
+		},
+		DeleteFunc: func(obj any) {
+			var namespace, name string
+			if cr := toUnstructured(obj); cr != nil {
+				namespace, name = cr.GetNamespace(), cr.GetName()
+			} else if key, ok := tombstoneKey(obj); ok {
+				var err error
+				if namespace, name, err = cache.SplitMetaNamespaceKey(key); err != nil || namespace == "" {
+					klog.ErrorS(err, "cannot derive custom resource from tombstone key", "key", key)
+					return
+				}
+			} else {
+				return
+			}
+			klog.V(6).InfoS("custom resource deleted", "object", cacheKey(namespace, name))
+			store.DeleteCustomResourceLabels(namespace, name)
+		},
+	}
+}
+
+func toUnstructured(obj any) *unstructured.Unstructured {
+	switch typed := obj.(type) {
+	case *unstructured.Unstructured:
+		return typed
+	case cache.DeletedFinalStateUnknown:
+		cr, _ := typed.Obj.(*unstructured.Unstructured)
+		return cr
+	default:
+		return nil
+	}
+}
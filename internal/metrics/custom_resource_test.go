@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseGroupVersionResource(t *testing.T) {
+	gvr, err := ParseGroupVersionResource(" apps.example.com/v1alpha1/applications ")
+	if want := (schema.GroupVersionResource{Group: "apps.example.com", Version: "v1alpha1", Resource: "applications"}); err != nil || gvr != want {
+		t.Errorf("ParseGroupVersionResource = %v, %v; want %v", gvr, err, want)
+	}
+	for _, raw := range []string{"", "applications", "v1/applications", "apps.example.com//applications", "a/b/c/d"} {
+		if _, err := ParseGroupVersionResource(raw); err == nil {
+			t.Errorf("ParseGroupVersionResource(%q) succeeded", raw)
+		}
+	}
+}
+
+func TestServiceCustomResourceLabels(t *testing.T) {
+	gvr := schema.GroupVersionResource{Group: "apps.example.com", Version: "v1", Resource: "applications"}
+	app := &unstructured.Unstructured{}
+	app.SetAPIVersion("apps.example.com/v1")
+	app.SetKind("Application")
+	app.SetNamespace("default")
+	app.SetName("shop")
+	app.SetLabels(map[string]string{"owner": "alice"})
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{gvr: "ApplicationList"}, app)
+
+	pod := func(name string, labels map[string]string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Labels: labels}}
+	}
+	client := fake.NewSimpleClientset(
+		pod("web-0", map[string]string{"app.example.com/name": "shop"}),
+		pod("web-1", map[string]string{"app.example.com/name": "unknown"}),
+		pod("web-2", nil),
+	)
+	svc := NewService(informers.NewSharedInformerFactory(client, 0), ServiceOptions{
+		StaticNodes: []string{"10.0.0.1"},
+		CustomResources: &CustomResourceSource{
+			Factory:   dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0),
+			Resource:  gvr,
+			JoinLabel: "app.example.com/name",
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- svc.Run(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	syncCtx, syncCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer syncCancel()
+	if err := svc.WaitForSync(syncCtx); err != nil {
+		t.Fatalf("WaitForSync: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for svc.CustomResourceLabels("default", "web-0") == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := svc.CustomResourceLabels("default", "web-0"); got["owner"] != "alice" {
+		t.Errorf("labels through the join label = %v, want owner=alice", got)
+	}
+	if got := svc.CustomResourceLabels("default", "web-1"); got != nil {
+		t.Errorf("labels for an unknown custom resource = %v, want nil", got)
+	}
+	if got := svc.CustomResourceLabels("default", "web-2"); got != nil {
+		t.Errorf("labels for a pod without the join label = %v, want nil", got)
+	}
+
+	got := enrich(t, ProcessorOptions{}, `up{namespace="default",pod="web-0"} 1`, "cr:owner", "", svc)
+	if want := `up{namespace="default",pod="web-0",owner="alice"} 1`; got != want {
+		t.Errorf("cr: enrichment:\n got %s\nwant %s", got, want)
+	}
+}
@@ -1,45 +1,66 @@
 package metrics
 
 import (
+	"fmt"
+
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog/v2"
 )
 
-// newNodeEventHandler wires the cache updates required for node events.
-func newNodeEventHandler(store *Cache) cache.ResourceEventHandlerFuncs {
+// newNodeEventHandler wires the cache updates required for node events. When
+// selector is non-nil, nodes whose labels do not match it are kept out of the
+// cache, and removed from it when a label change makes them stop matching.
+func newNodeEventHandler(store *Cache, selector labels.Selector) cache.ResourceEventHandlerFuncs {
+	excluded := func(node *corev1.Node) bool {
+		if selector == nil || selector.Matches(labels.Set(node.Labels)) {
+			return false
+		}
+		klog.V(5).InfoS("node excluded by label selector", "node", node.Name, "selector", selector.String())
+		store.DeleteNode(node.Name)
+		return true
+	}
+
 	return cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj any) {
 			node := toNode(obj)
-			if node == nil {
+			if node == nil || excluded(node) {
 				return
 			}
 			ip := internalNodeIP(node)
 			klog.V(4).InfoS("node added/updated", "node", node.Name, "ip", ip)
 			store.StoreNodeIP(node.Name, ip)
+			store.StoreNodeLabels(node.Name, node.Labels)
 		},
 		UpdateFunc: func(_, newObj any) {
 			node := toNode(newObj)
-			if node == nil {
+			if node == nil || excluded(node) {
 				return
 			}
 			ip := internalNodeIP(node)
 			klog.V(5).InfoS("node updated", "node", node.Name, "ip", ip)
 			store.StoreNodeIP(node.Name, ip)
+			store.StoreNodeLabels(node.Name, node.Labels)
 		},
 		DeleteFunc: func(obj any) {
-			node := toNode(obj)
-			if node == nil {
+			name := ""
+			if node := toNode(obj); node != nil {
+				name = node.Name
+			} else if key, ok := tombstoneKey(obj); ok {
+				name = key
+			} else {
 				return
 			}
-			klog.V(4).InfoS("node deleted", "node", node.Name)
-			store.DeleteNode(node.Name)
+			klog.V(4).InfoS("node deleted", "node", name)
+			store.DeleteNode(name)
 		},
 	}
 }
 
 // newPodEventHandler wires the cache updates required for pod events.
-func newPodEventHandler(store *Cache) cache.ResourceEventHandlerFuncs {
+// Annotations are cached only when withAnnotations is set.
+func newPodEventHandler(store *Cache, withAnnotations bool) cache.ResourceEventHandlerFuncs {
 	return cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj any) {
 			pod := toPod(obj)
@@ -47,7 +68,7 @@ func newPodEventHandler(store *Cache) cache.ResourceEventHandlerFuncs {
 				return
 			}
 			klog.V(6).InfoS("pod added", "pod", cacheKey(pod.Namespace, pod.Name))
-			store.StorePodLabels(pod.Namespace, pod.Name, pod.Labels)
+			storePod(store, pod, withAnnotations)
 		},
 		UpdateFunc: func(_, newObj any) {
 			pod := toPod(newObj)
@@ -55,17 +76,67 @@ func newPodEventHandler(store *Cache) cache.ResourceEventHandlerFuncs {
 				return
 			}
 			klog.V(6).InfoS("pod updated", "pod", cacheKey(pod.Namespace, pod.Name))
-			store.StorePodLabels(pod.Namespace, pod.Name, pod.Labels)
+			storePod(store, pod, withAnnotations)
 		},
 		DeleteFunc: func(obj any) {
-			pod := toPod(obj)
-			if pod == nil {
+			var namespace, name string
+			if pod := toPod(obj); pod != nil {
+				namespace, name = pod.Namespace, pod.Name
+			} else if key, ok := tombstoneKey(obj); ok {
+				var err error
+				if namespace, name, err = cache.SplitMetaNamespaceKey(key); err != nil || namespace == "" {
+					klog.ErrorS(err, "cannot derive pod from tombstone key", "key", key)
+					return
+				}
+			} else {
+				return
+			}
+			klog.V(6).InfoS("pod deleted", "pod", cacheKey(namespace, name))
+			store.DeletePodLabels(namespace, name)
+		},
+	}
+}
+
+// newNamespaceEventHandler wires the cache updates required for namespace events.
+func newNamespaceEventHandler(store *Cache) cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj any) {
+			ns := toNamespace(obj)
+			if ns == nil {
+				return
+			}
+			klog.V(6).InfoS("namespace added", "namespace", ns.Name)
+			store.StoreNamespaceLabels(ns.Name, ns.Labels)
+		},
+		UpdateFunc: func(_, newObj any) {
+			ns := toNamespace(newObj)
+			if ns == nil {
 				return
 			}
-			klog.V(6).InfoS("pod deleted", "pod", cacheKey(pod.Namespace, pod.Name))
-			store.DeletePodLabels(pod.Namespace, pod.Name)
+			klog.V(6).InfoS("namespace updated", "namespace", ns.Name)
+			store.StoreNamespaceLabels(ns.Name, ns.Labels)
 		},
+		DeleteFunc: func(obj any) {
+			name := ""
+			if ns := toNamespace(obj); ns != nil {
+				name = ns.Name
+			} else if key, ok := tombstoneKey(obj); ok {
+				name = key
+			} else {
+				return
+			}
+			klog.V(6).InfoS("namespace deleted", "namespace", name)
+			store.DeleteNamespaceLabels(name)
+		},
+	}
+}
+
+func storePod(store *Cache, pod *corev1.Pod, withAnnotations bool) {
+	var annotations map[string]string
+	if withAnnotations {
+		annotations = pod.Annotations
 	}
+	store.StorePodMetadata(pod.Namespace, pod.Name, pod.Labels, annotations)
 }
 
 func internalNodeIP(node *corev1.Node) string {
@@ -77,6 +148,24 @@ func internalNodeIP(node *corev1.Node) string {
 	return ""
 }
 
+// tombstoneKey returns the informer key of a tombstone whose final object is
+// missing or of an unexpected type, so the cache entry can still be removed.
+// Cluster-scoped objects are keyed by name and namespaced ones by
+// "namespace/name".
+func tombstoneKey(obj any) (string, bool) {
+	tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+	if !ok {
+		klog.InfoS("ignoring delete event with unexpected object type", "type", fmt.Sprintf("%T", obj))
+		return "", false
+	}
+	if tombstone.Key == "" {
+		klog.InfoS("ignoring tombstone without key", "type", fmt.Sprintf("%T", tombstone.Obj))
+		return "", false
+	}
+	klog.V(4).InfoS("tombstone carries unexpected object; deleting by key", "key", tombstone.Key, "type", fmt.Sprintf("%T", tombstone.Obj))
+	return tombstone.Key, true
+}
+
 func toNode(obj any) *corev1.Node {
 	switch typed := obj.(type) {
 	case *corev1.Node:
@@ -89,6 +178,18 @@ func toNode(obj any) *corev1.Node {
 	}
 }
 
+func toNamespace(obj any) *corev1.Namespace {
+	switch typed := obj.(type) {
+	case *corev1.Namespace:
+		return typed
+	case cache.DeletedFinalStateUnknown:
+		ns, _ := typed.Obj.(*corev1.Namespace)
+		return ns
+	default:
+		return nil
+	}
+}
+
 func toPod(obj any) *corev1.Pod {
 	switch typed := obj.(type) {
 	case *corev1.Pod:
@@ -0,0 +1,182 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+func testNode(name, ip string, labels map[string]string) *corev1.Node {
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+	if ip != "" {
+		node.Status.Addresses = []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: ip}}
+	}
+	return node
+}
+
+func TestNodeWithoutAddressKeptForGracePeriod(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewCache(0, time.Minute)
+	store.now = func() time.Time { return now }
+	handler := newNodeEventHandler(store, nil)
+
+	handler.OnAdd(testNode("worker-1", "10.0.0.1", nil), false)
+	handler.OnUpdate(testNode("worker-1", "10.0.0.1", nil), testNode("worker-1", "", nil))
+
+	now = now.Add(30 * time.Second)
+	if ips := store.NodeIPs(); len(ips) != 1 || ips[0] != "10.0.0.1" {
+		t.Errorf("within the grace period: NodeIPs = %v, want the last known IP", ips)
+	}
+	if got := nodesWithoutAddress.Value(); got != 1 {
+		t.Errorf("nodes without address = %v, want 1", got)
+	}
+
+	// A second address-less update must not restart the grace period.
+	handler.OnUpdate(testNode("worker-1", "", nil), testNode("worker-1", "", nil))
+	now = now.Add(31 * time.Second)
+	if ips := store.NodeIPs(); len(ips) != 0 {
+		t.Errorf("after the grace period: NodeIPs = %v, want none", ips)
+	}
+
+	handler.OnUpdate(testNode("worker-1", "", nil), testNode("worker-1", "10.0.0.9", nil))
+	if ips := store.NodeIPs(); len(ips) != 1 || ips[0] != "10.0.0.9" {
+		t.Errorf("after the address returned: NodeIPs = %v", ips)
+	}
+	if got := nodesWithoutAddress.Value(); got != 0 {
+		t.Errorf("nodes without address = %v, want 0", got)
+	}
+}
+
+func TestNodeAddedWithoutAddressIsNotScraped(t *testing.T) {
+	store := NewCache(0, time.Minute)
+	newNodeEventHandler(store, nil).OnAdd(testNode("worker-1", "", nil), false)
+	if ips := store.NodeIPs(); len(ips) != 0 {
+		t.Errorf("NodeIPs = %v, want none for a node that never had an address", ips)
+	}
+}
+
+func TestNodeEventHandlerLabelSelector(t *testing.T) {
+	store := NewCache(0, 0)
+	handler := newNodeEventHandler(store, labels.SelectorFromSet(labels.Set{"pool": "gpu"}))
+
+	handler.OnAdd(testNode("cpu-1", "10.0.0.1", map[string]string{"pool": "cpu"}), false)
+	handler.OnAdd(testNode("gpu-1", "10.0.0.2", map[string]string{"pool": "gpu"}), false)
+	if ips := store.NodeIPs(); len(ips) != 1 || ips[0] != "10.0.0.2" {
+		t.Fatalf("NodeIPs = %v, want only the matching node", ips)
+	}
+	if _, ok := store.NodeLabels("cpu-1"); ok {
+		t.Error("labels cached for a node outside the selector")
+	}
+
+	handler.OnUpdate(
+		testNode("cpu-1", "10.0.0.1", map[string]string{"pool": "cpu"}),
+		testNode("cpu-1", "10.0.0.1", map[string]string{"pool": "cpu", "tier": "batch"}),
+	)
+	if ips := store.NodeIPs(); len(ips) != 1 || ips[0] != "10.0.0.2" {
+		t.Errorf("after updating a non-matching node: NodeIPs = %v", ips)
+	}
+
+	// A relabel that takes a node out of the selector removes it.
+	handler.OnUpdate(
+		testNode("gpu-1", "10.0.0.2", map[string]string{"pool": "gpu"}),
+		testNode("gpu-1", "10.0.0.2", map[string]string{"pool": "cpu"}),
+	)
+	if ips := store.NodeIPs(); len(ips) != 0 {
+		t.Errorf("after the node stopped matching: NodeIPs = %v, want none", ips)
+	}
+}
+
+func TestNamespaceEventHandler(t *testing.T) {
+	store := NewCache(0, 0)
+	handler := newNamespaceEventHandler(store)
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "payments", Labels: map[string]string{"team": "billing"}}}
+
+	handler.OnAdd(ns, false)
+	if labels, ok := store.NamespaceLabels("payments"); !ok || labels["team"] != "billing" {
+		t.Errorf("after add: labels = %v, %v", labels, ok)
+	}
+	if values := store.UniqueNamespaceLabelValues("team"); len(values) != 1 || values[0] != "billing" {
+		t.Errorf("UniqueNamespaceLabelValues = %v", values)
+	}
+
+	handler.OnDelete(ns)
+	if _, ok := store.NamespaceLabels("payments"); ok {
+		t.Error("namespace still cached after delete")
+	}
+}
+
+func TestPodEventHandlerAnnotations(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "default",
+		Name:        "web-0",
+		Labels:      map[string]string{"app": "web"},
+		Annotations: map[string]string{"example.com/owner": "alice"},
+	}}
+	for _, withAnnotations := range []bool{false, true} {
+		store := NewCache(0, 0)
+		newPodEventHandler(store, withAnnotations).OnAdd(pod, false)
+
+		if labels, _ := store.PodLabels("default", "web-0"); labels["app"] != "web" {
+			t.Errorf("withAnnotations=%v: labels = %v", withAnnotations, labels)
+		}
+		annotations, _ := store.PodAnnotations("default", "web-0")
+		if got := annotations["example.com/owner"]; (got == "alice") != withAnnotations {
+			t.Errorf("withAnnotations=%v: cached annotation = %q", withAnnotations, got)
+		}
+	}
+}
+
+func TestNodeDeleteTombstones(t *testing.T) {
+	tests := []struct {
+		name    string
+		obj     any
+		deleted bool
+	}{
+		{"valid tombstone", cache.DeletedFinalStateUnknown{Key: "worker-1", Obj: testNode("worker-1", "10.0.0.1", nil)}, true},
+		{"nil inner object", cache.DeletedFinalStateUnknown{Key: "worker-1"}, true},
+		{"missing key", cache.DeletedFinalStateUnknown{}, false},
+		{"unexpected type", "worker-1", false},
+	}
+	for _, tt := range tests {
+		store := NewCache(0, 0)
+		handler := newNodeEventHandler(store, nil)
+		handler.OnAdd(testNode("worker-1", "10.0.0.1", map[string]string{"zone": "a"}), false)
+		handler.OnDelete(tt.obj)
+
+		_, cached := store.NodeLabels("worker-1")
+		if cached == tt.deleted {
+			t.Errorf("%s: node cached = %v, want deleted = %v", tt.name, cached, tt.deleted)
+		}
+		if ips := store.NodeIPs(); (len(ips) == 0) != tt.deleted {
+			t.Errorf("%s: node IPs = %v, want deleted = %v", tt.name, ips, tt.deleted)
+		}
+	}
+}
+
+func TestPodDeleteTombstones(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-0", Labels: map[string]string{"app": "web"}}}
+	tests := []struct {
+		name    string
+		obj     any
+		deleted bool
+	}{
+		{"valid tombstone", cache.DeletedFinalStateUnknown{Key: "default/web-0", Obj: pod}, true},
+		{"nil inner object", cache.DeletedFinalStateUnknown{Key: "default/web-0"}, true},
+		{"key without namespace", cache.DeletedFinalStateUnknown{Key: "web-0"}, false},
+		{"malformed key", cache.DeletedFinalStateUnknown{Key: "a/b/c"}, false},
+	}
+	for _, tt := range tests {
+		store := NewCache(0, 0)
+		handler := newPodEventHandler(store, false)
+		handler.OnAdd(pod, false)
+		handler.OnDelete(tt.obj)
+
+		if _, cached := store.PodLabels("default", "web-0"); cached == tt.deleted {
+			t.Errorf("%s: pod cached = %v, want deleted = %v", tt.name, cached, tt.deleted)
+		}
+	}
+}
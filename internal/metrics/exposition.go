@@ -0,0 +1,329 @@
+package metrics
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// FormatPrometheus renders the classic Prometheus text exposition format.
+	FormatPrometheus = "prometheus"
+	// FormatOpenMetrics renders strict OpenMetrics text, terminated by "# EOF".
+	FormatOpenMetrics = "openmetrics"
+)
+
+// sampleSuffixes are the suffixes a sample may carry while still belonging to
+// the family declared by the preceding TYPE line.
+var sampleSuffixes = []string{"_bucket", "_sum", "_count", "_total", "_created", "_info"}
+
+// metricFamily groups the metadata and sample lines of a single metric family.
+type metricFamily struct {
+	name    string
+	help    string
+	typ     string
+	samples []string
+}
+
+// familySet merges metric families from several payloads, keeping the order
+// in which families were first seen and each family's HELP/TYPE only once.
+type familySet struct {
+	order  []*metricFamily
+	byName map[string]*metricFamily
+	// dropPrefixes lists metric name prefixes whose families are discarded.
+	dropPrefixes []string
+	// summed lists families whose identical series are added together by
+	// aggregate; add does not transform their samples.
+	summed map[string]struct{}
+}
+
+func newFamilySet() *familySet {
+	return &familySet{byName: make(map[string]*metricFamily)}
+}
+
+func (fs *familySet) dropped(name string) bool {
+	for _, prefix := range fs.dropPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fs *familySet) family(name string) *metricFamily {
+	if mf, ok := fs.byName[name]; ok {
+		return mf
+	}
+	mf := &metricFamily{name: name}
+	fs.byName[name] = mf
+	fs.order = append(fs.order, mf)
+	return mf
+}
+
+// add parses payload and appends its lines to the matching families. Comment
+// lines other than HELP and TYPE are discarded, as are families matching
+// dropPrefixes. transform, when non-nil, is applied to every sample line
+// before it is stored.
+func (fs *familySet) add(payload string, transform func(line string) string) {
+	var current *metricFamily
+
+	for _, line := range strings.Split(payload, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "#") {
+			kind, name, ok := parseMetadataLine(trimmed)
+			if !ok || fs.dropped(name) {
+				current = nil
+				continue
+			}
+			current = fs.family(name)
+			switch kind {
+			case "HELP":
+				if current.help == "" {
+					current.help = trimmed
+				}
+			case "TYPE":
+				if current.typ == "" {
+					current.typ = trimmed
+				}
+			}
+			continue
+		}
+
+		name := sampleMetricName(trimmed)
+		if fs.dropped(name) {
+			continue
+		}
+		if current == nil || !belongsToFamily(name, current.name) {
+			current = fs.family(name)
+		}
+		if _, sum := fs.summed[current.name]; transform != nil && !sum {
+			trimmed = transform(trimmed)
+		}
+		current.samples = append(current.samples, trimmed)
+	}
+}
+
+// aggregate replaces the samples of every summed family with one sample per
+// distinct series, valued with the sum over all payloads. Timestamps are
+// dropped; a sample whose value cannot be parsed is kept unchanged.
+func (fs *familySet) aggregate() {
+	for name := range fs.summed {
+		mf, ok := fs.byName[name]
+		if !ok {
+			continue
+		}
+
+		var order []string
+		sums := make(map[string]float64)
+		var kept []string
+		for _, sample := range mf.samples {
+			series, value, ok := splitSample(sample)
+			if !ok {
+				kept = append(kept, sample)
+				continue
+			}
+			if _, seen := sums[series]; !seen {
+				order = append(order, series)
+			}
+			sums[series] += value
+		}
+
+		samples := make([]string, 0, len(order)+len(kept))
+		for _, series := range order {
+			samples = append(samples, series+" "+strconv.FormatFloat(sums[series], 'g', -1, 64))
+		}
+		mf.samples = append(samples, kept...)
+	}
+}
+
+// splitSample separates a sample line into its series (name and label block)
+// and its value.
+func splitSample(line string) (series string, value float64, ok bool) {
+	series = sampleMetricName(line)
+	if start, end := labelBlockBounds(line); start == len(series) {
+		series = line[:end+1]
+	}
+	fields := strings.Fields(line[len(series):])
+	if len(fields) == 0 {
+		return "", 0, false
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return series, value, true
+}
+
+// write renders every family in Prometheus text format.
+func (fs *familySet) write(b *strings.Builder) {
+	for _, mf := range fs.order {
+		if mf.help != "" {
+			b.WriteString(mf.help)
+			b.WriteByte('\n')
+		}
+		if mf.typ != "" {
+			b.WriteString(mf.typ)
+			b.WriteByte('\n')
+		}
+		for _, sample := range mf.samples {
+			b.WriteString(sample)
+			b.WriteByte('\n')
+		}
+	}
+}
+
+// writeOpenMetrics renders every family using OpenMetrics naming rules: counter
+// families drop their "_total" suffix, which their samples must then carry,
+// and untyped families become "unknown". Sample timestamps are converted from
+// milliseconds to seconds.
+func (fs *familySet) writeOpenMetrics(b *strings.Builder) {
+	for _, mf := range fs.order {
+		name := mf.name
+		typ := metadataValue(mf.typ)
+		counter := false
+		switch typ {
+		case "counter":
+			name = strings.TrimSuffix(name, "_total")
+			counter = true
+		case "untyped":
+			typ = "unknown"
+		}
+
+		if help := metadataValue(mf.help); mf.help != "" {
+			b.WriteString("# HELP ")
+			b.WriteString(name)
+			if help != "" {
+				b.WriteByte(' ')
+				b.WriteString(help)
+			}
+			b.WriteByte('\n')
+		}
+		if typ != "" {
+			b.WriteString("# TYPE ")
+			b.WriteString(name)
+			b.WriteByte(' ')
+			b.WriteString(typ)
+			b.WriteByte('\n')
+		}
+		for _, sample := range mf.samples {
+			if counter && sampleMetricName(sample) == name {
+				sample = name + "_total" + sample[len(name):]
+			}
+			b.WriteString(openMetricsTimestamp(sample))
+			b.WriteByte('\n')
+		}
+	}
+}
+
+// openMetricsTimestamp rewrites the millisecond timestamp of a Prometheus text
+// sample in the seconds OpenMetrics expects. Lines without a timestamp, or
+// with one that is not an integer, are returned unchanged.
+func openMetricsTimestamp(line string) string {
+	if sampleFieldCount(line) != 2 {
+		return line
+	}
+	i := strings.LastIndexAny(line, " \t")
+	ms, err := strconv.ParseInt(line[i+1:], 10, 64)
+	if err != nil {
+		return line
+	}
+	return line[:i+1] + formatOpenMetricsTimestamp(ms)
+}
+
+// formatOpenMetricsTimestamp renders a Unix millisecond timestamp as seconds.
+func formatOpenMetricsTimestamp(ms int64) string {
+	return strconv.FormatFloat(float64(ms)/1000, 'f', 3, 64)
+}
+
+// toOpenMetrics regroups a Prometheus text payload into OpenMetrics framing,
+// dropping free-form comments and appending the mandatory "# EOF" marker.
+func toOpenMetrics(payload string) string {
+	fs := newFamilySet()
+	fs.add(payload, nil)
+
+	var b strings.Builder
+	b.Grow(len(payload) + len("# EOF\n"))
+	fs.writeOpenMetrics(&b)
+	b.WriteString("# EOF\n")
+	return b.String()
+}
+
+// appendTimestamps adds an explicit timestamp to every sample that lacks one,
+// so series keep their collection time while the payload is re-served from
+// cache. Prometheus text uses milliseconds; OpenMetrics uses seconds.
+func appendTimestamps(payload string, at time.Time, openMetrics bool) string {
+	stamp := " " + strconv.FormatInt(at.UnixMilli(), 10)
+	if openMetrics {
+		stamp = " " + formatOpenMetricsTimestamp(at.UnixMilli())
+	}
+
+	lines := strings.Split(payload, "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if sampleFieldCount(trimmed) == 1 {
+			lines[i] = strings.TrimRight(line, " \t") + stamp
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// sampleFieldCount returns how many whitespace-separated fields follow the
+// metric name and label block of a sample line: 1 for a bare value, 2 when a
+// timestamp is present.
+func sampleFieldCount(line string) int {
+	rest := line[len(sampleMetricName(line)):]
+	if _, end := labelBlockBounds(line); end != -1 && strings.HasPrefix(rest, "{") {
+		rest = line[end+1:]
+	}
+	return len(strings.Fields(rest))
+}
+
+// parseMetadataLine extracts the keyword and metric name from a HELP or TYPE comment.
+func parseMetadataLine(line string) (kind, name string, ok bool) {
+	fields := strings.Fields(strings.TrimPrefix(line, "#"))
+	if len(fields) < 2 || (fields[0] != "HELP" && fields[0] != "TYPE") {
+		return "", "", false
+	}
+	return fields[0], fields[1], true
+}
+
+// metadataValue returns everything after the metric name in a HELP or TYPE line.
+func metadataValue(line string) string {
+	fields := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(line, "#")), " ", 3)
+	if len(fields) < 3 {
+		return ""
+	}
+	return strings.TrimSpace(fields[2])
+}
+
+// sampleMetricName returns the metric name of a sample line, i.e. the token
+// before the label block or the value.
+func sampleMetricName(line string) string {
+	if end := strings.IndexAny(line, "{ \t"); end >= 0 {
+		return line[:end]
+	}
+	return line
+}
+
+func belongsToFamily(sample, family string) bool {
+	if sample == family {
+		return true
+	}
+	if !strings.HasPrefix(sample, family) {
+		return false
+	}
+	suffix := sample[len(family):]
+	for _, s := range sampleSuffixes {
+		if suffix == s {
+			return true
+		}
+	}
+	return false
+}
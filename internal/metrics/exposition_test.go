@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFamilySetMergesPayloads(t *testing.T) {
+	fs := newFamilySet()
+	fs.add("# HELP up Whether up.\n# TYPE up gauge\nup{node=\"a\"} 1\n# a free comment\n", nil)
+	fs.add("# HELP up Other help.\n# TYPE up gauge\nup{node=\"b\"} 1\n# TYPE http_requests_total counter\nhttp_requests_total 3\n",
+		strings.ToUpper)
+
+	var b strings.Builder
+	fs.write(&b)
+	want := "# HELP up Whether up.\n# TYPE up gauge\nup{node=\"a\"} 1\nUP{NODE=\"B\"} 1\n" +
+		"# TYPE http_requests_total counter\nHTTP_REQUESTS_TOTAL 3\n"
+	if b.String() != want {
+		t.Errorf("write:\n got %q\nwant %q", b.String(), want)
+	}
+}
+
+func TestFamilySetDropsPrefixes(t *testing.T) {
+	fs := newFamilySet()
+	fs.dropPrefixes = []string{"container_network_"}
+	fs.add("# HELP container_network_receive_bytes_total Received.\n# TYPE container_network_receive_bytes_total counter\n"+
+		"container_network_receive_bytes_total{interface=\"eth0\"} 7\n"+
+		"# HELP container_cpu_usage_seconds_total CPU.\n# TYPE container_cpu_usage_seconds_total counter\n"+
+		"container_cpu_usage_seconds_total 3\n", nil)
+
+	var b strings.Builder
+	fs.write(&b)
+	want := "# HELP container_cpu_usage_seconds_total CPU.\n# TYPE container_cpu_usage_seconds_total counter\n" +
+		"container_cpu_usage_seconds_total 3\n"
+	if b.String() != want {
+		t.Errorf("write:\n got %q\nwant %q", b.String(), want)
+	}
+}
+
+func TestFamilySetAggregate(t *testing.T) {
+	fs := newFamilySet()
+	fs.summed = map[string]struct{}{"jobs_total": {}}
+	fs.add("# TYPE jobs_total counter\njobs_total{q=\"a\"} 1 1700000000000\njobs_total{q=\"b\"} 2\n", nil)
+	fs.add("# TYPE jobs_total counter\njobs_total{q=\"a\"} 1.5\njobs_total{q=\"c\"} NaNx\n", nil)
+	fs.aggregate()
+
+	var b strings.Builder
+	fs.write(&b)
+	want := "# TYPE jobs_total counter\njobs_total{q=\"a\"} 2.5\njobs_total{q=\"b\"} 2\njobs_total{q=\"c\"} NaNx\n"
+	if b.String() != want {
+		t.Errorf("aggregate:\n got %q\nwant %q", b.String(), want)
+	}
+}
+
+func TestToOpenMetrics(t *testing.T) {
+	in := "# HELP requests_total Requests.\n# TYPE requests_total counter\nrequests_total 3\n" +
+		"# TYPE temp untyped\ntemp 21\n# free-form comment\n"
+	want := "# HELP requests Requests.\n# TYPE requests counter\nrequests_total 3\n" +
+		"# TYPE temp unknown\ntemp 21\n# EOF\n"
+	if got := toOpenMetrics(in); got != want {
+		t.Errorf("toOpenMetrics:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestToOpenMetricsTimestampedCounter(t *testing.T) {
+	in := "# HELP container_cpu_cfs_periods Elapsed periods.\n# TYPE container_cpu_cfs_periods counter\n" +
+		"container_cpu_cfs_periods{pod=\"p\"} 12 1700000000123\n" +
+		"# TYPE container_last_seen gauge\ncontainer_last_seen{pod=\"p\"} 1.7e+09 1700000000000\n"
+	want := "# HELP container_cpu_cfs_periods Elapsed periods.\n# TYPE container_cpu_cfs_periods counter\n" +
+		"container_cpu_cfs_periods_total{pod=\"p\"} 12 1700000000.123\n" +
+		"# TYPE container_last_seen gauge\ncontainer_last_seen{pod=\"p\"} 1.7e+09 1700000000.000\n# EOF\n"
+	if got := toOpenMetrics(in); got != want {
+		t.Errorf("toOpenMetrics:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestOpenMetricsTimestamp(t *testing.T) {
+	tests := map[string]string{
+		`up 1`:                `up 1`,
+		`up{a="b c"} 1 1500`:  `up{a="b c"} 1 1.500`,
+		`up 1 notanumber`:     `up 1 notanumber`,
+		`up{a="1 2"} 1`:       `up{a="1 2"} 1`,
+		"up 1\t1700000000000": "up 1\t1700000000.000",
+	}
+	for in, want := range tests {
+		if got := openMetricsTimestamp(in); got != want {
+			t.Errorf("openMetricsTimestamp(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestAppendTimestamps(t *testing.T) {
+	at := time.UnixMilli(1700000000123)
+	in := "# TYPE up gauge\nup{node=\"a b\"} 1\nup 0 1600000000000\n"
+
+	if got, want := appendTimestamps(in, at, false),
+		"# TYPE up gauge\nup{node=\"a b\"} 1 1700000000123\nup 0 1600000000000\n"; got != want {
+		t.Errorf("prometheus:\n got %q\nwant %q", got, want)
+	}
+	if got, want := appendTimestamps(in, at, true),
+		"# TYPE up gauge\nup{node=\"a b\"} 1 1700000000.123\nup 0 1600000000000\n"; got != want {
+		t.Errorf("openmetrics:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestBelongsToFamily(t *testing.T) {
+	tests := []struct {
+		sample, family string
+		want           bool
+	}{
+		{"latency", "latency", true},
+		{"latency_bucket", "latency", true},
+		{"latency_count", "latency", true},
+		{"latency_seconds", "latency", false},
+		{"other", "latency", false},
+	}
+	for _, tt := range tests {
+		if got := belongsToFamily(tt.sample, tt.family); got != tt.want {
+			t.Errorf("belongsToFamily(%q, %q) = %v, want %v", tt.sample, tt.family, got, tt.want)
+		}
+	}
+}
@@ -1,10 +1,71 @@
 package metrics
 
 import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
 	"regexp"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+
+	"github.com/puzhihao/kubelet-cadvisor-addlabel/internal/selfmetrics"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	scanBufferSize = 64 * 1024
+	maxLineSize    = 16 * 1024 * 1024
+	// cancelCheckLines is how many lines are enriched between context checks.
+	cancelCheckLines = 4096
+	// parallelThreshold is the payload size from which enrichment is split
+	// across workers; smaller payloads are not worth the coordination.
+	parallelThreshold = 1 << 20
+	// chunksPerWorker splits parallel payloads finer than the worker count, so
+	// chunks can be written out while later ones are still being enriched.
+	chunksPerWorker = 4
+)
+
+var labelDefaultFallbacks = selfmetrics.NewCounterVec(
+	"addlabel_label_default_fallback_total",
+	"Enriched label values taken from LABEL_DEFAULTS because the source metadata lacked the key, by ADD_LABELS entry.",
+	"label",
+)
+
+var enrichLines = selfmetrics.NewGaugeVec(
+	"addlabel_enrich_lines",
+	"Sample lines seen by label enrichment in the last collection cycle, by kind: processed, enriched (changed) or skipped (no namespace label).",
+	"kind",
 )
 
+// EnrichStats counts the sample lines handled by one AddLabelsToMetrics call.
+type EnrichStats struct {
+	// Processed is the number of sample lines, excluding comments and blanks.
+	Processed int
+	// Enriched is the number of sample lines that gained or changed a label.
+	Enriched int
+	// Skipped is the number of sample lines without the namespace label that
+	// ADD_LABELS enrichment needs.
+	Skipped int
+}
+
+func (s *EnrichStats) add(other EnrichStats) {
+	s.Processed += other.Processed
+	s.Enriched += other.Enriched
+	s.Skipped += other.Skipped
+}
+
+// publish exposes the stats on the self-metrics endpoint.
+func (s EnrichStats) publish() {
+	enrichLines.Set(float64(s.Processed), "processed")
+	enrichLines.Set(float64(s.Enriched), "enriched")
+	enrichLines.Set(float64(s.Skipped), "skipped")
+}
+
 var (
 	namespacePattern = regexp.MustCompile(`namespace="([^"]+)"`)
 	podPattern       = regexp.MustCompile(`pod="([^"]+)"`)
@@ -12,89 +73,557 @@ var (
 
 // LabelProcessor enriches Prometheus metrics with additional labels sourced
 // from pod metadata or default value fallbacks.
-type LabelProcessor struct{}
+type LabelProcessor struct {
+	enrichPrefixes []string
+	enrichPatterns []*regexp.Regexp
+	// constantNames holds the ConstantLabels keys in sorted order so every
+	// line receives them in the same sequence.
+	constantNames  []string
+	constantLabels map[string]string
+	collision      string
+	rules          []namespaceRule
+	dropLabels     map[string]struct{}
+	annotateSource bool
+	maxValueLen    int
+	sortLabels     bool
+	emptyMode      string
+	emptyValue     string
+}
+
+// ProcessorOptions configures which lines a LabelProcessor enriches.
+type ProcessorOptions struct {
+	// EnrichPrefixes restricts enrichment to metric names starting with one of
+	// the prefixes; every metric is enriched when it is empty. Entries with a
+	// leading "~" are regular expressions that must match the whole name.
+	EnrichPrefixes []string
+	// ConstantLabels are added to every sample line, with or without pod
+	// labels.
+	ConstantLabels map[string]string
+	// DropLabels are removed from every sample line after enrichment, so
+	// labels such as pod remain available for the lookups.
+	DropLabels []string
+	// NamespaceRules select a different ADD_LABELS list per namespace; the
+	// first matching rule wins and lines matching none use ADD_LABELS.
+	NamespaceRules []NamespaceRule
+	// CollisionStrategy decides what happens when a line already carries a
+	// label that enrichment would add: CollisionSkip (the default),
+	// CollisionPrefix or CollisionOverwrite.
+	CollisionStrategy string
+	// AnnotateSource adds "<name>_source" next to every ADD_LABELS label,
+	// set to the metadata source the value came from, "default" or "empty".
+	AnnotateSource bool
+	// MaxLabelValueLen truncates ADD_LABELS values longer than this many
+	// characters, ending them with "…"; zero keeps values whole.
+	MaxLabelValueLen int
+	// SortLabels re-serializes every sample line with its labels in name
+	// order, as the last enrichment step.
+	SortLabels bool
+	// EmptyMode decides what happens to ADD_LABELS entries that neither the
+	// metadata nor LABEL_DEFAULTS resolve: EmptySkip (also used when empty)
+	// leaves the label out, EmptyBlank writes it with an empty value and
+	// EmptyPlaceholder writes EmptyValue, so every enriched series carries
+	// the same label set.
+	EmptyMode  string
+	EmptyValue string
+}
 
 // NewLabelProcessor returns a ready-to-use LabelProcessor.
-func NewLabelProcessor() *LabelProcessor {
-	return &LabelProcessor{}
+func NewLabelProcessor(opts ProcessorOptions) *LabelProcessor {
+	names := make([]string, 0, len(opts.ConstantLabels))
+	for name := range opts.ConstantLabels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	prefixes, patterns, err := compileMetricMatchers(opts.EnrichPrefixes)
+	if err != nil {
+		// Config.Validate rejects invalid patterns, so this only affects
+		// callers that skipped validation.
+		klog.ErrorS(err, "ignoring invalid ENRICH_METRIC_PREFIXES pattern")
+	}
+
+	rules := make([]namespaceRule, 0, len(opts.NamespaceRules))
+	for _, rule := range opts.NamespaceRules {
+		rules = append(rules, namespaceRule{
+			patterns: rule.Namespaces,
+			targets:  parseLabelTargets(rule.AddLabels),
+		})
+	}
+
+	var drop map[string]struct{}
+	if len(opts.DropLabels) > 0 {
+		drop = make(map[string]struct{}, len(opts.DropLabels))
+		for _, name := range opts.DropLabels {
+			drop[name] = struct{}{}
+		}
+	}
+
+	return &LabelProcessor{
+		enrichPrefixes: prefixes,
+		enrichPatterns: patterns,
+		constantNames:  names,
+		constantLabels: opts.ConstantLabels,
+		collision:      opts.CollisionStrategy,
+		rules:          rules,
+		dropLabels:     drop,
+		annotateSource: opts.AnnotateSource,
+		maxValueLen:    opts.MaxLabelValueLen,
+		sortLabels:     opts.SortLabels,
+		emptyMode:      opts.EmptyMode,
+		emptyValue:     opts.EmptyValue,
+	}
+}
+
+// Enabled reports whether AddLabelsToMetrics would change a payload enriched
+// with addLabels.
+func (lp *LabelProcessor) Enabled(addLabels string) bool {
+	return len(splitLabels(addLabels)) > 0 || len(lp.rules) > 0 || len(lp.constantNames) > 0 ||
+		len(lp.dropLabels) > 0 || lp.sortLabels
+}
+
+// sources reports which metadata sources enrichment with addLabels reads,
+// across ADD_LABELS and every namespace rule.
+func (lp *LabelProcessor) sources(addLabels string) map[labelSource]bool {
+	used := make(map[labelSource]bool)
+	for _, t := range parseLabelTargets(addLabels) {
+		used[t.source] = true
+	}
+	for _, rule := range lp.rules {
+		for _, t := range rule.targets {
+			used[t.source] = true
+		}
+	}
+	return used
+}
+
+// targetsFor returns the targets of the first rule matching namespace, or
+// the global ADD_LABELS targets when no rule matches.
+func (lp *LabelProcessor) targetsFor(namespace string, global []labelTarget) []labelTarget {
+	for _, rule := range lp.rules {
+		if rule.matches(namespace) {
+			return rule.targets
+		}
+	}
+	return global
 }
 
 // AddLabelsToMetrics walks the metrics payload and appends the requested
-// labels to lines that already contain pod and namespace labels.
+// labels to lines that already contain pod and namespace labels; entries
+// prefixed with "ns:" only need the namespace label, "anno:" entries are
+// read from pod annotations, "cr:" entries from the custom resource the
+// pod references and "container:" entries from the spec of the line's
+// container. Constant labels are appended to every sample.
+//
+// Large payloads are split at line boundaries and enriched by GOMAXPROCS
+// workers sharing resolver, which must therefore be safe for concurrent use.
+// When ctx is cancelled mid-stream the lines enriched so far are returned
+// together with the context error. The returned stats cover the lines seen.
+// Callers writing the result out should prefer EnrichTo.
 func (lp *LabelProcessor) AddLabelsToMetrics(
+	ctx context.Context,
+	metrics,
+	addLabels,
+	labelDefaults string,
+	resolver LabelResolver,
+) (string, EnrichStats, error) {
+	if !lp.Enabled(addLabels) {
+		return metrics, EnrichStats{}, nil
+	}
+
+	var builder strings.Builder
+	builder.Grow(len(metrics) + len(metrics)/4)
+	stats, err := lp.EnrichTo(ctx, &builder, metrics, addLabels, labelDefaults, resolver)
+	return builder.String(), stats, err
+}
+
+// EnrichTo is AddLabelsToMetrics writing the result to w. Enriched chunks are
+// written in order as soon as they and their predecessors are done, so at most
+// a few chunks are held in memory at once. A payload with a line too long to
+// enrich is written unchanged instead.
+func (lp *LabelProcessor) EnrichTo(
+	ctx context.Context,
+	w io.Writer,
 	metrics,
 	addLabels,
 	labelDefaults string,
-	resolvePodLabels func(namespace, podName string) map[string]string,
-) string {
-	targetLabels := splitLabels(addLabels)
-	if len(targetLabels) == 0 {
-		return metrics
+	resolver LabelResolver,
+) (EnrichStats, error) {
+	var stats EnrichStats
+	if !lp.Enabled(addLabels) {
+		_, err := io.WriteString(w, metrics)
+		return stats, err
+	}
+	// Checked up front because nothing can be taken back once the first
+	// chunk has been written.
+	if hasLongLine(metrics, maxLineSize) {
+		klog.ErrorS(nil, "label enrichment aborted: a metric line exceeds the maximum size; serving metrics without added labels", "maxBytes", maxLineSize)
+		_, err := io.WriteString(w, metrics)
+		return stats, err
 	}
 
+	workers := runtime.GOMAXPROCS(0)
+	chunks := []string{metrics}
+	if workers > 1 {
+		chunks = splitChunks(metrics, workers*chunksPerWorker)
+	}
+	var err error
+	if len(chunks) == 1 {
+		err = lp.enrich(ctx, strings.NewReader(metrics), w, &stats, addLabels, labelDefaults, resolver)
+	} else {
+		err = lp.enrichChunks(ctx, w, chunks, workers, &stats, addLabels, labelDefaults, resolver)
+	}
+	if err != nil && ctx.Err() != nil {
+		return stats, fmt.Errorf("label enrichment cancelled: %w", ctx.Err())
+	}
+	return stats, err
+}
+
+// enrichedChunk is the result of enriching one chunk of a payload.
+type enrichedChunk struct {
+	out   strings.Builder
+	stats EnrichStats
+	err   error
+}
+
+// enrichChunks enriches chunks with workers goroutines and writes them to w in
+// order. At most two chunks per worker are enriched ahead of the writer, which
+// bounds memory when w is slower than enrichment.
+func (lp *LabelProcessor) enrichChunks(
+	ctx context.Context,
+	w io.Writer,
+	chunks []string,
+	workers int,
+	stats *EnrichStats,
+	addLabels,
+	labelDefaults string,
+	resolver LabelResolver,
+) error {
+	results := make([]chan *enrichedChunk, len(chunks))
+	for i := range results {
+		results[i] = make(chan *enrichedChunk, 1)
+	}
+	ahead := make(chan struct{}, 2*workers)
+	stop := make(chan struct{})
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(jobs)
+		for i := range chunks {
+			select {
+			case ahead <- struct{}{}:
+			case <-stop:
+				return
+			}
+			select {
+			case jobs <- i:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				r := &enrichedChunk{}
+				r.out.Grow(len(chunks[i]) + len(chunks[i])/4)
+				r.err = lp.enrich(ctx, strings.NewReader(chunks[i]), &r.out, &r.stats, addLabels, labelDefaults, resolver)
+				results[i] <- r
+			}
+		}()
+	}
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	for i := range chunks {
+		r := <-results[i]
+		if _, err := io.WriteString(w, r.out.String()); err != nil {
+			return err
+		}
+		stats.add(r.stats)
+		if r.err != nil {
+			return r.err
+		}
+		<-ahead
+	}
+	return nil
+}
+
+// hasLongLine reports whether payload has a line, newline included, longer
+// than the enrichment scanner can hold.
+func hasLongLine(payload string, limit int) bool {
+	for len(payload) >= limit {
+		i := strings.IndexByte(payload, '\n')
+		if i == -1 || i+1 > limit {
+			return true
+		}
+		payload = payload[i+1:]
+	}
+	return false
+}
+
+// splitChunks cuts payload at line boundaries into at most n pieces of similar
+// size so they can be enriched concurrently and concatenated in order.
+// Payloads below parallelThreshold are returned whole.
+func splitChunks(payload string, n int) []string {
+	if n <= 1 || len(payload) < parallelThreshold {
+		return []string{payload}
+	}
+
+	size := len(payload) / n
+	chunks := make([]string, 0, n)
+	for len(payload) > 0 {
+		if len(chunks) == n-1 || len(payload) <= size {
+			chunks = append(chunks, payload)
+			break
+		}
+		end := strings.IndexByte(payload[size:], '\n')
+		if end == -1 {
+			chunks = append(chunks, payload)
+			break
+		}
+		end += size + 1
+		chunks = append(chunks, payload[:end])
+		payload = payload[end:]
+	}
+	return chunks
+}
+
+// enrich streams metric lines from r to w one line at a time, appending the
+// requested labels, so the payload never has to be split into a slice.
+func (lp *LabelProcessor) enrich(
+	ctx context.Context,
+	r io.Reader,
+	w io.Writer,
+	stats *EnrichStats,
+	addLabels,
+	labelDefaults string,
+	resolver LabelResolver,
+) error {
+	targets := parseLabelTargets(addLabels)
 	defaultValues := parseLabelDefaults(labelDefaults)
 
-	var builder strings.Builder
-	lines := strings.Split(metrics, "\n")
+	bw := bufio.NewWriterSize(w, scanBufferSize)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, scanBufferSize), maxLineSize)
 
-	for _, line := range lines {
-		trimmed := strings.TrimSpace(line)
-		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
-			builder.WriteString(line)
-			builder.WriteByte('\n')
-			continue
+	for lines := 1; scanner.Scan(); lines++ {
+		if lines%cancelCheckLines == 0 {
+			if err := ctx.Err(); err != nil {
+				_ = bw.Flush()
+				return err
+			}
 		}
 
-		if strings.Contains(line, "{") && strings.Contains(line, "}") {
-			line = lp.processMetricLine(line, targetLabels, defaultValues, resolvePodLabels)
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			stats.Processed++
+			original := line
+			if len(targets) > 0 || len(lp.rules) > 0 {
+				var ok bool
+				line, ok = lp.processMetricLine(line, targets, defaultValues, resolver)
+				if !ok {
+					stats.Skipped++
+				}
+			}
+			line = lp.addConstantLabels(line)
+			if lp.dropLabels != nil {
+				line = removeLabels(line, lp.dropLabels)
+			}
+			if lp.sortLabels {
+				line = sortLabels(line)
+			}
+			if line != original {
+				stats.Enriched++
+			}
 		}
 
-		builder.WriteString(line)
-		builder.WriteByte('\n')
+		if _, err := bw.WriteString(line); err != nil {
+			return err
+		}
+		if err := bw.WriteByte('\n'); err != nil {
+			return err
+		}
 	}
 
-	return builder.String()
+	if err := scanner.Err(); err != nil {
+		_ = bw.Flush()
+		return fmt.Errorf("scan metrics: %w", err)
+	}
+	return bw.Flush()
 }
 
+// processMetricLine adds the ADD_LABELS targets to a sample line. It reports
+// false when the line was skipped for lacking a namespace label.
 func (lp *LabelProcessor) processMetricLine(
 	line string,
-	targetLabels []string,
+	targets []labelTarget,
 	defaultValues map[string]string,
-	resolvePodLabels func(namespace, podName string) map[string]string,
-) string {
+	resolver LabelResolver,
+) (string, bool) {
+	if !lp.shouldEnrich(sampleMetricName(line)) {
+		return line, true
+	}
+
 	namespace, podName := extractNamespaceAndPod(line)
-	if namespace == "" || podName == "" {
-		return line
+	if namespace == "" {
+		return line, false
 	}
+	targets = lp.targetsFor(namespace, targets)
 
-	podLabels := resolvePodLabels(namespace, podName)
+	var podLabels, podAnnotations, namespaceLabels, crLabels, containerFields map[string]string
+	podResolved, annotationsResolved, namespaceResolved, crResolved, containerResolved := false, false, false, false, false
 	mutated := line
 
-	for _, label := range targetLabels {
-		if strings.Contains(mutated, label+"=") {
+	for _, target := range targets {
+		name := target.name
+		if lp.collision != CollisionOverwrite && lp.collision != CollisionPrefix && hasLabel(mutated, name) {
 			continue
 		}
 
-		value := labelValue(label, podLabels, defaultValues)
+		var source map[string]string
+		switch target.source {
+		case sourceNamespaceLabel:
+			if !namespaceResolved {
+				namespaceLabels = resolver.NamespaceLabels(namespace)
+				namespaceResolved = true
+			}
+			source = namespaceLabels
+		case sourcePodAnnotation:
+			if podName == "" {
+				continue
+			}
+			if !annotationsResolved {
+				podAnnotations = resolver.PodAnnotations(namespace, podName)
+				annotationsResolved = true
+			}
+			source = podAnnotations
+		case sourceCustomResource:
+			if podName == "" {
+				continue
+			}
+			if !crResolved {
+				crLabels = resolver.CustomResourceLabels(namespace, podName)
+				crResolved = true
+			}
+			source = crLabels
+		case sourceContainer:
+			// Pod- and node-level cgroup series carry no container label;
+			// they fall back to defaults like any unresolved lookup.
+			if podName == "" {
+				continue
+			}
+			if !containerResolved {
+				if container := extractContainer(line); container != "" {
+					containerFields = resolver.ContainerMetadata(namespace, podName, container)
+				}
+				containerResolved = true
+			}
+			source = containerFields
+		default:
+			if podName == "" {
+				continue
+			}
+			if !podResolved {
+				podLabels = resolver.PodLabels(namespace, podName)
+				podResolved = true
+			}
+			source = podLabels
+		}
+
+		value, fromDefault := labelValue(target, source, defaultValues, namespace)
+		origin := target.source.String()
 		if value == "" {
-			continue
+			switch lp.emptyMode {
+			case EmptyBlank:
+				origin = "empty"
+			case EmptyPlaceholder:
+				value, origin = lp.emptyValue, "empty"
+			default:
+				continue
+			}
+		} else if fromDefault {
+			origin = "default"
+		}
+		if fromDefault {
+			labelDefaultFallbacks.Inc(target.key)
+			klog.V(5).InfoS("label resolved from defaults", "label", target.key, "namespace", namespace, "pod", podName)
 		}
 
-		pos := strings.LastIndex(mutated, "}")
-		if pos == -1 {
-			continue
+		mutated = setLabel(mutated, name, truncateLabelValue(value, lp.maxValueLen), lp.collision)
+		if lp.annotateSource {
+			mutated = setLabel(mutated, name+labelSourceSuffix, origin, lp.collision)
 		}
+	}
 
-		head := mutated[:pos]
-		tail := mutated[pos+1:]
-		separator := ""
-		if len(tail) > 0 && tail[0] != ' ' && tail[0] != '\t' {
-			separator = " "
+	return mutated, true
+}
+
+// addConstantLabels sets every constant label on the line, resolving existing
+// labels of the same name with the collision strategy.
+func (lp *LabelProcessor) addConstantLabels(line string) string {
+	for _, name := range lp.constantNames {
+		line = setLabel(line, name, lp.constantLabels[name], lp.collision)
+	}
+	return line
+}
+
+// shouldEnrich reports whether the metric family passes the enrichment allowlist.
+func (lp *LabelProcessor) shouldEnrich(metricName string) bool {
+	if len(lp.enrichPrefixes) == 0 && len(lp.enrichPatterns) == 0 {
+		return true
+	}
+	for _, prefix := range lp.enrichPrefixes {
+		if strings.HasPrefix(metricName, prefix) {
+			return true
+		}
+	}
+	for _, pattern := range lp.enrichPatterns {
+		if pattern.MatchString(metricName) {
+			return true
 		}
-		mutated = head + `,` + label + `="` + escapeLabelValue(value) + `"}` + separator + tail
 	}
+	return false
+}
 
-	return mutated
+// ValidateMetricMatchers reports the first "~" entry that is not a valid
+// regular expression.
+func ValidateMetricMatchers(entries []string) error {
+	_, _, err := compileMetricMatchers(entries)
+	return err
+}
+
+// compileMetricMatchers separates literal prefixes from "~" regular
+// expressions, anchoring each expression to the whole metric name. Invalid
+// expressions are skipped and reported.
+func compileMetricMatchers(entries []string) (prefixes []string, patterns []*regexp.Regexp, err error) {
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		expr, isPattern := strings.CutPrefix(entry, "~")
+		if !isPattern {
+			prefixes = append(prefixes, entry)
+			continue
+		}
+		re, compileErr := regexp.Compile("^(?:" + expr + ")$")
+		if compileErr != nil {
+			if err == nil {
+				err = fmt.Errorf("metric pattern %q: %w", entry, compileErr)
+			}
+			continue
+		}
+		patterns = append(patterns, re)
+	}
+	return prefixes, patterns, err
 }
 
 func extractNamespaceAndPod(line string) (namespace, pod string) {
@@ -107,6 +636,22 @@ func extractNamespaceAndPod(line string) (namespace, pod string) {
 	return
 }
 
+// extractContainer returns the container label of a line, or "" when it has
+// none or it is empty. Only a label named exactly container counts, so
+// lookalikes such as kube_container are not mistaken for it.
+func extractContainer(line string) string {
+	start, end := labelBlockBounds(line)
+	if start == -1 {
+		return ""
+	}
+	for _, pair := range parseLabelPairs(line[start+1 : end]) {
+		if pair.name == "container" {
+			return pair.value
+		}
+	}
+	return ""
+}
+
 func splitLabels(labels string) []string {
 	if labels == "" {
 		return nil
@@ -136,7 +681,7 @@ func parseLabelDefaults(defaults string) map[string]string {
 		}
 
 		if !strings.Contains(pair, "=") {
-			defaultMap["__global__"] = pair
+			defaultMap["__global__"] = expandDefault(pair)
 			continue
 		}
 
@@ -148,23 +693,46 @@ func parseLabelDefaults(defaults string) map[string]string {
 		}
 
 		if key != "" {
-			defaultMap[key] = value
+			defaultMap[key] = expandDefault(value)
 		}
 	}
 
 	return defaultMap
 }
 
-func labelValue(label string, podLabels map[string]string, defaults map[string]string) string {
-	if podLabels != nil {
-		if value := strings.TrimSpace(podLabels[label]); value != "" {
-			return value
+// expandDefault substitutes $VAR and ${VAR} references in a LABEL_DEFAULTS
+// value from the environment. Unset variables expand to the empty string and
+// "$$" yields a literal "$".
+func expandDefault(value string) string {
+	if !strings.Contains(value, "$") {
+		return value
+	}
+	return os.Expand(value, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		return os.Getenv(name)
+	})
+}
+
+// labelValue resolves a target against its source metadata, falling back to a
+// namespace-scoped default ("<namespace>/<key>=value"), then the key default,
+// then the global default. fromDefault reports whether a default was used.
+func labelValue(target labelTarget, sourceLabels map[string]string, defaults map[string]string, namespace string) (value string, fromDefault bool) {
+	if sourceLabels != nil {
+		if value := strings.TrimSpace(sourceLabels[target.sourceKey]); value != "" {
+			return value, false
 		}
 	}
 
-	if value := strings.TrimSpace(defaults[label]); value != "" {
-		return value
+	if value := strings.TrimSpace(defaults[namespace+"/"+target.key]); value != "" {
+		return value, true
+	}
+
+	if value := strings.TrimSpace(defaults[target.key]); value != "" {
+		return value, true
 	}
 
-	return strings.TrimSpace(defaults["__global__"])
+	value = strings.TrimSpace(defaults["__global__"])
+	return value, value != ""
 }
@@ -0,0 +1,683 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/puzhihao/kubelet-cadvisor-addlabel/internal/selfmetrics"
+)
+
+// fakeResolver answers lookups from fixed maps keyed like the cache.
+type fakeResolver struct {
+	pods        map[string]map[string]string
+	namespaces  map[string]map[string]string
+	annotations map[string]map[string]string
+	crs         map[string]map[string]string
+	containers  map[string]map[string]string
+}
+
+func (r fakeResolver) PodLabels(namespace, podName string) map[string]string {
+	return r.pods[cacheKey(namespace, podName)]
+}
+
+func (r fakeResolver) NamespaceLabels(namespace string) map[string]string {
+	return r.namespaces[namespace]
+}
+
+func (r fakeResolver) PodAnnotations(namespace, podName string) map[string]string {
+	return r.annotations[cacheKey(namespace, podName)]
+}
+
+func (r fakeResolver) CustomResourceLabels(namespace, podName string) map[string]string {
+	return r.crs[cacheKey(namespace, podName)]
+}
+
+func (r fakeResolver) ContainerMetadata(namespace, podName, container string) map[string]string {
+	return r.containers[cacheKey(namespace, podName)+"/"+container]
+}
+
+func enrich(t *testing.T, opts ProcessorOptions, line, addLabels, labelDefaults string, resolver LabelResolver) string {
+	t.Helper()
+	out, _, err := NewLabelProcessor(opts).AddLabelsToMetrics(context.Background(), line, addLabels, labelDefaults, resolver)
+	if err != nil {
+		t.Fatalf("AddLabelsToMetrics: %v", err)
+	}
+	return strings.TrimSuffix(out, "\n")
+}
+
+func TestEmptyModes(t *testing.T) {
+	const line = `container_cpu_usage_seconds_total{namespace="default",pod="web-0"} 1`
+	resolver := fakeResolver{pods: map[string]map[string]string{"default/web-0": {"app": "web"}}}
+
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{EmptySkip, `container_cpu_usage_seconds_total{namespace="default",pod="web-0",app="web"} 1`},
+		{"", `container_cpu_usage_seconds_total{namespace="default",pod="web-0",app="web"} 1`},
+		{EmptyBlank, `container_cpu_usage_seconds_total{namespace="default",pod="web-0",app="web",team=""} 1`},
+		{EmptyPlaceholder, `container_cpu_usage_seconds_total{namespace="default",pod="web-0",app="web",team="unknown"} 1`},
+	}
+	for _, tt := range tests {
+		opts := ProcessorOptions{EmptyMode: tt.mode, EmptyValue: "unknown"}
+		if got := enrich(t, opts, line, "app,team", "", resolver); got != tt.want {
+			t.Errorf("mode %q:\n got %s\nwant %s", tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestEmptyModeSourceAnnotation(t *testing.T) {
+	const line = `container_memory_usage_bytes{namespace="default",pod="web-0"} 1`
+	opts := ProcessorOptions{EmptyMode: EmptyPlaceholder, EmptyValue: "none", AnnotateSource: true}
+
+	got := enrich(t, opts, line, "team", "", fakeResolver{})
+	want := `container_memory_usage_bytes{namespace="default",pod="web-0",team="none",team_source="empty"} 1`
+	if got != want {
+		t.Errorf("\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestDefaultsTakePrecedenceOverEmptyMode(t *testing.T) {
+	const line = `container_memory_usage_bytes{namespace="default",pod="web-0"} 1`
+	opts := ProcessorOptions{EmptyMode: EmptyPlaceholder, EmptyValue: "none"}
+
+	got := enrich(t, opts, line, "team", "team=platform", fakeResolver{})
+	want := `container_memory_usage_bytes{namespace="default",pod="web-0",team="platform"} 1`
+	if got != want {
+		t.Errorf("\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestExtractContainer(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{`m{namespace="ns",pod="p",container="app"} 1`, "app"},
+		{`m{kube_container="sidecar",container="app"} 1`, "app"},
+		{`m{kube_container="sidecar"} 1`, ""},
+		{`m{container_name="app"} 1`, ""},
+		{`m{container=""} 1`, ""},
+		{`m{label="container=\"x\""} 1`, ""},
+		{`m 1`, ""},
+	}
+	for _, tt := range tests {
+		if got := extractContainer(tt.line); got != tt.want {
+			t.Errorf("extractContainer(%s) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+// syntheticPayload returns a cAdvisor-like payload of at least size bytes
+// spread over pods pods, together with a resolver that knows all of them.
+func syntheticPayload(size, pods int) (string, fakeResolver) {
+	resolver := fakeResolver{pods: make(map[string]map[string]string, pods)}
+	for i := range pods {
+		resolver.pods[cacheKey(fmt.Sprintf("ns-%d", i%10), fmt.Sprintf("pod-%d", i))] = map[string]string{
+			"app":  fmt.Sprintf("app-%d", i%50),
+			"team": "platform",
+		}
+	}
+
+	var b strings.Builder
+	b.Grow(size + 256)
+	b.WriteString("# HELP container_cpu_usage_seconds_total Cumulative cpu time consumed in seconds.\n")
+	b.WriteString("# TYPE container_cpu_usage_seconds_total counter\n")
+	for i := 0; b.Len() < size; i++ {
+		pod := i % pods
+		fmt.Fprintf(&b, "container_cpu_usage_seconds_total{container=\"app\",cpu=\"cpu%d\",id=\"/kubepods/pod%d\",namespace=\"ns-%d\",pod=\"pod-%d\"} %d.25 1700000000000\n",
+			i%64, pod, pod%10, pod, i)
+	}
+	return b.String(), resolver
+}
+
+// enrichBySplitting is the pre-streaming implementation, which split the
+// whole payload into a slice of lines; it is kept as a benchmark baseline.
+func enrichBySplitting(lp *LabelProcessor, payload, addLabels string, resolver LabelResolver) string {
+	targets := parseLabelTargets(addLabels)
+	defaults := parseLabelDefaults("")
+	var b strings.Builder
+	for _, line := range strings.Split(payload, "\n") {
+		if trimmed := strings.TrimSpace(line); trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			line, _ = lp.processMetricLine(line, targets, defaults, resolver)
+		}
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+func BenchmarkEnrichStreaming(b *testing.B) {
+	payload, resolver := syntheticPayload(4<<20, 2000)
+	lp := NewLabelProcessor(ProcessorOptions{})
+
+	b.Run("split", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(payload)))
+		for b.Loop() {
+			_ = enrichBySplitting(lp, payload, "app,team", resolver)
+		}
+	})
+	b.Run("stream", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(payload)))
+		for b.Loop() {
+			var stats EnrichStats
+			if err := lp.enrich(context.Background(), strings.NewReader(payload), io.Discard, &stats, "app,team", "", resolver); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkEnrichParallel(b *testing.B) {
+	payload, resolver := syntheticPayload(5<<20, 2000)
+	lp := NewLabelProcessor(ProcessorOptions{})
+
+	b.Run("serial", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(payload)))
+		for b.Loop() {
+			var out strings.Builder
+			var stats EnrichStats
+			if err := lp.enrich(context.Background(), strings.NewReader(payload), &out, &stats, "app,team", "", resolver); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(payload)))
+		for b.Loop() {
+			if _, _, err := lp.AddLabelsToMetrics(context.Background(), payload, "app,team", "", resolver); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// countingSink records how many writes a payload arrived in.
+type countingSink struct {
+	b      strings.Builder
+	writes int
+}
+
+func (s *countingSink) Write(p []byte) (int, error) {
+	s.writes++
+	return s.b.Write(p)
+}
+
+func TestEnrichToStreamsChunksInOrder(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	payload, resolver := syntheticPayload(3<<20, 500)
+	lp := NewLabelProcessor(ProcessorOptions{})
+
+	var serial strings.Builder
+	var serialStats EnrichStats
+	if err := lp.enrich(context.Background(), strings.NewReader(payload), &serial, &serialStats, "app", "", resolver); err != nil {
+		t.Fatal(err)
+	}
+
+	var sink countingSink
+	stats, err := lp.EnrichTo(context.Background(), &sink, payload, "app", "", resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sink.b.String() != serial.String() {
+		t.Error("parallel output differs from serial enrichment")
+	}
+	if stats != serialStats {
+		t.Errorf("stats = %+v, want %+v", stats, serialStats)
+	}
+	if sink.writes < 4*chunksPerWorker {
+		t.Errorf("payload arrived in %d writes, want one per chunk", sink.writes)
+	}
+}
+
+func TestEnrichToStopsOnWriteError(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	payload, resolver := syntheticPayload(2<<20, 100)
+
+	_, err := NewLabelProcessor(ProcessorOptions{}).EnrichTo(context.Background(), errWriter{}, payload, "app", "", resolver)
+	if !errors.Is(err, errSinkClosed) {
+		t.Errorf("EnrichTo error = %v, want %v", err, errSinkClosed)
+	}
+}
+
+var errSinkClosed = errors.New("sink closed")
+
+type errWriter struct{}
+
+func (errWriter) Write([]byte) (int, error) { return 0, errSinkClosed }
+
+func TestEnrichToLongLineServesOriginal(t *testing.T) {
+	payload := `m{namespace="default",pod="web-0",id="` + strings.Repeat("x", maxLineSize) + `"} 1` + "\n"
+	var out strings.Builder
+	if _, err := NewLabelProcessor(ProcessorOptions{}).EnrichTo(context.Background(), &out, payload, "app", "", fakeResolver{}); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != payload {
+		t.Error("payload with an oversized line was not served unchanged")
+	}
+}
+
+func TestHasLongLine(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    bool
+	}{
+		{"", false},
+		{"abc\nde\n", false},
+		{"abcd\nde\n", false},
+		{"abcde\nd\n", true},
+		{"ab\nabcdef", true},
+		{"ab\nabc", false},
+	}
+	for _, tt := range tests {
+		if got := hasLongLine(tt.payload, 5); got != tt.want {
+			t.Errorf("hasLongLine(%q, 5) = %v, want %v", tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestEnrichPrefixes(t *testing.T) {
+	resolver := fakeResolver{pods: map[string]map[string]string{"default/web-0": {"app": "web"}}}
+	tests := []struct {
+		name     string
+		prefixes []string
+		line     string
+		want     string
+	}{
+		{"matching family", []string{"container_cpu_", "container_memory_working_set_bytes"},
+			`container_cpu_usage_seconds_total{namespace="default",pod="web-0"} 1`,
+			`container_cpu_usage_seconds_total{namespace="default",pod="web-0",app="web"} 1`},
+		{"exact name", []string{"container_cpu_", "container_memory_working_set_bytes"},
+			`container_memory_working_set_bytes{namespace="default",pod="web-0"} 1`,
+			`container_memory_working_set_bytes{namespace="default",pod="web-0",app="web"} 1`},
+		{"other family unchanged", []string{"container_cpu_"},
+			`container_network_receive_bytes_total{namespace="default",pod="web-0"} 1`,
+			`container_network_receive_bytes_total{namespace="default",pod="web-0"} 1`},
+		{"empty list enriches everything", nil,
+			`container_network_receive_bytes_total{namespace="default",pod="web-0"} 1`,
+			`container_network_receive_bytes_total{namespace="default",pod="web-0",app="web"} 1`},
+	}
+	for _, tt := range tests {
+		if got := enrich(t, ProcessorOptions{EnrichPrefixes: tt.prefixes}, tt.line, "app", "", resolver); got != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNamespaceLabelSource(t *testing.T) {
+	resolver := fakeResolver{
+		pods:       map[string]map[string]string{"payments/api-0": {"app": "api"}},
+		namespaces: map[string]map[string]string{"payments": {"team": "billing"}},
+	}
+	tests := []struct {
+		name     string
+		line     string
+		defaults string
+		want     string
+	}{
+		{"cached namespace", `container_memory_usage_bytes{namespace="payments",pod="api-0"} 1`, "",
+			`container_memory_usage_bytes{namespace="payments",pod="api-0",team="billing"} 1`},
+		{"uncached namespace falls back", `container_memory_usage_bytes{namespace="other",pod="x-0"} 1`, "ns:team=unowned",
+			`container_memory_usage_bytes{namespace="other",pod="x-0",team="unowned"} 1`},
+		{"node-level series untouched", `machine_memory_bytes 1`, "unowned", `machine_memory_bytes 1`},
+	}
+	for _, tt := range tests {
+		if got := enrich(t, ProcessorOptions{}, tt.line, "ns:team", tt.defaults, resolver); got != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPodAnnotationSource(t *testing.T) {
+	resolver := fakeResolver{
+		pods:        map[string]map[string]string{"default/web-0": {"app": "web"}, "default/web-1": {"app": "web"}},
+		annotations: map[string]map[string]string{"default/web-0": {"example.com/owner": "alice"}},
+	}
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{"annotation present", `container_memory_usage_bytes{namespace="default",pod="web-0"} 1`,
+			`container_memory_usage_bytes{namespace="default",pod="web-0",app="web",example_com_owner="alice"} 1`},
+		{"annotation missing", `container_memory_usage_bytes{namespace="default",pod="web-1"} 1`,
+			`container_memory_usage_bytes{namespace="default",pod="web-1",app="web",example_com_owner="nobody"} 1`},
+	}
+	for _, tt := range tests {
+		got := enrich(t, ProcessorOptions{}, tt.line, "app,anno:example.com/owner", "anno:example.com/owner=nobody", resolver)
+		if got != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestConstantLabels(t *testing.T) {
+	opts := ProcessorOptions{ConstantLabels: map[string]string{"cluster": "prod-east", "region": "eu"}}
+	tests := []struct {
+		name      string
+		line      string
+		addLabels string
+		want      string
+	}{
+		{"node-level series", `machine_cpu_cores 4`, "",
+			`machine_cpu_cores{cluster="prod-east",region="eu"} 4`},
+		{"pod series without ADD_LABELS", `container_cpu_usage_seconds_total{namespace="default",pod="web-0"} 1`, "",
+			`container_cpu_usage_seconds_total{namespace="default",pod="web-0",cluster="prod-east",region="eu"} 1`},
+		{"existing label kept", `up{cluster="staging"} 1`, "app",
+			`up{cluster="staging",region="eu"} 1`},
+	}
+	for _, tt := range tests {
+		if got := enrich(t, opts, tt.line, tt.addLabels, "", fakeResolver{}); got != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseLabelDefaultsNamespaceScoped(t *testing.T) {
+	got := parseLabelDefaults("none, team=unknown, kube-system/team=platform")
+	want := map[string]string{
+		"__global__":       "none",
+		"team":             "unknown",
+		"kube-system/team": "platform",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseLabelDefaults = %v, want %v", got, want)
+	}
+}
+
+func TestLabelDefaultsPrecedence(t *testing.T) {
+	resolver := fakeResolver{pods: map[string]map[string]string{
+		"kube-system/dns-0": {},
+		"default/web-0":     {},
+		"prod/api-0":        {"team": "payments"},
+	}}
+	tests := []struct {
+		name     string
+		line     string
+		defaults string
+		want     string
+	}{
+		{"namespace default", `up{namespace="kube-system",pod="dns-0"} 1`, "none,team=unknown,kube-system/team=platform",
+			`up{namespace="kube-system",pod="dns-0",team="platform"} 1`},
+		{"key default", `up{namespace="default",pod="web-0"} 1`, "none,team=unknown,kube-system/team=platform",
+			`up{namespace="default",pod="web-0",team="unknown"} 1`},
+		{"global default", `up{namespace="default",pod="web-0"} 1`, "none,kube-system/team=platform",
+			`up{namespace="default",pod="web-0",team="none"} 1`},
+		{"pod label wins", `up{namespace="prod",pod="api-0"} 1`, "none,team=unknown,prod/team=platform",
+			`up{namespace="prod",pod="api-0",team="payments"} 1`},
+		{"no default", `up{namespace="default",pod="web-0"} 1`, "kube-system/team=platform",
+			`up{namespace="default",pod="web-0"} 1`},
+	}
+	for _, tt := range tests {
+		if got := enrich(t, ProcessorOptions{}, tt.line, "team", tt.defaults, resolver); got != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLabelDefaultFallbackCounter(t *testing.T) {
+	resolver := fakeResolver{pods: map[string]map[string]string{
+		"default/web-0": {"app": "web", "owner": "alice"},
+		"default/web-1": {"app": "web"},
+	}}
+	const addLabels, defaults = "app,owner", "owner=nobody"
+	before, appBefore := labelDefaultFallbacks.Value("owner"), labelDefaultFallbacks.Value("app")
+
+	enrich(t, ProcessorOptions{}, `up{namespace="default",pod="web-0"} 1`, addLabels, defaults, resolver)
+	if got := labelDefaultFallbacks.Value("owner") - before; got != 0 {
+		t.Errorf("fallbacks after resolved label = %v, want 0", got)
+	}
+	enrich(t, ProcessorOptions{}, `up{namespace="default",pod="web-1"} 1`, addLabels, defaults, resolver)
+	if got := labelDefaultFallbacks.Value("owner") - before; got != 1 {
+		t.Errorf("fallbacks after missing label = %v, want 1", got)
+	}
+	if got := labelDefaultFallbacks.Value("app") - appBefore; got != 0 {
+		t.Errorf("app fallbacks = %v, want 0", got)
+	}
+	if rendered := selfmetrics.Render(); !strings.Contains(rendered, `addlabel_label_default_fallback_total{label="owner"}`) {
+		t.Errorf("self-metrics lack the fallback counter:\n%s", rendered)
+	}
+}
+
+// cancellingResolver cancels its context once after lookups calls.
+type cancellingResolver struct {
+	fakeResolver
+	lookups *atomic.Int64
+	after   int64
+	cancel  context.CancelFunc
+}
+
+func (r cancellingResolver) PodLabels(namespace, podName string) map[string]string {
+	if r.lookups.Add(1) == r.after {
+		r.cancel()
+	}
+	return r.fakeResolver.PodLabels(namespace, podName)
+}
+
+func TestAddLabelsToMetricsCancelledMidStream(t *testing.T) {
+	payload, resolver := syntheticPayload(8<<20, 200)
+	lp := NewLabelProcessor(ProcessorOptions{})
+
+	full, _, err := lp.AddLabelsToMetrics(context.Background(), payload, "app", "", resolver)
+	if err != nil {
+		t.Fatalf("uncancelled enrichment: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cancelling := cancellingResolver{fakeResolver: resolver, lookups: new(atomic.Int64), after: 1000, cancel: cancel}
+	start := time.Now()
+	partial, stats, err := lp.AddLabelsToMetrics(ctx, payload, "app", "", cancelling)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("cancelled enrichment took %v", elapsed)
+	}
+	if len(partial) >= len(full) {
+		t.Errorf("partial result is %d bytes, full result %d; want a shorter partial result", len(partial), len(full))
+	}
+	if total := int64(strings.Count(payload, "\n")); stats.Processed >= int(total) {
+		t.Errorf("processed %d of %d lines after cancellation", stats.Processed, total)
+	}
+}
+
+func TestEnrichPrefixPatterns(t *testing.T) {
+	resolver := fakeResolver{pods: map[string]map[string]string{"default/web-0": {"app": "web"}}}
+	opts := ProcessorOptions{EnrichPrefixes: []string{"~container_(cpu|memory)_.*", "machine_"}}
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{"cpu family", `container_cpu_usage_seconds_total{namespace="default",pod="web-0"} 1`,
+			`container_cpu_usage_seconds_total{namespace="default",pod="web-0",app="web"} 1`},
+		{"memory family", `container_memory_rss{namespace="default",pod="web-0"} 1`,
+			`container_memory_rss{namespace="default",pod="web-0",app="web"} 1`},
+		{"network family rejected", `container_network_receive_bytes_total{namespace="default",pod="web-0"} 1`,
+			`container_network_receive_bytes_total{namespace="default",pod="web-0"} 1`},
+		{"pattern anchored", `x_container_cpu_usage_seconds_total{namespace="default",pod="web-0"} 1`,
+			`x_container_cpu_usage_seconds_total{namespace="default",pod="web-0"} 1`},
+		{"literal prefix", `machine_cpu_cores{namespace="default",pod="web-0"} 1`,
+			`machine_cpu_cores{namespace="default",pod="web-0",app="web"} 1`},
+	}
+	for _, tt := range tests {
+		if got := enrich(t, opts, tt.line, "app", "", resolver); got != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateMetricMatchers(t *testing.T) {
+	if err := ValidateMetricMatchers([]string{"container_", "~container_(cpu|memory)_.*", ""}); err != nil {
+		t.Errorf("valid matchers rejected: %v", err)
+	}
+	if err := ValidateMetricMatchers([]string{"container_", "~container_(cpu"}); err == nil {
+		t.Error("invalid pattern accepted")
+	}
+}
+
+func TestCollisionStrategies(t *testing.T) {
+	const line = `m{namespace="default",pod="web-0",app="old",cluster="old"} 1`
+	resolver := fakeResolver{pods: map[string]map[string]string{"default/web-0": {"app": "web"}}}
+	tests := []struct {
+		strategy string
+		want     string
+	}{
+		{CollisionSkip, line},
+		{CollisionOverwrite, `m{namespace="default",pod="web-0",app="web",cluster="prod"} 1`},
+		{CollisionPrefix, `m{namespace="default",pod="web-0",exported_app="old",exported_cluster="old",app="web",cluster="prod"} 1`},
+	}
+	for _, tt := range tests {
+		opts := ProcessorOptions{CollisionStrategy: tt.strategy, ConstantLabels: map[string]string{"cluster": "prod"}}
+		if got := enrich(t, opts, line, "app", "", resolver); got != tt.want {
+			t.Errorf("strategy %q:\n got %s\nwant %s", tt.strategy, got, tt.want)
+		}
+	}
+}
+
+func TestEnrichStatsMixedPayload(t *testing.T) {
+	const payload = "# TYPE up gauge\n" +
+		"\n" +
+		"machine_cpu_cores 4\n" +
+		`up{namespace="default",pod="web-0"} 1` + "\n" +
+		`up{namespace="default",pod="web-1"} 1` + "\n" +
+		`up{namespace="default",pod="gone"} 1` + "\n"
+	resolver := fakeResolver{pods: map[string]map[string]string{
+		"default/web-0": {"app": "web"},
+		"default/web-1": {"app": "web"},
+	}}
+
+	_, stats, err := NewLabelProcessor(ProcessorOptions{}).AddLabelsToMetrics(context.Background(), payload, "app", "", resolver)
+	if err != nil {
+		t.Fatalf("AddLabelsToMetrics: %v", err)
+	}
+	if want := (EnrichStats{Processed: 4, Enriched: 2, Skipped: 1}); stats != want {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+}
+
+func TestNamespaceRules(t *testing.T) {
+	resolver := fakeResolver{pods: map[string]map[string]string{
+		"team-a-prod/api-0": {"app": "api", "version": "v2", "component": "backend"},
+		"team-b/worker-0":   {"app": "worker", "version": "v1", "component": "queue"},
+		"default/web-0":     {"app": "web", "version": "v3", "component": "frontend"},
+	}}
+	opts := ProcessorOptions{NamespaceRules: []NamespaceRule{
+		{Namespaces: []string{"team-a-*"}, AddLabels: "app,version"},
+		{Namespaces: []string{"team-b", "team-c"}, AddLabels: "component"},
+	}}
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{"glob rule", `up{namespace="team-a-prod",pod="api-0"} 1`,
+			`up{namespace="team-a-prod",pod="api-0",app="api",version="v2"} 1`},
+		{"exact rule", `up{namespace="team-b",pod="worker-0"} 1`,
+			`up{namespace="team-b",pod="worker-0",component="queue"} 1`},
+		{"global fallback", `up{namespace="default",pod="web-0"} 1`,
+			`up{namespace="default",pod="web-0",app="web"} 1`},
+	}
+	for _, tt := range tests {
+		if got := enrich(t, opts, tt.line, "app", "", resolver); got != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseLabelDefaultsExpandsEnvironment(t *testing.T) {
+	t.Setenv("CLUSTER_NAME", "prod-east")
+	t.Setenv("REGION", "eu")
+	tests := []struct {
+		defaults string
+		key      string
+		want     string
+	}{
+		{"cluster=$CLUSTER_NAME", "cluster", "prod-east"},
+		{"cluster=${CLUSTER_NAME}-${REGION}", "cluster", "prod-east-eu"},
+		{"cluster=$UNSET_CLUSTER_NAME", "cluster", ""},
+		{"cost=$$5", "cost", "$5"},
+		{"team=platform", "team", "platform"},
+		{"$CLUSTER_NAME", "__global__", "prod-east"},
+	}
+	for _, tt := range tests {
+		if got := parseLabelDefaults(tt.defaults)[tt.key]; got != tt.want {
+			t.Errorf("parseLabelDefaults(%q)[%q] = %q, want %q", tt.defaults, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestDropLabels(t *testing.T) {
+	resolver := fakeResolver{pods: map[string]map[string]string{"default/web-0": {"app": "web"}}}
+	opts := ProcessorOptions{DropLabels: []string{"id", "image"}}
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{"dropped and enriched",
+			`container_cpu_usage_seconds_total{id="/kubepods/pod1",image="registry/app@sha256:abc",namespace="default",pod="web-0"} 1`,
+			`container_cpu_usage_seconds_total{namespace="default",pod="web-0",app="web"} 1`},
+		{"escaped values kept intact",
+			`container_memory_rss{name="a\",id=\"b",id="/x",namespace="default",pod="web-0"} 1`,
+			`container_memory_rss{name="a\",id=\"b",namespace="default",pod="web-0",app="web"} 1`},
+		{"lookalike label kept", `machine_info{image_id="x",idle="y"} 1`, `machine_info{image_id="x",idle="y"} 1`},
+		{"only dropped labels", `machine_info{id="/",image="x"} 1`, `machine_info 1`},
+	}
+	for _, tt := range tests {
+		if got := enrich(t, opts, tt.line, "app", "", resolver); got != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMaxLabelValueLen(t *testing.T) {
+	const line = `up{namespace="default",pod="web-0"} 1`
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"below cap", "abc", `up{namespace="default",pod="web-0",sha="abc"} 1`},
+		{"at cap", "abcdef", `up{namespace="default",pod="web-0",sha="abcdef"} 1`},
+		{"above cap", "abcdefgh", `up{namespace="default",pod="web-0",sha="abcde…"} 1`},
+		{"truncated before escaping", `a"b"cdefgh`, `up{namespace="default",pod="web-0",sha="a\"b\"c…"} 1`},
+	}
+	for _, tt := range tests {
+		resolver := fakeResolver{pods: map[string]map[string]string{"default/web-0": {"sha": tt.value}}}
+		if got := enrich(t, ProcessorOptions{MaxLabelValueLen: 6}, line, "sha", "", resolver); got != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSortLabelsAfterEnrichment(t *testing.T) {
+	resolver := fakeResolver{pods: map[string]map[string]string{"default/web-0": {"app": "web", "team": "shop"}}}
+	const line = `container_cpu_usage_seconds_total{pod="web-0",namespace="default",cpu="total"} 1`
+	tests := []struct {
+		sort bool
+		want string
+	}{
+		{false, `container_cpu_usage_seconds_total{pod="web-0",namespace="default",cpu="total",team="shop",app="web",cluster="prod"} 1`},
+		{true, `container_cpu_usage_seconds_total{app="web",cluster="prod",cpu="total",namespace="default",pod="web-0",team="shop"} 1`},
+	}
+	for _, tt := range tests {
+		opts := ProcessorOptions{SortLabels: tt.sort, ConstantLabels: map[string]string{"cluster": "prod"}}
+		if got := enrich(t, opts, line, "team,app", "", resolver); got != tt.want {
+			t.Errorf("sort=%v:\n got %s\nwant %s", tt.sort, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+)
+
+const (
+	// namespaceLabelPrefix marks an ADD_LABELS entry whose value is read from
+	// the labels of the metric's Namespace instead of its pod.
+	namespaceLabelPrefix = "ns:"
+	// podAnnotationPrefix marks an ADD_LABELS entry whose value is read from
+	// the annotations of the metric's pod.
+	podAnnotationPrefix = "anno:"
+	// customResourcePrefix marks an ADD_LABELS entry whose value is read from
+	// the labels of the custom resource object the pod references.
+	customResourcePrefix = "cr:"
+	// containerPrefix marks an ADD_LABELS entry whose value is read from the
+	// spec of the container named by the metric's container label.
+	containerPrefix = "container:"
+)
+
+// labelSource identifies the Kubernetes metadata an ADD_LABELS entry reads from.
+type labelSource int
+
+const (
+	sourcePodLabel labelSource = iota
+	sourceNamespaceLabel
+	sourcePodAnnotation
+	sourceCustomResource
+	sourceContainer
+)
+
+// labelSourceSuffix names the companion label that ANNOTATE_LABEL_SOURCE adds
+// next to every enriched label.
+const labelSourceSuffix = "_source"
+
+// String returns the value written to the companion source label.
+func (s labelSource) String() string {
+	switch s {
+	case sourceNamespaceLabel:
+		return "namespace"
+	case sourcePodAnnotation:
+		return "annotation"
+	case sourceCustomResource:
+		return "customresource"
+	case sourceContainer:
+		return "container"
+	default:
+		return "pod"
+	}
+}
+
+// labelSourcePrefixes maps ADD_LABELS prefixes to the source they select.
+var labelSourcePrefixes = []struct {
+	prefix string
+	source labelSource
+}{
+	{namespaceLabelPrefix, sourceNamespaceLabel},
+	{podAnnotationPrefix, sourcePodAnnotation},
+	{customResourcePrefix, sourceCustomResource},
+	{containerPrefix, sourceContainer},
+}
+
+// labelTarget is a parsed ADD_LABELS entry.
+type labelTarget struct {
+	// key is the entry as written, which is also its LABEL_DEFAULTS key.
+	key    string
+	source labelSource
+	// sourceKey is the metadata key looked up on the source object.
+	sourceKey string
+	// name is the Prometheus label name written to metric lines.
+	name string
+}
+
+func parseLabelTarget(entry string) labelTarget {
+	t := labelTarget{key: entry, source: sourcePodLabel, sourceKey: entry}
+	for _, p := range labelSourcePrefixes {
+		if rest, ok := strings.CutPrefix(entry, p.prefix); ok {
+			t.source = p.source
+			t.sourceKey = strings.TrimSpace(rest)
+			break
+		}
+	}
+	t.name = sanitizeLabelName(t.sourceKey)
+	return t
+}
+
+func parseLabelTargets(addLabels string) []labelTarget {
+	entries := splitLabels(addLabels)
+	if len(entries) == 0 {
+		return nil
+	}
+
+	targets := make([]labelTarget, 0, len(entries))
+	for _, entry := range entries {
+		targets = append(targets, parseLabelTarget(entry))
+	}
+	return targets
+}
+
+// NamespaceRule replaces ADD_LABELS for metric lines whose namespace matches
+// one of Namespaces, given as path.Match glob patterns.
+type NamespaceRule struct {
+	Namespaces []string
+	AddLabels  string
+}
+
+type namespaceRule struct {
+	patterns []string
+	targets  []labelTarget
+}
+
+func (r namespaceRule) matches(namespace string) bool {
+	for _, pattern := range r.patterns {
+		if ok, _ := path.Match(pattern, namespace); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// validate reports entries whose source key is missing or whose label name
+// would be reserved.
+func (t labelTarget) validate() error {
+	if t.sourceKey == "" {
+		return fmt.Errorf("label %q has no key after its prefix", t.key)
+	}
+	if strings.HasPrefix(t.name, "__") {
+		return fmt.Errorf("label %q maps to reserved label name %q", t.key, t.name)
+	}
+	if t.source == sourceContainer && !validContainerField(t.sourceKey) {
+		return fmt.Errorf("label %q: container field must be image, imagePullPolicy, requests.<resource> or limits.<resource>", t.key)
+	}
+	return nil
+}
+
+// UsesNamespaceLabels reports whether any ADD_LABELS entry reads from
+// Namespace labels, which requires watching Namespace objects.
+func UsesNamespaceLabels(addLabels string) bool {
+	return usesSource(addLabels, sourceNamespaceLabel)
+}
+
+// UsesPodAnnotations reports whether any ADD_LABELS entry reads from pod
+// annotations, which must then be cached alongside pod labels.
+func UsesPodAnnotations(addLabels string) bool {
+	return usesSource(addLabels, sourcePodAnnotation)
+}
+
+// UsesCustomResourceLabels reports whether any ADD_LABELS entry reads from
+// custom resource labels, which requires watching the configured resource.
+func UsesCustomResourceLabels(addLabels string) bool {
+	return usesSource(addLabels, sourceCustomResource)
+}
+
+func usesSource(addLabels string, source labelSource) bool {
+	for _, t := range parseLabelTargets(addLabels) {
+		if t.source == source {
+			return true
+		}
+	}
+	return false
+}
+
+// LabelResolver supplies the Kubernetes metadata used to enrich metric lines.
+// Implementations must be safe for concurrent use and must not let callers
+// mutate shared state through the returned maps; Service satisfies both by
+// reading sync.Map-backed caches and returning defensive copies.
+type LabelResolver interface {
+	// PodLabels returns the labels of a pod, or nil when it is unknown.
+	PodLabels(namespace, podName string) map[string]string
+	// NamespaceLabels returns the labels of a namespace, or nil when it is unknown.
+	NamespaceLabels(namespace string) map[string]string
+	// PodAnnotations returns the annotations of a pod, or nil when it is unknown.
+	PodAnnotations(namespace, podName string) map[string]string
+	// CustomResourceLabels returns the labels of the custom resource object a
+	// pod references, or nil when there is none.
+	CustomResourceLabels(namespace, podName string) map[string]string
+	// ContainerMetadata returns the fields of a pod's container keyed as
+	// "container:" entries name them, or nil when it is unknown.
+	ContainerMetadata(namespace, podName, container string) map[string]string
+}
+
+// memoResolver caches the answers of another resolver; it is meant to live
+// for a single Collect call so each pod and namespace is looked up once.
+// Concurrent enrichment workers share it, so the memo maps are guarded; the
+// lock is not held while the underlying resolver runs, so lookups of
+// different pods proceed in parallel.
+type memoResolver struct {
+	mu              sync.Mutex
+	resolver        LabelResolver
+	pods            map[string]map[string]string
+	namespaces      map[string]map[string]string
+	annotations     map[string]map[string]string
+	customResources map[string]map[string]string
+	containers      map[string]map[string]string
+}
+
+func memoizeResolver(resolver LabelResolver) *memoResolver {
+	return &memoResolver{
+		resolver:    resolver,
+		pods:        make(map[string]map[string]string),
+		namespaces:  make(map[string]map[string]string),
+		annotations: make(map[string]map[string]string),
+
+		customResources: make(map[string]map[string]string),
+		containers:      make(map[string]map[string]string),
+	}
+}
+
+func (m *memoResolver) PodLabels(namespace, podName string) map[string]string {
+	return m.lookup(m.pods, cacheKey(namespace, podName), func() map[string]string {
+		return m.resolver.PodLabels(namespace, podName)
+	})
+}
+
+func (m *memoResolver) PodAnnotations(namespace, podName string) map[string]string {
+	return m.lookup(m.annotations, cacheKey(namespace, podName), func() map[string]string {
+		return m.resolver.PodAnnotations(namespace, podName)
+	})
+}
+
+func (m *memoResolver) CustomResourceLabels(namespace, podName string) map[string]string {
+	return m.lookup(m.customResources, cacheKey(namespace, podName), func() map[string]string {
+		return m.resolver.CustomResourceLabels(namespace, podName)
+	})
+}
+
+func (m *memoResolver) ContainerMetadata(namespace, podName, container string) map[string]string {
+	return m.lookup(m.containers, cacheKey(namespace, podName)+"/"+container, func() map[string]string {
+		return m.resolver.ContainerMetadata(namespace, podName, container)
+	})
+}
+
+func (m *memoResolver) NamespaceLabels(namespace string) map[string]string {
+	return m.lookup(m.namespaces, namespace, func() map[string]string {
+		return m.resolver.NamespaceLabels(namespace)
+	})
+}
+
+// lookup returns memo[key], calling resolve and storing its answer on a miss.
+// Two workers missing the same key may both resolve it; the answers are
+// equivalent, so the later one simply wins.
+func (m *memoResolver) lookup(memo map[string]map[string]string, key string, resolve func() map[string]string) map[string]string {
+	m.mu.Lock()
+	labels, ok := memo[key]
+	m.mu.Unlock()
+	if ok {
+		return labels
+	}
+
+	labels = resolve()
+	m.mu.Lock()
+	memo[key] = labels
+	m.mu.Unlock()
+	return labels
+}
+
+// prefetch resolves the metadata of every pod and namespace referenced by
+// payload, for the sources in use, using up to workers goroutines so the
+// enrichment pass that follows is served from the memo. It stops early when
+// ctx is cancelled; enrichment then resolves the rest on demand.
+func (m *memoResolver) prefetch(ctx context.Context, payload string, workers int, sources map[labelSource]bool) {
+	pods := make(map[[2]string]struct{})
+	namespaces := make(map[string]struct{})
+	for len(payload) > 0 {
+		line := payload
+		if i := strings.IndexByte(payload, '\n'); i >= 0 {
+			line, payload = payload[:i], payload[i+1:]
+		} else {
+			payload = ""
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "#") || !strings.Contains(line, `namespace="`) {
+			continue
+		}
+		namespace, podName := extractNamespaceAndPod(line)
+		if namespace == "" {
+			continue
+		}
+		namespaces[namespace] = struct{}{}
+		if podName != "" {
+			pods[[2]string{namespace, podName}] = struct{}{}
+		}
+	}
+
+	if !sources[sourceNamespaceLabel] {
+		clear(namespaces)
+	}
+	if !sources[sourcePodLabel] && !sources[sourcePodAnnotation] && !sources[sourceCustomResource] {
+		clear(pods)
+	}
+	if len(namespaces) == 0 && len(pods) == 0 {
+		return
+	}
+
+	jobs := make(chan func())
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				job()
+			}
+		}()
+	}
+
+	defer func() {
+		close(jobs)
+		wg.Wait()
+	}()
+	for namespace := range namespaces {
+		select {
+		case jobs <- func() { m.NamespaceLabels(namespace) }:
+		case <-ctx.Done():
+			return
+		}
+	}
+	for pod := range pods {
+		select {
+		case jobs <- func() {
+			if sources[sourcePodLabel] {
+				m.PodLabels(pod[0], pod[1])
+			}
+			if sources[sourcePodAnnotation] {
+				m.PodAnnotations(pod[0], pod[1])
+			}
+			if sources[sourceCustomResource] {
+				m.CustomResourceLabels(pod[0], pod[1])
+			}
+		}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowResolver stands in for a cold lister: every pod lookup takes delay.
+type slowResolver struct {
+	fakeResolver
+	delay   time.Duration
+	lookups atomic.Int64
+}
+
+func (r *slowResolver) PodLabels(namespace, podName string) map[string]string {
+	r.lookups.Add(1)
+	time.Sleep(r.delay)
+	return r.fakeResolver.PodLabels(namespace, podName)
+}
+
+func TestPrefetchResolvesEachPodOnce(t *testing.T) {
+	payload, pods := syntheticPayload(64<<10, 40)
+	slow := &slowResolver{fakeResolver: pods}
+	memo := memoizeResolver(slow)
+
+	memo.prefetch(context.Background(), payload, 4, map[labelSource]bool{sourcePodLabel: true})
+	if got := slow.lookups.Load(); got != 40 {
+		t.Fatalf("prefetch made %d lookups, want 40", got)
+	}
+	if _, _, err := NewLabelProcessor(ProcessorOptions{}).AddLabelsToMetrics(context.Background(), payload, "app", "", memo); err != nil {
+		t.Fatal(err)
+	}
+	if got := slow.lookups.Load(); got != 40 {
+		t.Errorf("enrichment after prefetch made %d more lookups", got-40)
+	}
+}
+
+func TestPrefetchSkipsUnusedSources(t *testing.T) {
+	payload, pods := syntheticPayload(16<<10, 10)
+	slow := &slowResolver{fakeResolver: pods}
+
+	memoizeResolver(slow).prefetch(context.Background(), payload, 4, map[labelSource]bool{sourceNamespaceLabel: true})
+	if got := slow.lookups.Load(); got != 0 {
+		t.Errorf("prefetch of namespace labels made %d pod lookups", got)
+	}
+}
+
+func BenchmarkColdCacheEnrichment(b *testing.B) {
+	payload, pods := syntheticPayload(512<<10, 500)
+	lp := NewLabelProcessor(ProcessorOptions{})
+	sources := lp.sources("app,team")
+
+	for _, workers := range []int{0, 16} {
+		name := "no-prefetch"
+		if workers > 0 {
+			name = "prefetch"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				memo := memoizeResolver(&slowResolver{fakeResolver: pods, delay: 50 * time.Microsecond})
+				if workers > 0 {
+					memo.prefetch(context.Background(), payload, workers, sources)
+				}
+				if _, _, err := lp.AddLabelsToMetrics(context.Background(), payload, "app,team", "", memo); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
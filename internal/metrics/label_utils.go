@@ -1,6 +1,33 @@
 package metrics
 
-import "strings"
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// CollisionSkip leaves a line untouched when it already carries the label.
+	CollisionSkip = "skip"
+	// CollisionPrefix renames the existing label to "exported_<name>", as
+	// Prometheus does for conflicting target labels, and adds the new one.
+	CollisionPrefix = "prefix"
+	// CollisionOverwrite replaces the value of the existing label.
+	CollisionOverwrite  = "overwrite"
+	exportedLabelPrefix = "exported_"
+	// truncationMarker ends label values shortened to MAX_LABEL_VALUE_LEN.
+	truncationMarker = "…"
+)
+
+const (
+	// EmptySkip leaves out ADD_LABELS labels that resolve to no value.
+	EmptySkip = "skip"
+	// EmptyBlank writes unresolved ADD_LABELS labels with an empty value.
+	EmptyBlank = "empty"
+	// EmptyPlaceholder writes unresolved ADD_LABELS labels with a configured
+	// placeholder value.
+	EmptyPlaceholder = "placeholder"
+)
 
 // escapeLabelValue escapes special characters so Prometheus accepts the label.
 func escapeLabelValue(value string) string {
@@ -9,3 +36,356 @@ func escapeLabelValue(value string) string {
 	value = strings.ReplaceAll(value, "\n", `\n`)
 	return value
 }
+
+// truncateLabelValue shortens value to at most maxLen runes, the last of
+// which is truncationMarker. It works on the raw value, before escaping, so
+// escape sequences are never cut in half. A maxLen of zero disables it.
+func truncateLabelValue(value string, maxLen int) string {
+	if maxLen <= 0 || len(value) <= maxLen {
+		return value
+	}
+	runes := []rune(value)
+	if len(runes) <= maxLen {
+		return value
+	}
+	return string(runes[:maxLen-1]) + truncationMarker
+}
+
+// labelBlockBounds returns the indexes of the braces delimiting the label block
+// of a sample line, skipping braces that appear inside quoted label values.
+// Both indexes are -1 when the line has no well-formed label block.
+func labelBlockBounds(line string) (start, end int) {
+	start = strings.IndexByte(line, '{')
+	if start == -1 {
+		return -1, -1
+	}
+
+	inQuotes := false
+	for i := start + 1; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			if inQuotes {
+				i++
+			}
+		case '"':
+			inQuotes = !inQuotes
+		case '}':
+			if !inQuotes {
+				return start, i
+			}
+		}
+	}
+	return -1, -1
+}
+
+// appendLabel adds key="value" to the end of the label block of a sample line,
+// creating the block when the line has none.
+func appendLabel(line, key, value string) string {
+	pair := key + `="` + escapeLabelValue(value) + `"`
+
+	start, end := labelBlockBounds(line)
+	if start == -1 {
+		name := sampleMetricName(line)
+		return name + "{" + pair + "}" + line[len(name):]
+	}
+
+	separator := ","
+	if existing := strings.TrimSpace(line[start+1 : end]); existing == "" || strings.HasSuffix(existing, ",") {
+		separator = ""
+	}
+	return line[:end] + separator + pair + line[end:]
+}
+
+// setLabel adds key="value" to a sample line, resolving a label of the same
+// name that the line already carries according to strategy. Unknown
+// strategies behave like CollisionSkip.
+func setLabel(line, key, value, strategy string) string {
+	if !hasLabel(line, key) {
+		return appendLabel(line, key, value)
+	}
+
+	switch strategy {
+	case CollisionOverwrite:
+		return rewriteLabel(line, key, key, escapeLabelValue(value), true)
+	case CollisionPrefix:
+		renamed := exportedLabelPrefix + key
+		for hasLabel(line, renamed) {
+			renamed = exportedLabelPrefix + renamed
+		}
+		return appendLabel(rewriteLabel(line, key, renamed, "", false), key, value)
+	default:
+		return line
+	}
+}
+
+// rewriteLabel renames the label key of a sample line to newKey. When replace
+// is set, value also replaces the label's value; it must already be escaped.
+func rewriteLabel(line, key, newKey, value string, replace bool) string {
+	start, end := labelBlockBounds(line)
+	if start == -1 {
+		return line
+	}
+
+	pairs := parseLabelPairs(line[start+1 : end])
+	var b strings.Builder
+	b.Grow(len(line) + len(newKey))
+	b.WriteString(line[:start+1])
+	for i, pair := range pairs {
+		if pair.name == key {
+			pair.name = newKey
+			if replace {
+				pair.value = value
+			}
+		}
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pair.name)
+		b.WriteString(`="`)
+		b.WriteString(pair.value)
+		b.WriteByte('"')
+	}
+	b.WriteString(line[end:])
+	return b.String()
+}
+
+// removeLabels strips the labels listed in drop from a sample line, dropping
+// the braces entirely when no label remains.
+func removeLabels(line string, drop map[string]struct{}) string {
+	start, end := labelBlockBounds(line)
+	if start == -1 {
+		return line
+	}
+
+	pairs := parseLabelPairs(line[start+1 : end])
+	kept := pairs[:0]
+	for _, pair := range pairs {
+		if _, ok := drop[pair.name]; !ok {
+			kept = append(kept, pair)
+		}
+	}
+	if len(kept) == len(pairs) {
+		return line
+	}
+	if len(kept) == 0 {
+		return line[:start] + line[end+1:]
+	}
+	return replaceLabelBlock(line, start, end, kept)
+}
+
+// sortLabels re-serializes the label block of a sample line with its labels
+// in name order, so lines compare equal regardless of the order in which
+// enrichment added labels.
+func sortLabels(line string) string {
+	start, end := labelBlockBounds(line)
+	if start == -1 {
+		return line
+	}
+
+	pairs := parseLabelPairs(line[start+1 : end])
+	if sort.SliceIsSorted(pairs, func(i, j int) bool { return pairs[i].name < pairs[j].name }) {
+		return line
+	}
+	sort.SliceStable(pairs, func(i, j int) bool { return pairs[i].name < pairs[j].name })
+	return replaceLabelBlock(line, start, end, pairs)
+}
+
+// replaceLabelBlock returns line with the label block between the braces at
+// start and end replaced by pairs.
+func replaceLabelBlock(line string, start, end int, pairs []labelPair) string {
+	var b strings.Builder
+	b.Grow(len(line))
+	b.WriteString(line[:start+1])
+	for i, pair := range pairs {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pair.name)
+		b.WriteString(`="`)
+		b.WriteString(pair.value)
+		b.WriteByte('"')
+	}
+	b.WriteString(line[end:])
+	return b.String()
+}
+
+// labelPair is a single name="value" entry of a label block. The value is kept
+// in its escaped, on-the-wire form.
+type labelPair struct {
+	name  string
+	value string
+}
+
+// parseLabelPairs splits the contents of a label block (without braces) into
+// its pairs, honouring escaped quotes inside values.
+func parseLabelPairs(block string) []labelPair {
+	var pairs []labelPair
+	i := 0
+	for i < len(block) {
+		for i < len(block) && (block[i] == ',' || block[i] == ' ' || block[i] == '\t') {
+			i++
+		}
+		eq := strings.IndexByte(block[i:], '=')
+		if eq == -1 {
+			break
+		}
+		name := strings.TrimSpace(block[i : i+eq])
+		i += eq + 1
+		for i < len(block) && block[i] != '"' {
+			i++
+		}
+		if i >= len(block) {
+			break
+		}
+		i++
+		valueStart := i
+		for i < len(block) && block[i] != '"' {
+			if block[i] == '\\' {
+				i++
+			}
+			i++
+		}
+		if i > len(block) {
+			i = len(block)
+		}
+		pairs = append(pairs, labelPair{name: name, value: block[valueStart:i]})
+		i++
+	}
+	return pairs
+}
+
+// hasLabel reports whether the sample line already carries a label named key.
+func hasLabel(line, key string) bool {
+	start, end := labelBlockBounds(line)
+	if start == -1 {
+		return false
+	}
+	for _, pair := range parseLabelPairs(line[start+1 : end]) {
+		if pair.name == key {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeLabelName converts a Kubernetes label key such as
+// "app.kubernetes.io/name" into a legal Prometheus label name by replacing
+// every unsupported character with an underscore.
+func sanitizeLabelName(key string) string {
+	var b strings.Builder
+	b.Grow(len(key) + 1)
+	for i, r := range key {
+		switch {
+		case r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z'):
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// ValidateLabelConfig checks the ADD_LABELS and LABEL_DEFAULTS syntax,
+// reporting empty or duplicate keys, keys whose sanitized label name would be
+// reserved or is shared with another key, and malformed default entries.
+func ValidateLabelConfig(addLabels, labelDefaults string) error {
+	if strings.TrimSpace(addLabels) != "" {
+		seen := make(map[string]struct{})
+		names := make(map[string]string)
+		for _, entry := range strings.Split(addLabels, ",") {
+			key := strings.TrimSpace(entry)
+			if key == "" {
+				return fmt.Errorf("ADD_LABELS contains an empty entry")
+			}
+			target := parseLabelTarget(key)
+			if err := target.validate(); err != nil {
+				return fmt.Errorf("ADD_LABELS: %w", err)
+			}
+			if _, dup := seen[key]; dup {
+				return fmt.Errorf("ADD_LABELS: duplicate label %q", key)
+			}
+			seen[key] = struct{}{}
+			// Keys such as "app.name" and "app/name" both sanitize to
+			// "app_name"; the second would silently lose to the first.
+			if other, dup := names[target.name]; dup {
+				return fmt.Errorf("ADD_LABELS: %q and %q both map to label name %q", other, key, target.name)
+			}
+			names[target.name] = key
+		}
+	}
+
+	if labelDefaults == "" || labelDefaults == "null" {
+		return nil
+	}
+
+	seen := make(map[string]struct{})
+	for _, entry := range strings.Split(labelDefaults, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			return fmt.Errorf("LABEL_DEFAULTS contains an empty entry")
+		}
+
+		key := "__global__"
+		if strings.Contains(entry, "=") {
+			parts := strings.SplitN(entry, "=", 2)
+			key = strings.TrimSpace(parts[0])
+			if key == "" {
+				return fmt.Errorf("LABEL_DEFAULTS: entry %q has an empty key", entry)
+			}
+			if strings.Contains(parts[1], "=") {
+				return fmt.Errorf("LABEL_DEFAULTS: entry %q contains more than one '='", entry)
+			}
+			if err := validateLabelKey(key); err != nil {
+				return fmt.Errorf("LABEL_DEFAULTS: %w", err)
+			}
+		}
+
+		if _, dup := seen[key]; dup {
+			if key == "__global__" {
+				return fmt.Errorf("LABEL_DEFAULTS: more than one global default")
+			}
+			return fmt.Errorf("LABEL_DEFAULTS: duplicate key %q", key)
+		}
+		seen[key] = struct{}{}
+	}
+
+	return nil
+}
+
+// ParseConstantLabels parses CONSTANT_LABELS, a comma-separated list of
+// name=value pairs, rejecting names that are not valid Prometheus label names.
+func ParseConstantLabels(raw string) (map[string]string, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+
+	labels := make(map[string]string)
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			return nil, fmt.Errorf("CONSTANT_LABELS contains an empty entry")
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("CONSTANT_LABELS: entry %q is not a name=value pair", entry)
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if name == "" || sanitizeLabelName(name) != name || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("CONSTANT_LABELS: %q is not a valid label name", name)
+		}
+		if _, dup := labels[name]; dup {
+			return nil, fmt.Errorf("CONSTANT_LABELS: duplicate label %q", name)
+		}
+		labels[name] = value
+	}
+	return labels, nil
+}
+
+func validateLabelKey(key string) error {
+	return parseLabelTarget(key).validate()
+}
@@ -0,0 +1,195 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLabelBlockBounds(t *testing.T) {
+	tests := []struct {
+		line       string
+		start, end int
+	}{
+		{`m 1`, -1, -1},
+		{`m{} 1`, 1, 2},
+		{`m{a="}"} 1`, 1, 7},
+		{`m{a="\"}"} 1`, 1, 9},
+		{`m{a="x" 1`, -1, -1},
+	}
+	for _, tt := range tests {
+		if start, end := labelBlockBounds(tt.line); start != tt.start || end != tt.end {
+			t.Errorf("labelBlockBounds(%s) = %d, %d, want %d, %d", tt.line, start, end, tt.start, tt.end)
+		}
+	}
+}
+
+func TestAppendLabel(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{`m 1`, `m{app="a\"b"} 1`},
+		{`m{} 1`, `m{app="a\"b"} 1`},
+		{`m{pod="p"} 1`, `m{pod="p",app="a\"b"} 1`},
+		{`m{pod="p",} 1`, `m{pod="p",app="a\"b"} 1`},
+	}
+	for _, tt := range tests {
+		if got := appendLabel(tt.line, "app", `a"b`); got != tt.want {
+			t.Errorf("appendLabel(%s) = %s, want %s", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseLabelPairs(t *testing.T) {
+	got := parseLabelPairs(`a="1", b="x\"y,z" ,c=""`)
+	want := []labelPair{{"a", "1"}, {"b", `x\"y,z`}, {"c", ""}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseLabelPairs = %+v, want %+v", got, want)
+	}
+}
+
+func TestHasLabel(t *testing.T) {
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{`m{node_ip="1"} 1`, true},
+		{`m{a="node_ip=\"x\""} 1`, false},
+		{`m{pod_node_ip="1"} 1`, false},
+		{`m 1`, false},
+	}
+	for _, tt := range tests {
+		if got := hasLabel(tt.line, "node_ip"); got != tt.want {
+			t.Errorf("hasLabel(%s) = %v, want %v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestValidateLabelConfig(t *testing.T) {
+	tests := []struct {
+		addLabels, labelDefaults string
+		wantErr                  bool
+	}{
+		{"app,team", "app=none,unknown", false},
+		{"", "null", false},
+		{"app,,team", "", true},
+		{"app,app", "", true},
+		{"app.name,app/name", "", true},
+		{"app.name,ns:app_name", "", true},
+		{"app", "a=,b", false},
+		{"app", "=x", true},
+		{"app", "a=b=c", true},
+		{"app", "x,y", true},
+		{"app", "a=x,a=y", true},
+		{"app", "a=x,", true},
+	}
+	for _, tt := range tests {
+		err := ValidateLabelConfig(tt.addLabels, tt.labelDefaults)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ValidateLabelConfig(%q, %q) = %v, wantErr %v", tt.addLabels, tt.labelDefaults, err, tt.wantErr)
+		}
+	}
+}
+
+func TestParseConstantLabels(t *testing.T) {
+	got, err := ParseConstantLabels(" cluster = prod , region=eu ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"cluster": "prod", "region": "eu"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseConstantLabels = %v, want %v", got, want)
+	}
+
+	if got, err := ParseConstantLabels(" "); got != nil || err != nil {
+		t.Errorf("blank input = %v, %v, want nil, nil", got, err)
+	}
+	for _, raw := range []string{"cluster", "cluster=a,cluster=b", "bad-name=x", "__name__=x", "a=1,"} {
+		if _, err := ParseConstantLabels(raw); err == nil {
+			t.Errorf("ParseConstantLabels(%q) succeeded, want an error", raw)
+		}
+	}
+}
+
+func TestSetLabelStrategies(t *testing.T) {
+	const line = `m{app="old",pod="p"} 1`
+	tests := []struct {
+		strategy string
+		want     string
+	}{
+		{CollisionSkip, line},
+		{"", line},
+		{CollisionOverwrite, `m{app="new",pod="p"} 1`},
+		{CollisionPrefix, `m{exported_app="old",pod="p",app="new"} 1`},
+	}
+	for _, tt := range tests {
+		if got := setLabel(line, "app", "new", tt.strategy); got != tt.want {
+			t.Errorf("strategy %q: got %s, want %s", tt.strategy, got, tt.want)
+		}
+	}
+
+	// The existence check is exact, so a lookalike label is no collision.
+	if got, want := setLabel(`m{kube_app="x"} 1`, "app", "new", CollisionSkip), `m{kube_app="x",app="new"} 1`; got != want {
+		t.Errorf("lookalike label: got %s, want %s", got, want)
+	}
+	if got, want := setLabel(`m{app="a",exported_app="b"} 1`, "app", "c", CollisionPrefix),
+		`m{exported_exported_app="a",exported_app="b",app="c"} 1`; got != want {
+		t.Errorf("repeated prefix: got %s, want %s", got, want)
+	}
+}
+
+func TestRemoveLabels(t *testing.T) {
+	drop := map[string]struct{}{"id": {}, "pod": {}}
+	tests := []struct {
+		line string
+		want string
+	}{
+		{`m{id="/x",pod="p",app="a"} 1`, `m{app="a"} 1`},
+		{`m{id="/x",pod="p"} 1`, `m 1`},
+		{`m{app="a"} 1`, `m{app="a"} 1`},
+		{`m 1`, `m 1`},
+	}
+	for _, tt := range tests {
+		if got := removeLabels(tt.line, drop); got != tt.want {
+			t.Errorf("removeLabels(%s) = %s, want %s", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestTruncateLabelValue(t *testing.T) {
+	tests := []struct {
+		value  string
+		maxLen int
+		want   string
+	}{
+		{"frontend", 0, "frontend"},
+		{"frontend", 8, "frontend"},
+		{"frontend", 5, "fron…"},
+		{"日本語テキスト", 7, "日本語テキスト"},
+		{"日本語テキスト", 4, "日本語…"},
+	}
+	for _, tt := range tests {
+		if got := truncateLabelValue(tt.value, tt.maxLen); got != tt.want {
+			t.Errorf("truncateLabelValue(%q, %d) = %q, want %q", tt.value, tt.maxLen, got, tt.want)
+		}
+	}
+}
+
+func TestSortLabels(t *testing.T) {
+	if got, want := sortLabels(`m{pod="p",app="a,b",namespace="n"} 1 1700000000000`),
+		`m{app="a,b",namespace="n",pod="p"} 1 1700000000000`; got != want {
+		t.Errorf("sortLabels = %s, want %s", got, want)
+	}
+}
+
+func TestSanitizeLabelName(t *testing.T) {
+	tests := map[string]string{
+		"app":                    "app",
+		"app.kubernetes.io/name": "app_kubernetes_io_name",
+		"1st":                    "_1st",
+	}
+	for in, want := range tests {
+		if got := sanitizeLabelName(in); got != want {
+			t.Errorf("sanitizeLabelName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
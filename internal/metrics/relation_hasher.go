@@ -2,15 +2,88 @@ package metrics
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"strings"
 )
 
-const relationMod = 4294967295
+const (
+	// DefaultRelationHashAlgo is the hash algorithm used when none is configured.
+	DefaultRelationHashAlgo = "md5"
+	// DefaultRelationHashMod is the modulo applied to relation hashes when none is configured.
+	DefaultRelationHashMod uint64 = 4294967295
 
-// labelRelationHash hashes the provided label value and applies the requested modulo.
-func labelRelationHash(value string) uint64 {
+	// hashSegmentWidth is the number of digest bytes read as a big-endian
+	// uint64. Relation values are joined on downstream, so the width and the
+	// offsets below are part of the output contract and must not change;
+	// TestRelationHasherGolden pins the resulting values.
+	hashSegmentWidth = 8
+	// md5SegmentOffset selects bytes 8..15 of the MD5 digest.
+	md5SegmentOffset = md5.Size - hashSegmentWidth
+	// sha256SegmentOffset selects the trailing 8 bytes of the SHA-256 digest.
+	sha256SegmentOffset = sha256.Size - hashSegmentWidth
+)
+
+// The segments must lie inside their digests; a negative difference fails to
+// compile as a uint constant.
+const (
+	_ = uint(md5.Size - md5SegmentOffset - hashSegmentWidth)
+	_ = uint(sha256.Size - sha256SegmentOffset - hashSegmentWidth)
+)
+
+// RelationHasher maps a label value onto the numeric sample emitted by the
+// relation metric. Implementations must be deterministic across processes.
+type RelationHasher interface {
+	Hash(value string) uint64
+}
+
+// NewRelationHasher returns the hasher registered under algo, reducing every
+// hash modulo mod.
+func NewRelationHasher(algo string, mod uint64) (RelationHasher, error) {
+	if mod == 0 {
+		return nil, fmt.Errorf("relation hash modulo must be greater than zero")
+	}
+
+	switch strings.ToLower(strings.TrimSpace(algo)) {
+	case "", "md5":
+		return md5Hasher{mod: mod}, nil
+	case "sha256":
+		return sha256Hasher{mod: mod}, nil
+	case "fnv":
+		return fnvHasher{mod: mod}, nil
+	default:
+		return nil, fmt.Errorf("unsupported relation hash algorithm %q", algo)
+	}
+}
+
+// defaultRelationHasher returns the historical MD5 hasher.
+func defaultRelationHasher() RelationHasher {
+	return md5Hasher{mod: DefaultRelationHashMod}
+}
+
+type md5Hasher struct{ mod uint64 }
+
+// Hash reads the trailing 8 bytes of the MD5 digest as a big-endian integer.
+func (h md5Hasher) Hash(value string) uint64 {
 	sum := md5.Sum([]byte(value))
-	segment := sum[8:]
-	num := binary.BigEndian.Uint64(segment)
-	return num % relationMod
+	return binary.BigEndian.Uint64(sum[md5SegmentOffset:md5SegmentOffset+hashSegmentWidth]) % h.mod
+}
+
+type sha256Hasher struct{ mod uint64 }
+
+// Hash reads the trailing 8 bytes of the SHA-256 digest as a big-endian integer.
+func (h sha256Hasher) Hash(value string) uint64 {
+	sum := sha256.Sum256([]byte(value))
+	return binary.BigEndian.Uint64(sum[sha256SegmentOffset:sha256SegmentOffset+hashSegmentWidth]) % h.mod
+}
+
+type fnvHasher struct{ mod uint64 }
+
+// Hash uses the 64-bit FNV-1a hash of the value.
+func (h fnvHasher) Hash(value string) uint64 {
+	f := fnv.New64a()
+	_, _ = f.Write([]byte(value))
+	return f.Sum64() % h.mod
 }
@@ -0,0 +1,51 @@
+package metrics
+
+import "testing"
+
+// The expected values are joined on downstream and must never change.
+func TestRelationHasherGolden(t *testing.T) {
+	tests := []struct {
+		algo  string
+		mod   uint64
+		value string
+		want  uint64
+	}{
+		{"md5", DefaultRelationHashMod, "nginx", 19857739},
+		{"md5", DefaultRelationHashMod, "app", 2576379441},
+		{"md5", DefaultRelationHashMod, "", 3598208023},
+		{"md5", 1000, "nginx", 524},
+		{"sha256", DefaultRelationHashMod, "nginx", 3036382565},
+		{"sha256", DefaultRelationHashMod, "app", 3164079750},
+		{"sha256", DefaultRelationHashMod, "", 484987249},
+		{"fnv", DefaultRelationHashMod, "nginx", 1730309215},
+		{"fnv", DefaultRelationHashMod, "app", 3971623589},
+		{"fnv", DefaultRelationHashMod, "", 1343537162},
+	}
+	for _, tt := range tests {
+		h, err := NewRelationHasher(tt.algo, tt.mod)
+		if err != nil {
+			t.Fatalf("NewRelationHasher(%q, %d): %v", tt.algo, tt.mod, err)
+		}
+		if got := h.Hash(tt.value); got != tt.want {
+			t.Errorf("%s mod %d: Hash(%q) = %d, want %d", tt.algo, tt.mod, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultRelationHasherIsMD5(t *testing.T) {
+	if got := defaultRelationHasher().Hash("nginx"); got != 19857739 {
+		t.Errorf("default Hash(%q) = %d, want the MD5 value 19857739", "nginx", got)
+	}
+}
+
+func TestNewRelationHasherErrors(t *testing.T) {
+	if _, err := NewRelationHasher("md5", 0); err == nil {
+		t.Error("modulo 0 was accepted")
+	}
+	if _, err := NewRelationHasher("crc32", DefaultRelationHashMod); err == nil {
+		t.Error("unknown algorithm was accepted")
+	}
+	if _, err := NewRelationHasher(" SHA256 ", DefaultRelationHashMod); err != nil {
+		t.Errorf("algorithm names should be case- and space-insensitive: %v", err)
+	}
+}
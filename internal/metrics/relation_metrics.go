@@ -6,35 +6,40 @@ import (
 	"strings"
 )
 
-const relationMetricName = "kubelet_cadvisor_label_relation"
+// DefaultRelationMetricName is the metric name used for relation series when none is configured.
+const DefaultRelationMetricName = "kubelet_cadvisor_label_relation"
 
-func buildRelationMetrics(service *Service, labelKeys []string, defaults map[string]string) string {
-	if service == nil || len(labelKeys) == 0 {
+// nodeRelationSource is the source label value of relation series built from node labels.
+const nodeRelationSource = "node"
+
+func buildRelationMetrics(
+	service *Service,
+	metricName string,
+	hasher RelationHasher,
+	targets []labelTarget,
+	defaults map[string]string,
+	nodeLabelKeys []string,
+) string {
+	if service == nil || metricName == "" || hasher == nil || (len(targets) == 0 && len(nodeLabelKeys) == 0) {
 		return ""
 	}
 
 	var builder strings.Builder
 	metricsWritten := false
-
-	for _, key := range labelKeys {
-		key = strings.TrimSpace(key)
-		if key == "" {
-			continue
-		}
-
+	writeSeries := func(key, source string, observed []string, def string) {
 		set := make(map[string]struct{})
-		for _, value := range service.UniqueLabelValues(key) {
+		for _, value := range observed {
 			value = strings.TrimSpace(value)
 			if value != "" {
 				set[value] = struct{}{}
 			}
 		}
-		if def := relationDefaultValue(key, defaults); def != "" {
+		if def != "" {
 			set[def] = struct{}{}
 		}
 
 		if len(set) == 0 {
-			continue
+			return
 		}
 
 		values := make([]string, 0, len(set))
@@ -45,27 +50,57 @@ func buildRelationMetrics(service *Service, labelKeys []string, defaults map[str
 
 		if !metricsWritten {
 			builder.WriteString("# HELP ")
-			builder.WriteString(relationMetricName)
-			builder.WriteString(" Hash of unique pod label values requested via ADD_LABELS.\n")
+			builder.WriteString(metricName)
+			builder.WriteString(" Hash of unique label values requested via ADD_LABELS and RELATION_NODE_LABELS.\n")
 			builder.WriteString("# TYPE ")
-			builder.WriteString(relationMetricName)
+			builder.WriteString(metricName)
 			builder.WriteString(" gauge\n")
 			metricsWritten = true
 		}
 
 		for _, value := range values {
-			hash := labelRelationHash(value)
-			builder.WriteString(relationMetricName)
+			hash := hasher.Hash(value)
+			builder.WriteString(metricName)
 			builder.WriteString(`{label_key="`)
 			builder.WriteString(escapeLabelValue(key))
 			builder.WriteString(`",label_value="`)
 			builder.WriteString(escapeLabelValue(value))
+			if source != "" {
+				builder.WriteString(`",source="`)
+				builder.WriteString(source)
+			}
 			builder.WriteString(`"} `)
 			builder.WriteString(strconv.FormatUint(hash, 10))
 			builder.WriteByte('\n')
 		}
 	}
 
+	for _, target := range targets {
+		// Container fields come from specs, not labels, and are not cached
+		// for enumeration.
+		if target.source == sourceContainer {
+			continue
+		}
+		var observed []string
+		switch target.source {
+		case sourceNamespaceLabel:
+			observed = service.UniqueNamespaceLabelValues(target.sourceKey)
+		case sourcePodAnnotation:
+			observed = service.UniqueAnnotationValues(target.sourceKey)
+		case sourceCustomResource:
+			observed = service.UniqueCustomResourceLabelValues(target.sourceKey)
+		default:
+			observed = service.UniqueLabelValues(target.sourceKey)
+		}
+		writeSeries(target.key, "", observed, relationDefaultValue(target.key, defaults))
+	}
+
+	// Node label series carry source="node" so they never collide with pod
+	// label series for the same key.
+	for _, key := range nodeLabelKeys {
+		writeSeries(key, nodeRelationSource, service.UniqueNodeLabelValues(key), "")
+	}
+
 	if !metricsWritten {
 		return ""
 	}
@@ -73,6 +108,77 @@ func buildRelationMetrics(service *Service, labelKeys []string, defaults map[str
 	return builder.String()
 }
 
+// podInfoMetricName names the info series emitted per cached pod when
+// EMIT_POD_INFO is set.
+const podInfoMetricName = "addlabel_pod_info"
+
+// buildPodInfoMetrics renders one addlabel_pod_info{namespace,pod,...} 1
+// series per cached pod, carrying the ADD_LABELS values the pod resolves to,
+// defaults included, so they can be joined in queries instead of being
+// repeated on every sample. Targets named namespace or pod are skipped, as
+// are container targets, which have no single value per pod.
+func buildPodInfoMetrics(service *Service, targets []labelTarget, defaults map[string]string) string {
+	if service == nil {
+		return ""
+	}
+
+	var lines []string
+	service.cache.RangePods(func(namespace, podName string, labels, annotations map[string]string) bool {
+		var b strings.Builder
+		b.WriteString(podInfoMetricName)
+		b.WriteString(`{namespace="`)
+		b.WriteString(escapeLabelValue(namespace))
+		b.WriteString(`",pod="`)
+		b.WriteString(escapeLabelValue(podName))
+		b.WriteByte('"')
+		for _, target := range targets {
+			if target.name == "namespace" || target.name == "pod" || target.source == sourceContainer {
+				continue
+			}
+			var source map[string]string
+			switch target.source {
+			case sourceNamespaceLabel:
+				source = service.NamespaceLabels(namespace)
+			case sourcePodAnnotation:
+				source = annotations
+			case sourceCustomResource:
+				source = service.CustomResourceLabels(namespace, podName)
+			default:
+				source = labels
+			}
+			value, _ := labelValue(target, source, defaults, namespace)
+			if value == "" {
+				continue
+			}
+			b.WriteByte(',')
+			b.WriteString(target.name)
+			b.WriteString(`="`)
+			b.WriteString(escapeLabelValue(value))
+			b.WriteByte('"')
+		}
+		b.WriteString("} 1")
+		lines = append(lines, b.String())
+		return true
+	})
+	if len(lines) == 0 {
+		return ""
+	}
+	sort.Strings(lines)
+
+	var b strings.Builder
+	b.WriteString("# HELP ")
+	b.WriteString(podInfoMetricName)
+	b.WriteString(" Always 1; labelled with the ADD_LABELS values of every cached pod.\n")
+	b.WriteString("# TYPE ")
+	b.WriteString(podInfoMetricName)
+	b.WriteString(" gauge\n")
+	for _, line := range lines {
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
 func relationDefaultValue(label string, defaults map[string]string) string {
 	if len(defaults) == 0 {
 		return ""
@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestBuildRelationMetricsName(t *testing.T) {
+	_, svc := newTestCollector(t, CollectorOptions{})
+	svc.cache.StorePodLabels("default", "web-0", map[string]string{"app": "web"})
+	hasher := defaultRelationHasher()
+	targets := parseLabelTargets("app")
+
+	got := buildRelationMetrics(svc, "team_label_relation", hasher, targets, nil, nil)
+	want := "# HELP team_label_relation Hash of unique label values requested via ADD_LABELS and RELATION_NODE_LABELS.\n" +
+		"# TYPE team_label_relation gauge\n" +
+		"team_label_relation{label_key=\"app\",label_value=\"web\"} " + strconv.FormatUint(hasher.Hash("web"), 10) + "\n"
+	if got != want {
+		t.Errorf("relation metrics:\n got %q\nwant %q", got, want)
+	}
+
+	if got := buildRelationMetrics(svc, "", hasher, targets, nil, nil); got != "" {
+		t.Errorf("empty metric name should disable relation metrics, got %q", got)
+	}
+}
+
+func TestBuildRelationMetricsNodeLabels(t *testing.T) {
+	_, svc := newTestCollector(t, CollectorOptions{})
+	svc.cache.StorePodLabels("default", "web-0", map[string]string{"zone": "pod-zone"})
+	svc.cache.StoreNodeLabels("worker-1", map[string]string{"zone": "eu-1a"})
+	svc.cache.StoreNodeLabels("worker-2", map[string]string{"zone": "eu-1b"})
+	hasher := defaultRelationHasher()
+	hash := func(v string) string { return strconv.FormatUint(hasher.Hash(v), 10) }
+
+	got := buildRelationMetrics(svc, DefaultRelationMetricName, hasher, parseLabelTargets("zone"), nil, []string{"zone", "missing"})
+	want := "# HELP kubelet_cadvisor_label_relation Hash of unique label values requested via ADD_LABELS and RELATION_NODE_LABELS.\n" +
+		"# TYPE kubelet_cadvisor_label_relation gauge\n" +
+		`kubelet_cadvisor_label_relation{label_key="zone",label_value="pod-zone"} ` + hash("pod-zone") + "\n" +
+		`kubelet_cadvisor_label_relation{label_key="zone",label_value="eu-1a",source="node"} ` + hash("eu-1a") + "\n" +
+		`kubelet_cadvisor_label_relation{label_key="zone",label_value="eu-1b",source="node"} ` + hash("eu-1b") + "\n"
+	if got != want {
+		t.Errorf("relation metrics:\n got %q\nwant %q", got, want)
+	}
+
+	if got := buildRelationMetrics(svc, DefaultRelationMetricName, hasher, nil, nil, []string{"missing"}); got != "" {
+		t.Errorf("node label without values: got %q, want no series", got)
+	}
+}
+
+func TestBuildPodInfoMetrics(t *testing.T) {
+	_, svc := newTestCollector(t, CollectorOptions{})
+	svc.cache.StorePodMetadata("default", "web-0", map[string]string{"app": "web"}, map[string]string{"owner": "alice"})
+	svc.cache.StorePodMetadata("data", "db-0", map[string]string{"app": `d"b`}, nil)
+	svc.cache.StoreNamespaceLabels("default", map[string]string{"team": "frontend"})
+	targets := parseLabelTargets("app,ns:team,anno:owner,pod,container:image")
+
+	got := buildPodInfoMetrics(svc, targets, parseLabelDefaults("anno:owner=nobody"))
+	want := "# HELP addlabel_pod_info Always 1; labelled with the ADD_LABELS values of every cached pod.\n" +
+		"# TYPE addlabel_pod_info gauge\n" +
+		`addlabel_pod_info{namespace="data",pod="db-0",app="d\"b",owner="nobody"} 1` + "\n" +
+		`addlabel_pod_info{namespace="default",pod="web-0",app="web",team="frontend",owner="alice"} 1` + "\n"
+	if got != want {
+		t.Errorf("pod info metrics:\n got %q\nwant %q", got, want)
+	}
+
+	_, empty := newTestCollector(t, CollectorOptions{})
+	if got := buildPodInfoMetrics(empty, targets, nil); got != "" {
+		t.Errorf("no cached pods: got %q, want no series", got)
+	}
+}
@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// statusError reports a kubelet response other than 200 OK.
+type statusError struct {
+	code int
+	body string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d: %s", e.code, e.body)
+}
+
+// SelfCheckResult summarises a single-node probe scrape.
+type SelfCheckResult struct {
+	Node       string
+	StatusCode int
+	Bytes      int
+	Duration   time.Duration
+	// TLS describes how the kubelet certificate was checked.
+	TLS string
+	Err error
+}
+
+// SelfCheck scrapes one node with the collector's token, CA and transport so
+// misconfiguration is reported at startup instead of on the first cycle. The
+// lowest node IP is used to keep the probe target stable across restarts.
+func (c *Collector) SelfCheck(ctx context.Context) SelfCheckResult {
+	result := SelfCheckResult{TLS: c.tlsMode()}
+
+	nodes := c.service.NodeTargets()
+	if len(nodes) == 0 {
+		result.Err = fmt.Errorf("no node IPs available for scraping")
+		return result
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].IP < nodes[j].IP })
+	result.Node = nodes[0].IP
+
+	token, err := c.token()
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	if c.caBundle != nil {
+		c.caBundle.maybeReload()
+	}
+
+	start := time.Now()
+	data, err := c.fetchNode(ctx, nodes[0], token, nil)
+	result.Duration = time.Since(start)
+	if err != nil {
+		var se *statusError
+		if errors.As(err, &se) {
+			result.StatusCode = se.code
+		}
+		result.Err = err
+		return result
+	}
+
+	result.StatusCode = http.StatusOK
+	result.Bytes = len(data)
+	return result
+}
+
+func (c *Collector) tlsMode() string {
+	switch {
+	case c.apiServerHost != "":
+		return "API server node proxy"
+	case c.scheme != SchemeHTTPS:
+		return "none (plain HTTP)"
+	case c.insecureSkipVerify:
+		return "verification disabled"
+	case c.caBundle != nil:
+		return "verified against " + c.caFile
+	default:
+		return "verified against system roots"
+	}
+}
@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSelfCheck(t *testing.T) {
+	c, _ := newTestCollector(t, CollectorOptions{}, newTestKubelet(t, "up 1\n"))
+	result := c.SelfCheck(context.Background())
+	if result.Err != nil {
+		t.Fatalf("SelfCheck: %v", result.Err)
+	}
+	if result.StatusCode != http.StatusOK || result.Bytes != len("up 1\n") || result.Node == "" {
+		t.Errorf("result = %+v, want 200 with the payload size", result)
+	}
+	if result.TLS != "none (plain HTTP)" {
+		t.Errorf("TLS = %q", result.TLS)
+	}
+}
+
+func TestSelfCheckReportsStatusCode(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	c, _ := newTestCollector(t, CollectorOptions{}, strings.TrimPrefix(srv.URL, "http://"))
+	result := c.SelfCheck(context.Background())
+	if result.Err == nil || result.StatusCode != http.StatusForbidden {
+		t.Errorf("result = %+v, want a 403 failure", result)
+	}
+}
+
+func TestSelfCheckWithoutNodes(t *testing.T) {
+	c, _ := newTestCollector(t, CollectorOptions{})
+	if result := c.SelfCheck(context.Background()); result.Err == nil {
+		t.Error("SelfCheck without nodes succeeded")
+	}
+}
@@ -4,8 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog/v2"
@@ -16,23 +22,104 @@ var errCacheSyncFailed = errors.New("failed to sync informer caches")
 // Service manages the informer lifecycle and exposes cached cluster metadata
 // needed by the metrics collector.
 type Service struct {
-	factory      informers.SharedInformerFactory
-	cache        *Cache
+	factory informers.SharedInformerFactory
+	cache   *Cache
+	// nodeInformer is nil when static node targets are configured.
 	nodeInformer cache.SharedIndexInformer
-	podInformer  cache.SharedIndexInformer
-	synced       chan struct{}
-	syncOnce     sync.Once
+	// nodeSelector, when non-nil, limits the scrape set to matching nodes.
+	nodeSelector labels.Selector
+	// fallbackNodes are scraped while the node informer reports no nodes.
+	fallbackNodes []NodeTarget
+	// podInformer is nil when pod metadata is not watched.
+	podInformer cache.SharedIndexInformer
+	// nsInformer is nil unless namespace labels were requested.
+	nsInformer cache.SharedIndexInformer
+	// crFactory and crInformer are nil unless a custom resource is watched;
+	// crJoinLabel is the pod label naming a pod's custom resource object.
+	crFactory   dynamicinformer.DynamicSharedInformerFactory
+	crInformer  cache.SharedIndexInformer
+	crJoinLabel string
+	// podAnnotations caches pod annotations alongside labels.
+	podAnnotations bool
+	synced         chan struct{}
+	syncOnce       sync.Once
+	podCacheTTL    time.Duration
+}
+
+// ServiceOptions tunes the informer-backed metadata cache.
+type ServiceOptions struct {
+	// PodCacheTTL evicts pod label entries that have not been refreshed by an
+	// informer event within the period; zero keeps entries until deleted.
+	// Evicted pods that still exist are re-read from the lister on demand.
+	PodCacheTTL time.Duration
+	// NodeAddressGrace keeps scraping a node at its last known IP for this long
+	// after it stops reporting an InternalIP; zero drops it immediately.
+	NodeAddressGrace time.Duration
+	// WatchNamespaces starts a Namespace informer so "ns:" entries in
+	// ADD_LABELS can be resolved.
+	WatchNamespaces bool
+	// CachePodAnnotations keeps pod annotations in the cache so "anno:"
+	// entries in ADD_LABELS can be resolved.
+	CachePodAnnotations bool
+	// StaticNodes replaces the node informer with a fixed list of scrape
+	// targets, each an IP or host optionally followed by ":port".
+	StaticNodes []string
+	// NodeSelector, when set, only scrapes nodes whose labels match it. Nodes
+	// are filtered as informer events arrive, so the shared factory keeps
+	// watching every node.
+	NodeSelector labels.Selector
+	// FallbackNodes are scrape targets, in the StaticNodes format, used only
+	// while the node informer has no nodes with an address, so a standalone
+	// or test deployment still serves its relation and info metrics.
+	FallbackNodes []string
+	// DisablePodInformer skips watching pods; pod-based enrichment then
+	// resolves nothing and only defaults and constant labels apply.
+	DisablePodInformer bool
+	// CustomResources, when set, watches a custom resource so "cr:" entries
+	// in ADD_LABELS can be resolved through the pods that reference it.
+	CustomResources *CustomResourceSource
 }
 
 // NewService wires the informers and cache used to look up labels and node IPs.
-func NewService(factory informers.SharedInformerFactory) *Service {
-	return &Service{
-		factory:      factory,
-		cache:        NewCache(),
-		nodeInformer: factory.Core().V1().Nodes().Informer(),
-		podInformer:  factory.Core().V1().Pods().Informer(),
-		synced:       make(chan struct{}),
+func NewService(factory informers.SharedInformerFactory, opts ServiceOptions) *Service {
+	s := &Service{
+		factory:     factory,
+		cache:       NewCache(opts.PodCacheTTL, opts.NodeAddressGrace),
+		podCacheTTL: opts.PodCacheTTL,
+		synced:      make(chan struct{}),
+
+		podAnnotations: opts.CachePodAnnotations,
+	}
+	if len(opts.StaticNodes) > 0 {
+		for _, target := range opts.StaticNodes {
+			s.cache.StoreNodeIP(target, target)
+		}
+		klog.InfoS("using static node targets; node informer disabled", "targets", opts.StaticNodes)
+	} else {
+		s.nodeInformer = factory.Core().V1().Nodes().Informer()
+		s.nodeSelector = opts.NodeSelector
+		if s.nodeSelector != nil {
+			klog.InfoS("scraping only nodes matching label selector", "selector", s.nodeSelector.String())
+		}
+		for _, target := range opts.FallbackNodes {
+			s.fallbackNodes = append(s.fallbackNodes, NodeTarget{Name: target, IP: target})
+		}
+	}
+	if !opts.DisablePodInformer {
+		s.podInformer = factory.Core().V1().Pods().Informer()
+	} else {
+		klog.InfoS("pod informer disabled; pod labels will not be resolved")
 	}
+	if opts.WatchNamespaces {
+		s.nsInformer = factory.Core().V1().Namespaces().Informer()
+	}
+	if cr := opts.CustomResources; cr != nil {
+		s.crFactory = cr.Factory
+		s.crInformer = cr.Factory.ForResource(cr.Resource).Informer()
+		s.crJoinLabel = cr.JoinLabel
+		klog.InfoS("watching custom resource for label enrichment", "resource", cr.Resource.String(), "joinLabel", cr.JoinLabel)
+	}
+	return s
 }
 
 // Run starts the informers and blocks until the context is cancelled.
@@ -41,8 +128,24 @@ func (s *Service) Run(ctx context.Context) error {
 
 	klog.InfoS("starting shared informers")
 	s.factory.Start(ctx.Done())
+	if s.crFactory != nil {
+		s.crFactory.Start(ctx.Done())
+	}
 
-	if ok := cache.WaitForCacheSync(ctx.Done(), s.nodeInformer.HasSynced, s.podInformer.HasSynced); !ok {
+	var synced []cache.InformerSynced
+	if s.podInformer != nil {
+		synced = append(synced, s.podInformer.HasSynced)
+	}
+	if s.nodeInformer != nil {
+		synced = append(synced, s.nodeInformer.HasSynced)
+	}
+	if s.nsInformer != nil {
+		synced = append(synced, s.nsInformer.HasSynced)
+	}
+	if s.crInformer != nil {
+		synced = append(synced, s.crInformer.HasSynced)
+	}
+	if ok := cache.WaitForCacheSync(ctx.Done(), synced...); !ok {
 		return errCacheSyncFailed
 	}
 
@@ -51,10 +154,39 @@ func (s *Service) Run(ctx context.Context) error {
 		klog.InfoS("informer caches synced")
 	})
 
+	if s.podCacheTTL > 0 {
+		go s.runJanitor(ctx)
+	}
+
 	<-ctx.Done()
 	return ctx.Err()
 }
 
+// runJanitor evicts expired pod cache entries until the context is cancelled.
+func (s *Service) runJanitor(ctx context.Context) {
+	ticker := time.NewTicker(s.podCacheTTL / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.cache.EvictExpired()
+		}
+	}
+}
+
+// HasSynced reports whether the informer caches have completed their initial sync.
+func (s *Service) HasSynced() bool {
+	select {
+	case <-s.synced:
+		return true
+	default:
+		return false
+	}
+}
+
 // WaitForSync blocks until the informers report a synced cache or the context is cancelled.
 func (s *Service) WaitForSync(ctx context.Context) error {
 	select {
@@ -70,20 +202,113 @@ func (s *Service) NodeIPs() []string {
 	return s.cache.NodeIPs()
 }
 
+// NodeTargets returns the cached nodes with their names and IP addresses, or
+// the fallback targets when no node is cached.
+func (s *Service) NodeTargets() []NodeTarget {
+	targets := s.cache.NodeTargets()
+	if len(targets) == 0 && len(s.fallbackNodes) > 0 {
+		klog.V(2).InfoS("no nodes cached; scraping fallback targets", "targets", len(s.fallbackNodes))
+		return slices.Clone(s.fallbackNodes)
+	}
+	return targets
+}
+
 // PodLabels resolves pod labels with a cache-first lookup and informer fallback.
 func (s *Service) PodLabels(namespace, podName string) map[string]string {
 	if labels, ok := s.cache.PodLabels(namespace, podName); ok {
 		return labels
 	}
 
+	pod := s.lookupPod(namespace, podName)
+	if pod == nil {
+		return nil
+	}
+	return cloneStringMap(pod.Labels)
+}
+
+// PodAnnotations resolves pod annotations with a cache-first lookup and
+// informer fallback. It returns nil unless annotations are cached.
+func (s *Service) PodAnnotations(namespace, podName string) map[string]string {
+	if !s.podAnnotations {
+		return nil
+	}
+	if annotations, ok := s.cache.PodAnnotations(namespace, podName); ok {
+		return annotations
+	}
+
+	pod := s.lookupPod(namespace, podName)
+	if pod == nil {
+		return nil
+	}
+	return cloneStringMap(pod.Annotations)
+}
+
+// lookupPod reads a pod from the informer lister and refreshes its cache entry.
+func (s *Service) lookupPod(namespace, podName string) *corev1.Pod {
+	if s.podInformer == nil {
+		return nil
+	}
 	pod, err := s.factory.Core().V1().Pods().Lister().Pods(namespace).Get(podName)
 	if err != nil {
-		klog.V(4).InfoS("pod labels unavailable from lister", "pod", cacheKey(namespace, podName), "err", err)
+		klog.V(4).InfoS("pod unavailable from lister", "pod", cacheKey(namespace, podName), "err", err)
 		return nil
 	}
 
-	s.cache.StorePodLabels(namespace, podName, pod.Labels)
-	return cloneStringMap(pod.Labels)
+	storePod(s.cache, pod, s.podAnnotations)
+	return pod
+}
+
+// NamespaceLabels returns the cached labels of a namespace, or nil when the
+// namespace is unknown or namespaces are not watched.
+func (s *Service) NamespaceLabels(namespace string) map[string]string {
+	labels, _ := s.cache.NamespaceLabels(namespace)
+	return labels
+}
+
+// CustomResourceLabels returns the labels of the custom resource object that
+// the pod names through the join label, or nil when no custom resource is
+// watched, the pod carries no join label or the object is unknown.
+func (s *Service) CustomResourceLabels(namespace, podName string) map[string]string {
+	if s.crInformer == nil {
+		return nil
+	}
+	name := strings.TrimSpace(s.PodLabels(namespace, podName)[s.crJoinLabel])
+	if name == "" {
+		return nil
+	}
+	labels, _ := s.cache.CustomResourceLabels(namespace, name)
+	return labels
+}
+
+// ContainerMetadata returns the "container:" fields of the named container
+// (regular or init) of a pod, read from the pod informer's cached spec, or
+// nil when the pod or container is unknown.
+func (s *Service) ContainerMetadata(namespace, podName, container string) map[string]string {
+	pod := s.lookupPod(namespace, podName)
+	if pod == nil {
+		return nil
+	}
+	for _, containers := range [][]corev1.Container{pod.Spec.Containers, pod.Spec.InitContainers} {
+		for i := range containers {
+			if containers[i].Name == container {
+				return containerFields(&containers[i])
+			}
+		}
+	}
+	return nil
+}
+
+// UniqueCustomResourceLabelValues returns all unique cached values for the
+// provided custom resource label key.
+func (s *Service) UniqueCustomResourceLabelValues(label string) []string {
+	return s.cache.UniqueCustomResourceLabelValues(label)
+}
+
+// NodeLabels returns the cached labels of a node, or nil when the node is
+// unknown or static node targets are used.
+func (s *Service) NodeLabels(nodeName string) map[string]string {
+	labels, _ := s.cache.NodeLabels(nodeName)
+	return labels
 }
 
 // UniqueLabelValues returns all unique cached values for the provided label key.
@@ -91,9 +316,42 @@ func (s *Service) UniqueLabelValues(label string) []string {
 	return s.cache.UniqueLabelValues(label)
 }
 
+// UniqueAnnotationValues returns all unique cached values for the provided pod
+// annotation key.
+func (s *Service) UniqueAnnotationValues(annotation string) []string {
+	return s.cache.UniqueAnnotationValues(annotation)
+}
+
+// UniqueNodeLabelValues returns all unique cached values for the provided node
+// label key.
+func (s *Service) UniqueNodeLabelValues(label string) []string {
+	return s.cache.UniqueNodeLabelValues(label)
+}
+
+// UniqueNamespaceLabelValues returns all unique cached values for the provided
+// namespace label key.
+func (s *Service) UniqueNamespaceLabelValues(label string) []string {
+	return s.cache.UniqueNamespaceLabelValues(label)
+}
+
 func (s *Service) registerHandlers() {
-	s.nodeInformer.AddEventHandler(newNodeEventHandler(s.cache))
-	s.podInformer.AddEventHandler(newPodEventHandler(s.cache))
+	if s.nodeInformer != nil {
+		s.nodeInformer.AddEventHandler(newNodeEventHandler(s.cache, s.nodeSelector))
+	}
+	if s.podInformer != nil {
+		s.podInformer.AddEventHandler(newPodEventHandler(s.cache, s.podAnnotations))
+	}
+	if s.nsInformer != nil {
+		s.nsInformer.AddEventHandler(newNamespaceEventHandler(s.cache))
+	}
+	if s.crInformer != nil {
+		s.crInformer.AddEventHandler(newCustomResourceEventHandler(s.cache))
+	}
+}
+
+// CacheSnapshot returns the cached nodes and up to maxPods pods.
+func (s *Service) CacheSnapshot(maxPods int) CacheSnapshot {
+	return s.cache.Snapshot(maxPods)
 }
 
 // DebugString returns a snapshot of key cache statistics for logging.
@@ -0,0 +1,227 @@
+package metrics
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// caBundle holds the pool of CAs trusted for kubelet serving certificates and
+// re-reads it from disk periodically. file is a comma-separated list of PEM
+// files or directories, so several CAs can be trusted at once, e.g. while a
+// CA is rotated. Only these CAs are trusted, not the system roots. Each new
+// connection is verified against the pool current at dial time, so a reload
+// takes effect without rebuilding the shared transport.
+type caBundle struct {
+	file     string
+	interval time.Duration
+
+	mu       sync.RWMutex
+	pool     *x509.CertPool
+	loadedAt time.Time
+}
+
+func newCABundle(file string, interval time.Duration) *caBundle {
+	b := &caBundle{file: file, interval: interval}
+	if err := b.load(); err != nil {
+		klog.Warningf("unable to load CA certificate from %s: %v", file, err)
+	}
+	return b
+}
+
+// load rebuilds the pool from the configured files. On failure the
+// previously loaded pool is kept; before the first successful load the pool
+// is empty, so every kubelet certificate is rejected.
+func (b *caBundle) load() error {
+	pool := x509.NewCertPool()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.loadedAt = time.Now()
+	if b.pool == nil {
+		b.pool = pool
+	}
+
+	files, err := caFiles(b.file)
+	if err != nil {
+		return err
+	}
+
+	loaded := 0
+	var errs []error
+	for _, file := range files {
+		n, err := appendCertFile(pool, file)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		loaded += n
+	}
+	if loaded == 0 {
+		errs = append(errs, fmt.Errorf("no PEM certificates found"))
+		return errors.Join(errs...)
+	}
+	for _, err := range errs {
+		klog.Warningf("skipping unreadable CA file: %v", err)
+	}
+
+	b.pool = pool
+	klog.V(2).InfoS("loaded kubelet CA certificates", "certificates", loaded, "files", len(files))
+	return nil
+}
+
+// caFiles expands a comma-separated list of files and directories into the
+// files to read. Directory entries starting with "." are skipped, which
+// covers the "..data" links of mounted ConfigMaps and Secrets.
+func caFiles(spec string) ([]string, error) {
+	var files []string
+	for _, path := range strings.Split(spec, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file: %w", err)
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("read CA directory: %w", err)
+		}
+		var names []string
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			full := filepath.Join(path, entry.Name())
+			if info, err := os.Stat(full); err == nil && info.Mode().IsRegular() {
+				names = append(names, full)
+			}
+		}
+		sort.Strings(names)
+		files = append(files, names...)
+	}
+	return files, nil
+}
+
+// appendCertFile adds every certificate of a PEM file to pool and returns how
+// many were added.
+func appendCertFile(pool *x509.CertPool, file string) (int, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return 0, fmt.Errorf("read CA file: %w", err)
+	}
+
+	added := 0
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return added, fmt.Errorf("parse certificate in %s: %w", file, err)
+		}
+		pool.AddCert(cert)
+		added++
+	}
+	return added, nil
+}
+
+// maybeReload re-reads the CA file once the reload interval has elapsed.
+func (b *caBundle) maybeReload() {
+	if b.interval <= 0 {
+		return
+	}
+
+	b.mu.RLock()
+	due := time.Since(b.loadedAt) >= b.interval
+	b.mu.RUnlock()
+	if !due {
+		return
+	}
+
+	if err := b.load(); err != nil {
+		klog.Warningf("unable to reload CA certificate from %s, keeping previous pool: %v", b.file, err)
+		return
+	}
+	klog.V(4).InfoS("reloaded kubelet CA bundle", "file", b.file)
+}
+
+func (b *caBundle) currentPool() *x509.CertPool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.pool
+}
+
+// serverNamePlaceholder is replaced with the node name in TLS_SERVER_NAME.
+const serverNamePlaceholder = "{node}"
+
+// serverNameKey is the context key carrying the TLS server name a kubelet
+// request must be verified against.
+type serverNameKey struct{}
+
+// tlsServerName renders a TLS_SERVER_NAME template for node.
+func tlsServerName(template string, node NodeTarget) string {
+	return strings.ReplaceAll(template, serverNamePlaceholder, node.Name)
+}
+
+// newKubeletDialer returns a DialTLSContext function that leaves chain and
+// hostname verification to crypto/tls. Each connection is verified against
+// the dialled host, or against the server name carried in the request
+// context when TLS_SERVER_NAME is set, and trusts the current pool of bundle
+// when it is non-nil. Connections are pooled per address, and each address is
+// a single node, so a pooled connection always carries the right name.
+func newKubeletDialer(cfg *tls.Config, bundle *caBundle) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		// cfg is cloned per connection because the transport adds its ALPN
+		// protocols to it after construction.
+		connCfg := cfg.Clone()
+		if name, _ := ctx.Value(serverNameKey{}).(string); name != "" {
+			connCfg.ServerName = name
+		} else if host, _, err := net.SplitHostPort(addr); err == nil {
+			connCfg.ServerName = host
+		}
+		if bundle != nil {
+			connCfg.RootCAs = bundle.currentPool()
+		}
+
+		tlsConn := tls.Client(conn, connCfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
+
+func buildTLSConfig(insecureSkipVerify bool) *tls.Config {
+	return &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+}
@@ -0,0 +1,281 @@
+package metrics
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTLSKubelet starts an HTTPS server whose certificate is valid for
+// 127.0.0.1 and example.com, and writes its CA to a PEM file.
+func newTLSKubelet(t *testing.T) (*httptest.Server, string) {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Proto))
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	file := filepath.Join(t.TempDir(), "ca.crt")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return srv, file
+}
+
+func kubeletGet(t *testing.T, bundle *caBundle, url, serverName string) (string, error) {
+	t.Helper()
+	tr := &http.Transport{TLSClientConfig: buildTLSConfig(false), ForceAttemptHTTP2: true}
+	tr.DialTLSContext = newKubeletDialer(tr.TLSClientConfig, bundle)
+	defer tr.CloseIdleConnections()
+
+	ctx := context.Background()
+	if serverName != "" {
+		ctx = context.WithValue(ctx, serverNameKey{}, serverName)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	return resp.Proto, nil
+}
+
+func TestKubeletDialerVerifiesDialledIP(t *testing.T) {
+	srv, caFile := newTLSKubelet(t)
+	bundle := newCABundle(caFile, 0)
+
+	proto, err := kubeletGet(t, bundle, srv.URL, "")
+	if err != nil {
+		t.Fatalf("scrape by IP with the configured CA: %v", err)
+	}
+	if proto != "HTTP/2.0" {
+		t.Errorf("negotiated %s, want HTTP/2.0", proto)
+	}
+}
+
+func TestKubeletDialerServerName(t *testing.T) {
+	srv, caFile := newTLSKubelet(t)
+	bundle := newCABundle(caFile, 0)
+
+	if _, err := kubeletGet(t, bundle, srv.URL, "example.com"); err != nil {
+		t.Errorf("server name covered by the certificate: %v", err)
+	}
+	if _, err := kubeletGet(t, bundle, srv.URL, "bad.test"); err == nil {
+		t.Error("server name not covered by the certificate was accepted")
+	}
+}
+
+func TestKubeletDialerRejectsUntrustedCA(t *testing.T) {
+	srv, _ := newTLSKubelet(t)
+
+	// A CA file without certificates leaves the pool empty; the system roots
+	// must not be trusted in its place.
+	empty := filepath.Join(t.TempDir(), "empty.crt")
+	if err := os.WriteFile(empty, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kubeletGet(t, newCABundle(empty, 0), srv.URL, ""); err == nil {
+		t.Error("certificate accepted with no CA loaded")
+	}
+}
+
+func TestTLSServerName(t *testing.T) {
+	node := NodeTarget{Name: "worker-1", IP: "10.0.0.1"}
+	tests := map[string]string{
+		"{node}":                   "worker-1",
+		"{node}.nodes.example.com": "worker-1.nodes.example.com",
+		"kubelet":                  "kubelet",
+	}
+	for template, want := range tests {
+		if got := tlsServerName(template, node); got != want {
+			t.Errorf("tlsServerName(%q) = %q, want %q", template, got, want)
+		}
+	}
+}
+
+func TestCAFilesSkipsHiddenEntries(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"b.crt", "a.crt", ".hidden", "..data"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := caFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(dir, "a.crt"), filepath.Join(dir, "b.crt")}
+	if len(files) != len(want) || files[0] != want[0] || files[1] != want[1] {
+		t.Errorf("caFiles = %v, want %v", files, want)
+	}
+}
+
+func TestBuildTLSConfigKeepsVerification(t *testing.T) {
+	if cfg := buildTLSConfig(false); cfg.InsecureSkipVerify || cfg.VerifyConnection != nil {
+		t.Error("buildTLSConfig disabled crypto/tls verification")
+	}
+	if cfg := buildTLSConfig(true); !cfg.InsecureSkipVerify {
+		t.Error("INSECURE_SKIP_VERIFY not honoured")
+	}
+}
+
+// newSelfSignedKubelet starts an HTTPS server with a fresh self-signed
+// certificate for 127.0.0.1, so every call yields a different CA.
+func newSelfSignedKubelet(t *testing.T) (*httptest.Server, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "kubelet"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Proto))
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestCABundleReloadTrustsRotatedCA(t *testing.T) {
+	oldSrv, oldCA := newSelfSignedKubelet(t)
+	newSrv, newCA := newSelfSignedKubelet(t)
+	file := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(file, oldCA, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	bundle := newCABundle(file, time.Nanosecond)
+	if _, err := kubeletGet(t, bundle, oldSrv.URL, ""); err != nil {
+		t.Fatalf("kubelet signed by the loaded CA: %v", err)
+	}
+	if _, err := kubeletGet(t, bundle, newSrv.URL, ""); err == nil {
+		t.Fatal("kubelet signed by a CA not yet in the file was accepted")
+	}
+
+	if err := os.WriteFile(file, newCA, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	bundle.maybeReload()
+	if _, err := kubeletGet(t, bundle, newSrv.URL, ""); err != nil {
+		t.Errorf("kubelet signed by the rotated CA after reload: %v", err)
+	}
+	if _, err := kubeletGet(t, bundle, oldSrv.URL, ""); err == nil {
+		t.Error("kubelet signed by the removed CA was still accepted")
+	}
+}
+
+func TestCABundleReloadKeepsPoolOnBadFile(t *testing.T) {
+	srv, ca := newSelfSignedKubelet(t)
+	file := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(file, ca, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	bundle := newCABundle(file, time.Nanosecond)
+
+	if err := os.WriteFile(file, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	bundle.maybeReload()
+	if _, err := kubeletGet(t, bundle, srv.URL, ""); err != nil {
+		t.Errorf("previous CA pool was not kept after a failed reload: %v", err)
+	}
+}
+
+func TestCABundleDoesNotTrustSystemRoots(t *testing.T) {
+	_, ca := newSelfSignedKubelet(t)
+	file := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(file, ca, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	system, err := x509.SystemCertPool()
+	if err != nil || len(system.Subjects()) == 0 {
+		t.Skip("no system roots to compare against")
+	}
+	if got := len(newCABundle(file, 0).currentPool().Subjects()); got != 1 {
+		t.Errorf("pool holds %d certificates, want only the configured CA", got)
+	}
+}
+
+func TestCABundleTrustsEveryFile(t *testing.T) {
+	srvA, caA := newSelfSignedKubelet(t)
+	srvB, caB := newSelfSignedKubelet(t)
+	dir := t.TempDir()
+	fileA, fileB := filepath.Join(dir, "a.crt"), filepath.Join(dir, "b.crt")
+	for file, data := range map[string][]byte{fileA: caA, fileB: caB} {
+		if err := os.WriteFile(file, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, spec := range []string{fileA + ", " + fileB, dir} {
+		bundle := newCABundle(spec, 0)
+		if got := len(bundle.currentPool().Subjects()); got != 2 {
+			t.Errorf("%q: pool holds %d certificates, want 2", spec, got)
+		}
+		for _, srv := range []*httptest.Server{srvA, srvB} {
+			if _, err := kubeletGet(t, bundle, srv.URL, ""); err != nil {
+				t.Errorf("%q: kubelet %s rejected: %v", spec, srv.URL, err)
+			}
+		}
+	}
+}
+
+func TestCABundleLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.crt")
+	_, ca := newSelfSignedKubelet(t)
+	if err := os.WriteFile(good, ca, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(dir, "empty.crt")
+	if err := os.WriteFile(empty, []byte("no certificates here"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := (&caBundle{file: good + "," + empty}).load(); err != nil {
+		t.Errorf("a file without certificates next to a good one failed the load: %v", err)
+	}
+	if err := (&caBundle{file: empty}).load(); err == nil {
+		t.Error("loading only a file without certificates succeeded")
+	}
+	if err := (&caBundle{file: filepath.Join(dir, "missing.crt")}).load(); err == nil {
+		t.Error("loading a missing file succeeded")
+	}
+}
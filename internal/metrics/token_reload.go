@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// minTokenReloadInterval spaces out token re-reads triggered by rejected
+// requests, so a token that is genuinely invalid does not make every failing
+// node hit the disk.
+const minTokenReloadInterval = 10 * time.Second
+
+// tokenReloader re-reads the service account token when a kubelet rejects the
+// one a cycle started with, which happens for the rest of a cycle after the
+// token is rotated on disk.
+type tokenReloader struct {
+	read func() (string, error)
+
+	mu       sync.Mutex
+	token    string
+	loadedAt time.Time
+}
+
+// refresh returns a token different from stale, reporting false when none is
+// available. Workers rejected together share one re-read: after a reload,
+// later callers within minTokenReloadInterval receive the reloaded token
+// without reading the file again.
+func (r *tokenReloader) refresh(stale string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.loadedAt) < minTokenReloadInterval {
+		return r.token, r.token != "" && r.token != stale
+	}
+	r.loadedAt = time.Now()
+
+	token, err := r.read()
+	if err != nil {
+		klog.Warningf("unable to reload service account token after kubelet rejected it: %v", err)
+		return "", false
+	}
+	r.token = token
+	if token == stale {
+		return "", false
+	}
+	klog.InfoS("reloaded service account token after kubelet rejected it")
+	return token, true
+}
+
+// isAuthError reports whether err is a kubelet response rejecting the
+// request's credentials.
+func isAuthError(err error) bool {
+	var se *statusError
+	return errors.As(err, &se) && (se.code == http.StatusUnauthorized || se.code == http.StatusForbidden)
+}
@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestTokenReloaderRefresh(t *testing.T) {
+	reads := 0
+	current := "new"
+	r := &tokenReloader{read: func() (string, error) {
+		reads++
+		return current, nil
+	}}
+
+	if got, ok := r.refresh("old"); !ok || got != "new" {
+		t.Fatalf("refresh(old) = %q, %v; want new, true", got, ok)
+	}
+	// A second rejected worker shares the reload instead of re-reading.
+	if got, ok := r.refresh("old"); !ok || got != "new" || reads != 1 {
+		t.Errorf("shared refresh = %q, %v after %d reads; want new, true after 1", got, ok, reads)
+	}
+	// The reloaded token was rejected too: no further reads within the interval.
+	if _, ok := r.refresh("new"); ok || reads != 1 {
+		t.Errorf("refresh of the reloaded token = %v after %d reads; want false after 1", ok, reads)
+	}
+}
+
+func TestTokenReloaderUnchangedOrUnreadable(t *testing.T) {
+	r := &tokenReloader{read: func() (string, error) { return "old", nil }}
+	if _, ok := r.refresh("old"); ok {
+		t.Error("refresh succeeded although the token on disk did not change")
+	}
+
+	r = &tokenReloader{read: func() (string, error) { return "", errors.New("no such file") }}
+	if _, ok := r.refresh("old"); ok {
+		t.Error("refresh succeeded although the token could not be read")
+	}
+}
+
+func TestIsAuthError(t *testing.T) {
+	for code, want := range map[int]bool{401: true, 403: true, 404: false, 500: false} {
+		err := fmt.Errorf("fetch: %w", &statusError{code: code})
+		if got := isAuthError(err); got != want {
+			t.Errorf("isAuthError(%d) = %v, want %v", code, got, want)
+		}
+	}
+	if isAuthError(errors.New("connection refused")) {
+		t.Error("a transport error was treated as an auth error")
+	}
+}
@@ -0,0 +1,284 @@
+// Package selfmetrics holds the exporter's own operational metrics and renders
+// them in the Prometheus text exposition format.
+package selfmetrics
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// metric is implemented by every value type held in a Registry.
+type metric interface {
+	metricName() string
+	write(b *strings.Builder)
+}
+
+// Registry is a set of metrics rendered together.
+type Registry struct {
+	mu      sync.RWMutex
+	metrics []metric
+}
+
+var defaultRegistry = &Registry{}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+	sort.Slice(r.metrics, func(i, j int) bool { return r.metrics[i].metricName() < r.metrics[j].metricName() })
+}
+
+// Render returns every registered metric in Prometheus text format.
+func (r *Registry) Render() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var b strings.Builder
+	for _, m := range r.metrics {
+		m.write(&b)
+	}
+	return b.String()
+}
+
+// Render returns every metric in the default registry in Prometheus text format.
+func Render() string {
+	return defaultRegistry.Render()
+}
+
+// value is a float64 that can be updated atomically.
+type value struct {
+	bits uint64
+}
+
+func (v *value) load() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+func (v *value) store(f float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(f))
+}
+
+func (v *value) add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		next := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&v.bits, old, next) {
+			return
+		}
+	}
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	desc
+	v value
+}
+
+// NewCounter registers a counter in the default registry.
+func NewCounter(name, help string) *Counter {
+	c := &Counter{desc: desc{name: name, help: help, typ: "counter"}}
+	defaultRegistry.register(c)
+	return c
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() { c.v.add(1) }
+
+// Add increments the counter by delta, which must not be negative.
+func (c *Counter) Add(delta float64) {
+	if delta > 0 {
+		c.v.add(delta)
+	}
+}
+
+// Value returns the current counter value.
+func (c *Counter) Value() float64 { return c.v.load() }
+
+func (c *Counter) write(b *strings.Builder) {
+	c.writeHeader(b)
+	writeSample(b, c.name, nil, nil, c.v.load())
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	desc
+	v value
+}
+
+// NewGauge registers a gauge in the default registry.
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{desc: desc{name: name, help: help, typ: "gauge"}}
+	defaultRegistry.register(g)
+	return g
+}
+
+// Set replaces the gauge value.
+func (g *Gauge) Set(f float64) { g.v.store(f) }
+
+// Add adjusts the gauge value by delta.
+func (g *Gauge) Add(delta float64) { g.v.add(delta) }
+
+// Value returns the current gauge value.
+func (g *Gauge) Value() float64 { return g.v.load() }
+
+func (g *Gauge) write(b *strings.Builder) {
+	g.writeHeader(b)
+	writeSample(b, g.name, nil, nil, g.v.load())
+}
+
+// CounterVec is a counter partitioned by a fixed set of label names.
+type CounterVec struct {
+	vec
+}
+
+// NewCounterVec registers a labelled counter in the default registry.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec{desc: desc{name: name, help: help, typ: "counter"}, labels: labels}}
+	defaultRegistry.register(c)
+	return c
+}
+
+// Inc increments the series identified by labelValues by one.
+func (c *CounterVec) Inc(labelValues ...string) { c.child(labelValues).add(1) }
+
+// Add increments the series identified by labelValues by delta.
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta > 0 {
+		c.child(labelValues).add(delta)
+	}
+}
+
+// GaugeVec is a gauge partitioned by a fixed set of label names.
+type GaugeVec struct {
+	vec
+}
+
+// NewGaugeVec registers a labelled gauge in the default registry.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{vec{desc: desc{name: name, help: help, typ: "gauge"}, labels: labels}}
+	defaultRegistry.register(g)
+	return g
+}
+
+// Set replaces the value of the series identified by labelValues.
+func (g *GaugeVec) Set(f float64, labelValues ...string) { g.child(labelValues).store(f) }
+
+// Reset removes every series so stale label combinations stop being reported.
+func (g *GaugeVec) Reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.children = nil
+}
+
+type desc struct {
+	name string
+	help string
+	typ  string
+}
+
+func (d desc) metricName() string { return d.name }
+
+func (d desc) writeHeader(b *strings.Builder) {
+	b.WriteString("# HELP ")
+	b.WriteString(d.name)
+	b.WriteByte(' ')
+	b.WriteString(d.help)
+	b.WriteString("\n# TYPE ")
+	b.WriteString(d.name)
+	b.WriteByte(' ')
+	b.WriteString(d.typ)
+	b.WriteByte('\n')
+}
+
+type vec struct {
+	desc
+	labels   []string
+	mu       sync.RWMutex
+	children map[string]*vecChild
+}
+
+type vecChild struct {
+	labelValues []string
+	value
+}
+
+// Value returns the current value of the series identified by labelValues.
+func (v *vec) Value(labelValues ...string) float64 {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if child, ok := v.children[strings.Join(labelValues, "\xff")]; ok {
+		return child.load()
+	}
+	return 0
+}
+
+func (v *vec) child(labelValues []string) *vecChild {
+	key := strings.Join(labelValues, "\xff")
+
+	v.mu.RLock()
+	child, ok := v.children[key]
+	v.mu.RUnlock()
+	if ok {
+		return child
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if child, ok := v.children[key]; ok {
+		return child
+	}
+	if v.children == nil {
+		v.children = make(map[string]*vecChild)
+	}
+	child = &vecChild{labelValues: append([]string(nil), labelValues...)}
+	v.children[key] = child
+	return child
+}
+
+func (v *vec) write(b *strings.Builder) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	v.writeHeader(b)
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		child := v.children[key]
+		writeSample(b, v.name, v.labels, child.labelValues, child.load())
+	}
+}
+
+func writeSample(b *strings.Builder, name string, labels, labelValues []string, f float64) {
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(label)
+			b.WriteString(`="`)
+			if i < len(labelValues) {
+				b.WriteString(escape(labelValues[i]))
+			}
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+	b.WriteByte('\n')
+}
+
+func escape(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return strings.ReplaceAll(s, "\n", `\n`)
+}
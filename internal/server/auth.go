@@ -0,0 +1,30 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// requireAuth wraps next so that it is only served to requests carrying the
+// configured bearer token. It is a no-op when no token is configured.
+func (s *MetricsServer) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	if s.authToken == "" {
+		return next
+	}
+
+	expected := []byte(s.authToken)
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), expected) != 1 {
+			klog.V(4).InfoS("rejected unauthenticated request", "path", r.URL.Path, "remote", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="kubelet-cadvisor-addlabel"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte("unauthorized\n"))
+			return
+		}
+		next(w, r)
+	}
+}
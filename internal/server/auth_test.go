@@ -0,0 +1,73 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAuthProtectsDebugEndpoints(t *testing.T) {
+	srv := NewMetricsServer(Options{AuthToken: "secret", EnablePprof: true})
+	srv.Update("up 1\n")
+
+	paths := []string{"/metrics", "/status", "/debug/pprof/", "/debug/pprof/cmdline", "/debug/pprof/symbol"}
+	for _, path := range paths {
+		rec := httptest.NewRecorder()
+		srv.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("GET %s without token: status %d, want %d", path, rec.Code, http.StatusUnauthorized)
+		}
+
+		rec = httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		srv.server.Handler.ServeHTTP(rec, req)
+		if rec.Code == http.StatusUnauthorized {
+			t.Errorf("GET %s with token: rejected", path)
+		}
+	}
+}
+
+func TestRequireAuthDisabledWithoutToken(t *testing.T) {
+	srv := NewMetricsServer(Options{EnablePprof: true})
+
+	rec := httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/pprof/cmdline", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestRequireAuthTokens(t *testing.T) {
+	srv := NewMetricsServer(Options{AuthToken: "secret"})
+	srv.Update("up 1\n")
+
+	tests := []struct {
+		name          string
+		path          string
+		authorization string
+		want          int
+	}{
+		{"missing token", "/metrics", "", http.StatusUnauthorized},
+		{"wrong token", "/metrics", "Bearer nope", http.StatusUnauthorized},
+		{"token prefix", "/metrics", "Bearer secre", http.StatusUnauthorized},
+		{"wrong scheme", "/metrics", "Basic secret", http.StatusUnauthorized},
+		{"correct token", "/metrics", "Bearer secret", http.StatusOK},
+		{"self metrics", "/self-metrics", "", http.StatusUnauthorized},
+		{"health unauthenticated", "/health", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.authorization != "" {
+			req.Header.Set("Authorization", tt.authorization)
+		}
+		srv.server.Handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: GET %s status %d, want %d", tt.name, tt.path, rec.Code, tt.want)
+		}
+		if tt.want == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: 401 without a WWW-Authenticate challenge", tt.name)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// defaultCacheDumpPods and maxCacheDumpPods bound the pods listed by
+	// /debug/cache; the limit query parameter picks a value in between.
+	defaultCacheDumpPods = 100
+	maxCacheDumpPods     = 1000
+)
+
+func (s *MetricsServer) handleCacheDump(w http.ResponseWriter, r *http.Request) {
+	limit := defaultCacheDumpPods
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			http.Error(w, "limit must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxCacheDumpPods)
+	}
+
+	body, err := json.MarshalIndent(s.cacheDump(limit), "", "  ")
+	if err != nil {
+		klog.ErrorS(err, "encode cache dump")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+	_, _ = w.Write([]byte("\n"))
+}
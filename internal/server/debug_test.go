@@ -0,0 +1,70 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandleCacheDump(t *testing.T) {
+	var gotLimit int
+	srv := NewMetricsServer(Options{AuthToken: "secret", CacheDump: func(maxPods int) any {
+		gotLimit = maxPods
+		return map[string]any{"nodes": map[string]string{"worker-1": "10.0.0.1"}}
+	}})
+
+	tests := []struct {
+		query     string
+		wantCode  int
+		wantLimit int
+	}{
+		{"", http.StatusOK, defaultCacheDumpPods},
+		{"?limit=5", http.StatusOK, 5},
+		{"?limit=0", http.StatusOK, 0},
+		{"?limit=100000", http.StatusOK, maxCacheDumpPods},
+		{"?limit=-1", http.StatusBadRequest, -1},
+		{"?limit=many", http.StatusBadRequest, -1},
+	}
+	for _, tt := range tests {
+		gotLimit = -1
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/debug/cache"+tt.query, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		srv.server.Handler.ServeHTTP(rec, req)
+		if rec.Code != tt.wantCode {
+			t.Errorf("GET /debug/cache%s: status %d, want %d", tt.query, rec.Code, tt.wantCode)
+			continue
+		}
+		if gotLimit != tt.wantLimit {
+			t.Errorf("GET /debug/cache%s: limit %d, want %d", tt.query, gotLimit, tt.wantLimit)
+		}
+		if tt.wantCode != http.StatusOK {
+			continue
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		var body struct {
+			Nodes map[string]string `json:"nodes"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Nodes["worker-1"] != "10.0.0.1" {
+			t.Errorf("body %q: %v", rec.Body.String(), err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/cache", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET /debug/cache without token: status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestCacheDumpDisabled(t *testing.T) {
+	srv := NewMetricsServer(Options{})
+	rec := httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/cache", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
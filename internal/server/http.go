@@ -1,46 +1,210 @@
 package server
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/puzhihao/kubelet-cadvisor-addlabel/internal/selfmetrics"
+
 	"k8s.io/klog/v2"
 )
 
 // MetricsServer exposes the aggregated metrics payload over HTTP.
 type MetricsServer struct {
-	mu     sync.RWMutex
-	data   string
-	server *http.Server
+	mu sync.RWMutex
+	// data is the payload served under /metrics; gzipped is its compressed
+	// form when precompression is enabled. Both are replaced, never mutated.
+	data        []byte
+	gzipped     []byte
+	precompress bool
+	lastUpdate  time.Time
+	nodes       map[string]NodeStatus
+	ready       bool
+	// warmupUntil withholds readiness until it has passed, even once ready
+	// is set.
+	warmupUntil time.Time
+	server      *http.Server
+	certFile    string
+	keyFile     string
+	authToken   string
+	openMetrics bool
+	cacheDump   func(maxPods int) any
+	refresh     func(ctx context.Context) error
+	pprof       bool
+	generate    func(ctx context.Context, w io.Writer) error
+	// failures counts consecutive failed collection cycles; /health/deep
+	// reports unhealthy once it reaches failureThreshold.
+	failures         int
+	failureThreshold int
+}
+
+// Options configures the metrics HTTP server.
+type Options struct {
+	Port int
+	// ListenAddress is the IP address to bind; all interfaces when empty.
+	ListenAddress string
+	// TLSCertFile and TLSKeyFile enable HTTPS when both are set.
+	TLSCertFile string
+	TLSKeyFile  string
+	// AuthToken, when set, is required as a bearer token on data endpoints.
+	AuthToken string
+	// OpenMetrics serves the payload with the OpenMetrics content type.
+	OpenMetrics bool
+	// PrecompressGzip compresses each payload once in Update and serves that
+	// copy to clients accepting gzip, instead of sending it uncompressed.
+	PrecompressGzip bool
+	// EnablePprof registers the net/http/pprof handlers under /debug/pprof/.
+	EnablePprof bool
+	// CacheDump, when set, serves its result as JSON under /debug/cache,
+	// listing at most the requested number of pods.
+	CacheDump func(maxPods int) any
+	// WarmupDuration keeps /ready failing for this long after the server is
+	// created, so a just-started replica is not hit by every scraper at once.
+	WarmupDuration time.Duration
+	// DeepHealthFailures is how many consecutive failed collection cycles
+	// make /health/deep report unhealthy; one is used when it is not positive.
+	DeepHealthFailures int
+	// Refresh, when set, runs a collection cycle out of band for POST /refresh.
+	Refresh func(ctx context.Context) error
+	// Generate, when set, is called on every /metrics request to write a
+	// freshly collected payload instead of serving the one passed to Update.
+	Generate func(ctx context.Context, w io.Writer) error
 }
 
-// NewMetricsServer creates a metrics HTTP server bound to the provided port.
-func NewMetricsServer(port int) *MetricsServer {
+// NewMetricsServer creates a metrics HTTP server bound to the configured port.
+func NewMetricsServer(opts Options) *MetricsServer {
 	mux := http.NewServeMux()
 	srv := &MetricsServer{
 		server: &http.Server{
-			Addr:    fmt.Sprintf(":%d", port),
+			Addr:    net.JoinHostPort(opts.ListenAddress, strconv.Itoa(opts.Port)),
 			Handler: mux,
 		},
+		certFile:    opts.TLSCertFile,
+		keyFile:     opts.TLSKeyFile,
+		authToken:   opts.AuthToken,
+		openMetrics: opts.OpenMetrics,
+		precompress: opts.PrecompressGzip,
+		cacheDump:   opts.CacheDump,
+		refresh:     opts.Refresh,
+		pprof:       opts.EnablePprof,
+		generate:    opts.Generate,
+		warmupUntil: time.Now().Add(opts.WarmupDuration),
+
+		failureThreshold: max(opts.DeepHealthFailures, 1),
 	}
 
-	mux.HandleFunc("/metrics", srv.handleMetrics)
+	mux.HandleFunc("/metrics", srv.requireAuth(srv.handleMetrics))
 	mux.HandleFunc("/health", srv.handleHealth)
+	mux.HandleFunc("/health/deep", srv.handleDeepHealth)
+	mux.HandleFunc("/ready", srv.handleReady)
+	mux.HandleFunc("/status", srv.requireAuth(srv.handleStatus))
+	mux.HandleFunc("/self-metrics", srv.requireAuth(srv.handleSelfMetrics))
 	mux.HandleFunc("/", srv.handleInfo)
 
+	if opts.Refresh != nil {
+		mux.HandleFunc("/refresh", srv.requireAuth(srv.handleRefresh))
+	}
+
+	if opts.CacheDump != nil {
+		mux.HandleFunc("/debug/cache", srv.requireAuth(srv.handleCacheDump))
+		klog.InfoS("cache dump endpoint enabled", "path", "/debug/cache")
+	}
+
+	if opts.EnablePprof {
+		mux.HandleFunc("/debug/pprof/", srv.requireAuth(pprof.Index))
+		mux.HandleFunc("/debug/pprof/cmdline", srv.requireAuth(pprof.Cmdline))
+		mux.HandleFunc("/debug/pprof/profile", srv.requireAuth(pprof.Profile))
+		mux.HandleFunc("/debug/pprof/symbol", srv.requireAuth(pprof.Symbol))
+		mux.HandleFunc("/debug/pprof/trace", srv.requireAuth(pprof.Trace))
+		klog.InfoS("pprof endpoints enabled", "path", "/debug/pprof/")
+	}
+
 	return srv
 }
 
-// Update replaces the metrics payload served under /metrics.
+// Update replaces the metrics payload served under /metrics. The payload is
+// converted to bytes, and compressed when enabled, once here rather than on
+// every request.
 func (s *MetricsServer) Update(data string) {
+	payload := []byte(data)
+	var gzipped []byte
+	if s.precompress && len(payload) > 0 {
+		var err error
+		if gzipped, err = gzipPayload(payload); err != nil {
+			klog.ErrorS(err, "compressing metrics payload failed; serving it uncompressed")
+			gzipped = nil
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = payload
+	s.gzipped = gzipped
+	s.lastUpdate = time.Now()
+	klog.InfoS("metrics payload updated", "bytes", len(payload), "gzipBytes", len(gzipped))
+}
+
+// Touch records that the served payload was confirmed current at at, without
+// replacing it, so /status keeps advancing when a collection cycle produces
+// an identical payload.
+func (s *MetricsServer) Touch(at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastUpdate = at
+	klog.V(3).InfoS("metrics payload unchanged", "bytes", len(s.data))
+}
+
+func gzipPayload(payload []byte) ([]byte, error) {
+	var b bytes.Buffer
+	b.Grow(len(payload) / 8)
+	gz := gzip.NewWriter(&b)
+	if _, err := gz.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, entry := range strings.Split(header, ",") {
+			coding, params, _ := strings.Cut(strings.TrimSpace(entry), ";")
+			if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+				continue
+			}
+			q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q=")
+			if !ok {
+				return true
+			}
+			weight, err := strconv.ParseFloat(q, 64)
+			return err == nil && weight > 0
+		}
+	}
+	return false
+}
+
+// SetReady records whether the exporter is ready to receive scrapes.
+func (s *MetricsServer) SetReady(ready bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.data = data
-	klog.InfoS("metrics payload updated", "bytes", len(data))
+	if s.ready != ready {
+		klog.InfoS("metrics server readiness changed", "ready", ready)
+	}
+	s.ready = ready
 }
 
 // Run starts listening for HTTP requests and blocks until the context ends.
@@ -48,8 +212,15 @@ func (s *MetricsServer) Run(ctx context.Context) error {
 	errCh := make(chan error, 1)
 
 	go func() {
-		klog.InfoS("metrics HTTP server listening", "address", s.server.Addr)
-		if err := s.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		var err error
+		if s.tlsEnabled() {
+			klog.InfoS("metrics HTTPS server listening", "address", s.server.Addr)
+			err = s.server.ListenAndServeTLS(s.certFile, s.keyFile)
+		} else {
+			klog.InfoS("metrics HTTP server listening", "address", s.server.Addr)
+			err = s.server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			errCh <- err
 			return
 		}
@@ -71,22 +242,103 @@ func (s *MetricsServer) Run(ctx context.Context) error {
 	}
 }
 
-func (s *MetricsServer) handleMetrics(w http.ResponseWriter, _ *http.Request) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+func (s *MetricsServer) tlsEnabled() bool {
+	return s.certFile != "" && s.keyFile != ""
+}
 
-	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+func (s *MetricsServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if s.openMetrics {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	}
 
-	if s.data == "" {
+	if s.generate != nil {
+		s.serveGenerated(w, r)
+		return
+	}
+
+	// The slices are never mutated after Update, so they can be written
+	// without holding the lock while a slow client drains them.
+	s.mu.RLock()
+	data, gzipped := s.data, s.gzipped
+	s.mu.RUnlock()
+
+	if len(data) == 0 {
 		klog.V(2).Info("metrics payload unavailable")
 		w.WriteHeader(http.StatusServiceUnavailable)
 		_, _ = w.Write([]byte("# metrics temporarily unavailable\n"))
 		return
 	}
 
-	klog.V(4).InfoS("serving metrics payload", "bytes", len(s.data))
+	if gzipped != nil {
+		w.Header().Set("Vary", "Accept-Encoding")
+		if acceptsGzip(r) {
+			w.Header().Set("Content-Encoding", "gzip")
+			data = gzipped
+		}
+	}
+
+	klog.V(4).InfoS("serving metrics payload", "bytes", len(data))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
+
+// serveGenerated streams a fresh payload, gzip-compressed on the fly for
+// clients that accept it. Failures before the first byte are reported as 503;
+// later ones can only cut the response short.
+func (s *MetricsServer) serveGenerated(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Vary", "Accept-Encoding")
+	var gz *gzip.Writer
+	out := io.Writer(w)
+	if acceptsGzip(r) {
+		gz = gzip.NewWriter(w)
+		out = gz
+	}
+
+	// cw sits in front of the compressor, so nothing has reached w while
+	// cw.n is zero and the 503 below can still replace the gzip header.
+	cw := &countingWriter{w: out}
+	if gz != nil {
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	err := s.generate(r.Context(), cw)
+	if err != nil && cw.n == 0 {
+		klog.V(2).InfoS("metrics payload unavailable", "err", err)
+		w.Header().Del("Content-Encoding")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("# metrics temporarily unavailable\n"))
+		return
+	}
+	if gz != nil {
+		if cerr := gz.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		klog.ErrorS(err, "generating metrics payload failed mid-response", "bytes", cw.n)
+		return
+	}
+	klog.V(4).InfoS("served generated metrics payload", "bytes", cw.n, "gzip", gz != nil)
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func (s *MetricsServer) handleSelfMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
 	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write([]byte(s.data))
+	_, _ = w.Write([]byte(selfmetrics.Render()))
 }
 
 func (s *MetricsServer) handleHealth(w http.ResponseWriter, _ *http.Request) {
@@ -94,15 +346,72 @@ func (s *MetricsServer) handleHealth(w http.ResponseWriter, _ *http.Request) {
 	_, _ = w.Write([]byte("ok"))
 }
 
+// SetConsecutiveFailures records how many collection cycles in a row have
+// failed; zero marks a successful cycle.
+func (s *MetricsServer) SetConsecutiveFailures(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n >= s.failureThreshold && s.failures < s.failureThreshold {
+		klog.InfoS("deep health check failing", "consecutiveFailures", n, "threshold", s.failureThreshold)
+	}
+	s.failures = n
+}
+
+// handleDeepHealth reports unhealthy when the last failureThreshold
+// collection cycles all failed, i.e. no kubelet could be scraped usefully.
+func (s *MetricsServer) handleDeepHealth(w http.ResponseWriter, _ *http.Request) {
+	s.mu.RLock()
+	failures, threshold := s.failures, s.failureThreshold
+	s.mu.RUnlock()
+
+	if failures >= threshold {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = fmt.Fprintf(w, "unhealthy: %d consecutive collection cycles failed", failures)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
+
+func (s *MetricsServer) handleReady(w http.ResponseWriter, _ *http.Request) {
+	s.mu.RLock()
+	ready := s.ready && !time.Now().Before(s.warmupUntil)
+	s.mu.RUnlock()
+
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("not ready"))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
+
 func (s *MetricsServer) handleInfo(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	if r.URL.Path != "/" {
 		w.WriteHeader(http.StatusNotFound)
 	}
 
-	_, _ = w.Write([]byte(
-		"Available endpoints:\n" +
-			"  GET /metrics - aggregated cadvisor metrics\n" +
-			"  GET /health  - server liveness probe\n",
-	))
+	var b strings.Builder
+	b.WriteString("Available endpoints:\n" +
+		"  GET /metrics - aggregated cadvisor metrics\n" +
+		"  GET /health  - server liveness probe\n" +
+		"  GET /health/deep - fails after consecutive failed collection cycles\n" +
+		"  GET /ready   - readiness probe (informers synced and metrics published)\n" +
+		"  GET /status  - last refresh time and per-node scrape status as JSON\n" +
+		"  GET /self-metrics - operational metrics of the exporter itself\n")
+	// Optional endpoints are listed only when registered.
+	if s.refresh != nil {
+		b.WriteString("  POST /refresh - run a collection cycle immediately\n")
+	}
+	if s.cacheDump != nil {
+		b.WriteString("  GET /debug/cache - cached nodes and pods as JSON\n")
+	}
+	if s.pprof {
+		b.WriteString("  GET /debug/pprof/ - pprof profiling\n")
+	}
+	_, _ = io.WriteString(w, b.String())
 }
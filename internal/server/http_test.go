@@ -0,0 +1,327 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/puzhihao/kubelet-cadvisor-addlabel/internal/selfmetrics"
+)
+
+func TestServeGeneratedGzip(t *testing.T) {
+	srv := NewMetricsServer(Options{Generate: func(_ context.Context, w io.Writer) error {
+		_, err := io.WriteString(w, "up 1\n")
+		return err
+	}})
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "up 1\n" {
+		t.Errorf("body = %q, want %q", body, "up 1\n")
+	}
+}
+
+func TestServeGeneratedFailureIsUncompressed(t *testing.T) {
+	srv := NewMetricsServer(Options{Generate: func(context.Context, io.Writer) error {
+		return errors.New("kubelets unreachable")
+	}})
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if got := rec.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("Content-Encoding = %q on a plain-text 503", got)
+	}
+}
+
+func TestHandleMetricsPrecompressed(t *testing.T) {
+	srv := NewMetricsServer(Options{PrecompressGzip: true})
+	srv.Update("up 1\n")
+
+	for _, accept := range []string{"", "gzip"} {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if accept != "" {
+			req.Header.Set("Accept-Encoding", accept)
+		}
+		rec := httptest.NewRecorder()
+		srv.server.Handler.ServeHTTP(rec, req)
+
+		body := rec.Body.Bytes()
+		if accept == "gzip" {
+			if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+				t.Fatalf("Content-Encoding = %q, want gzip", got)
+			}
+			zr, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body, err = io.ReadAll(zr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if string(body) != "up 1\n" {
+			t.Errorf("Accept-Encoding %q: body = %q", accept, body)
+		}
+		if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+			t.Errorf("Accept-Encoding %q: Vary = %q", accept, got)
+		}
+	}
+}
+
+func TestHandleMetricsUnavailableBeforeUpdate(t *testing.T) {
+	srv := NewMetricsServer(Options{})
+	rec := httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestTouchKeepsPayload(t *testing.T) {
+	srv := NewMetricsServer(Options{})
+	srv.Update("up 1\n")
+	at := time.Now().Add(time.Minute)
+	srv.Touch(at)
+
+	srv.mu.RLock()
+	data, lastUpdate := string(srv.data), srv.lastUpdate
+	srv.mu.RUnlock()
+	if data != "up 1\n" {
+		t.Errorf("Touch replaced the payload with %q", data)
+	}
+	if !lastUpdate.Equal(at) {
+		t.Errorf("lastUpdate = %v, want %v", lastUpdate, at)
+	}
+}
+
+// discardResponseWriter lets benchmarks measure the handler alone.
+type discardResponseWriter struct{ header http.Header }
+
+func (w *discardResponseWriter) Header() http.Header         { return w.header }
+func (w *discardResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardResponseWriter) WriteHeader(int)             {}
+
+func BenchmarkHandleMetricsConcurrent(b *testing.B) {
+	var payload strings.Builder
+	for i := 0; payload.Len() < 2<<20; i++ {
+		fmt.Fprintf(&payload, "container_cpu_usage_seconds_total{namespace=\"ns-%d\",pod=\"pod-%d\"} %d\n", i%10, i, i)
+	}
+	data := payload.String()
+	generate := func(_ context.Context, w io.Writer) error {
+		_, err := io.WriteString(w, data)
+		return err
+	}
+
+	tests := []struct {
+		name   string
+		opts   Options
+		accept string
+	}{
+		{"identity", Options{}, ""},
+		{"precompressed-gzip", Options{PrecompressGzip: true}, "gzip"},
+		{"per-request-gzip", Options{Generate: generate}, "gzip"},
+	}
+	for _, tt := range tests {
+		srv := NewMetricsServer(tt.opts)
+		srv.Update(data)
+		b.Run(tt.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			b.RunParallel(func(pb *testing.PB) {
+				req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+				if tt.accept != "" {
+					req.Header.Set("Accept-Encoding", tt.accept)
+				}
+				for pb.Next() {
+					srv.handleMetrics(&discardResponseWriter{header: make(http.Header)}, req)
+				}
+			})
+		})
+	}
+}
+
+func TestHandleInfoListsEnabledEndpoints(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   Options
+		want   []string
+		absent []string
+	}{
+		{"defaults", Options{}, []string{"/metrics", "/status"}, []string{"/refresh", "/debug/cache", "/debug/pprof/"}},
+		{"refresh", Options{Refresh: func(context.Context) error { return nil }}, []string{"POST /refresh"}, []string{"/debug/cache"}},
+		{"cache dump", Options{CacheDump: func(int) any { return nil }}, []string{"GET /debug/cache"}, []string{"/refresh"}},
+		{"pprof", Options{EnablePprof: true}, []string{"GET /debug/pprof/"}, []string{"/refresh", "/debug/cache"}},
+	}
+	for _, tt := range tests {
+		srv := NewMetricsServer(tt.opts)
+		rec := httptest.NewRecorder()
+		srv.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		body := rec.Body.String()
+		for _, path := range tt.want {
+			if !strings.Contains(body, path) {
+				t.Errorf("%s: %q not listed:\n%s", tt.name, path, body)
+			}
+		}
+		for _, path := range tt.absent {
+			if strings.Contains(body, path) {
+				t.Errorf("%s: disabled %q listed:\n%s", tt.name, path, body)
+			}
+		}
+	}
+}
+
+func TestHandleReady(t *testing.T) {
+	srv := NewMetricsServer(Options{})
+	ready := func() int {
+		rec := httptest.NewRecorder()
+		srv.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		return rec.Code
+	}
+
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("before SetReady: status %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	srv.SetReady(true)
+	if code := ready(); code != http.StatusOK {
+		t.Errorf("after SetReady: status %d, want %d", code, http.StatusOK)
+	}
+	srv.SetReady(false)
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("after SetReady(false): status %d, want %d", code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestReadyWaitsForWarmup(t *testing.T) {
+	srv := NewMetricsServer(Options{WarmupDuration: time.Hour})
+	ready := func() int {
+		rec := httptest.NewRecorder()
+		srv.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		return rec.Code
+	}
+
+	srv.SetReady(true)
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("during warmup: status %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	srv.warmupUntil = time.Now().Add(-time.Second)
+	if code := ready(); code != http.StatusOK {
+		t.Errorf("after warmup: status %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestHandleDeepHealth(t *testing.T) {
+	srv := NewMetricsServer(Options{DeepHealthFailures: 3})
+	get := func(path string) int {
+		rec := httptest.NewRecorder()
+		srv.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+
+	for failures, want := range []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusServiceUnavailable, http.StatusServiceUnavailable} {
+		srv.SetConsecutiveFailures(failures)
+		if got := get("/health/deep"); got != want {
+			t.Errorf("%d failures: /health/deep status %d, want %d", failures, got, want)
+		}
+		if got := get("/health"); got != http.StatusOK {
+			t.Errorf("%d failures: /health status %d, want %d", failures, got, http.StatusOK)
+		}
+	}
+	srv.SetConsecutiveFailures(0)
+	if got := get("/health/deep"); got != http.StatusOK {
+		t.Errorf("after a successful cycle: /health/deep status %d, want %d", got, http.StatusOK)
+	}
+}
+
+func TestServerAddr(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"", ":9100"},
+		{"127.0.0.1", "127.0.0.1:9100"},
+		{"::1", "[::1]:9100"},
+	}
+	for _, tt := range tests {
+		if got := NewMetricsServer(Options{Port: 9100, ListenAddress: tt.address}).server.Addr; got != tt.want {
+			t.Errorf("ListenAddress %q: Addr = %q, want %q", tt.address, got, tt.want)
+		}
+	}
+}
+
+func TestRunBindsListenAddress(t *testing.T) {
+	port := freePort(t)
+	srv := NewMetricsServer(Options{Port: port, ListenAddress: "127.0.0.1"})
+	srv.Update("up 1\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.Run(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Errorf("Run: %v", err)
+		}
+	}()
+
+	url := "http://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(port)) + "/metrics"
+	var resp *http.Response
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if resp, err = http.Get(url); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "up 1\n" {
+		t.Errorf("body %q, want the published payload", body)
+	}
+}
+
+var testSelfMetric = selfmetrics.NewGauge("addlabel_server_test_gauge", "Set by the server tests.")
+
+func TestHandleSelfMetrics(t *testing.T) {
+	testSelfMetric.Set(42)
+	srv := NewMetricsServer(Options{})
+	srv.Update("up 1\n")
+	rec := httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/self-metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if body := rec.Body.String(); !strings.Contains(body, "addlabel_server_test_gauge 42\n") {
+		t.Errorf("body lacks the registered self-metric:\n%s", body)
+	}
+}
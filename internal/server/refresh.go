@@ -0,0 +1,61 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// ErrRefreshInFlight is returned by a Refresh callback when a collection
+// cycle is already running; /refresh answers it with 409 Conflict.
+var ErrRefreshInFlight = errors.New("a collection cycle is already running")
+
+// ErrNotSynced is returned by a Refresh callback while the informer caches
+// have not synced yet; /refresh answers it with 503 Service Unavailable.
+var ErrNotSynced = errors.New("informer caches have not synced yet")
+
+type refreshResponse struct {
+	Status          string  `json:"status"`
+	Error           string  `json:"error,omitempty"`
+	DurationSeconds float64 `json:"durationSeconds"`
+}
+
+func (s *MetricsServer) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	start := time.Now()
+	err := s.refresh(r.Context())
+	resp := refreshResponse{Status: "ok", DurationSeconds: time.Since(start).Seconds()}
+	code := http.StatusOK
+	switch {
+	case errors.Is(err, ErrRefreshInFlight):
+		resp.Status, resp.Error = "in_flight", err.Error()
+		code = http.StatusConflict
+	case errors.Is(err, ErrNotSynced):
+		resp.Status, resp.Error = "not_synced", err.Error()
+		code = http.StatusServiceUnavailable
+	case err != nil:
+		resp.Status, resp.Error = "failed", err.Error()
+		code = http.StatusInternalServerError
+	}
+	klog.InfoS("on-demand refresh", "status", resp.Status, "duration", time.Since(start), "remote", r.RemoteAddr)
+
+	body, err := json.Marshal(resp)
+	if err != nil {
+		klog.ErrorS(err, "encode refresh response")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, _ = w.Write(body)
+	_, _ = w.Write([]byte("\n"))
+}
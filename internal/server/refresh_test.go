@@ -0,0 +1,38 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandleRefreshStatusCodes(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{nil, http.StatusOK},
+		{ErrRefreshInFlight, http.StatusConflict},
+		{ErrNotSynced, http.StatusServiceUnavailable},
+		{errors.New("scrape failed"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		srv := NewMetricsServer(Options{Refresh: func(context.Context) error { return tt.err }})
+		rec := httptest.NewRecorder()
+		srv.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/refresh", nil))
+		if rec.Code != tt.want {
+			t.Errorf("refresh error %v: status %d, want %d", tt.err, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestHandleRefreshRejectsGet(t *testing.T) {
+	srv := NewMetricsServer(Options{Refresh: func(context.Context) error { return nil }})
+	rec := httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/refresh", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
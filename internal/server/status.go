@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// NodeStatus reports the most recent scrape outcome for a single node.
+type NodeStatus struct {
+	OK         bool      `json:"ok"`
+	Bytes      int       `json:"bytes,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	LastScrape time.Time `json:"lastScrape"`
+	// DurationSeconds is how long the scrape of this node took.
+	DurationSeconds float64 `json:"durationSeconds"`
+}
+
+// Status is the JSON document served under /status.
+type Status struct {
+	LastUpdate *time.Time            `json:"lastUpdate"`
+	NodeCount  int                   `json:"nodeCount"`
+	Nodes      map[string]NodeStatus `json:"nodes"`
+}
+
+// SetNodeStatus replaces the per-node scrape outcomes reported under /status.
+func (s *MetricsServer) SetNodeStatus(nodes map[string]NodeStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nodes = nodes
+}
+
+func (s *MetricsServer) status() Status {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	status := Status{
+		NodeCount: len(s.nodes),
+		Nodes:     make(map[string]NodeStatus, len(s.nodes)),
+	}
+	if !s.lastUpdate.IsZero() {
+		lastUpdate := s.lastUpdate
+		status.LastUpdate = &lastUpdate
+	}
+	for ip, node := range s.nodes {
+		status.Nodes[ip] = node
+	}
+	return status
+}
+
+func (s *MetricsServer) handleStatus(w http.ResponseWriter, _ *http.Request) {
+	body, err := json.MarshalIndent(s.status(), "", "  ")
+	if err != nil {
+		klog.ErrorS(err, "encode status response")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+	_, _ = w.Write([]byte("\n"))
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func getStatus(t *testing.T, srv *MetricsServer) map[string]any {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	srv.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /status: status %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("decode /status: %v", err)
+	}
+	return doc
+}
+
+func TestHandleStatusBeforeUpdate(t *testing.T) {
+	doc := getStatus(t, NewMetricsServer(Options{}))
+	if doc["lastUpdate"] != nil {
+		t.Errorf("lastUpdate = %v, want null before the first update", doc["lastUpdate"])
+	}
+	if doc["nodeCount"] != float64(0) {
+		t.Errorf("nodeCount = %v, want 0", doc["nodeCount"])
+	}
+	if nodes, ok := doc["nodes"].(map[string]any); !ok || len(nodes) != 0 {
+		t.Errorf("nodes = %v, want an empty object", doc["nodes"])
+	}
+}
+
+func TestHandleStatusShape(t *testing.T) {
+	srv := NewMetricsServer(Options{})
+	scraped := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	srv.SetNodeStatus(map[string]NodeStatus{
+		"10.0.0.1": {OK: true, Bytes: 42, LastScrape: scraped, DurationSeconds: 0.5},
+		"10.0.0.2": {Error: "connection refused", LastScrape: scraped},
+	})
+	srv.Update("up 1\n")
+
+	doc := getStatus(t, srv)
+	if _, err := time.Parse(time.RFC3339Nano, doc["lastUpdate"].(string)); err != nil {
+		t.Errorf("lastUpdate %v is not an RFC 3339 time: %v", doc["lastUpdate"], err)
+	}
+	if doc["nodeCount"] != float64(2) {
+		t.Errorf("nodeCount = %v, want 2", doc["nodeCount"])
+	}
+	nodes := doc["nodes"].(map[string]any)
+	ok := nodes["10.0.0.1"].(map[string]any)
+	want := map[string]any{"ok": true, "bytes": float64(42), "lastScrape": "2024-01-02T03:04:05Z", "durationSeconds": 0.5}
+	for key, value := range want {
+		if ok[key] != value {
+			t.Errorf("nodes[10.0.0.1][%s] = %v, want %v", key, ok[key], value)
+		}
+	}
+	failed := nodes["10.0.0.2"].(map[string]any)
+	if failed["ok"] != false || failed["error"] != "connection refused" {
+		t.Errorf("failed node = %v, want ok=false with the error", failed)
+	}
+	if _, present := failed["bytes"]; present {
+		t.Errorf("failed node reports bytes: %v", failed)
+	}
+}
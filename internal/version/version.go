@@ -0,0 +1,82 @@
+// Package version reports the build identity of the exporter. The variables
+// are meant to be set at link time, for example:
+//
+//	go build -ldflags "-X github.com/puzhihao/kubelet-cadvisor-addlabel/internal/version.Version=v1.2.0" ./cmd/
+//
+// Unset values fall back to the module and VCS information recorded by the
+// Go toolchain, or "unknown".
+package version
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set via -ldflags "-X ...".
+var (
+	Version   = ""
+	GitCommit = ""
+	BuildDate = ""
+)
+
+const unknown = "unknown"
+
+// Info is the resolved build identity.
+type Info struct {
+	Version   string
+	GitCommit string
+	BuildDate string
+	GoVersion string
+}
+
+// Get returns the build identity, filling values not injected at link time
+// from the embedded build information.
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		GitCommit: GitCommit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+	}
+
+	if build, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" && build.Main.Version != "" {
+			info.Version = build.Main.Version
+		}
+		for _, setting := range build.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.GitCommit == "" {
+					info.GitCommit = setting.Value
+				}
+			case "vcs.time":
+				if info.BuildDate == "" {
+					info.BuildDate = setting.Value
+				}
+			}
+		}
+	}
+
+	if info.Version == "" {
+		info.Version = "(devel)"
+	}
+	if info.GitCommit == "" {
+		info.GitCommit = unknown
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = unknown
+	}
+	return info
+}
+
+// UserAgent returns the default User-Agent sent to kubelets and the API
+// server, e.g. "kubelet-cadvisor-addlabel/v1.2.0".
+func UserAgent() string {
+	return "kubelet-cadvisor-addlabel/" + Get().Version
+}
+
+// String renders the build identity on a single line.
+func (i Info) String() string {
+	return fmt.Sprintf("version=%s commit=%s buildDate=%s go=%s", i.Version, i.GitCommit, i.BuildDate, i.GoVersion)
+}
@@ -0,0 +1,40 @@
+package version
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func setBuildVars(t *testing.T, version, commit, date string) {
+	t.Helper()
+	oldVersion, oldCommit, oldDate := Version, GitCommit, BuildDate
+	Version, GitCommit, BuildDate = version, commit, date
+	t.Cleanup(func() { Version, GitCommit, BuildDate = oldVersion, oldCommit, oldDate })
+}
+
+func TestGetInjected(t *testing.T) {
+	setBuildVars(t, "v1.2.0", "abc123", "2024-01-01T00:00:00Z")
+
+	info := Get()
+	if want := (Info{Version: "v1.2.0", GitCommit: "abc123", BuildDate: "2024-01-01T00:00:00Z", GoVersion: runtime.Version()}); info != want {
+		t.Errorf("Get() = %+v, want %+v", info, want)
+	}
+	if got, want := info.String(), "version=v1.2.0 commit=abc123 buildDate=2024-01-01T00:00:00Z go="+runtime.Version(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	if got := UserAgent(); got != "kubelet-cadvisor-addlabel/v1.2.0" {
+		t.Errorf("UserAgent() = %q", got)
+	}
+}
+
+func TestGetFallbacks(t *testing.T) {
+	setBuildVars(t, "", "", "")
+
+	info := Get()
+	for name, value := range map[string]string{"Version": info.Version, "GitCommit": info.GitCommit, "BuildDate": info.BuildDate} {
+		if strings.TrimSpace(value) == "" {
+			t.Errorf("%s is empty without link-time values", name)
+		}
+	}
+}